@@ -4,6 +4,9 @@ let peerConnections = {}; // Map of peer connections by peer ID
 let peerUsernames = {}; // Map of peer ID to username
 let websocket = null;
 let chatWebsocket = null;
+let chatToken = null; // Identifies us on the chat websocket
+let replyingTo = null; // ID of the chat message being replied to
+const chatReactions = new Map(); // Message ID -> emoji -> peer IDs
 let viewerWebsocket = null;
 let screenStream = null;
 let isAudioEnabled = true;
@@ -13,6 +16,10 @@ let myPeerId = null;
 let isHost = false;
 let hostId = null;
 let canShareScreen = false;
+let screenShareApproved = false; // The host let us share outside our role
+let myRole = null;
+let myCapabilities = null; // What our role lets us do, once the server says
+const peerRoles = {};
 let activeSharingPeerId = null; // Track who is sharing screen
 let localCameraStream = null; // Keep reference to camera stream
 let myUsername = null; // Store user's chosen name
@@ -64,7 +71,6 @@ document.addEventListener('DOMContentLoaded', async () => {
     await promptForUsername();
     await initializeMedia();
     connectWebSocket();
-    connectChatWebSocket();
     connectViewerWebSocket();
     populateDeviceSelectors();
     initializeAdminPanel();
@@ -122,7 +128,10 @@ async function initializeMedia() {
 // Connect to WebRTC signaling WebSocket
 function connectWebSocket() {
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const wsUrl = `${protocol}//${window.location.host}/room/${roomId}/websocket`;
+    // A join token in the page URL says who we are and with what role
+    const joinToken = new URLSearchParams(window.location.search).get('token');
+    const query = joinToken ? `?token=${encodeURIComponent(joinToken)}` : '';
+    const wsUrl = `${protocol}//${window.location.host}/room/${roomId}/websocket${query}`;
     
     websocket = new WebSocket(wsUrl);
 
@@ -148,8 +157,8 @@ function connectWebSocket() {
         console.error('WebSocket error:', error);
     };
 
-    websocket.onclose = () => {
-        console.log('WebSocket closed');
+    websocket.onclose = (event) => {
+        console.log('WebSocket closed', event.code, event.reason);
         // Clean up all peer connections
         Object.keys(peerConnections).forEach(peerId => {
             if (peerConnections[peerId]) {
@@ -157,6 +166,9 @@ function connectWebSocket() {
             }
         });
         peerConnections = {};
+        if (event.code === 1008) {
+            return; // Turned away from the waiting room; don't queue up again
+        }
         setTimeout(connectWebSocket, 3000); // Reconnect after 3 seconds
     };
 }
@@ -256,17 +268,20 @@ async function handleSignalingMessage(message) {
                 if (message.data) {
                     // Set our peer ID and role
                     myPeerId = message.data.yourId || myPeerId;
+                    
+                    // Chat connects once the server has told us who we are
+                    chatToken = message.data.chatToken || null;
+                    if (!chatWebsocket) {
+                        connectChatWebSocket();
+                    }
                     isHost = message.data.isHost || false;
                     hostId = message.data.hostId;
-                    canShareScreen = isHost; // Host can always share
+                    myRole = message.data.role || null;
+                    myCapabilities = message.data.capabilities || null;
                     
                     // Update UI based on role
                     updateHostUI();
-                    
-                    // Show admin button if host
-                    if (isHost) {
-                        showAdminButton();
-                    }
+                    applyCapabilities();
                     
                     if (message.data.peers) {
                         message.data.peers.forEach(peerId => {
@@ -319,6 +334,7 @@ async function handleSignalingMessage(message) {
                 // Participant receives response to their request
                 if (message.data) {
                     if (message.data.approved) {
+                        screenShareApproved = true;
                         canShareScreen = true;
                         alert('Screen sharing approved! You can now share your screen.');
                     } else {
@@ -330,7 +346,8 @@ async function handleSignalingMessage(message) {
 
             case 'screen-share-revoked':
                 // Host revoked screen sharing
-                canShareScreen = false;
+                screenShareApproved = false;
+                canShareScreen = can('share-screen');
                 if (isScreenSharing) {
                     stopScreenShare();
                 }
@@ -471,6 +488,36 @@ async function handleSignalingMessage(message) {
                 if (chatSendBtnEnabled) chatSendBtnEnabled.disabled = false;
                 break;
 
+            case 'private-chat-disabled':
+                showAdminNotification('Private chat has been disabled');
+                break;
+
+            case 'private-chat-enabled':
+                showAdminNotification('Private chat has been enabled');
+                break;
+
+            case 'chat-message-deleted':
+                removeChatMessage(message.data.messageId);
+                break;
+
+            case 'chat-muted':
+                if (message.data && message.data.peerId === myPeerId) {
+                    showAdminNotification('You have been muted in chat');
+                }
+                break;
+
+            case 'chat-unmuted':
+                if (message.data && message.data.peerId === myPeerId) {
+                    showAdminNotification('You can chat again');
+                }
+                break;
+
+            case 'slow-mode-changed':
+                showAdminNotification(message.data.seconds > 0
+                    ? `Slow mode: one message every ${message.data.seconds}s`
+                    : 'Slow mode is off');
+                break;
+
             case 'participant-muted':
                 if (message.data && message.data.peerId === myPeerId) {
                     // You've been muted
@@ -487,6 +534,22 @@ async function handleSignalingMessage(message) {
                 }
                 break;
 
+            case 'host-changed':
+                updateHost(message.data);
+                break;
+
+            case 'role-changed':
+                updateRole(message.data);
+                break;
+
+            case 'role-capabilities-changed':
+                if (message.data && message.data.role === myRole) {
+                    myCapabilities = message.data.capabilities || [];
+                    applyCapabilities();
+                    showAdminNotification('What your role can do has changed');
+                }
+                break;
+
             case 'cohost-added':
                 if (message.data && message.data.peerId === myPeerId) {
                     showAdminNotification('You are now a co-host');
@@ -515,6 +578,59 @@ async function handleSignalingMessage(message) {
                 }
                 break;
 
+            case 'waiting-room-updated':
+                updateWaitingListUI(message.data.participants);
+                break;
+
+            case 'waiting-room-changed':
+                updateWaitingRoomToggle(message.data.enabled);
+                showAdminNotification(message.data.enabled ? '⏳ Waiting room enabled' : 'Waiting room disabled');
+                break;
+
+            case 'in-waiting-room':
+                showAdminNotification(`⏳ ${message.data.message}`);
+                break;
+
+            case 'admitted-to-room':
+                showAdminNotification(`✅ ${message.data.message}`);
+                break;
+
+            case 'entry-denied':
+                alert(message.data.message);
+                break;
+
+            case 'guest-policy-changed':
+                showAdminNotification(`Guests without an invitation: ${message.data.policy}`);
+                break;
+
+            case 'passcode-required':
+                promptForPasscode('This room is protected by a passcode.');
+                break;
+
+            case 'passcode-invalid':
+                if (message.data.attemptsLeft > 0) {
+                    promptForPasscode(`${message.data.message}. ${message.data.attemptsLeft} attempts left.`);
+                } else {
+                    alert(message.data.message);
+                }
+                break;
+
+            case 'passcode-changed':
+                updatePasscodeToggle(message.data.enabled);
+                showAdminNotification(message.data.enabled ? '🔑 A passcode is now required to join' : '🔑 Passcode removed');
+                break;
+
+            case 'error':
+                if (message.data && message.data.code === 'unauthorized') {
+                    alert(message.data.message);
+                } else if (message.data && message.data.event === 'set-passcode') {
+                    updatePasscodeToggle(false);
+                    alert(message.data.message);
+                } else if (message.data && ['set-role', 'set-role-capabilities'].includes(message.data.event)) {
+                    alert(message.data.message);
+                }
+                break;
+
             case 'recording-started':
                 showAdminNotification('Recording started');
                 // Show recording indicator for all users
@@ -687,6 +803,10 @@ function removeRemoteVideo(peerId) {
 
 // Toggle microphone
 function toggleMicrophone() {
+    if (!isAudioEnabled && !can('publish-audio')) {
+        showAdminNotification("🎤 Your role can't use the microphone");
+        return;
+    }
     isAudioEnabled = !isAudioEnabled;
     
     if (localStream) {
@@ -743,6 +863,10 @@ function updateLocalAudioStatus() {
 
 // Toggle camera
 function toggleCamera() {
+    if (!isVideoEnabled && !can('publish-video')) {
+        showAdminNotification("📷 Your role can't use the camera");
+        return;
+    }
     isVideoEnabled = !isVideoEnabled;
     
     if (localStream) {
@@ -922,12 +1046,31 @@ function stopScreenShare() {
 // Chat functionality
 function connectChatWebSocket() {
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const wsUrl = `${protocol}//${window.location.host}/room/${roomId}/chat/websocket`;
+    const wsUrl = `${protocol}//${window.location.host}/room/${roomId}/chat/websocket?token=${encodeURIComponent(chatToken || '')}`;
     
     chatWebsocket = new WebSocket(wsUrl);
 
     chatWebsocket.onmessage = (event) => {
         const data = JSON.parse(event.data);
+        if (data.type === 'error') {
+            showAdminNotification(`❌ ${data.message}`);
+            return;
+        }
+        if (data.type === 'deleted') {
+            removeChatMessage(data.id);
+            return;
+        }
+        if (data.type === 'edited') {
+            updateChatMessageText(data.id, data.text);
+            return;
+        }
+        if (data.type === 'reacted') {
+            updateChatReaction(data.id, data.emoji, data.peerId, data.added);
+            return;
+        }
+        if ((data.type && data.type !== 'message' && data.type !== 'file-shared') || data.deleted) {
+            return;
+        }
         // Check if this is our own message by comparing sender peer ID
         const isOwn = data.sender === myPeerId;
         displayChatMessage(event.data, isOwn);
@@ -953,16 +1096,18 @@ function sendChatMessage() {
     const message = input.value.trim();
     
     if (message && chatWebsocket && chatWebsocket.readyState === WebSocket.OPEN) {
+        // The server fills in who sent it and when
         const messageData = JSON.stringify({
+            type: 'message',
             text: message,
-            timestamp: new Date().toISOString(),
-            sender: myPeerId || 'Anonymous',  // Send actual peer ID
-            senderName: myUsername || 'Guest'  // Send actual username
+            replyTo: replyingTo || undefined
         });
         
         chatWebsocket.send(messageData);
         // Don't display immediately - let server echo it back to avoid duplicates
         input.value = '';
+        input.placeholder = 'Type a message...';
+        replyingTo = null;
     }
 }
 
@@ -977,6 +1122,78 @@ function displayChatMessage(messageData, isOwn) {
     displayChatMessageWithFile(messageData, isOwn);
 }
 
+function findChatMessage(messageId) {
+    return document.querySelector(`.chat-message[data-message-id="${CSS.escape(messageId)}"]`);
+}
+
+function removeChatMessage(messageId) {
+    const messageDiv = findChatMessage(messageId);
+    if (messageDiv) {
+        messageDiv.remove();
+    }
+    chatReactions.delete(messageId);
+}
+
+function updateChatMessageText(messageId, text) {
+    const messageDiv = findChatMessage(messageId);
+    if (!messageDiv) return;
+    messageDiv.querySelector('.message-text').textContent = text;
+    messageDiv.querySelector('.message-edited').style.display = 'inline';
+}
+
+function updateChatReaction(messageId, emoji, peerId, added) {
+    const reactions = chatReactions.get(messageId) || {};
+    const peers = (reactions[emoji] || []).filter(id => id !== peerId);
+    if (added) {
+        peers.push(peerId);
+    }
+    if (peers.length > 0) {
+        reactions[emoji] = peers;
+    } else {
+        delete reactions[emoji];
+    }
+    chatReactions.set(messageId, reactions);
+    renderChatReactions(messageId);
+}
+
+function renderChatReactions(messageId) {
+    const messageDiv = findChatMessage(messageId);
+    if (!messageDiv) return;
+    const container = messageDiv.querySelector('.message-reactions');
+    container.innerHTML = '';
+    Object.entries(chatReactions.get(messageId) || {}).forEach(([emoji, peers]) => {
+        const button = document.createElement('button');
+        button.className = `reaction ${peers.includes(myPeerId) ? 'mine' : ''}`;
+        button.textContent = `${emoji} ${peers.length}`;
+        button.onclick = () => reactToChatMessage(messageId, emoji);
+        container.appendChild(button);
+    });
+}
+
+function reactToChatMessage(messageId, emoji) {
+    if (chatWebsocket && chatWebsocket.readyState === WebSocket.OPEN) {
+        chatWebsocket.send(JSON.stringify({ type: 'react', id: messageId, emoji: emoji }));
+    }
+}
+
+function editChatMessage(messageId) {
+    const messageDiv = findChatMessage(messageId);
+    if (!messageDiv) return;
+    const text = prompt('Edit message', messageDiv.querySelector('.message-text').textContent);
+    if (text && text.trim() && chatWebsocket && chatWebsocket.readyState === WebSocket.OPEN) {
+        chatWebsocket.send(JSON.stringify({ type: 'edit', id: messageId, text: text.trim() }));
+    }
+}
+
+function replyToChatMessage(messageId) {
+    const messageDiv = findChatMessage(messageId);
+    if (!messageDiv) return;
+    replyingTo = messageId;
+    const input = document.getElementById('chatInput');
+    input.placeholder = `Replying to ${messageDiv.querySelector('.message-sender').textContent}...`;
+    input.focus();
+}
+
 function escapeHtml(text) {
     const div = document.createElement('div');
     div.textContent = text;
@@ -1018,38 +1235,33 @@ function validateFile(file) {
     return true;
 }
 
-// Send file through chat
-function sendFile(file) {
-    const reader = new FileReader();
-    
-    reader.onload = function(e) {
-        const fileData = {
-            text: `📎 Shared a file: ${file.name}`,
-            timestamp: new Date().toISOString(),
-            sender: myPeerId || 'Anonymous',
-            senderName: myUsername || 'Guest',
-            isFile: true,
-            file: {
-                name: file.name,
-                size: file.size,
-                type: file.type,
-                data: e.target.result // Base64 data
-            }
-        };
-        
-        if (chatWebsocket && chatWebsocket.readyState === WebSocket.OPEN) {
-            chatWebsocket.send(JSON.stringify(fileData));
-            showAdminNotification(`✅ File "${file.name}" sent`);
-        } else {
-            showAdminNotification('❌ Chat connection not available');
+// Upload a file to the room. The server posts it to the chat as a
+// file-shared message once it is stored.
+async function sendFile(file) {
+    if (!chatToken) {
+        showAdminNotification('❌ Join the room before sharing files.');
+        return;
+    }
+    const form = new FormData();
+    form.append('file', file);
+    try {
+        const response = await fetch(`/room/${roomId}/files?token=${encodeURIComponent(chatToken)}`, {
+            method: 'POST',
+            body: form
+        });
+        if (!response.ok) {
+            showAdminNotification(`❌ Could not share "${file.name}": ${await response.text()}`);
         }
-    };
-    
-    reader.onerror = function() {
-        showAdminNotification(`❌ Failed to read file "${file.name}"`);
-    };
-    
-    reader.readAsDataURL(file);
+    } catch (error) {
+        console.error('Upload error:', error);
+        showAdminNotification(`❌ Could not share "${file.name}"`);
+    }
+}
+
+// Link to a shared file. Downloads need our token, so only people in the
+// room can fetch them.
+function sharedFileUrl(fileId) {
+    return `/room/${roomId}/files/${encodeURIComponent(fileId)}?token=${encodeURIComponent(chatToken || '')}`;
 }
 
 // Format file size for display
@@ -1090,14 +1302,22 @@ function displayChatMessageWithFile(messageData, isOwn) {
         minute: '2-digit' 
     });
     
-    const displayName = isOwn ? 'You' : (data.senderName || 'Guest');
+    if (data.id) {
+        messageDiv.dataset.messageId = data.id;
+    }
+    
+    let displayName = isOwn ? 'You' : escapeHtml(data.senderName || 'Guest');
+    if (data.to && data.to.length > 0) {
+        displayName += ' (private)';
+    }
     
     let content = '';
     
     // Check if it's a file message
-    if (data.isFile && data.file) {
+    if (data.type === 'file-shared' && data.file) {
         const file = data.file;
         const isImage = file.type.startsWith('image/');
+        const fileUrl = sharedFileUrl(file.id);
         
         content = `
             <div class="message-sender">${displayName}</div>
@@ -1111,8 +1331,8 @@ function displayChatMessageWithFile(messageData, isOwn) {
                         <div class="file-size">${formatFileSize(file.size)}</div>
                     </div>
                 </div>
-                ${isImage ? `<img src="${file.data}" alt="${escapeHtml(file.name)}" class="file-preview" onclick="openFilePreview('${file.data}', '${escapeHtml(file.name)}')">` : ''}
-                <button class="btn-download" onclick="downloadFile('${escapeHtml(file.name)}', '${file.data}')">
+                ${isImage ? `<img src="${escapeHtml(fileUrl)}" alt="${escapeHtml(file.name)}" class="file-preview">` : ''}
+                <button class="btn-download">
                     <svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor">
                         <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M4 16v1a3 3 0 003 3h10a3 3 0 003-3v-1m-4-4l-4 4m0 0l-4-4m4 4V4" />
                     </svg>
@@ -1120,18 +1340,56 @@ function displayChatMessageWithFile(messageData, isOwn) {
                 </button>
             </div>
             <div class="message-time">${time}</div>
+            <div class="message-reactions"></div>
+            <div class="message-actions"></div>
         `;
     } else {
-        // Regular text message
+        // Regular text message, possibly replying to another
+        let quote = '';
+        if (data.replyTo) {
+            const parent = findChatMessage(data.replyTo);
+            const parentText = parent ? parent.querySelector('.message-text').textContent : 'an earlier message';
+            quote = `<div class="message-reply">↪ ${escapeHtml(parentText)}</div>`;
+        }
         content = `
             <div class="message-sender">${displayName}</div>
+            ${quote}
             <div class="message-text">${escapeHtml(data.text)}</div>
-            <div class="message-time">${time}</div>
+            <div class="message-time">${time} <span class="message-edited" style="display: ${data.editedAt ? 'inline' : 'none'}">(edited)</span></div>
+            <div class="message-reactions"></div>
+            <div class="message-actions"></div>
         `;
     }
     
     messageDiv.innerHTML = content;
     chatMessages.appendChild(messageDiv);
+
+    if (data.type === 'file-shared' && data.file) {
+        const fileUrl = sharedFileUrl(data.file.id);
+        const preview = messageDiv.querySelector('.file-preview');
+        if (preview) {
+            preview.onclick = () => openFilePreview(fileUrl, data.file.name);
+        }
+        messageDiv.querySelector('.btn-download').onclick = () => downloadFile(data.file.name, fileUrl);
+    }
+
+    // Edits, reactions and replies need the message's ID
+    const actions = messageDiv.querySelector('.message-actions');
+    if (actions && data.id) {
+        const addAction = (label, handler) => {
+            const button = document.createElement('button');
+            button.textContent = label;
+            button.onclick = handler;
+            actions.appendChild(button);
+        };
+        addAction('👍', () => reactToChatMessage(data.id, '👍'));
+        addAction('Reply', () => replyToChatMessage(data.id));
+        if (isOwn && data.type !== 'file-shared') {
+            addAction('Edit', () => editChatMessage(data.id));
+        }
+        chatReactions.set(data.id, data.reactions || {});
+        renderChatReactions(data.id);
+    }
     chatMessages.scrollTop = chatMessages.scrollHeight;
     
     // Show notification if chat is hidden
@@ -1159,15 +1417,16 @@ function openFilePreview(fileData, fileName) {
                 </button>
             </div>
             <div class="modal-body">
-                <img src="${fileData}" alt="${escapeHtml(fileName)}" style="max-width: 100%; max-height: 70vh;">
+                <img src="${escapeHtml(fileData)}" alt="${escapeHtml(fileName)}" style="max-width: 100%; max-height: 70vh;">
             </div>
             <div class="modal-footer">
-                <button class="btn-primary" onclick="downloadFile('${escapeHtml(fileName)}', '${fileData}')">
+                <button class="btn-primary">
                     Download
                 </button>
             </div>
         </div>
     `;
+    modal.querySelector('.modal-footer .btn-primary').onclick = () => downloadFile(fileName, fileData);
     document.body.appendChild(modal);
 }
 
@@ -1716,6 +1975,101 @@ function updateHostUI() {
     updateRoomInfoVisibility();
 }
 
+// Apply a change of host
+function updateHost(change) {
+    const wasHost = isHost;
+    hostId = change.hostId || null;
+    isHost = hostId === myPeerId;
+
+    if (isHost && !wasHost) {
+        canShareScreen = true;
+        updateHostUI();
+        showAdminButton();
+        showAdminNotification(change.reason === 'reclaimed' ? '👑 You are the host again' : '👑 You are now the host');
+    } else if (!isHost && wasHost) {
+        const badge = localVideo.parentElement && localVideo.parentElement.querySelector('.host-badge');
+        if (badge) badge.remove();
+        ['adminBtn', 'pollBtn'].forEach(id => {
+            const btn = document.getElementById(id);
+            if (btn) btn.style.display = 'none';
+        });
+        updateRoomInfoVisibility();
+        showAdminNotification('You are no longer the host');
+    } else if (!hostId) {
+        showAdminNotification('The host left the meeting');
+    } else {
+        showAdminNotification('The meeting has a new host');
+    }
+}
+
+// Check if our role lets us do something. Until the server has said,
+// assume it does.
+function can(capability) {
+    return !myCapabilities || myCapabilities.includes(capability);
+}
+
+// Bring the UI in line with what our role lets us do
+function applyCapabilities() {
+    canShareScreen = can('share-screen') || screenShareApproved;
+    if (isScreenSharing && !canShareScreen) {
+        stopScreenShare();
+    }
+    if (isAudioEnabled && !can('publish-audio')) {
+        toggleMicrophone();
+    }
+    if (isVideoEnabled && !can('publish-video')) {
+        toggleCamera();
+    }
+
+    const chatInput = document.getElementById('chatInput');
+    const chatSendBtn = document.getElementById('sendChatBtn');
+    if (chatInput) chatInput.disabled = !can('chat');
+    if (chatSendBtn) chatSendBtn.disabled = !can('chat');
+    if (isAnnotating && !can('annotate')) {
+        toggleAnnotationMode();
+    }
+
+    const adminBtn = document.getElementById('adminBtn');
+    if (adminBtn) {
+        adminBtn.style.display = can('manage-participants') ? 'flex' : 'none';
+    }
+    showAdminButton();
+}
+
+// Apply a change of someone's role
+function updateRole(change) {
+    if (!change || !change.peerId) return;
+    peerRoles[change.peerId] = change.role;
+    if (change.peerId !== myPeerId) return;
+
+    const previous = myRole;
+    myRole = change.role;
+    myCapabilities = change.capabilities || [];
+    applyCapabilities();
+    if (previous && previous !== myRole) {
+        showAdminNotification(`Your role is now ${myRole}`);
+    }
+}
+
+// Give a participant another role
+function setRole(peerId, role) {
+    if (!role) return;
+    sendSignalingMessage({
+        event: 'set-role',
+        data: { peerId, role }
+    });
+}
+
+// Hand hosting to another participant
+function transferHost(peerId) {
+    if (confirm('Make this participant the host? You will no longer be the host.')) {
+        sendSignalingMessage({
+            event: 'transfer-host',
+            data: { peerId }
+        });
+    }
+}
+
 // Update room info visibility based on host status and room lock
 function updateRoomInfoVisibility() {
     const roomIdElement = document.getElementById('roomId');
@@ -1995,6 +2349,49 @@ function toggleRoomLock() {
     showAdminNotification(isLocked ? '🔒 Room locked - New participants blocked' : '🔓 Room unlocked - New participants allowed');
 }
 
+// Ask for the room's passcode before joining
+function promptForPasscode(reason) {
+    const passcode = prompt(`${reason}\nEnter the passcode:`);
+    if (passcode === null) {
+        leaveRoom();
+        return;
+    }
+    sendSignalingMessage({
+        event: 'passcode',
+        data: { passcode: passcode }
+    });
+}
+
+// Toggle Room Passcode
+function toggleRoomPasscode() {
+    const toggle = document.getElementById('passcodeToggle');
+    if (!toggle) {
+        return;
+    }
+
+    let passcode = '';
+    if (toggle.checked) {
+        passcode = prompt('Passcode new participants must enter (4 to 64 characters):');
+        if (!passcode) {
+            toggle.checked = false;
+            return;
+        }
+    }
+
+    sendSignalingMessage({
+        event: 'set-passcode',
+        data: { passcode: passcode }
+    });
+}
+
+function updatePasscodeToggle(enabled) {
+    const toggle = document.getElementById('passcodeToggle');
+    if (toggle) {
+        toggle.checked = enabled;
+        toggle.parentElement.classList.toggle('active', enabled);
+    }
+}
+
 // Toggle Chat Permission
 function toggleChatPermission() {
     const toggle = document.getElementById('chatToggle');
@@ -2086,6 +2483,18 @@ function createParticipantItem(peerId, name, isCurrentUser, isCoHost) {
                     <path d="M12 2L2 7v10c0 5.55 3.84 10.74 9 12 5.16-1.26 9-6.45 9-12V7l-10-5zm0 10l-4 4-1.41-1.41L10 11.17l6.59-6.59L18 6l-6 6z"/>
                 </svg>
             </button>
+            <select class="participant-role-select" onchange="setRole('${peerId}', this.value)" title="Role">
+                ${['', 'co-host', 'presenter', 'attendee', 'viewer'].map(role => `
+                <option value="${role}" ${peerRoles[peerId] === role ? 'selected' : ''}>${role || 'Role…'}</option>
+                `).join('')}
+            </select>
+            ${isHost ? `
+            <button class="participant-action-btn" onclick="transferHost('${peerId}')" title="Make Host">
+                <svg viewBox="0 0 24 24" fill="currentColor">
+                    <path d="M5 16L3 5l5.5 5L12 4l3.5 6L21 5l-2 11H5zm14 3c0 .6-.4 1-1 1H6c-.6 0-1-.4-1-1v-1h14v1z"/>
+                </svg>
+            </button>
+            ` : ''}
             <button class="participant-action-btn danger" onclick="removeParticipant('${peerId}')" title="Remove">
                 <svg viewBox="0 0 24 24" fill="currentColor">
                     <path d="M19 6.41L17.59 5 12 10.59 6.41 5 5 6.41 10.59 12 5 17.59 6.41 19 12 13.41 17.59 19 19 17.59 13.41 12z"/>
@@ -2141,9 +2550,21 @@ function populateWaitingList() {
 }
 
 // Update Waiting List UI
+let waitingPeerIds = new Set();
+
 function updateWaitingListUI(participants) {
     const list = document.getElementById('waitingList');
     const empty = document.getElementById('waitingEmpty');
+    const count = document.getElementById('waitingCount');
+    if (!list || !empty) return;
+
+    // Let hosts know when someone new starts waiting
+    const arrived = participants.filter(p => !waitingPeerIds.has(p.peerId));
+    if (arrived.length > 0) {
+        showAdminNotification(`⏳ ${arrived.map(p => p.name).join(', ')} waiting to join`);
+    }
+    waitingPeerIds = new Set(participants.map(p => p.peerId));
+    if (count) count.textContent = participants.length;
     
     if (participants.length === 0) {
         list.style.display = 'none';
@@ -2166,8 +2587,8 @@ function createWaitingItem(peerId, name) {
     item.className = 'waiting-item';
     item.innerHTML = `
         <div class="waiting-info">
-            <div class="waiting-avatar">${name.charAt(0).toUpperCase()}</div>
-            <div>${name}</div>
+            <div class="waiting-avatar">${escapeHtml(name.charAt(0).toUpperCase())}</div>
+            <div>${escapeHtml(name)}</div>
         </div>
         <div class="waiting-actions">
             <button class="admit-btn" onclick="admitParticipant('${peerId}')">Admit</button>
@@ -2185,18 +2606,38 @@ function admitParticipant(peerId) {
     });
     
     showAdminNotification('Participant admitted');
-    populateWaitingList();
 }
 
 // Deny Participant
 function denyParticipant(peerId) {
+    const reason = prompt('Reason (optional):');
+    if (reason === null) return;
+
     sendSignalingMessage({
         event: 'deny-participant',
-        data: { peerId }
+        data: { peerId, reason }
     });
     
     showAdminNotification('Participant denied');
-    populateWaitingList();
+}
+
+// Toggle Waiting Room
+function toggleWaitingRoom() {
+    const toggle = document.getElementById('waitingRoomToggle');
+    if (!toggle) return;
+
+    sendSignalingMessage({
+        event: 'set-waiting-room',
+        data: { enabled: toggle.checked }
+    });
+}
+
+function updateWaitingRoomToggle(enabled) {
+    const toggle = document.getElementById('waitingRoomToggle');
+    if (toggle) {
+        toggle.checked = enabled;
+        toggle.parentElement.classList.toggle('active', enabled);
+    }
 }
 
 // Toggle Recording
@@ -2313,7 +2754,7 @@ function showAdminNotification(message) {
 // Show admin button for host
 function showAdminButton() {
     const adminBtn = document.getElementById('adminBtn');
-    if (adminBtn && isHost) {
+    if (adminBtn && (isHost || can('manage-participants'))) {
         adminBtn.style.display = 'flex';
     }
     
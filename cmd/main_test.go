@@ -5,6 +5,8 @@ import (
 	_ "videochat/internal/handler"
 	_ "videochat/internal/server"
 	_ "videochat/pkg/chat"
+	_ "videochat/pkg/dispatch"
+	_ "videochat/pkg/signaling"
 	_ "videochat/pkg/webrtc"
 )
 
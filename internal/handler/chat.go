@@ -1,6 +1,125 @@
 package handlers
 
-// Note: Chat functionality is handled through RoomChatWebSocket and StreamChatWebSocket
-// in room.go and stream.go respectively. This file is kept for future chat-specific
-// handlers if needed.
+import (
+	"errors"
+	"log"
 
+	"videochat/pkg/files"
+	"videochat/pkg/signaling"
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Note: Chat messages are handled through RoomChatWebSocket and StreamChatWebSocket
+// in room.go and stream.go respectively. This file holds the chat's HTTP handlers.
+
+// ============= FILE SHARING =============
+//
+// Participants upload files to a room and download them with the chat
+// token they were given on joining, so only people in the room can fetch
+// what is shared there.
+
+// roomParticipant finds the room in the URL and the participant holding
+// the token in the query. It writes the error response itself when either
+// is missing.
+func roomParticipant(c *fiber.Ctx) (*w.Room, string, error) {
+	roomUUID := c.Params("uuid")
+	if uuid.Validate(roomUUID) != nil {
+		return nil, "", c.Status(fiber.StatusBadRequest).SendString("A valid room UUID is required")
+	}
+	room, exists := w.GetRoom(roomUUID)
+	if !exists {
+		return nil, "", c.Status(fiber.StatusNotFound).SendString("Room not found")
+	}
+	peerID, ok := room.ChatIdentity(c.Query("token"))
+	if !ok {
+		return nil, "", c.Status(fiber.StatusForbidden).SendString("A token from joining the room is required")
+	}
+	return room, peerID, nil
+}
+
+// RoomFileUpload shares a file posted as the "file" field of a multipart form
+func RoomFileUpload(c *fiber.Ctx) error {
+	room, peerID, err := roomParticipant(c)
+	if room == nil {
+		return err
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("A file is required")
+	}
+	if header.Size > room.Files.Limits.MaxFileSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString(files.ErrTooLarge.Error())
+	}
+	content, err := header.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Could not read the file")
+	}
+	defer content.Close()
+
+	file, err := room.ShareFile(peerID, header.Filename, content)
+	var sigErr *signaling.Error
+	switch {
+	case err == nil:
+		return c.Status(fiber.StatusCreated).JSON(file)
+	case errors.As(err, &sigErr):
+		status := fiber.StatusForbidden
+		if sigErr.Code == signaling.CodeRateLimited {
+			status = fiber.StatusTooManyRequests
+		}
+		return c.Status(status).SendString(sigErr.Message)
+	case errors.Is(err, files.ErrTooLarge), errors.Is(err, files.ErrRoomFull):
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString(err.Error())
+	case errors.Is(err, files.ErrTypeNotAllowed):
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString(err.Error())
+	default:
+		log.Printf("Error sharing file in room %s: %v", room.ID, err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Could not store the file")
+	}
+}
+
+// RoomFiles lists the files shared in a room
+func RoomFiles(c *fiber.Ctx) error {
+	room, _, err := roomParticipant(c)
+	if room == nil {
+		return err
+	}
+	list, err := room.Files.List()
+	if err != nil {
+		log.Printf("Error listing files in room %s: %v", room.ID, err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Could not list files")
+	}
+	if list == nil {
+		list = []*files.File{}
+	}
+	return c.JSON(list)
+}
+
+// RoomFileDownload sends a shared file as an attachment
+func RoomFileDownload(c *fiber.Ctx) error {
+	room, _, err := roomParticipant(c)
+	if room == nil {
+		return err
+	}
+	file, path, err := room.Files.Open(c.Params("id"))
+	if errors.Is(err, files.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).SendString("File not found")
+	}
+	if err != nil {
+		log.Printf("Error opening file in room %s: %v", room.ID, err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Could not open the file")
+	}
+
+	// Never let a shared file run as a page of this site
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "sandbox")
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	if err := c.Download(path, file.Name); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, file.Type)
+	return nil
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"videochat/pkg/hls"
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// StreamHLS serves a stream's LL-HLS playlist, init segment, segments and
+// partial segments
+func StreamHLS(c *fiber.Ctx) error {
+	streamID := c.Params("ssuid")
+	if uuid.Validate(streamID) != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("A valid stream UUID is required")
+	}
+	stream, exists := w.GetStream(streamID)
+	if !exists {
+		return c.Status(fiber.StatusNotFound).SendString("Stream not found")
+	}
+	muxer := stream.Peers.HLSMuxer()
+	if muxer == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Stream is not live")
+	}
+
+	file := c.Params("file")
+	switch {
+	case file == "index.m3u8":
+		msn, part, err := blockingReloadParams(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		data, err := muxer.Playlist(msn, part)
+		if err != nil {
+			return hlsError(c, err)
+		}
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+		return c.Send(data)
+
+	case file == "init.mp4":
+		data, err := muxer.Init()
+		if err != nil {
+			return hlsError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, "video/mp4")
+		return c.Send(data)
+
+	case strings.HasPrefix(file, "segment-") && strings.HasSuffix(file, ".m4s"):
+		msn, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "segment-"), ".m4s"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Not found")
+		}
+		data, err := muxer.Segment(msn)
+		if err != nil {
+			return hlsError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, "video/iso.segment")
+		return c.Send(data)
+
+	case strings.HasPrefix(file, "part-") && strings.HasSuffix(file, ".m4s"):
+		name := strings.TrimSuffix(strings.TrimPrefix(file, "part-"), ".m4s")
+		msnText, indexText, ok := strings.Cut(name, "-")
+		msn, msnErr := strconv.ParseUint(msnText, 10, 64)
+		index, indexErr := strconv.Atoi(indexText)
+		if !ok || msnErr != nil || indexErr != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Not found")
+		}
+		data, err := muxer.Part(msn, index)
+		if err != nil {
+			return hlsError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, "video/iso.segment")
+		return c.Send(data)
+	}
+
+	return c.Status(fiber.StatusNotFound).SendString("Not found")
+}
+
+// blockingReloadParams reads the _HLS_msn and _HLS_part directives of a
+// playlist request. Both are -1 when absent.
+func blockingReloadParams(c *fiber.Ctx) (msn, part int64, err error) {
+	msn, part = -1, -1
+	if value := c.Query("_HLS_msn"); value != "" {
+		if msn, err = strconv.ParseInt(value, 10, 64); err != nil || msn < 0 {
+			return 0, 0, errors.New("invalid _HLS_msn")
+		}
+	}
+	if value := c.Query("_HLS_part"); value != "" {
+		if msn < 0 {
+			return 0, 0, errors.New("_HLS_part requires _HLS_msn")
+		}
+		if part, err = strconv.ParseInt(value, 10, 64); err != nil || part < 0 {
+			return 0, 0, errors.New("invalid _HLS_part")
+		}
+	}
+	return msn, part, nil
+}
+
+func hlsError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, hls.ErrTooFarAhead) {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	return c.Status(fiber.StatusNotFound).SendString(err.Error())
+}
@@ -4,9 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"videochat/pkg/auth"
 	"videochat/pkg/chat"
+	"videochat/pkg/dispatch"
+	"videochat/pkg/signaling"
 	w "videochat/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
@@ -15,22 +20,46 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-// RoomCreate creates a new room and redirects to it
+// RoomCreate creates a new room and redirects to it. An optional ?mode=
+// query picks mesh or SFU media for the new room, ?guests= what happens
+// to people joining it without a join token and ?waiting-room=true parks
+// every joiner until a host admits them.
 func RoomCreate(c *fiber.Ctx) error {
 	newUUID := uuid.New()
+
+	var opts w.RoomOptions
+	if modeParam := c.Query("mode"); modeParam != "" {
+		mode, err := w.ParseRoomMode(modeParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		opts.Mode = mode
+	}
+	if guestsParam := c.Query("guests"); guestsParam != "" {
+		policy, err := w.ParseGuestPolicy(guestsParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		opts.GuestPolicy = policy
+	}
+	opts.WaitingRoom = c.QueryBool("waiting-room")
+	if opts != (w.RoomOptions{}) {
+		w.CreateRoomWithOptions(newUUID.String(), opts)
+	}
+
 	return c.Redirect(fmt.Sprintf("/room/%s", newUUID.String()))
 }
 
 // Room renders the room page
 func Room(c *fiber.Ctx) error {
 	roomUUID := c.Params("uuid")
-	if roomUUID == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Room UUID is required")
+	if uuid.Validate(roomUUID) != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("A valid room UUID is required")
 	}
 
 	// Ensure room exists
 	room := w.CreateRoom(roomUUID)
-	
+
 	return c.Render("room", fiber.Map{
 		"RoomID": roomUUID,
 		"Title":  "Video Conference Room",
@@ -38,124 +67,237 @@ func Room(c *fiber.Ctx) error {
 	}, "layouts/main")
 }
 
+// Where RoomJoinAuth leaves a verified identity and the client's address
+// for RoomWebSocket
+const (
+	identityLocal = "identity"
+	clientLocal   = "client"
+)
+
+// RoomJoinAuth verifies the join token of a room websocket upgrade, passed
+// as ?token= or a bearer token. Upgrades with an invalid token are refused;
+// those without one go on as guests, subject to the room's guest policy.
+func RoomJoinAuth(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	c.Locals(clientLocal, c.IP())
+
+	token := c.Query("token")
+	if bearer, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		token = bearer
+	}
+	if token == "" {
+		return c.Next()
+	}
+
+	identity, err := auth.Verify(token, c.Params("uuid"))
+	if err != nil {
+		log.Printf("Join token refused for room %s: %v", c.Params("uuid"), err)
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid join token")
+	}
+	c.Locals(identityLocal, identity)
+	return c.Next()
+}
+
 // RoomWebSocket handles WebRTC signaling via WebSocket
 func RoomWebSocket(c *websocket.Conn) {
 	roomUUID := c.Params("uuid")
-	if roomUUID == "" {
-		log.Println("Room UUID is required")
+	if uuid.Validate(roomUUID) != nil {
+		log.Println("A valid room UUID is required")
 		c.Close()
 		return
 	}
 
 	room := w.CreateRoom(roomUUID)
-	
+
 	// Generate a unique peer ID for this connection
 	peerID := uuid.New().String()
-	username := "" // Will be set from the first message
-	
+
 	log.Printf("Peer %s joining room %s", peerID, roomUUID)
 
-	// Check if this is the first person (make them host)
-	isFirstPerson := len(room.Peers.Connections) == 0
-	if isFirstPerson {
-		room.SetHost(peerID)
-	} else {
-		// Check if room is locked (only if not the first person/host)
-		if room.IsRoomLocked() {
-			log.Printf("Room %s is locked. Peer %s denied entry.", roomUUID, peerID)
-			// Send locked message
-			lockedMsg := map[string]interface{}{
-				"event": "room-locked",
-				"data": map[string]interface{}{
-					"message": "This room is locked and not accepting new participants",
-				},
-			}
-			c.WriteJSON(lockedMsg)
+	done := make(chan struct{})
+	defer close(done)
+	frames := readFrames(c, peerID, done)
+
+	// Joiners with a token are who it says; the rest are guests
+	username := "Guest"
+	var pending [][]byte
+	identity, verified := c.Locals(identityLocal).(auth.Identity)
+	if verified {
+		room.SetIdentity(peerID, identity)
+		defer room.ForgetIdentity(peerID)
+		if identity.Name != "" {
+			username = identity.Name
+		}
+	}
+
+	// A host rejoining soon after leaving takes the room back
+	reclaiming := verified && room.CanReclaimHost(identity.UserID, time.Now())
+
+	// Everyone but hosts must know the room's passcode, if it has one
+	if room.HasPasscode() && !(verified && identity.Role == auth.RoleHost) && !reclaiming {
+		// Wrong passcodes count against the user of a join token, or else
+		// the client's address, so reconnecting doesn't reset the count
+		client, _ := c.Locals(clientLocal).(string)
+		switch {
+		case verified && identity.UserID != "":
+			client = "user:" + identity.UserID
+		case client == "":
+			client = peerID
+		}
+		var ok bool
+		if ok, pending = awaitPasscode(c, room, client, frames); !ok {
 			c.Close()
 			return
 		}
 	}
 
+	if !verified && room.GetGuestPolicy() == w.GuestsRejected {
+		log.Printf("Room %s requires a join token. Peer %s denied entry.", roomUUID, peerID)
+		c.WriteJSON(signaling.NewError(signaling.CodeUnauthorized, "", "this room requires a join token").Frame())
+		c.Close()
+		return
+	}
+
+	// Hosts come from a host join token; without join tokens whoever joins
+	// a room with no host hosts it
+	hostToken := verified && identity.Role == auth.RoleHost
+	firstIn := !auth.Enabled() && room.GetHostPeerID() == ""
+
+	// Everyone else waits to be admitted if the waiting room is on, as do
+	// guests if that is the guest policy
+	var admitted bool
+	if !hostToken && !firstIn && !reclaiming && (room.IsWaitingRoomEnabled() || (!verified && room.GetGuestPolicy() == w.GuestsWait)) {
+		var reason string
+		if admitted, username, reason, pending = waitForAdmission(c, room, peerID, username, frames, pending); !admitted {
+			closeWithReason(c, reason)
+			return
+		}
+	}
+
+	switch previous, reclaimed := room.ReclaimHost(peerID, identity.UserID, time.Now()); {
+	case reclaimed:
+		announceHost(room, peerID, previous, signaling.HostChangedReclaimed)
+	case hostToken || firstIn:
+		if room.SetHost(peerID) {
+			announceHost(room, peerID, "", signaling.HostChangedJoined)
+		} else if hostToken {
+			room.AddCoHost(peerID)
+		}
+	}
+
+	// A join token can also name the role the peer joins with
+	if role, err := w.ParseRole(string(identity.Role)); err == nil && role != w.RoleHost {
+		room.SetRole(peerID, role)
+	}
+	defer room.ForgetRole(peerID)
+
+	// Hand hosting on once this peer is gone, however it leaves
+	defer func() {
+		if hostID, wasHost := room.HostLeft(peerID, time.Now()); wasHost {
+			announceHost(room, hostID, peerID, signaling.HostChangedLeft)
+		}
+	}()
+
+	// Check if room is locked (those who manage the room, and those they
+	// admitted, can always get in)
+	if !admitted && !room.Can(peerID, w.CapManageParticipants) && room.IsRoomLocked() {
+		log.Printf("Room %s is locked. Peer %s denied entry.", roomUUID, peerID)
+		c.WriteJSON(signaling.New(signaling.EventRoomLocked, signaling.Notice{
+			Message: "This room is locked and not accepting new participants",
+		}))
+		c.Close()
+		return
+	}
+
 	// Send current list of peers to the new peer with their usernames
 	room.Peers.ListLock.RLock()
-	existingPeers := make([]map[string]interface{}, 0)
+	existingPeers := make([]signaling.PeerInfo, 0, len(room.Peers.Connections))
 	for _, conn := range room.Peers.Connections {
 		if conn.PeerID != "" && conn.PeerID != peerID {
-			existingPeers = append(existingPeers, map[string]interface{}{
-				"peerId":   conn.PeerID,
-				"username": conn.Username,
+			existingPeers = append(existingPeers, signaling.PeerInfo{
+				PeerID:   conn.PeerID,
+				Username: conn.Username,
 			})
 		}
 	}
+	var existingTracks []signaling.TrackInfo
+	for ownerID, tracks := range room.Peers.PeerTracks {
+		for _, track := range tracks {
+			existingTracks = append(existingTracks, trackInfo(ownerID, track))
+		}
+	}
 	room.Peers.ListLock.RUnlock()
 
 	// Send peers list and role info to new joiner
-	peersMsg := map[string]interface{}{
-		"event": "peers",
-		"data": map[string]interface{}{
-			"peers":      existingPeers,
-			"yourId":     peerID,
-			"isHost":     room.IsHost(peerID),
-			"hostId":     room.GetHostPeerID(),
-			"roomLocked": room.IsRoomLocked(),
-		},
-	}
-	c.WriteJSON(peersMsg)
+	role := room.Role(peerID)
+	c.WriteJSON(signaling.New(signaling.EventPeers, signaling.Peers{
+		Peers:      existingPeers,
+		YourID:     peerID,
+		IsHost:     role == w.RoleHost,
+		Role:       string(role),
+		HostID:     room.GetHostPeerID(),
+		RoomLocked: room.IsRoomLocked(),
+		Mode:       string(room.Mode),
+		Tracks:     existingTracks,
+
+		Capabilities: capabilityNames(room.RoleCapabilities(role)),
+
+		ActiveSpeaker: activeSpeaker(room),
+		ChatToken:     room.IssueChatToken(peerID),
+	}))
+	if room.Can(peerID, w.CapManageParticipants) {
+		c.WriteJSON(signaling.New(signaling.EventWaitingRoomUpdated, room.WaitingRoomList()))
+	}
 
 	// Create new peer connection
-	peerConnection, err := webrtc.NewPeerConnection(w.RoomConfig)
+	peerConnection, err := w.NewPeerConnection()
 	if err != nil {
 		log.Printf("Failed to create peer connection: %v", err)
 		c.Close()
 		return
 	}
+	defer w.DiscardEstimator(peerConnection)
+
+	if room.Mode == w.RoomModeSFU {
+		// The server's offer asks the client to publish one audio and one
+		// video track; screen shares are added by client renegotiation
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			if _, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				log.Printf("Failed to add %s transceiver for peer %s: %v", kind, peerID, err)
+				peerConnection.Close()
+				c.Close()
+				return
+			}
+		}
+	}
 
 	// Add this peer to the room with peer ID (username will be updated when join message is received)
-	room.Peers.AddPeerConnectionWithID(peerConnection, c, peerID, "Guest")
-	
-	// Add all existing tracks to this new peer connection (only after connection is established)
-	// We'll do this in a goroutine after a short delay to allow the connection to establish
-	go func(peerConn *webrtc.PeerConnection, pID string) {
-		// Wait a bit for the connection to establish
-		time.Sleep(2 * time.Second)
-		
-		room.Peers.ListLock.RLock()
-		for _, track := range room.Peers.TrackLocals {
-			if peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
-				if rtpSender, err := peerConn.AddTrack(track); err != nil {
-					log.Printf("Error adding existing track to new peer %s: %v", pID, err)
-				} else {
-					log.Printf("Added existing track %s to new peer %s", track.ID(), pID)
-					// Read RTCP packets to keep connection alive
-					go func(sender *webrtc.RTPSender) {
-						rtcpBuf := make([]byte, 1500)
-						for {
-							if _, _, rtcpErr := sender.Read(rtcpBuf); rtcpErr != nil {
-								return
-							}
-						}
-					}(rtpSender)
-				}
-			} else {
-				log.Printf("Cannot add existing track to peer %s (connection not ready, state: %s)", pID, peerConn.ConnectionState())
+	room.Peers.AddPeerConnectionWithID(peerConnection, c, peerID, username)
+
+	if room.Mode == w.RoomModeSFU {
+		// Trickle the server's ICE candidates to the client
+		peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+			if candidate == nil {
+				return
 			}
-		}
-		room.Peers.ListLock.RUnlock()
-	}(peerConnection, peerID)
-	
+			room.Peers.SendToPeer(signaling.New(signaling.EventCandidate, signaling.ICECandidate{
+				Candidate: signaling.Candidate(candidate.ToJSON()),
+			}), peerID)
+		})
+	}
+
 	// Note: peer-joined broadcast is sent when we receive the "join" message with username
 
 	defer func() {
 		// Notify others that peer left
-		leaveMsg := map[string]interface{}{
-			"event": "peer-left",
-			"data": map[string]interface{}{
-				"peerId": peerID,
-			},
-		}
-		room.Peers.BroadcastToOthers(leaveMsg, peerID)
-		
+		room.Peers.BroadcastToOthers(signaling.New(signaling.EventPeerLeft, signaling.PeerRef{PeerID: peerID}), peerID)
+
 		room.Peers.RemovePeerConnection(peerConnection)
+		room.RevokeChatTokens(peerID)
 		peerConnection.Close()
 		log.Printf("Peer %s left room %s", peerID, roomUUID)
 	}()
@@ -164,22 +306,34 @@ func RoomWebSocket(c *websocket.Conn) {
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		log.Printf("Track received from peer %s: %s, Type: %s", peerID, remoteTrack.ID(), remoteTrack.Kind())
 
-		// Add track to the room for forwarding to other peers
-		localTrack := room.Peers.AddTrack(remoteTrack, peerID)
-		if localTrack == nil {
-			log.Printf("Failed to add track %s from peer %s", remoteTrack.ID(), peerID)
+		// Only forward what the peer's role lets them publish
+		if source := room.Peers.SourceOf(remoteTrack, peerID); !room.CanPublish(peerID, source) {
+			log.Printf("Peer %s may not publish %s; ignoring track %s", peerID, source, remoteTrack.ID())
 			return
 		}
 
-		log.Printf("Successfully added track %s from peer %s to room", remoteTrack.ID(), peerID)
+		// Add track to the room for forwarding to other peers. Simulcast
+		// layers of one track each arrive here but publish it only once.
+		localTrack, published := room.Peers.AddTrack(remoteTrack, peerID)
+		info := trackInfo(peerID, localTrack)
+		if published {
+			log.Printf("Successfully added track %s from peer %s to room", remoteTrack.ID(), peerID)
+			room.Peers.BroadcastToOthers(signaling.New(signaling.EventTrackPublished, info), peerID)
+		}
+
+		room.Peers.Forward(remoteTrack, localTrack)
+
+		if room.Peers.RemoveTrack(localTrack, remoteTrack.RID()) {
+			room.Peers.BroadcastToOthers(signaling.New(signaling.EventTrackUnpublished, info), peerID)
+		}
 	})
 
 	// Handle ICE connection state changes
 	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		log.Printf("Peer %s ICE Connection State: %s", peerID, state.String())
-		
-		if state == webrtc.ICEConnectionStateFailed || 
-		   state == webrtc.ICEConnectionStateClosed {
+
+		if state == webrtc.ICEConnectionStateFailed ||
+			state == webrtc.ICEConnectionStateClosed {
 			room.Peers.RemovePeerConnection(peerConnection)
 		}
 	})
@@ -189,684 +343,267 @@ func RoomWebSocket(c *websocket.Conn) {
 		log.Printf("Peer %s Connection State: %s", peerID, state.String())
 	})
 
-	// Handle WebSocket messages (SDP, ICE candidates)
-	for {
-		var msg map[string]interface{}
-		if err := c.ReadJSON(&msg); err != nil {
-			log.Printf("WebSocket read error from peer %s: %v", peerID, err)
-			break
+	// SFU peers get the server's first offer, including existing tracks
+	if room.Mode == w.RoomModeSFU {
+		room.Peers.Renegotiate(peerID)
+	}
+
+	// Handle WebSocket messages (SDP, ICE candidates), starting with any
+	// sent from the waiting room
+	negotiated := false
+	handle := func(raw []byte) bool {
+		env, err := signaling.Decode(raw)
+		if err != nil {
+			replyError(room, peerID, err)
+			return true
 		}
 
-		event, ok := msg["event"].(string)
-		if !ok {
-			log.Println("Invalid message format")
-			continue
+		// The first message fixes the protocol version for this connection
+		if !negotiated {
+			version, err := signaling.Negotiate(env.Version)
+			if err != nil {
+				replyError(room, peerID, signaling.NewError(signaling.CodeUnsupportedVersion, env.Event,
+					fmt.Sprintf("protocol version %d is not supported", env.Version)))
+				return false
+			}
+			room.Peers.SendToPeer(signaling.New(signaling.EventProtocol, signaling.Protocol{
+				Version:    version,
+				MinVersion: signaling.MinProtocolVersion,
+				MaxVersion: signaling.ProtocolVersion,
+			}), peerID)
+			negotiated = true
 		}
 
-		// Add sender peer ID to the message
-		if data, ok := msg["data"].(map[string]interface{}); ok {
-			// Messages are forwarded to target peer
-			if targetPeerID, hasTarget := data["targetPeerId"].(string); hasTarget {
-				// This is a direct message to another peer
-				log.Printf("Forwarding %s from %s to %s", event, peerID, targetPeerID)
-				data["peerId"] = peerID // Add sender ID
-				delete(data, "targetPeerId") // Remove target from forwarded message
-				
-				forwardMsg := map[string]interface{}{
-					"event": event,
-					"data":  data,
-				}
-				
-				room.Peers.SendToPeer(forwardMsg, targetPeerID)
-				continue
-			}
+		ctx := &dispatch.Context{
+			Room:     room,
+			RoomID:   roomUUID,
+			PeerID:   peerID,
+			Envelope: env,
 		}
+		if err := dispatch.Default.Dispatch(ctx); err != nil {
+			replyError(room, peerID, err)
+		}
+		return true
+	}
+	for _, raw := range pending {
+		if !handle(raw) {
+			return
+		}
+	}
+	for raw := range frames {
+		if !handle(raw) {
+			return
+		}
+	}
+}
 
-		// Handle messages for the server
-		switch event {
-		case "ping":
-			// Respond to ping with pong to keep connection alive
-			// No action needed, just don't log/error
-			continue
-			
-		case "join":
-			// Extract and store username
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				if usernameVal, hasUsername := data["username"].(string); hasUsername && usernameVal != "" {
-					username = usernameVal
-					// Update the peer's username
-					room.Peers.ListLock.Lock()
-					for i := range room.Peers.Connections {
-						if room.Peers.Connections[i].PeerID == peerID {
-							room.Peers.Connections[i].Username = username
-							break
-						}
-					}
-					room.Peers.ListLock.Unlock()
-					log.Printf("Peer %s set username to: %s", peerID, username)
-				}
-			}
-			
-			// Notify other peers about the new peer with username
-			joinMsgWithUsername := map[string]interface{}{
-				"event": "peer-joined",
-				"data": map[string]interface{}{
-					"peerId":   peerID,
-					"username": username,
-				},
-			}
-			room.Peers.BroadcastToOthers(joinMsgWithUsername, peerID)
-			
-			
-		case "offer":
-			// WebRTC offer - forward to target peer
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				if targetPeerID, hasTarget := data["targetPeerId"].(string); hasTarget {
-					log.Printf("📨 Forwarding offer from %s to %s", peerID, targetPeerID)
-					data["peerId"] = peerID
-					delete(data, "targetPeerId")
-					
-					forwardMsg := map[string]interface{}{
-						"event": "offer",
-						"data":  data,
-					}
-					room.Peers.SendToPeer(forwardMsg, targetPeerID)
-				}
-			}
-			
-		case "answer":
-			// WebRTC answer - forward to target peer
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				if targetPeerID, hasTarget := data["targetPeerId"].(string); hasTarget {
-					log.Printf("📬 Forwarding answer from %s to %s", peerID, targetPeerID)
-					data["peerId"] = peerID
-					delete(data, "targetPeerId")
-					
-					forwardMsg := map[string]interface{}{
-						"event": "answer",
-						"data":  data,
-					}
-					room.Peers.SendToPeer(forwardMsg, targetPeerID)
-				}
-			}
-			
-		case "candidate":
-			// ICE candidate - forward to target peer
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				if targetPeerID, hasTarget := data["targetPeerId"].(string); hasTarget {
-					log.Printf("🧊 Forwarding ICE candidate from %s to %s", peerID, targetPeerID)
-					data["peerId"] = peerID
-					delete(data, "targetPeerId")
-					
-					forwardMsg := map[string]interface{}{
-						"event": "candidate",
-						"data":  data,
-					}
-					room.Peers.SendToPeer(forwardMsg, targetPeerID)
-				}
-			}
-			
-		case "request-screen-share":
-			// Participant requesting screen share permission
-			if room.IsHost(peerID) {
-				// Host can always share
-				room.GrantScreenShare(peerID)
-				responseMsg := map[string]interface{}{
-					"event": "screen-share-response",
-					"data": map[string]interface{}{
-						"approved": true,
-					},
-				}
-				room.Peers.SendToPeer(responseMsg, peerID)
-			} else {
-				// Forward request to host
-				hostID := room.GetHostPeerID()
-				if hostID != "" {
-					if msgData, ok := msg["data"].(map[string]interface{}); ok {
-						requestMsg := map[string]interface{}{
-							"event": "screen-share-request",
-							"data": map[string]interface{}{
-								"peerId":   peerID,
-								"peerName": msgData["peerName"],
-							},
-						}
-						room.Peers.SendToPeer(requestMsg, hostID)
-					}
-				}
-			}
-			
-		case "approve-screen-share":
-			// Host approving screen share request
-			if room.IsHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						room.GrantScreenShare(targetPeerID)
-						
-						// Notify the requester
-						responseMsg := map[string]interface{}{
-							"event": "screen-share-response",
-							"data": map[string]interface{}{
-								"approved": true,
-							},
-						}
-						room.Peers.SendToPeer(responseMsg, targetPeerID)
-					}
-				}
-			}
-			
-		case "deny-screen-share":
-			// Host denying screen share request
-			if room.IsHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						// Notify the requester
-						responseMsg := map[string]interface{}{
-							"event": "screen-share-response",
-							"data": map[string]interface{}{
-								"approved": false,
-							},
-						}
-						room.Peers.SendToPeer(responseMsg, targetPeerID)
-					}
-				}
-			}
-			
-		case "revoke-screen-share":
-			// Host revoking someone's screen share
-			if room.IsHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						room.RevokeScreenShare(targetPeerID)
-						
-						// Notify the user
-						responseMsg := map[string]interface{}{
-							"event": "screen-share-revoked",
-							"data": map[string]interface{}{},
-						}
-						room.Peers.SendToPeer(responseMsg, targetPeerID)
-					}
-				}
-			}
-			
-		case "screen-share-started":
-			// Broadcast to all other peers that someone started sharing
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				data["peerId"] = peerID
-				broadcastMsg := map[string]interface{}{
-					"event": "screen-share-started",
-					"data":  data,
-				}
-				room.Peers.BroadcastToOthers(broadcastMsg, peerID)
-				log.Printf("Peer %s started screen sharing", peerID)
-			}
-			
-		case "screen-share-stopped":
-			// Broadcast to all other peers that someone stopped sharing
-			broadcastMsg := map[string]interface{}{
-				"event": "screen-share-stopped",
-				"data": map[string]interface{}{
-					"peerId": peerID,
-				},
-			}
-			room.Peers.BroadcastToOthers(broadcastMsg, peerID)
-			log.Printf("Peer %s stopped screen sharing", peerID)
-			
-		// ============= CO-HOST CONTROLS =============
-		case "add-cohost":
-			if room.IsHostOrCoHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						room.AddCoHost(targetPeerID)
-						
-						// Notify the new co-host
-						notification := map[string]interface{}{
-							"event": "cohost-promoted",
-							"data": map[string]interface{}{
-								"message": "You have been promoted to co-host",
-							},
-						}
-						room.Peers.SendToPeer(notification, targetPeerID)
-						
-						// Broadcast to all
-						broadcast := map[string]interface{}{
-							"event": "cohost-added",
-							"data": map[string]interface{}{
-								"peerId": targetPeerID,
-							},
-						}
-						room.Peers.BroadcastToOthers(broadcast, peerID)
-					}
-				}
-			}
-			
-		case "remove-cohost":
-			if room.IsHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						room.RemoveCoHost(targetPeerID)
-						
-						notification := map[string]interface{}{
-							"event": "cohost-demoted",
-							"data": map[string]interface{}{},
-						}
-						room.Peers.SendToPeer(notification, targetPeerID)
-						
-						broadcast := map[string]interface{}{
-							"event": "cohost-removed",
-							"data": map[string]interface{}{
-								"peerId": targetPeerID,
-							},
-						}
-						room.Peers.BroadcastToOthers(broadcast, peerID)
-					}
-				}
-			}
-			
-		// ============= ROOM SECURITY =============
-		case "lock-room":
-			if room.IsHostOrCoHost(peerID) {
-				room.LockRoom()
-				broadcast := map[string]interface{}{
-					"event": "room-locked",
-					"data": map[string]interface{}{
-						"message": "Room has been locked by host",
-					},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		case "unlock-room":
-			if room.IsHostOrCoHost(peerID) {
-				room.UnlockRoom()
-				broadcast := map[string]interface{}{
-					"event": "room-unlocked",
-					"data": map[string]interface{}{},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		// ============= CHAT CONTROLS =============
-		case "disable-chat":
-			if room.IsHostOrCoHost(peerID) {
-				room.DisableChat()
-				broadcast := map[string]interface{}{
-					"event": "chat-disabled",
-					"data": map[string]interface{}{
-						"message": "Chat has been disabled by host",
-					},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		case "enable-chat":
-			if room.IsHostOrCoHost(peerID) {
-				room.EnableChat()
-				broadcast := map[string]interface{}{
-					"event": "chat-enabled",
-					"data": map[string]interface{}{},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		// ============= MUTE CONTROLS =============
-		case "mute-participant":
-			if room.IsHostOrCoHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						room.MuteParticipant(targetPeerID)
-						
-						notification := map[string]interface{}{
-							"event": "muted-by-host",
-							"data": map[string]interface{}{
-								"message": "You have been muted by the host",
-							},
-						}
-						room.Peers.SendToPeer(notification, targetPeerID)
-					}
-				}
-			}
-			
-		case "unmute-participant":
-			if room.IsHostOrCoHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						room.UnmuteParticipant(targetPeerID)
-						
-						notification := map[string]interface{}{
-							"event": "unmuted-by-host",
-							"data": map[string]interface{}{},
-						}
-						room.Peers.SendToPeer(notification, targetPeerID)
-					}
-				}
-			}
-			
-		case "mute-all":
-			if room.IsHostOrCoHost(peerID) {
-				room.MuteAll()
-				broadcast := map[string]interface{}{
-					"event": "all-muted",
-					"data": map[string]interface{}{
-						"message": "All participants have been muted",
-					},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		case "unmute-all":
-			if room.IsHostOrCoHost(peerID) {
-				room.UnmuteAll()
-				broadcast := map[string]interface{}{
-					"event": "all-unmuted",
-					"data": map[string]interface{}{},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		// ============= WAITING ROOM =============
-		case "admit-participant":
-			if room.IsHostOrCoHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						participant := room.AdmitFromWaitingRoom(targetPeerID)
-						if participant != nil {
-							notification := map[string]interface{}{
-								"event": "admitted-to-room",
-								"data": map[string]interface{}{
-									"message": "You have been admitted to the meeting",
-								},
-							}
-							room.Peers.SendToPeer(notification, targetPeerID)
-						}
-					}
-				}
-			}
-			
-		case "deny-participant":
-			if room.IsHostOrCoHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						room.RemoveFromWaitingRoom(targetPeerID)
-						// Connection will be closed
-					}
-				}
-			}
-			
-		case "get-waiting-room":
-			if room.IsHostOrCoHost(peerID) {
-				participants := room.GetWaitingParticipants()
-				response := map[string]interface{}{
-					"event": "waiting-room-list",
-					"data": map[string]interface{}{
-						"participants": participants,
-					},
-				}
-				c.WriteJSON(response)
-			}
-			
-		// ============= RECORDING =============
-		case "start-recording":
-			if room.IsHostOrCoHost(peerID) {
-				room.StartRecording()
-				broadcast := map[string]interface{}{
-					"event": "recording-started",
-					"data": map[string]interface{}{
-						"message": "This meeting is being recorded",
-					},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		case "stop-recording":
-			if room.IsHostOrCoHost(peerID) {
-				duration := room.StopRecording()
-				broadcast := map[string]interface{}{
-					"event": "recording-stopped",
-					"data": map[string]interface{}{
-						"duration": duration.String(),
-					},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-			}
-			
-		// ============= REMOVE PARTICIPANT =============
-		case "remove-participant":
-			if room.IsHostOrCoHost(peerID) {
-				if data, ok := msg["data"].(map[string]interface{}); ok {
-					if targetPeerID, ok := data["peerId"].(string); ok {
-						notification := map[string]interface{}{
-							"event": "removed-from-room",
-							"data": map[string]interface{}{
-								"message": "You have been removed from the meeting",
-							},
-						}
-						room.Peers.SendToPeer(notification, targetPeerID)
-						
-						// Remove the peer connection
-						room.Peers.RemovePeer(targetPeerID)
-					}
-				}
-			}
-			
-		// ============= RAISED HANDS =============
-		case "raise-hand":
-			// Add participant to raised hands list
-			room.RaiseHand(peerID)
-			
-			// Broadcast to all participants (using same event name frontend expects)
-			broadcast := map[string]interface{}{
-				"event": "raise-hand",
-				"data": map[string]interface{}{
-					"peerId":   peerID,
-					"username": username,
-					"timestamp": time.Now().Unix(),
-				},
-			}
-			room.Peers.BroadcastToAll(broadcast)
-			log.Printf("Hand raised by peer: %s", username)
-			log.Printf("Hand raised by peer %s", peerID)
-			
-		case "lower-hand":
-			// Remove participant from raised hands list
-			room.LowerHand(peerID)
-			
-			// Broadcast to all participants (using same event name frontend expects)
-			broadcast := map[string]interface{}{
-				"event": "lower-hand",
-				"data": map[string]interface{}{
-					"peerId": peerID,
-				},
-			}
-			room.Peers.BroadcastToAll(broadcast)
-			log.Printf("Hand lowered by peer: %s", username)
-			log.Printf("Hand lowered by peer %s", peerID)
-			
-		case "clear-all-hands":
-			// Host/co-host can clear all raised hands
-			if room.IsHostOrCoHost(peerID) {
-				room.ClearAllHands()
-				
-				broadcast := map[string]interface{}{
-					"event": "all-hands-cleared",
-					"data": map[string]interface{}{
-						"message": "All hands have been cleared",
-					},
-				}
-				room.Peers.BroadcastToAll(broadcast)
-				log.Println("All hands cleared")
-			}
-			
-		// ============= REACTIONS =============
-		case "reaction":
-			// Broadcast reaction to all participants
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				emoji, hasEmoji := data["emoji"].(string)
-				if hasEmoji {
-					broadcast := map[string]interface{}{
-						"event": "reaction",
-						"data": map[string]interface{}{
-							"peerId": peerID,
-							"emoji":  emoji,
-						},
-					}
-					room.Peers.BroadcastToAll(broadcast)
-					log.Printf("Reaction %s from peer %s", emoji, peerID)
-				}
-			}
-			
-		// ============= CHAT =============
-		case "chat-message":
-			// Check if chat is enabled
-			if room.IsChatDisabled {
-				log.Printf("Chat message rejected from peer %s (chat disabled)", peerID)
-				continue
-			}
-			
-			// Broadcast chat message to all other participants (not the sender)
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				broadcast := map[string]interface{}{
-					"event": "chat-message",
-					"data":  data,
-				}
-				room.Peers.BroadcastToOthers(broadcast, peerID)
-				log.Printf("Chat message from %s: %v", username, data["message"])
-			}
-			
-		// ============= ANNOTATIONS =============
-		case "annotation-draw":
-			// Broadcast drawing annotation to all participants
-			if data, ok := msg["data"].(map[string]interface{}); ok {
-				broadcast := map[string]interface{}{
-					"event": "annotation-draw",
-					"data": data,
-				}
-				room.Peers.BroadcastToOthers(broadcast, peerID)
-				log.Printf("Annotation draw from peer %s", peerID)
+// readFrames reads a websocket until it fails or done is closed, handing
+// each message over on the returned channel. The channel is closed when
+// reading stops.
+func readFrames(c *websocket.Conn, peerID string, done <-chan struct{}) <-chan []byte {
+	frames := make(chan []byte)
+	conn := c.Conn // The wrapper is recycled once the handler returns
+	go func() {
+		defer close(frames)
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				log.Printf("WebSocket read error from peer %s: %v", peerID, err)
+				return
 			}
-			
-		case "annotation-clear":
-			// Broadcast clear annotations to all participants
-			broadcast := map[string]interface{}{
-				"event": "annotation-clear",
-				"data": map[string]interface{}{
-					"peerId": peerID,
-				},
+			select {
+			case frames <- raw:
+			case <-done:
+				return
 			}
-			room.Peers.BroadcastToAll(broadcast)
-			log.Printf("Annotations cleared by peer %s", peerID)
 		}
-	}
+	}()
+	return frames
 }
 
-// handleOffer processes an SDP offer from a peer
-func handleOffer(pc *webrtc.PeerConnection, ws *websocket.Conn, msg map[string]interface{}, room *w.Room) {
-	data, ok := msg["data"].(map[string]interface{})
-	if !ok {
-		log.Println("Invalid offer data")
-		return
+// awaitPasscode asks a joiner for the room's passcode until they enter it,
+// run out of attempts or leave. client identifies the joiner across
+// connections for the lockout. Join messages sent meanwhile are returned to
+// handle once the joiner is in; anything else is dropped.
+func awaitPasscode(c *websocket.Conn, room *w.Room, client string, frames <-chan []byte) (bool, [][]byte) {
+	// Someone typing the passcode keeps the room from being closed as idle
+	defer room.Joining()()
+
+	var pending [][]byte
+	lockedOut := func(until time.Time) {
+		c.WriteJSON(signaling.New(signaling.EventPasscodeInvalid, signaling.PasscodeInvalid{
+			RetryAfter: int(time.Until(until).Seconds() + 0.999),
+			Message:    "Too many wrong passcodes, try again later",
+		}))
 	}
 
-	sdpStr, ok := data["sdp"].(string)
-	if !ok {
-		log.Println("Invalid SDP in offer")
-		return
+	status := room.PasscodeStatus(client, time.Now())
+	if !status.LockedUntil.IsZero() {
+		lockedOut(status.LockedUntil)
+		return false, nil
 	}
+	c.WriteJSON(signaling.New(signaling.EventPasscodeRequired, signaling.PasscodeRequired{
+		AttemptsLeft: status.AttemptsLeft,
+	}))
 
-	// Set remote description
-	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  sdpStr,
-	}); err != nil {
-		log.Printf("Failed to set remote description: %v", err)
-		return
+	for {
+		select {
+		case raw, ok := <-frames:
+			if !ok {
+				return false, nil
+			}
+			env, err := signaling.Decode(raw)
+			if err != nil {
+				continue
+			}
+			switch env.Event {
+			case signaling.EventJoin:
+				pending = append(pending, raw)
+			case signaling.EventPasscode:
+				var entered signaling.Passcode
+				json.Unmarshal(env.Data, &entered)
+				result := room.TryPasscode(client, entered.Passcode, time.Now())
+				switch {
+				case result.OK:
+					return true, pending
+				case !result.LockedUntil.IsZero():
+					lockedOut(result.LockedUntil)
+					return false, nil
+				}
+				c.WriteJSON(signaling.New(signaling.EventPasscodeInvalid, signaling.PasscodeInvalid{
+					AttemptsLeft: result.AttemptsLeft,
+					Message:      "Wrong passcode",
+				}))
+			}
+
+		case <-room.Done():
+			return false, nil
+		}
 	}
+}
 
-	// Add all existing tracks to this peer
-	room.Peers.ListLock.RLock()
-	for _, track := range room.Peers.TrackLocals {
-		if _, err := pc.AddTrack(track); err != nil {
-			log.Printf("Failed to add track: %v", err)
+// waitForAdmission parks a joiner in the waiting room until a host admits
+// or denies them, their entry expires, they leave or the room ends. It
+// reports whether they were admitted, the name they gave, why they were
+// turned away and the join messages to handle once they are in, including
+// those already pending; anything else sent while waiting is dropped.
+func waitForAdmission(c *websocket.Conn, room *w.Room, peerID, username string, frames <-chan []byte, pending [][]byte) (bool, string, string, [][]byte) {
+	// A name from a join token can't be changed by the client
+	_, verified := room.Identity(peerID)
+	for _, raw := range pending {
+		if name := joinName(raw); name != "" && !verified {
+			username = name
 		}
 	}
-	room.Peers.ListLock.RUnlock()
 
-	// Create answer
-	answer, err := pc.CreateAnswer(nil)
-	if err != nil {
-		log.Printf("Failed to create answer: %v", err)
-		return
-	}
+	waiting := room.AddToWaitingRoom(peerID, username, c)
+	log.Printf("Peer %s waiting to be admitted to room %s", peerID, room.ID)
+	c.WriteJSON(signaling.New(signaling.EventInWaitingRoom, signaling.Notice{
+		Message: "Please wait, the host will let you in soon",
+	}))
 
-	// Set local description
-	if err := pc.SetLocalDescription(answer); err != nil {
-		log.Printf("Failed to set local description: %v", err)
-		return
-	}
+	for {
+		select {
+		case admitted := <-waiting.Decision():
+			if !admitted {
+				c.WriteJSON(signaling.New(signaling.EventEntryDenied, signaling.Notice{
+					Message: waiting.Reason(),
+				}))
+				return false, username, waiting.Reason(), nil
+			}
+			c.WriteJSON(signaling.New(signaling.EventAdmittedToRoom, signaling.Notice{
+				Message: "You have been admitted to the meeting",
+			}))
+			return true, username, "", pending
+
+		case raw, ok := <-frames:
+			if !ok {
+				room.RemoveFromWaitingRoom(peerID, "Left the waiting room")
+				return false, username, "", nil
+			}
+			env, err := signaling.Decode(raw)
+			if err != nil || env.Event != signaling.EventJoin {
+				continue
+			}
+			if name := joinName(raw); name != "" && !verified {
+				username = name
+				room.SetWaitingName(peerID, username)
+			}
+			pending = append(pending, raw)
 
-	// Send answer back
-	response := map[string]interface{}{
-		"event": "answer",
-		"data": map[string]interface{}{
-			"sdp": answer.SDP,
-		},
+		case <-room.Done():
+			room.RemoveFromWaitingRoom(peerID, "The meeting has ended")
+			return false, username, "The meeting has ended", nil
+		}
 	}
+}
 
-	if err := ws.WriteJSON(response); err != nil {
-		log.Printf("Failed to send answer: %v", err)
+// closeWithReason closes a websocket with a close frame carrying reason,
+// cut to what fits in one
+func closeWithReason(c *websocket.Conn, reason string) {
+	const maxCloseReason = 123 // Control frames carry up to 125 bytes
+	for len(reason) > maxCloseReason {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
 	}
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+		time.Now().Add(time.Second))
+	c.Close()
 }
 
-// handleAnswer processes an SDP answer from a peer
-func handleAnswer(pc *webrtc.PeerConnection, msg map[string]interface{}) {
-	data, ok := msg["data"].(map[string]interface{})
-	if !ok {
-		log.Println("Invalid answer data")
-		return
+// joinName returns the username in a join message, if it is one and has
+// a name
+func joinName(raw []byte) string {
+	env, err := signaling.Decode(raw)
+	if err != nil || env.Event != signaling.EventJoin {
+		return ""
 	}
-
-	sdpStr, ok := data["sdp"].(string)
-	if !ok {
-		log.Println("Invalid SDP in answer")
-		return
+	var join signaling.JoinRequest
+	if json.Unmarshal(env.Data, &join) != nil {
+		return ""
 	}
+	return join.Username
+}
 
-	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  sdpStr,
-	}); err != nil {
-		log.Printf("Failed to set remote description: %v", err)
-	}
+// replyError reports a failed message back to the peer that sent it
+func replyError(room *w.Room, peerID string, err error) {
+	room.Peers.SendToPeer(signaling.AsError(err).Frame(), peerID)
 }
 
-// handleCandidate processes an ICE candidate from a peer
-func handleCandidate(pc *webrtc.PeerConnection, msg map[string]interface{}) {
-	data, ok := msg["data"].(map[string]interface{})
-	if !ok {
-		log.Println("Invalid candidate data")
-		return
-	}
+// EventStats reports per-event dispatch counters for room websockets
+func EventStats(c *fiber.Ctx) error {
+	return c.JSON(EventMetrics.Snapshot())
+}
 
-	candidateStr, ok := data["candidate"].(string)
-	if !ok {
-		log.Println("Invalid candidate string")
-		return
-	}
+// RoomStats reports live and reaped room and stream counts
+func RoomStats(c *fiber.Ctx) error {
+	return c.JSON(w.GetRoomStats())
+}
 
-	var candidate webrtc.ICECandidateInit
-	if err := json.Unmarshal([]byte(candidateStr), &candidate); err != nil {
-		log.Printf("Failed to unmarshal candidate: %v", err)
-		return
+// trackInfo describes a forwarded track for track announcements
+func trackInfo(peerID string, track *w.PublishedTrack) signaling.TrackInfo {
+	return signaling.TrackInfo{
+		PeerID:   peerID,
+		TrackID:  track.ID(),
+		StreamID: track.StreamID(),
+		Kind:     track.Kind().String(),
+		Source:   string(track.Source()),
 	}
+}
 
-	if err := pc.AddICECandidate(candidate); err != nil {
-		log.Printf("Failed to add ICE candidate: %v", err)
+// activeSpeaker returns the room's dominant speaker, if it tracks one
+func activeSpeaker(room *w.Room) string {
+	if room.Peers.Speakers == nil {
+		return ""
 	}
+	return room.Peers.Speakers.ActiveSpeaker()
 }
 
-// RoomChat handles the chat websocket for a room
+// RoomChat handles the chat websocket for a room. Clients identify
+// themselves with the chat token sent to them on joining.
 func RoomChatWebSocket(c *websocket.Conn) {
 	roomUUID := c.Params("uuid")
-	if roomUUID == "" {
+	if uuid.Validate(roomUUID) != nil {
 		c.Close()
 		return
 	}
@@ -877,8 +614,19 @@ func RoomChatWebSocket(c *websocket.Conn) {
 		return
 	}
 
-	client := chat.NewClient(room.Hub, c)
-	room.Hub.Register <- client
+	peerID, ok := room.ChatIdentity(c.Query("token"))
+	if !ok {
+		chat.Refuse(c, signaling.NewError(signaling.CodeForbidden, "", "a chat token from joining the room is required"))
+		return
+	}
+
+	client := chat.NewClient(room.Hub, c, peerID, func() string {
+		return room.Peers.GetUsername(peerID)
+	})
+	if !room.Hub.Join(client) {
+		c.Close()
+		return
+	}
 
 	go client.WritePump()
 	client.ReadPump()
@@ -887,12 +635,39 @@ func RoomChatWebSocket(c *websocket.Conn) {
 // RoomViewerWebSocket provides viewer count updates
 func RoomViewerWebSocket(c *websocket.Conn) {
 	roomUUID := c.Params("uuid")
-	if roomUUID == "" {
+	if uuid.Validate(roomUUID) != nil {
 		c.Close()
 		return
 	}
 
-	room := w.CreateRoom(roomUUID)
+	room, exists := w.GetRoom(roomUUID)
+	if !exists {
+		c.Close()
+		return
+	}
+
+	watchRoom(c, room, func() signaling.ViewerCount {
+		return signaling.ViewerCount{Count: room.Peers.GetConnectionCount()}
+	})
+}
+
+// watchRoom pushes a viewer count every two seconds until the client goes
+// away or the room ends
+func watchRoom(c *websocket.Conn, room *w.Room, count func() signaling.ViewerCount) {
+	release := room.Watch()
+	defer release()
+
+	// Viewers send nothing; reading is how a departed client is noticed
+	gone := make(chan struct{})
+	conn := c.Conn // The wrapper is recycled once the handler returns
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
 
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
@@ -900,16 +675,17 @@ func RoomViewerWebSocket(c *websocket.Conn) {
 	for {
 		select {
 		case <-ticker.C:
-			count := room.Peers.GetConnectionCount()
-			msg := map[string]interface{}{
-				"event": "viewer_count",
-				"data": map[string]interface{}{
-					"count": count,
-				},
-			}
-			if err := c.WriteJSON(msg); err != nil {
+			if err := c.WriteJSON(signaling.New(signaling.EventViewerCount, count())); err != nil {
 				return
 			}
+		case <-room.Done():
+			c.WriteJSON(signaling.New(signaling.EventRoomEnded, signaling.RoomEnded{
+				RoomID: room.ID,
+				Reason: room.EndReason(),
+			}))
+			return
+		case <-gone:
+			return
 		}
 	}
 }
@@ -0,0 +1,845 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"videochat/pkg/chat"
+	"videochat/pkg/dispatch"
+	"videochat/pkg/signaling"
+	w "videochat/pkg/webrtc"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// EventMetrics counts every event handled on room websockets
+var EventMetrics = dispatch.NewMetrics()
+
+func init() {
+	dispatch.Use(
+		dispatch.Logger(),
+		EventMetrics.Middleware(),
+		dispatch.RateLimit(50, 100),
+		dispatch.Authorize(),
+	)
+
+	dispatch.Default.HandleRelay([]string{
+		signaling.EventOffer, signaling.EventAnswer, signaling.EventCandidate,
+	}, relayToPeer)
+
+	dispatch.Handle(signaling.EventPing, dispatch.Anyone, handlePing)
+	dispatch.Handle(signaling.EventJoin, dispatch.Anyone, handleJoin)
+	dispatch.Handle(signaling.EventOffer, dispatch.Anyone, handleOffer)
+	dispatch.Handle(signaling.EventAnswer, dispatch.Anyone, handleAnswer)
+	dispatch.Handle(signaling.EventCandidate, dispatch.Anyone, handleCandidate)
+	dispatch.Handle(signaling.EventSubscribe, dispatch.Anyone, handleSubscribe)
+	dispatch.Handle(signaling.EventUnsubscribe, dispatch.Anyone, handleUnsubscribe)
+	dispatch.Handle(signaling.EventSelectLayer, dispatch.Anyone, handleSelectLayer)
+
+	// Screen sharing
+	dispatch.Handle(signaling.EventRequestScreenShare, dispatch.Anyone, handleRequestScreenShare)
+	dispatch.Handle(signaling.EventApproveScreenShare, dispatch.ManageParticipants, handleApproveScreenShare)
+	dispatch.Handle(signaling.EventDenyScreenShare, dispatch.ManageParticipants, handleDenyScreenShare)
+	dispatch.Handle(signaling.EventRevokeScreenShare, dispatch.ManageParticipants, handleRevokeScreenShare)
+	dispatch.Handle(signaling.EventScreenShareStarted, dispatch.Anyone, handleScreenShareStarted)
+	dispatch.Handle(signaling.EventScreenShareStopped, dispatch.Anyone, handleScreenShareStopped)
+
+	// Co-host controls
+	dispatch.Handle(signaling.EventAddCoHost, dispatch.HostOnly, handleAddCoHost)
+	dispatch.Handle(signaling.EventRemoveCoHost, dispatch.HostOnly, handleRemoveCoHost)
+	dispatch.Handle(signaling.EventTransferHost, dispatch.HostOnly, handleTransferHost)
+
+	// Roles
+	dispatch.Handle(signaling.EventSetRole, dispatch.ManageParticipants, handleSetRole)
+	dispatch.Handle(signaling.EventSetRoleCapabilities, dispatch.HostOnly, handleSetRoleCapabilities)
+
+	// Room security
+	dispatch.Handle(signaling.EventLockRoom, dispatch.ManageParticipants, handleLockRoom)
+	dispatch.Handle(signaling.EventUnlockRoom, dispatch.ManageParticipants, handleUnlockRoom)
+	dispatch.Handle(signaling.EventSetGuestPolicy, dispatch.ManageParticipants, handleSetGuestPolicy)
+	dispatch.Handle(signaling.EventSetPasscode, dispatch.ManageParticipants, handleSetPasscode)
+
+	// Chat controls
+	dispatch.Handle(signaling.EventDisableChat, dispatch.ManageParticipants, handleDisableChat)
+	dispatch.Handle(signaling.EventEnableChat, dispatch.ManageParticipants, handleEnableChat)
+	dispatch.Handle(signaling.EventDisablePrivateChat, dispatch.ManageParticipants, handleDisablePrivateChat)
+	dispatch.Handle(signaling.EventEnablePrivateChat, dispatch.ManageParticipants, handleEnablePrivateChat)
+
+	// Chat moderation
+	dispatch.Handle(signaling.EventDeleteChatMessage, dispatch.ManageParticipants, handleDeleteChatMessage)
+	dispatch.Handle(signaling.EventMuteChat, dispatch.ManageParticipants, handleMuteChat)
+	dispatch.Handle(signaling.EventUnmuteChat, dispatch.ManageParticipants, handleUnmuteChat)
+	dispatch.Handle(signaling.EventSetSlowMode, dispatch.ManageParticipants, handleSetSlowMode)
+
+	// Mute controls
+	dispatch.Handle(signaling.EventMuteParticipant, dispatch.ManageParticipants, handleMuteParticipant)
+	dispatch.Handle(signaling.EventUnmuteParticipant, dispatch.ManageParticipants, handleUnmuteParticipant)
+	dispatch.Handle(signaling.EventMuteAll, dispatch.ManageParticipants, handleMuteAll)
+	dispatch.Handle(signaling.EventUnmuteAll, dispatch.ManageParticipants, handleUnmuteAll)
+
+	// Waiting room
+	dispatch.Handle(signaling.EventAdmitParticipant, dispatch.ManageParticipants, handleAdmitParticipant)
+	dispatch.Handle(signaling.EventDenyParticipant, dispatch.ManageParticipants, handleDenyParticipant)
+	dispatch.Handle(signaling.EventGetWaitingRoom, dispatch.ManageParticipants, handleGetWaitingRoom)
+	dispatch.Handle(signaling.EventSetWaitingRoom, dispatch.ManageParticipants, handleSetWaitingRoom)
+
+	// Recording
+	dispatch.Handle(signaling.EventStartRecording, dispatch.ManageParticipants, handleStartRecording)
+	dispatch.Handle(signaling.EventStopRecording, dispatch.ManageParticipants, handleStopRecording)
+
+	// Participants
+	dispatch.Handle(signaling.EventRemoveParticipant, dispatch.ManageParticipants, handleRemoveParticipant)
+
+	// Raised hands
+	dispatch.Handle(signaling.EventRaiseHand, dispatch.Anyone, handleRaiseHand)
+	dispatch.Handle(signaling.EventLowerHand, dispatch.Anyone, handleLowerHand)
+	dispatch.Handle(signaling.EventClearAllHands, dispatch.ManageParticipants, handleClearAllHands)
+
+	// Engagement
+	dispatch.Handle(signaling.EventReaction, dispatch.Anyone, handleReaction)
+	dispatch.Handle(signaling.EventChatMessage, dispatch.Require(w.CapChat), handleChatMessage)
+	dispatch.Handle(signaling.EventAnnotationDraw, dispatch.Require(w.CapAnnotate), handleAnnotationDraw)
+	dispatch.Handle(signaling.EventAnnotationClear, dispatch.Require(w.CapAnnotate), handleAnnotationClear)
+}
+
+// relayToPeer forwards a directed offer, answer or candidate from one peer
+// to another, validated against its payload type and with the sender ID
+// stamped on. Other events carrying a target go to their own handlers.
+func relayToPeer(ctx *dispatch.Context) error {
+	env := ctx.Envelope
+	targetPeerID := env.Target()
+	var msg signaling.Message
+
+	switch env.Event {
+	case signaling.EventOffer, signaling.EventAnswer:
+		var sd signaling.SessionDescription
+		if err := env.Bind(&sd); err != nil {
+			return err
+		}
+		sd.TargetPeerID = ""
+		sd.PeerID = ctx.PeerID
+		if sd.Username == "" {
+			sd.Username = ctx.Username()
+		}
+		msg = signaling.New(env.Event, sd)
+
+	case signaling.EventCandidate:
+		var candidate signaling.ICECandidate
+		if err := env.Bind(&candidate); err != nil {
+			return err
+		}
+		candidate.TargetPeerID = ""
+		candidate.PeerID = ctx.PeerID
+		if candidate.Username == "" {
+			candidate.Username = ctx.Username()
+		}
+		msg = signaling.New(env.Event, candidate)
+
+	default:
+		return signaling.NewError(signaling.CodeUnknownEvent, env.Event, "event can't be sent to a peer")
+	}
+
+	log.Printf("Forwarding %s from %s to %s", env.Event, ctx.PeerID, targetPeerID)
+	ctx.Room.Peers.SendToPeer(msg, targetPeerID)
+	return nil
+}
+
+func handlePing(ctx *dispatch.Context) error {
+	// Keep-alive only, no reply needed
+	return nil
+}
+
+func handleJoin(ctx *dispatch.Context) error {
+	var join signaling.JoinRequest
+	if err := ctx.Bind(&join); err != nil {
+		return err
+	}
+
+	// A name from a join token can't be changed by the client
+	if _, verified := ctx.Room.Identity(ctx.PeerID); join.Username != "" && !verified {
+		ctx.Room.Peers.SetUsername(ctx.PeerID, join.Username)
+		log.Printf("Peer %s set username to: %s", ctx.PeerID, join.Username)
+	}
+
+	// Notify other peers about the new peer with username
+	ctx.BroadcastToOthers(signaling.EventPeerJoined, signaling.PeerInfo{
+		PeerID:   ctx.PeerID,
+		Username: ctx.Username(),
+	})
+	return nil
+}
+
+// ============= SFU NEGOTIATION =============
+//
+// In mesh rooms offers, answers and candidates always carry a targetPeerId
+// and are relayed. In SFU rooms untargeted ones negotiate the sender's
+// connection with the server.
+
+// serverPeerConnection returns the sender's connection to the server, or an
+// error if this room does not negotiate media with the server
+func serverPeerConnection(ctx *dispatch.Context) (*webrtc.PeerConnection, error) {
+	if ctx.Room.Mode != w.RoomModeSFU {
+		return nil, signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), "targetPeerId is required")
+	}
+	pc := ctx.PeerConnection()
+	if pc == nil {
+		return nil, signaling.NewError(signaling.CodeInternal, ctx.Event(), "no server connection for peer")
+	}
+	return pc, nil
+}
+
+// handleOffer answers a client-initiated renegotiation, e.g. when the
+// client starts sharing its screen
+func handleOffer(ctx *dispatch.Context) error {
+	if _, err := serverPeerConnection(ctx); err != nil {
+		return err
+	}
+
+	var offer signaling.SessionDescription
+	if err := ctx.Bind(&offer); err != nil {
+		return err
+	}
+	return ctx.Room.Peers.AcceptOffer(ctx.PeerID, offer.SDP)
+}
+
+// handleAnswer completes a server-initiated offer
+func handleAnswer(ctx *dispatch.Context) error {
+	if _, err := serverPeerConnection(ctx); err != nil {
+		return err
+	}
+
+	var answer signaling.SessionDescription
+	if err := ctx.Bind(&answer); err != nil {
+		return err
+	}
+	return ctx.Room.Peers.AcceptAnswer(ctx.PeerID, answer.SDP)
+}
+
+// handleCandidate adds a client ICE candidate to its server connection
+func handleCandidate(ctx *dispatch.Context) error {
+	pc, err := serverPeerConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	var candidate signaling.ICECandidate
+	if err := ctx.Bind(&candidate); err != nil {
+		return err
+	}
+
+	if err := pc.AddICECandidate(webrtc.ICECandidateInit(candidate.Candidate)); err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	return nil
+}
+
+// handleSubscribe starts forwarding a peer's tracks to the sender. The
+// renegotiation that adds the senders follows as a server offer.
+func handleSubscribe(ctx *dispatch.Context) error {
+	publisherID, sources, err := bindSubscription(ctx)
+	if err != nil {
+		return err
+	}
+	ctx.Room.Peers.Subscribe(ctx.PeerID, publisherID, sources)
+	return nil
+}
+
+// handleUnsubscribe stops forwarding a peer's tracks to the sender
+func handleUnsubscribe(ctx *dispatch.Context) error {
+	publisherID, sources, err := bindSubscription(ctx)
+	if err != nil {
+		return err
+	}
+	ctx.Room.Peers.Unsubscribe(ctx.PeerID, publisherID, sources)
+	return nil
+}
+
+// bindSubscription decodes a subscribe or unsubscribe payload. An empty
+// source list means every source.
+func bindSubscription(ctx *dispatch.Context) (string, []w.TrackSource, error) {
+	if ctx.Room.Mode != w.RoomModeSFU {
+		return "", nil, signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), "subscriptions are only available in SFU rooms")
+	}
+
+	var sub signaling.Subscription
+	if err := ctx.Bind(&sub); err != nil {
+		return "", nil, err
+	}
+
+	if len(sub.Sources) == 0 {
+		return sub.PeerID, w.AllSources, nil
+	}
+	sources := make([]w.TrackSource, 0, len(sub.Sources))
+	for _, s := range sub.Sources {
+		source, err := w.ParseTrackSource(s)
+		if err != nil {
+			return "", nil, signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+		}
+		sources = append(sources, source)
+	}
+	return sub.PeerID, sources, nil
+}
+
+// handleSelectLayer pins the simulcast layer the sender receives for a
+// track, e.g. when a tile is shown as a thumbnail
+func handleSelectLayer(ctx *dispatch.Context) error {
+	if ctx.Room.Mode != w.RoomModeSFU {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), "layers are only available in SFU rooms")
+	}
+
+	var selection signaling.LayerSelection
+	if err := ctx.Bind(&selection); err != nil {
+		return err
+	}
+
+	if err := ctx.Room.Peers.SelectLayer(ctx.PeerID, selection.TrackID, selection.RID); err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	return nil
+}
+
+// ============= SCREEN SHARING =============
+
+func handleRequestScreenShare(ctx *dispatch.Context) error {
+	// Roles that can share don't need to ask
+	if ctx.Room.Can(ctx.PeerID, w.CapShareScreen) {
+		ctx.Room.GrantScreenShare(ctx.PeerID)
+		ctx.Reply(signaling.EventScreenShareResponse, signaling.ScreenShareResponse{Approved: true})
+		return nil
+	}
+
+	var req signaling.ScreenShareRequest
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+
+	// Forward request to host
+	if hostID := ctx.Room.GetHostPeerID(); hostID != "" {
+		ctx.SendTo(hostID, signaling.EventScreenShareRequest, signaling.ScreenShareRequested{
+			PeerID:   ctx.PeerID,
+			PeerName: req.PeerName,
+		})
+	}
+	return nil
+}
+
+func handleApproveScreenShare(ctx *dispatch.Context) error {
+	target, err := ctx.ManagedPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.GrantScreenShare(target)
+	ctx.SendTo(target, signaling.EventScreenShareResponse, signaling.ScreenShareResponse{Approved: true})
+	return nil
+}
+
+func handleDenyScreenShare(ctx *dispatch.Context) error {
+	target, err := ctx.ManagedPeer()
+	if err != nil {
+		return err
+	}
+	ctx.SendTo(target, signaling.EventScreenShareResponse, signaling.ScreenShareResponse{Approved: false})
+	return nil
+}
+
+func handleRevokeScreenShare(ctx *dispatch.Context) error {
+	target, err := ctx.ManagedPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.RevokeScreenShare(target)
+	ctx.SendTo(target, signaling.EventScreenShareRevoked, nil)
+	return nil
+}
+
+func handleScreenShareStarted(ctx *dispatch.Context) error {
+	if !ctx.Room.CanShareScreen(ctx.PeerID) {
+		return ctx.Forbidden()
+	}
+	ctx.BroadcastToOthers(signaling.EventScreenShareStarted, signaling.PeerRef{PeerID: ctx.PeerID})
+	log.Printf("Peer %s started screen sharing", ctx.PeerID)
+	return nil
+}
+
+func handleScreenShareStopped(ctx *dispatch.Context) error {
+	ctx.BroadcastToOthers(signaling.EventScreenShareStopped, signaling.PeerRef{PeerID: ctx.PeerID})
+	log.Printf("Peer %s stopped screen sharing", ctx.PeerID)
+	return nil
+}
+
+// ============= CO-HOST CONTROLS =============
+
+func handleAddCoHost(ctx *dispatch.Context) error {
+	target, err := ctx.TargetPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.AddCoHost(target)
+
+	// Notify the new co-host, then everyone else
+	ctx.SendTo(target, signaling.EventCoHostPromoted, signaling.Notice{
+		Message: "You have been promoted to co-host",
+	})
+	ctx.BroadcastToOthers(signaling.EventCoHostAdded, signaling.PeerRef{PeerID: target})
+	announceRole(ctx.Room, target)
+	return nil
+}
+
+func handleRemoveCoHost(ctx *dispatch.Context) error {
+	target, err := ctx.TargetPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.RemoveCoHost(target)
+
+	ctx.SendTo(target, signaling.EventCoHostDemoted, nil)
+	ctx.BroadcastToOthers(signaling.EventCoHostRemoved, signaling.PeerRef{PeerID: target})
+	announceRole(ctx.Room, target)
+	return nil
+}
+
+// handleTransferHost hands hosting to another peer in the room
+func handleTransferHost(ctx *dispatch.Context) error {
+	target, err := ctx.TargetPeer()
+	if err != nil {
+		return err
+	}
+	switch err := ctx.Room.TransferHost(ctx.PeerID, target); {
+	case errors.Is(err, w.ErrNotInRoom):
+		return signaling.NewError(signaling.CodeNotFound, ctx.Event(), err.Error())
+	case err != nil:
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	announceHost(ctx.Room, target, ctx.PeerID, signaling.HostChangedTransferred)
+	return nil
+}
+
+// announceHost tells the room who hosts it now, and shows a new host the
+// waiting room
+func announceHost(room *w.Room, hostID, previousID, reason string) {
+	room.Peers.BroadcastMessage(signaling.New(signaling.EventHostChanged, signaling.HostChanged{
+		HostID:         hostID,
+		PreviousHostID: previousID,
+		Reason:         reason,
+	}))
+	if hostID != "" {
+		announceRole(room, hostID)
+		room.Peers.SendToPeer(signaling.New(signaling.EventWaitingRoomUpdated, room.WaitingRoomList()), hostID)
+	}
+	if _, ok := room.Peers.Get(previousID); ok {
+		announceRole(room, previousID)
+	}
+}
+
+// ============= ROLES =============
+
+// handleSetRole gives a participant another role. Only the host makes or
+// unmakes co-hosts.
+func handleSetRole(ctx *dispatch.Context) error {
+	var change signaling.RoleChange
+	if err := ctx.Bind(&change); err != nil {
+		return err
+	}
+	role, err := w.ParseRole(change.Role)
+	if err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	if _, ok := ctx.Room.Peers.Get(change.PeerID); !ok {
+		return signaling.NewError(signaling.CodeNotFound, ctx.Event(), w.ErrNotInRoom.Error())
+	}
+	if (role == w.RoleCoHost || ctx.Room.Role(change.PeerID) == w.RoleCoHost) && !ctx.Room.IsHost(ctx.PeerID) {
+		return ctx.Forbidden()
+	}
+	if err := ctx.Room.SetRole(change.PeerID, role); err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	announceRole(ctx.Room, change.PeerID)
+	return nil
+}
+
+// handleSetRoleCapabilities changes what a role can do in the room
+func handleSetRoleCapabilities(ctx *dispatch.Context) error {
+	var req signaling.RoleCapabilities
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+	role, err := w.ParseRole(req.Role)
+	if err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	capabilities := make([]w.Capability, 0, len(req.Capabilities))
+	for _, name := range req.Capabilities {
+		capability, err := w.ParseCapability(name)
+		if err != nil {
+			return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+		}
+		capabilities = append(capabilities, capability)
+	}
+	if err := ctx.Room.SetRoleCapabilities(role, capabilities); err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	ctx.Broadcast(signaling.EventRoleCapabilitiesChanged, signaling.RoleCapabilities{
+		Role:         string(role),
+		Capabilities: capabilityNames(ctx.Room.RoleCapabilities(role)),
+	})
+	return nil
+}
+
+// announceRole tells the room a peer's role, and what it lets them do
+func announceRole(room *w.Room, peerID string) {
+	role := room.Role(peerID)
+	room.Peers.BroadcastMessage(signaling.New(signaling.EventRoleChanged, signaling.RoleChanged{
+		PeerID:       peerID,
+		Role:         string(role),
+		Capabilities: capabilityNames(room.RoleCapabilities(role)),
+	}))
+}
+
+// capabilityNames lists capabilities as they are sent to clients
+func capabilityNames(capabilities []w.Capability) []string {
+	names := make([]string, len(capabilities))
+	for i, capability := range capabilities {
+		names[i] = string(capability)
+	}
+	return names
+}
+
+// ============= ROOM SECURITY =============
+
+func handleLockRoom(ctx *dispatch.Context) error {
+	ctx.Room.LockRoom()
+	ctx.Broadcast(signaling.EventRoomLocked, signaling.Notice{Message: "Room has been locked by host"})
+	return nil
+}
+
+func handleUnlockRoom(ctx *dispatch.Context) error {
+	ctx.Room.UnlockRoom()
+	ctx.Broadcast(signaling.EventRoomUnlocked, nil)
+	return nil
+}
+
+func handleSetGuestPolicy(ctx *dispatch.Context) error {
+	var req signaling.GuestPolicy
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+	policy, err := w.ParseGuestPolicy(req.Policy)
+	if err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	ctx.Room.SetGuestPolicy(policy)
+	ctx.Broadcast(signaling.EventGuestPolicyChanged, signaling.GuestPolicy{Policy: string(policy)})
+	return nil
+}
+
+func handleSetPasscode(ctx *dispatch.Context) error {
+	var req signaling.Passcode
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+	if err := ctx.Room.SetPasscode(req.Passcode); err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), err.Error())
+	}
+	ctx.Broadcast(signaling.EventPasscodeChanged, signaling.PasscodeChanged{Enabled: req.Passcode != ""})
+	return nil
+}
+
+// ============= CHAT CONTROLS =============
+
+func handleDisableChat(ctx *dispatch.Context) error {
+	ctx.Room.DisableChat()
+	ctx.Broadcast(signaling.EventChatDisabled, signaling.Notice{Message: "Chat has been disabled by host"})
+	return nil
+}
+
+func handleEnableChat(ctx *dispatch.Context) error {
+	ctx.Room.EnableChat()
+	ctx.Broadcast(signaling.EventChatEnabled, nil)
+	return nil
+}
+
+func handleDisablePrivateChat(ctx *dispatch.Context) error {
+	ctx.Room.DisablePrivateChat()
+	ctx.Broadcast(signaling.EventPrivateChatDisabled, signaling.Notice{Message: "Private chat has been disabled by host"})
+	return nil
+}
+
+func handleEnablePrivateChat(ctx *dispatch.Context) error {
+	ctx.Room.EnablePrivateChat()
+	ctx.Broadcast(signaling.EventPrivateChatEnabled, nil)
+	return nil
+}
+
+// ============= CHAT MODERATION =============
+
+func handleDeleteChatMessage(ctx *dispatch.Context) error {
+	var ref signaling.ChatMessageRef
+	if err := ctx.Bind(&ref); err != nil {
+		return err
+	}
+
+	// Messages sent over the chat websocket are logged, and the hub tells
+	// those who could see them
+	if ctx.Room.Hub.Delete(ref.MessageID) {
+		return nil
+	}
+
+	// Those sent as chat-message events only need the notice, sent to
+	// whoever received them
+	audience, ok := ctx.Room.TakeChatMessage(ref.MessageID)
+	if !ok {
+		return signaling.NewError(signaling.CodeNotFound, ctx.Event(), "no such message")
+	}
+	notice := signaling.ChatMessageRef{MessageID: ref.MessageID, PeerID: ctx.PeerID}
+	if audience == nil {
+		ctx.Broadcast(signaling.EventChatMessageDeleted, notice)
+		return nil
+	}
+	for _, peerID := range audience {
+		ctx.SendTo(peerID, signaling.EventChatMessageDeleted, notice)
+	}
+	return nil
+}
+
+func handleMuteChat(ctx *dispatch.Context) error {
+	target, err := ctx.TargetPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.MuteChat(target)
+	ctx.Broadcast(signaling.EventChatMuted, signaling.PeerRef{PeerID: target})
+	return nil
+}
+
+func handleUnmuteChat(ctx *dispatch.Context) error {
+	target, err := ctx.TargetPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.UnmuteChat(target)
+	ctx.Broadcast(signaling.EventChatUnmuted, signaling.PeerRef{PeerID: target})
+	return nil
+}
+
+func handleSetSlowMode(ctx *dispatch.Context) error {
+	var slowMode signaling.SlowMode
+	if err := ctx.Bind(&slowMode); err != nil {
+		return err
+	}
+	ctx.Room.SetSlowMode(time.Duration(slowMode.Seconds) * time.Second)
+	ctx.Broadcast(signaling.EventSlowModeChanged, slowMode)
+	return nil
+}
+
+// ============= MUTE CONTROLS =============
+
+func handleMuteParticipant(ctx *dispatch.Context) error {
+	target, err := ctx.ManagedPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.MuteParticipant(target)
+	ctx.SendTo(target, signaling.EventMutedByHost, signaling.Notice{Message: "You have been muted by the host"})
+	return nil
+}
+
+func handleUnmuteParticipant(ctx *dispatch.Context) error {
+	target, err := ctx.ManagedPeer()
+	if err != nil {
+		return err
+	}
+	ctx.Room.UnmuteParticipant(target)
+	ctx.SendTo(target, signaling.EventUnmutedByHost, nil)
+	return nil
+}
+
+func handleMuteAll(ctx *dispatch.Context) error {
+	ctx.Room.MuteAll()
+	ctx.Broadcast(signaling.EventAllMuted, signaling.Notice{Message: "All participants have been muted"})
+	return nil
+}
+
+func handleUnmuteAll(ctx *dispatch.Context) error {
+	ctx.Room.UnmuteAll()
+	ctx.Broadcast(signaling.EventAllUnmuted, nil)
+	return nil
+}
+
+// ============= WAITING ROOM =============
+
+func handleAdmitParticipant(ctx *dispatch.Context) error {
+	target, err := ctx.TargetPeer()
+	if err != nil {
+		return err
+	}
+	// The participant's own connection finishes joining once admitted
+	if ctx.Room.AdmitFromWaitingRoom(target) == nil {
+		return signaling.NewError(signaling.CodeNotFound, ctx.Event(), "participant is not in the waiting room")
+	}
+	return nil
+}
+
+// handleDenyParticipant turns someone away; their own connection tells
+// them why and closes
+func handleDenyParticipant(ctx *dispatch.Context) error {
+	var req signaling.DenyEntry
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		reason = "The host did not let you in"
+	}
+	if !ctx.Room.RemoveFromWaitingRoom(req.PeerID, reason) {
+		return signaling.NewError(signaling.CodeNotFound, ctx.Event(), "participant is not in the waiting room")
+	}
+	return nil
+}
+
+func handleGetWaitingRoom(ctx *dispatch.Context) error {
+	ctx.Reply(signaling.EventWaitingRoomList, ctx.Room.WaitingRoomList())
+	return nil
+}
+
+func handleSetWaitingRoom(ctx *dispatch.Context) error {
+	var req signaling.WaitingRoom
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+	ctx.Room.SetWaitingRoom(req.Enabled)
+	ctx.Broadcast(signaling.EventWaitingRoomChanged, req)
+	return nil
+}
+
+// ============= RECORDING =============
+
+// handleStartRecording starts writing the room's media to disk. Mesh rooms
+// are refused because their media never reaches the server.
+func handleStartRecording(ctx *dispatch.Context) error {
+	if ctx.Room.Mode != w.RoomModeSFU {
+		return signaling.NewError(signaling.CodeInvalidPayload, ctx.Event(), "recording is only available in SFU rooms")
+	}
+	if err := ctx.Room.StartRecording(); err != nil {
+		log.Printf("Failed to start recording in room %s: %v", ctx.RoomID, err)
+		return signaling.NewError(signaling.CodeInternal, ctx.Event(), "could not start recording")
+	}
+	ctx.Broadcast(signaling.EventRecordingStarted, signaling.Notice{Message: "This meeting is being recorded"})
+	return nil
+}
+
+func handleStopRecording(ctx *dispatch.Context) error {
+	id, duration := ctx.Room.StopRecording()
+	ctx.Broadcast(signaling.EventRecordingStopped, signaling.RecordingStopped{
+		RecordingID: id,
+		Duration:    duration.String(),
+	})
+	return nil
+}
+
+// ============= REMOVE PARTICIPANT =============
+
+func handleRemoveParticipant(ctx *dispatch.Context) error {
+	target, err := ctx.ManagedPeer()
+	if err != nil {
+		return err
+	}
+	ctx.SendTo(target, signaling.EventRemovedFromRoom, signaling.Notice{
+		Message: "You have been removed from the meeting",
+	})
+	ctx.Room.Peers.RemovePeer(target)
+	return nil
+}
+
+// ============= RAISED HANDS =============
+
+func handleRaiseHand(ctx *dispatch.Context) error {
+	ctx.Room.RaiseHand(ctx.PeerID)
+
+	// Broadcast to all participants (using same event name frontend expects)
+	ctx.Broadcast(signaling.EventRaiseHand, signaling.HandRaised{
+		PeerID:    ctx.PeerID,
+		Username:  ctx.Username(),
+		Timestamp: time.Now().Unix(),
+	})
+	return nil
+}
+
+func handleLowerHand(ctx *dispatch.Context) error {
+	ctx.Room.LowerHand(ctx.PeerID)
+	ctx.Broadcast(signaling.EventLowerHand, signaling.PeerRef{PeerID: ctx.PeerID})
+	return nil
+}
+
+func handleClearAllHands(ctx *dispatch.Context) error {
+	ctx.Room.ClearAllHands()
+	ctx.Broadcast(signaling.EventAllHandsCleared, signaling.Notice{Message: "All hands have been cleared"})
+	return nil
+}
+
+// ============= ENGAGEMENT =============
+
+func handleReaction(ctx *dispatch.Context) error {
+	var reaction signaling.Reaction
+	if err := ctx.Bind(&reaction); err != nil {
+		return err
+	}
+	reaction.PeerID = ctx.PeerID
+	ctx.Broadcast(signaling.EventReaction, reaction)
+	return nil
+}
+
+func handleChatMessage(ctx *dispatch.Context) error {
+	var message signaling.ChatMessage
+	if err := ctx.Bind(&message); err != nil {
+		return err
+	}
+
+	// Chat sent here is screened the same as on the chat websocket
+	text, err := chat.CheckText(message.Message, ctx.Event())
+	if err != nil {
+		return err
+	}
+	private := message.TargetPeerID != ""
+	if private {
+		if _, ok := ctx.Room.Peers.Get(message.TargetPeerID); !ok || message.TargetPeerID == ctx.PeerID {
+			return signaling.NewError(signaling.CodeNotFound, ctx.Event(), "recipient is not in the room")
+		}
+	}
+	if text, err = ctx.Room.ModerateChat(ctx.PeerID, text, private, ctx.Event()); err != nil {
+		return err
+	}
+	message.ID = uuid.New().String()
+	message.PeerID = ctx.PeerID
+	message.Username = ctx.Username()
+	message.Message = text
+	ctx.Room.NoteChatMessage(message.ID, ctx.PeerID, message.TargetPeerID)
+
+	// A private message goes to its recipient only; the rest to all other
+	// participants (not the sender)
+	if private {
+		target := message.TargetPeerID
+		message.TargetPeerID = ""
+		ctx.SendTo(target, signaling.EventChatMessage, message)
+		return nil
+	}
+	ctx.BroadcastToOthers(signaling.EventChatMessage, message)
+	return nil
+}
+
+func handleAnnotationDraw(ctx *dispatch.Context) error {
+	var annotation signaling.Annotation
+	if err := ctx.Bind(&annotation); err != nil {
+		return err
+	}
+	annotation.PeerID = ctx.PeerID
+	ctx.BroadcastToOthers(signaling.EventAnnotationDraw, annotation)
+	return nil
+}
+
+func handleAnnotationClear(ctx *dispatch.Context) error {
+	ctx.Broadcast(signaling.EventAnnotationClear, signaling.PeerRef{PeerID: ctx.PeerID})
+	return nil
+}
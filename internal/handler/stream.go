@@ -1,11 +1,10 @@
 package handlers
 
 import (
-	"encoding/json"
 	"log"
-	"time"
 
 	"videochat/pkg/chat"
+	"videochat/pkg/signaling"
 	w "videochat/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
@@ -17,172 +16,190 @@ import (
 // Stream renders the stream viewer page
 func Stream(c *fiber.Ctx) error {
 	streamUUID := c.Params("ssuid")
-	if streamUUID == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Stream UUID is required")
+	if uuid.Validate(streamUUID) != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("A valid stream UUID is required")
 	}
 
-	stream := w.CreateStream(streamUUID)
+	stream, exists := w.GetStream(streamUUID)
+	if !exists {
+		return c.Status(fiber.StatusNotFound).SendString("Stream not found")
+	}
 
 	return c.Render("stream", fiber.Map{
 		"StreamID": streamUUID,
 		"Title":    "Live Stream",
 		"Viewers":  stream.Peers.GetConnectionCount(),
+		"State":    stream.StreamState(),
 	}, "layouts/main")
 }
 
+// StreamCreate registers a new stream. The publish key in the response is
+// the only way to publish to it and is not shown again.
+func StreamCreate(c *fiber.Ctx) error {
+	streamID := uuid.New().String()
+	_, key, err := w.CreateStream(streamID)
+	if err != nil {
+		log.Printf("Failed to create stream: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create stream")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"streamId":   streamID,
+		"publishKey": key,
+		"url":        "/stream/" + streamID,
+		"whip":       "/stream/" + streamID + "/whip",
+	})
+}
+
 // StreamWebSocket handles WebRTC streaming via WebSocket
 func StreamWebSocket(c *websocket.Conn) {
 	streamUUID := c.Params("ssuid")
-	if streamUUID == "" {
-		log.Println("Stream UUID is required")
+	if uuid.Validate(streamUUID) != nil {
+		log.Println("A valid stream UUID is required")
+		c.Close()
+		return
+	}
+
+	stream, exists := w.GetStream(streamUUID)
+	if !exists {
+		log.Printf("Stream %s not found", streamUUID)
 		c.Close()
 		return
 	}
 
-	stream := w.CreateStream(streamUUID)
-	
 	// Generate a unique peer ID for this connection
 	peerID := uuid.New().String()
 
-	peerConnection, err := webrtc.NewPeerConnection(w.RoomConfig)
+	// Only the connection presenting the publish key may send tracks
+	role := w.StreamViewer
+	if key := c.Query("key"); key != "" {
+		if err := stream.AuthorizePublisher(peerID, key); err != nil {
+			c.WriteJSON(signaling.NewError(signaling.CodeForbidden, "", err.Error()).Frame())
+			c.Close()
+			return
+		}
+		role = w.StreamPublisher
+		defer stream.ReleasePublisher(peerID)
+	}
+
+	peerConnection, err := w.NewPeerConnection()
 	if err != nil {
 		log.Printf("Failed to create peer connection: %v", err)
 		c.Close()
 		return
 	}
 
-	stream.Peers.AddPeerConnectionWithID(peerConnection, c, peerID, "Streamer")
+	if role == w.StreamPublisher {
+		stream.Peers.AddPeerConnectionWithID(peerConnection, c, peerID, "Streamer")
+		forwardStreamTracks(stream, peerConnection, peerID)
+	} else {
+		stream.Peers.AddViewerConnection(peerConnection, c, peerID, "Viewer")
+	}
 
 	defer func() {
 		stream.Peers.RemovePeerConnection(peerConnection)
 		peerConnection.Close()
 	}()
 
-	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("Stream track received: %s, Type: %s", remoteTrack.ID(), remoteTrack.Kind())
-
-		localTrack := stream.Peers.AddTrack(remoteTrack, peerID)
-		if localTrack == nil {
+	// Trickle the server's ICE candidates to the client
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
 			return
 		}
-
-		defer stream.Peers.RemoveTrack(localTrack)
-
-		rtpBuf := make([]byte, 1400)
-		for {
-			i, _, readErr := remoteTrack.Read(rtpBuf)
-			if readErr != nil {
-				return
-			}
-
-			if _, err := localTrack.Write(rtpBuf[:i]); err != nil {
-				return
-			}
-		}
+		stream.Peers.SendToPeer(signaling.New(signaling.EventCandidate, signaling.ICECandidate{
+			Candidate: signaling.Candidate(candidate.ToJSON()),
+		}), peerID)
 	})
 
 	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		log.Printf("Stream ICE State: %s", state.String())
 	})
 
+	// Viewers get an offer for whatever is already being published
 	stream.Peers.SignalPeerConnections()
 
 	for {
-		var msg map[string]interface{}
-		if err := c.ReadJSON(&msg); err != nil {
+		_, raw, err := c.ReadMessage()
+		if err != nil {
 			break
 		}
 
-		event, ok := msg["event"].(string)
-		if !ok {
+		env, err := signaling.Decode(raw)
+		if err != nil {
+			stream.Peers.SendToPeer(signaling.AsError(err).Frame(), peerID)
 			continue
 		}
 
-		switch event {
-		case "offer":
-			handleStreamOffer(peerConnection, c, msg, stream)
-		case "answer":
-			handleStreamAnswer(peerConnection, msg)
-		case "candidate":
-			handleStreamCandidate(peerConnection, msg)
+		if err := handleStreamEvent(peerConnection, stream, env, peerID, role); err != nil {
+			stream.Peers.SendToPeer(signaling.AsError(err).Frame(), peerID)
 		}
 	}
 }
 
-func handleStreamOffer(pc *webrtc.PeerConnection, ws *websocket.Conn, msg map[string]interface{}, stream *w.Room) {
-	data, ok := msg["data"].(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	sdpStr, ok := data["sdp"].(string)
-	if !ok {
-		return
-	}
-
-	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  sdpStr,
-	}); err != nil {
-		return
-	}
-
-	stream.Peers.ListLock.RLock()
-	for _, track := range stream.Peers.TrackLocals {
-		pc.AddTrack(track)
-	}
-	stream.Peers.ListLock.RUnlock()
-
-	answer, err := pc.CreateAnswer(nil)
-	if err != nil {
-		return
-	}
+// forwardStreamTracks forwards every track a stream publisher sends to the
+// stream's viewers
+func forwardStreamTracks(stream *w.Room, pc *webrtc.PeerConnection, peerID string) {
+	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Printf("Stream track received: %s, Type: %s", remoteTrack.ID(), remoteTrack.Kind())
 
-	pc.SetLocalDescription(answer)
+		localTrack, _ := stream.Peers.AddTrack(remoteTrack, peerID)
+		defer stream.Peers.RemoveTrack(localTrack, remoteTrack.RID())
 
-	ws.WriteJSON(map[string]interface{}{
-		"event": "answer",
-		"data":  map[string]interface{}{"sdp": answer.SDP},
+		stream.Peers.Forward(remoteTrack, localTrack)
 	})
 }
 
-func handleStreamAnswer(pc *webrtc.PeerConnection, msg map[string]interface{}) {
-	data, ok := msg["data"].(map[string]interface{})
-	if !ok {
-		return
-	}
+// handleStreamEvent processes a signaling message from a stream connection
+func handleStreamEvent(pc *webrtc.PeerConnection, stream *w.Room, env *signaling.Envelope, peerID string, role w.StreamRole) error {
+	switch env.Event {
+	case signaling.EventPing:
+		// Keep-alive only
 
-	sdpStr, ok := data["sdp"].(string)
-	if !ok {
-		return
-	}
+	case signaling.EventOffer:
+		// Viewers only answer the server's offers
+		if role != w.StreamPublisher {
+			return signaling.NewError(signaling.CodeForbidden, env.Event, "only the publisher can send tracks")
+		}
+		var offer signaling.SessionDescription
+		if err := env.Bind(&offer); err != nil {
+			return err
+		}
+		return stream.Peers.AcceptOffer(peerID, offer.SDP)
 
-	pc.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  sdpStr,
-	})
-}
+	case signaling.EventAnswer:
+		var answer signaling.SessionDescription
+		if err := env.Bind(&answer); err != nil {
+			return err
+		}
+		return stream.Peers.AcceptAnswer(peerID, answer.SDP)
 
-func handleStreamCandidate(pc *webrtc.PeerConnection, msg map[string]interface{}) {
-	data, ok := msg["data"].(map[string]interface{})
-	if !ok {
-		return
-	}
+	case signaling.EventCandidate:
+		var candidate signaling.ICECandidate
+		if err := env.Bind(&candidate); err != nil {
+			return err
+		}
+		return pc.AddICECandidate(webrtc.ICECandidateInit(candidate.Candidate))
 
-	candidateStr, ok := data["candidate"].(string)
-	if !ok {
-		return
+	case signaling.EventSelectLayer:
+		var selection signaling.LayerSelection
+		if err := env.Bind(&selection); err != nil {
+			return err
+		}
+		if err := stream.Peers.SelectLayer(peerID, selection.TrackID, selection.RID); err != nil {
+			return signaling.NewError(signaling.CodeInvalidPayload, env.Event, err.Error())
+		}
+
+	default:
+		return signaling.NewError(signaling.CodeUnknownEvent, env.Event, "unknown event")
 	}
 
-	var candidate webrtc.ICECandidateInit
-	json.Unmarshal([]byte(candidateStr), &candidate)
-	pc.AddICECandidate(candidate)
+	return nil
 }
 
 // StreamChatWebSocket handles chat for a stream
 func StreamChatWebSocket(c *websocket.Conn) {
 	streamUUID := c.Params("ssuid")
-	if streamUUID == "" {
+	if uuid.Validate(streamUUID) != nil {
 		c.Close()
 		return
 	}
@@ -193,8 +210,14 @@ func StreamChatWebSocket(c *websocket.Conn) {
 		return
 	}
 
-	client := chat.NewClient(stream.Hub, c)
-	stream.Hub.Register <- client
+	// Stream viewers chat anonymously under a name the server gives them
+	client := chat.NewClient(stream.Hub, c, uuid.New().String(), func() string {
+		return "Viewer"
+	})
+	if !stream.Hub.Join(client) {
+		c.Close()
+		return
+	}
 
 	go client.WritePump()
 	client.ReadPump()
@@ -203,21 +226,21 @@ func StreamChatWebSocket(c *websocket.Conn) {
 // StreamViewerWebSocket provides viewer count updates
 func StreamViewerWebSocket(c *websocket.Conn) {
 	streamUUID := c.Params("ssuid")
-	if streamUUID == "" {
+	if uuid.Validate(streamUUID) != nil {
 		c.Close()
 		return
 	}
 
-	stream := w.CreateStream(streamUUID)
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+	stream, exists := w.GetStream(streamUUID)
+	if !exists {
+		c.Close()
+		return
+	}
 
-	for range ticker.C {
-		if err := c.WriteJSON(map[string]interface{}{
-			"event": "viewer_count",
-			"data":  map[string]interface{}{"count": stream.Peers.GetConnectionCount()},
-		}); err != nil {
-			return
+	watchRoom(c, stream, func() signaling.ViewerCount {
+		return signaling.ViewerCount{
+			Count: stream.Peers.GetConnectionCount(),
+			State: string(stream.StreamState()),
 		}
-	}
+	})
 }
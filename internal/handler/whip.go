@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	w "videochat/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// ============= WHIP / WHEP SESSIONS =============
+//
+// WHIP (publish) and WHEP (playback) negotiate a connection with one HTTP
+// request instead of a websocket. The answer carries all of the server's
+// candidates; clients may trickle theirs with PATCH and end the session
+// with DELETE on the resource URL returned in Location. The resource ID is
+// a random secret rather than the session's peer ID, which other
+// participants can see, so only the client that made the session can
+// change or end it.
+
+const (
+	mimeSDP         = "application/sdp"
+	mimeTrickleFrag = "application/trickle-ice-sdpfrag"
+)
+
+// httpSession is a WHIP or WHEP connection, addressed by its resource ID
+type httpSession struct {
+	id       string // peer ID in the stream
+	resource string
+	streamID string
+	stream   *w.Room
+	pc       *webrtc.PeerConnection
+}
+
+var (
+	httpSessions     = make(map[string]*httpSession)
+	httpSessionsLock sync.Mutex
+)
+
+// close tears the session down. It is safe to call more than once.
+func (s *httpSession) close() {
+	httpSessionsLock.Lock()
+	delete(httpSessions, s.resource)
+	httpSessionsLock.Unlock()
+
+	s.stream.ReleasePublisher(s.id)
+	s.stream.Peers.RemovePeerConnection(s.pc)
+	if err := s.pc.Close(); err != nil {
+		log.Printf("Error closing session %s: %v", s.id, err)
+	}
+}
+
+// startHTTPSession answers an SDP offer posted to a WHIP or WHEP endpoint.
+// Publishers must present the stream's publish key as a bearer token.
+// setup runs before the offer is applied so it can register track handlers
+// or add the tracks to send.
+func startHTTPSession(c *fiber.Ctx, kind string, role w.StreamRole, setup func(s *httpSession) error) error {
+	streamID := c.Params("ssuid")
+	if uuid.Validate(streamID) != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("A valid stream UUID is required")
+	}
+	stream, exists := w.GetStream(streamID)
+	if !exists {
+		return c.Status(fiber.StatusNotFound).SendString("Stream not found")
+	}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), mimeSDP) {
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString("Content-Type must be " + mimeSDP)
+	}
+	offer := string(c.Body())
+	if offer == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("SDP offer is required")
+	}
+
+	resource, err := newResourceID()
+	if err != nil {
+		log.Printf("Failed to create %s resource ID: %v", kind, err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create session")
+	}
+	s := &httpSession{
+		id:       uuid.New().String(),
+		resource: resource,
+		streamID: streamID,
+		stream:   stream,
+	}
+
+	if role == w.StreamPublisher {
+		key := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		switch err := stream.AuthorizePublisher(s.id, key); {
+		case errors.Is(err, w.ErrStreamBusy):
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case err != nil:
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+	}
+
+	pc, err := w.NewPeerConnection()
+	if err != nil {
+		stream.ReleasePublisher(s.id)
+		log.Printf("Failed to create %s peer connection: %v", kind, err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create peer connection")
+	}
+	s.pc = pc
+	defer w.DiscardEstimator(pc)
+
+	// Until the session is registered, failing just drops the connection
+	abort := func() {
+		stream.ReleasePublisher(s.id)
+		pc.Close()
+	}
+
+	if err := setup(s); err != nil {
+		abort()
+		log.Printf("Failed to set up %s session: %v", kind, err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to set up session")
+	}
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		abort()
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid SDP offer: " + err.Error())
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		abort()
+		return c.Status(fiber.StatusBadRequest).SendString("Could not answer offer: " + err.Error())
+	}
+
+	// The server can't trickle over HTTP, so its candidates go in the answer
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		abort()
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to set local description")
+	}
+	<-gathered
+
+	if role == w.StreamPublisher {
+		s.stream.Peers.AddPeerConnectionWithID(pc, nil, s.id, kind)
+	} else {
+		s.stream.Peers.AddViewerConnection(pc, nil, s.id, kind)
+		s.stream.Peers.Renegotiate(s.id)
+	}
+
+	httpSessionsLock.Lock()
+	httpSessions[s.resource] = s
+	httpSessionsLock.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("%s session %s: %s", kind, s.id, state)
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.close()
+		}
+	})
+
+	for _, link := range iceServerLinks() {
+		c.Append(fiber.HeaderLink, link)
+	}
+	c.Set(fiber.HeaderLocation, c.Path()+"/"+s.resource)
+	c.Set(fiber.HeaderContentType, mimeSDP)
+	return c.Status(fiber.StatusCreated).SendString(pc.LocalDescription().SDP)
+}
+
+// newResourceID returns an unguessable ID for a session's resource URL
+func newResourceID() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// lookupHTTPSession finds the session addressed by a resource URL
+func lookupHTTPSession(c *fiber.Ctx) (*httpSession, bool) {
+	httpSessionsLock.Lock()
+	defer httpSessionsLock.Unlock()
+
+	s, ok := httpSessions[c.Params("id")]
+	if !ok || s.streamID != c.Params("ssuid") {
+		return nil, false
+	}
+	return s, true
+}
+
+// HTTPSessionPatch adds trickled ICE candidates to a WHIP or WHEP session
+func HTTPSessionPatch(c *fiber.Ctx) error {
+	s, ok := lookupHTTPSession(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Session not found")
+	}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), mimeTrickleFrag) {
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString("Content-Type must be " + mimeTrickleFrag)
+	}
+
+	candidates, err := parseTrickleFragment(string(c.Body()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	for _, candidate := range candidates {
+		if err := s.pc.AddICECandidate(candidate); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid candidate: " + err.Error())
+		}
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HTTPSessionDelete ends a WHIP or WHEP session
+func HTTPSessionDelete(c *fiber.Ctx) error {
+	s, ok := lookupHTTPSession(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Session not found")
+	}
+	s.close()
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// parseTrickleFragment extracts candidates from an SDP fragment (RFC 8840).
+// Candidates apply to the media section they follow, identified by its
+// index and, when present, its a=mid line.
+func parseTrickleFragment(frag string) ([]webrtc.ICECandidateInit, error) {
+	var candidates []webrtc.ICECandidateInit
+	var mid *string
+	section := -1
+
+	scanner := bufio.NewScanner(strings.NewReader(frag))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "m="):
+			section++
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			if section < 0 && mid == nil {
+				return nil, fmt.Errorf("candidate outside a media section")
+			}
+			candidate := webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			}
+			if section >= 0 {
+				index := uint16(section)
+				candidate.SDPMLineIndex = &index
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, scanner.Err()
+}
+
+// iceServerLinks advertises the server's STUN servers to WHIP/WHEP clients
+func iceServerLinks() []string {
+	var links []string
+	for _, server := range w.RoomConfig.ICEServers {
+		for _, url := range server.URLs {
+			links = append(links, fmt.Sprintf(`<%s>; rel="ice-server"`, url))
+		}
+	}
+	return links
+}
+
+// ============= WHIP =============
+
+// WHIPPublish accepts a WHIP offer from the stream's publisher and feeds
+// its tracks into the stream, exactly like a websocket publisher
+func WHIPPublish(c *fiber.Ctx) error {
+	return startHTTPSession(c, "WHIP", w.StreamPublisher, func(s *httpSession) error {
+		forwardStreamTracks(s.stream, s.pc, s.id)
+		return nil
+	})
+}
+
+// ============= WHEP =============
+
+// WHEPPlay answers a WHEP offer with an audio and a video sender, fed from
+// whatever the stream publishes now or later, including after the publisher
+// reconnects. The viewer counts as a stream connection like a websocket
+// viewer.
+func WHEPPlay(c *fiber.Ctx) error {
+	return startHTTPSession(c, "WHEP", w.StreamViewer, func(s *httpSession) error {
+		// Viewers need a keyframe as soon as media can flow
+		s.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+			if state == webrtc.ICEConnectionStateConnected {
+				s.stream.Peers.DispatchKeyFrame()
+			}
+		})
+		return s.stream.Peers.AddSendTransceivers(s.pc)
+	})
+}
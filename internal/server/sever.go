@@ -1,12 +1,20 @@
 package server
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"videochat/internal/handler"
+	"videochat/pkg/auth"
+	"videochat/pkg/chat"
+	"videochat/pkg/files"
+	"videochat/pkg/hls"
+	"videochat/pkg/recording"
 	w "videochat/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
@@ -20,6 +28,48 @@ var (
 	addr = flag.String("addr", ":"+os.Getenv("PORT"), "")
 	cert = flag.String("cert", "", "")
 	key  = flag.String("key", "", "")
+
+	trustedProxies = flag.String("trusted-proxies", "", "comma-separated addresses or CIDR ranges of reverse proxies trusted to give the client's address in X-Forwarded-For; without them everyone behind a proxy shares its address, e.g. for passcode lockouts")
+
+	roomMode = flag.String("room-mode", string(w.RoomModeMesh), "media topology for new rooms: mesh or sfu")
+
+	recordingsDir = flag.String("recordings-dir", recording.Dir, "directory recordings are written to")
+
+	joinTokenSecret = flag.String("join-token-secret", os.Getenv("JOIN_TOKEN_SECRET"), "HMAC key join tokens are signed with; empty disables join tokens and makes the first person in a room its host")
+	guestPolicy     = flag.String("guest-policy", string(w.DefaultGuestPolicy), "what happens to people joining new rooms without a join token: allow, waiting-room or reject")
+
+	hostSuccession   = flag.String("host-succession", string(w.Succession), "who takes over when a room's host leaves: anyone (co-hosts first), co-hosts or none")
+	hostReclaimGrace = flag.Duration("host-reclaim-grace", w.HostReclaimGrace, "how long a host who left can rejoin with their join token and take hosting back; 0 disables it")
+
+	defaultRole = flag.String("default-role", string(w.DefaultRole), "role of participants who join without one: presenter, attendee or viewer")
+
+	waitingRoom        = flag.Bool("waiting-room", w.DefaultWaitingRoom, "park everyone joining new rooms, except hosts, until a host admits them")
+	waitingRoomTimeout = flag.Duration("waiting-room-timeout", w.WaitingRoomTimeout, "how long someone may wait to be admitted before they are turned away; 0 lets them wait indefinitely")
+
+	passcodeAttempts = flag.Int("passcode-attempts", w.MaxPasscodeAttempts, "wrong room passcodes a client may enter before it is locked out")
+	passcodeLockout  = flag.Duration("passcode-lockout", w.PasscodeLockout, "how long a client that entered too many wrong passcodes is locked out")
+
+	roomIdleTimeout = flag.Duration("room-idle-timeout", w.RoomIdleTimeout, "how long an empty room or stream is kept before it is closed; 0 keeps them forever")
+	recordRetention = flag.Duration("room-record-retention", w.RecordRetention, "how long a closed room or stream can be brought back before its settings and chat history are deleted; 0 deletes them on closing")
+
+	roomStore = flag.String("room-store", "", "database file rooms and streams are kept in across restarts; empty keeps them in memory")
+
+	chatHistory      = flag.String("chat-history", "", "database file chat history is kept in across restarts; empty keeps it in memory")
+	chatHistoryLimit = flag.Int("chat-history-limit", chat.HistoryLimit, "number of messages kept per chat")
+	chatReplay       = flag.Int("chat-replay", chat.ReplayCount, "number of recent messages sent to a client when it joins a chat")
+	chatBannedWords  = flag.String("chat-banned-words", "", "comma-separated words masked in chat messages")
+	chatRejectBanned = flag.Bool("chat-reject-banned", false, "reject chat messages with banned words instead of masking them")
+
+	filesDir       = flag.String("files-dir", files.Dir, "directory files shared in chat are kept in")
+	filesMaxSize   = flag.Int64("files-max-size", files.DefaultLimits.MaxFileSize, "largest file that can be shared in a room, in bytes")
+	filesRoomQuota = flag.Int64("files-room-quota", files.DefaultLimits.MaxRoomSize, "total size of the files kept per room, in bytes")
+	filesTypes     = flag.String("files-types", strings.Join(files.DefaultLimits.AllowedTypes, ","), "comma-separated media types that can be shared")
+	filesRetention = flag.Duration("files-retention", files.Retention, "how long shared files are kept; 0 deletes them when their room is closed")
+
+	hlsEnabled         = flag.Bool("hls", hls.Enabled, "package streams as low-latency HLS")
+	hlsSegmentDuration = flag.Duration("hls-segment-duration", hls.SegmentDuration, "target duration of HLS segments")
+	hlsPartDuration    = flag.Duration("hls-part-duration", hls.PartDuration, "target duration of HLS partial segments")
+	hlsWindow          = flag.Int("hls-window", hls.Window, "number of segments kept in the HLS playlist")
 )
 
 func Run() error {
@@ -29,14 +79,115 @@ func Run() error {
 		*addr = ":8080"
 	}
 
+	mode, err := w.ParseRoomMode(*roomMode)
+	if err != nil {
+		return err
+	}
+	w.DefaultRoomMode = mode
+	policy, err := w.ParseGuestPolicy(*guestPolicy)
+	if err != nil {
+		return err
+	}
+	w.DefaultGuestPolicy = policy
+	auth.Secret = []byte(*joinTokenSecret)
+	if auth.Enabled() {
+		log.Printf("Join tokens enabled; guests are handled with policy %s", policy)
+	}
+	if *passcodeAttempts < 1 || *passcodeLockout < 0 {
+		return fmt.Errorf("invalid passcode settings: %d attempts, locked out for %s", *passcodeAttempts, *passcodeLockout)
+	}
+	succession, err := w.ParseHostSuccession(*hostSuccession)
+	if err != nil {
+		return err
+	}
+	if *hostReclaimGrace < 0 {
+		return fmt.Errorf("invalid host reclaim grace %s", *hostReclaimGrace)
+	}
+	w.Succession = succession
+	w.HostReclaimGrace = *hostReclaimGrace
+	role, err := w.ParseRole(*defaultRole)
+	if err != nil {
+		return err
+	}
+	if role == w.RoleHost || role == w.RoleCoHost {
+		return fmt.Errorf("invalid default role %q", role)
+	}
+	w.DefaultRole = role
+	if *waitingRoomTimeout < 0 {
+		return fmt.Errorf("invalid waiting room timeout %s", *waitingRoomTimeout)
+	}
+	w.DefaultWaitingRoom = *waitingRoom
+	w.WaitingRoomTimeout = *waitingRoomTimeout
+	w.MaxPasscodeAttempts = *passcodeAttempts
+	w.PasscodeLockout = *passcodeLockout
+	w.RoomIdleTimeout = *roomIdleTimeout
+	w.RecordRetention = *recordRetention
+	recording.Dir = *recordingsDir
+
+	if *roomStore != "" {
+		store, err := w.OpenBoltStore(*roomStore)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		w.Store = store
+		log.Printf("Keeping rooms in %s", *roomStore)
+	}
+
+	if *chatHistoryLimit < 1 || *chatReplay < 0 {
+		return fmt.Errorf("invalid chat history settings: %d messages kept, %d replayed", *chatHistoryLimit, *chatReplay)
+	}
+	chat.HistoryLimit = *chatHistoryLimit
+	chat.ReplayCount = *chatReplay
+	if *chatBannedWords != "" {
+		chat.DefaultFilter = chat.NewWordFilter(strings.Split(*chatBannedWords, ","), *chatRejectBanned)
+	}
+	if *chatHistory != "" {
+		history, err := chat.OpenBoltHistory(*chatHistory)
+		if err != nil {
+			return err
+		}
+		defer history.Close()
+		chat.History = history
+		log.Printf("Keeping chat history in %s", *chatHistory)
+	}
+
+	if *filesMaxSize < 1 || *filesRoomQuota < *filesMaxSize || *filesRetention < 0 {
+		return fmt.Errorf("invalid file sharing settings: files up to %d bytes, %d per room, kept %s", *filesMaxSize, *filesRoomQuota, *filesRetention)
+	}
+	files.Dir = *filesDir
+	files.Retention = *filesRetention
+	files.DefaultLimits = files.Limits{
+		MaxFileSize:  *filesMaxSize,
+		MaxRoomSize:  *filesRoomQuota,
+		AllowedTypes: strings.Split(*filesTypes, ","),
+	}
+
+	if *hlsPartDuration <= 0 || *hlsSegmentDuration < *hlsPartDuration || *hlsWindow < 1 {
+		return fmt.Errorf("invalid HLS settings: segments of %s, parts of %s, window of %d", *hlsSegmentDuration, *hlsPartDuration, *hlsWindow)
+	}
+	hls.Enabled = *hlsEnabled
+	hls.SegmentDuration = *hlsSegmentDuration
+	hls.PartDuration = *hlsPartDuration
+	hls.Window = *hlsWindow
+
 	// Initialize template engine
 	engine := html.New("./views", ".html")
 	
 	// Create Fiber app
-	app := fiber.New(fiber.Config{
+	config := fiber.Config{
 		Views:       engine,
 		ViewsLayout: "layouts/main",
-	})
+		BodyLimit:   max(fiber.DefaultBodyLimit, int(*filesMaxSize)+1<<20), // Room for a file and its form
+	}
+	if *trustedProxies != "" {
+		// Only requests from these proxies may say who the client is
+		config.ProxyHeader = fiber.HeaderXForwardedFor
+		config.EnableTrustedProxyCheck = true
+		config.TrustedProxies = strings.Split(*trustedProxies, ",")
+		config.EnableIPValidation = true
+	}
+	app := fiber.New(config)
 
 	// Middleware
 	app.Use(logger.New())
@@ -49,15 +200,23 @@ func Run() error {
 	app.Get("/", handlers.Welcome)
 	app.Get("/room/create", handlers.RoomCreate)
 	app.Get("/room/:uuid", handlers.Room)
+	app.Get("/metrics/events", handlers.EventStats)
+	app.Get("/metrics/rooms", handlers.RoomStats)
 	
 	// WebSocket routes
-	app.Get("/room/:uuid/websocket", websocket.New(handlers.RoomWebSocket, websocket.Config{
+	app.Get("/room/:uuid/websocket", handlers.RoomJoinAuth, websocket.New(handlers.RoomWebSocket, websocket.Config{
 		HandshakeTimeout: 10 * time.Second,
 	}))
 	app.Get("/room/:uuid/chat/websocket", websocket.New(handlers.RoomChatWebSocket))
 	app.Get("/room/:uuid/viewer/websocket", websocket.New(handlers.RoomViewerWebSocket))
+
+	// Files shared in room chat
+	app.Post("/room/:uuid/files", handlers.RoomFileUpload)
+	app.Get("/room/:uuid/files", handlers.RoomFiles)
+	app.Get("/room/:uuid/files/:id", handlers.RoomFileDownload)
 	
 	// Stream routes
+	app.Post("/stream/create", handlers.StreamCreate)
 	app.Get("/stream/:ssuid", handlers.Stream)
 	app.Get("/stream/:ssuid/websocket", websocket.New(handlers.StreamWebSocket, websocket.Config{
 		HandshakeTimeout: 10 * time.Second,
@@ -65,9 +224,27 @@ func Run() error {
 	app.Get("/stream/:ssuid/chat/websocket", websocket.New(handlers.StreamChatWebSocket))
 	app.Get("/stream/:ssuid/viewer/websocket", websocket.New(handlers.StreamViewerWebSocket))
 
+	app.Get("/stream/:ssuid/hls/:file", handlers.StreamHLS)
+
+	// WHIP ingest
+	app.Post("/stream/:ssuid/whip", handlers.WHIPPublish)
+	app.Patch("/stream/:ssuid/whip/:id", handlers.HTTPSessionPatch)
+	app.Delete("/stream/:ssuid/whip/:id", handlers.HTTPSessionDelete)
+
+	// WHEP playback
+	app.Post("/stream/:ssuid/whep", handlers.WHEPPlay)
+	app.Patch("/stream/:ssuid/whep/:id", handlers.HTTPSessionPatch)
+	app.Delete("/stream/:ssuid/whep/:id", handlers.HTTPSessionDelete)
+
 	// Start keyframe dispatcher
 	w.StartKeyFrameDispatcher()
 
+	// Close rooms nobody has been in for a while
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.StartRoomReaper(ctx)
+	files.StartExpiry(ctx)
+
 	log.Printf("Server starting on %s", *addr)
 
 	// Start server
@@ -0,0 +1,122 @@
+// Package auth signs and verifies the join tokens participants present when
+// they connect to a room. Tokens are HMAC-signed JWTs issued by whatever
+// application sends people to the room; they carry who the participant is
+// and the role they join with.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Role is what a join token lets its holder do in a room
+type Role string
+
+const (
+	RoleHost        Role = "host"
+	RoleParticipant Role = "participant"
+
+	// Tokens can also name the room role their holder joins with.
+	// Participants get the room's default role.
+	RoleCoHost    Role = "co-host"
+	RolePresenter Role = "presenter"
+	RoleAttendee  Role = "attendee"
+	RoleViewer    Role = "viewer"
+)
+
+// Identity is who a verified join token says its holder is
+type Identity struct {
+	UserID string
+	Name   string
+	Role   Role
+}
+
+// Claims are the claims of a join token. The subject is the user ID.
+type Claims struct {
+	jwt.RegisteredClaims
+	Name string `json:"name,omitempty"`
+	Role Role   `json:"role,omitempty"`
+
+	// Room limits the token to one room. Tokens without it are good for
+	// any room.
+	Room string `json:"room,omitempty"`
+}
+
+var (
+	// Secret is the HMAC key join tokens are signed with. Join tokens are
+	// disabled while it is empty.
+	Secret []byte
+
+	// Leeway allows for clock drift between the issuer and this server
+	Leeway = 30 * time.Second
+)
+
+var (
+	ErrDisabled     = errors.New("join tokens are not enabled")
+	ErrInvalidToken = errors.New("invalid join token")
+)
+
+// Enabled reports whether join tokens can be verified
+func Enabled() bool {
+	return len(Secret) > 0
+}
+
+// Issue signs a join token for a room, or for any room if roomID is empty,
+// valid for ttl
+func Issue(roomID string, id Identity, ttl time.Duration) (string, error) {
+	if !Enabled() {
+		return "", ErrDisabled
+	}
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   id.UserID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Name: id.Name,
+		Role: id.Role,
+		Room: roomID,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(Secret)
+}
+
+// Verify checks a join token's signature and expiry and that it is good
+// for roomID, and returns the identity it carries. Tokens without a role
+// join as participants.
+func Verify(token, roomID string) (Identity, error) {
+	if !Enabled() {
+		return Identity{}, ErrDisabled
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return Secret, nil
+	},
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(Leeway),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no user ID", ErrInvalidToken)
+	}
+	if claims.Room != "" && claims.Room != roomID {
+		return Identity{}, fmt.Errorf("%w: issued for another room", ErrInvalidToken)
+	}
+
+	switch claims.Role {
+	case "":
+		claims.Role = RoleParticipant
+	case RoleHost, RoleParticipant, RoleCoHost, RolePresenter, RoleAttendee, RoleViewer:
+	default:
+		return Identity{}, fmt.Errorf("%w: unknown role %q", ErrInvalidToken, claims.Role)
+	}
+
+	return Identity{UserID: claims.Subject, Name: claims.Name, Role: claims.Role}, nil
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerify(t *testing.T) {
+	Secret = []byte("test secret")
+	defer func() { Secret = nil }()
+
+	token, err := Issue("room-1", Identity{UserID: "u1", Name: "Alice", Role: RoleHost}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := Verify(token, "room-1")
+	if err != nil || id != (Identity{UserID: "u1", Name: "Alice", Role: RoleHost}) {
+		t.Errorf("Verify = %+v, %v", id, err)
+	}
+	if _, err := Verify(token, "room-2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token used in another room: %v", err)
+	}
+
+	anyRoom, _ := Issue("", Identity{UserID: "u2"}, time.Minute)
+	if id, err := Verify(anyRoom, "room-2"); err != nil || id.Role != RoleParticipant {
+		t.Errorf("token for any room = %+v, %v", id, err)
+	}
+	viewer, _ := Issue("", Identity{UserID: "u3", Role: RoleViewer}, time.Minute)
+	if id, err := Verify(viewer, "room-2"); err != nil || id.Role != RoleViewer {
+		t.Errorf("viewer token = %+v, %v", id, err)
+	}
+
+	expired, _ := Issue("room-1", Identity{UserID: "u1"}, -time.Hour)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "u1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		Role:             RoleHost,
+	}).SignedString([]byte("wrong secret"))
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "u1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	for name, token := range map[string]string{"expired": expired, "forged": forged, "unsigned": unsigned, "garbage": "x.y.z"} {
+		if _, err := Verify(token, "room-1"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s token: %v", name, err)
+		}
+	}
+
+	Secret = nil
+	if _, err := Verify(token, "room-1"); !errors.Is(err, ErrDisabled) {
+		t.Errorf("Verify without a secret: %v", err)
+	}
+}
@@ -1,10 +1,14 @@
 package chat
 
 import (
+	"encoding/json"
 	"log"
 	"time"
 
+	"videochat/pkg/signaling"
+
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 )
 
 const (
@@ -17,8 +21,12 @@ const (
 	// Send pings to peer with this period (must be less than pongWait)
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
+	// Maximum frame size allowed from peer. Larger frames close the
+	// connection; text over MaxTextLength is rejected with an error frame.
+	maxMessageSize = 32 * 1024
+
+	// Name shown for senders without one
+	defaultUsername = "Guest"
 )
 
 // Client represents a chat client connection
@@ -26,24 +34,43 @@ type Client struct {
 	Hub  *Hub
 	Conn *websocket.Conn
 	Send chan []byte
+
+	// PeerID identifies the sender of the client's messages, and Username
+	// looks up their current display name
+	PeerID   string
+	Username func() string
 }
 
-// NewClient creates a new chat client
-func NewClient(hub *Hub, conn *websocket.Conn) *Client {
+// NewClient creates a new chat client for the given sender
+func NewClient(hub *Hub, conn *websocket.Conn, peerID string, username func() string) *Client {
 	return &Client{
-		Hub:  hub,
-		Conn: conn,
-		Send: make(chan []byte, 256),
+		Hub:      hub,
+		Conn:     conn,
+		Send:     make(chan []byte, 256),
+		PeerID:   peerID,
+		Username: username,
 	}
 }
 
+// Refuse sends an error frame to a connection that may not chat and
+// closes it
+func Refuse(conn *websocket.Conn, err *signaling.Error) {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteJSON(errorFrame{Type: TypeError, Error: err})
+	conn.Close()
+}
+
 // ReadPump pumps messages from the websocket connection to the hub
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Unregister <- c
+		select {
+		case c.Hub.Unregister <- c:
+		case <-c.Hub.Done():
+		}
 		c.Conn.Close()
 	}()
 
+	c.Conn.SetReadLimit(maxMessageSize)
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -59,8 +86,141 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		// Broadcast message to all clients in the hub
-		c.Hub.Broadcast <- message
+		frame, ferr := parseFrame(message)
+		if ferr == nil {
+			ferr = c.handle(frame)
+		}
+		if ferr == errHubStopped {
+			return
+		}
+		if ferr != nil && !c.reply(errorFrame{Type: TypeError, Error: ferr}) {
+			return
+		}
+	}
+}
+
+// errHubStopped ends ReadPump once the hub is gone
+var errHubStopped = signaling.NewError(signaling.CodeInternal, "", "chat has ended")
+
+// handle acts on a valid frame from the client
+func (c *Client) handle(frame inbound) *signaling.Error {
+	switch frame.Type {
+	case TypeHistory:
+		// Answered to this client alone
+		if !c.reply(c.Hub.page(c.PeerID, frame.Before, frame.Limit)) {
+			return errHubStopped
+		}
+
+	case TypeMessage:
+		msg, err := c.message(frame)
+		if err != nil {
+			return err
+		}
+		if msg.Text, err = c.moderate(msg.Text, msg.Private(), TypeMessage); err != nil {
+			return err
+		}
+		select {
+		case c.Hub.Broadcast <- msg:
+		case <-c.Hub.Done():
+			return errHubStopped
+		}
+
+	case TypeEdit:
+		return c.Hub.change(frame.ID, frame.Type, func(msg *Message) (interface{}, *signaling.Error) {
+			// The new text is screened like the message it replaces
+			text, err := c.moderate(frame.Text, msg.Private(), TypeEdit)
+			if err != nil {
+				return nil, err
+			}
+			return msg.edit(c.PeerID, text)
+		})
+
+	case TypeReact:
+		return c.Hub.change(frame.ID, frame.Type, func(msg *Message) (interface{}, *signaling.Error) {
+			if !msg.visibleTo(c.PeerID) {
+				return nil, errNoMessage(TypeReact)
+			}
+			return msg.react(c.PeerID, frame.Emoji)
+		})
+	}
+	return nil
+}
+
+// moderate runs text past the hub's moderation, if any
+func (c *Client) moderate(text string, private bool, event string) (string, *signaling.Error) {
+	if c.Hub.Moderate == nil {
+		return text, nil
+	}
+	return c.Hub.Moderate(c.PeerID, text, private, event)
+}
+
+// message wraps a frame's text in a server-authored envelope
+func (c *Client) message(frame inbound) (Message, *signaling.Error) {
+	var to []string
+	for _, peerID := range frame.To {
+		if peerID != c.PeerID {
+			to = append(to, peerID)
+		}
+	}
+	if len(frame.To) > 0 && len(to) == 0 {
+		return Message{}, signaling.NewError(signaling.CodeInvalidPayload, TypeMessage, "a private message needs a recipient other than the sender")
+	}
+	if c.Hub.Member != nil {
+		for _, peerID := range to {
+			if !c.Hub.Member(peerID) {
+				return Message{}, signaling.NewError(signaling.CodeNotFound, TypeMessage, "recipient is not in the room")
+			}
+		}
+	}
+
+	// Replies to a private message stay among the people in it
+	if frame.ReplyTo != "" {
+		parent, ok := c.Hub.find(frame.ReplyTo)
+		if !ok || !parent.visibleTo(c.PeerID) {
+			return Message{}, errNoMessage(TypeMessage)
+		}
+		if parent.Private() {
+			to = nil
+			for _, peerID := range append([]string{parent.Sender}, parent.To...) {
+				if peerID != c.PeerID {
+					to = append(to, peerID)
+				}
+			}
+		}
+	}
+
+	name := ""
+	if c.Username != nil {
+		name = Sanitize(c.Username())
+	}
+	if name == "" {
+		name = defaultUsername
+	}
+	return Message{
+		Type:       TypeMessage,
+		ID:         uuid.NewString(),
+		Sender:     c.PeerID,
+		SenderName: name,
+		Text:       frame.Text,
+		Timestamp:  time.Now().UTC(),
+		To:         to,
+		ReplyTo:    frame.ReplyTo,
+	}, nil
+}
+
+// reply sends a frame to this client alone. It returns false once the hub
+// has stopped.
+func (c *Client) reply(frame interface{}) bool {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Error encoding chat frame: %v", err)
+		return true
+	}
+	select {
+	case c.Hub.replies <- reply{client: c, data: data}:
+		return true
+	case <-c.Hub.Done():
+		return false
 	}
 }
 
@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Entry is one message in a chat log. Seq orders the messages of a log
+// and starts at 1.
+type Entry struct {
+	Seq  uint64
+	Data []byte
+}
+
+// HistoryStore keeps the recent messages of every chat, bounded per chat
+type HistoryStore interface {
+	// Append adds a message to the end of a chat's log, dropping the oldest
+	// messages once the log is over its limit
+	Append(chatID string, entry Entry) error
+
+	// Replace swaps the data of a logged message. Messages no longer in the
+	// log are left alone.
+	Replace(chatID string, entry Entry) error
+
+	// Before returns up to n messages older than seq, oldest first
+	Before(chatID string, seq uint64, n int) ([]Entry, error)
+
+	// Delete drops a chat's log
+	Delete(chatID string) error
+
+	Close() error
+}
+
+var (
+	// History holds the message logs of every hub. It defaults to memory;
+	// set it before serving to keep chat across restarts.
+	History HistoryStore = NewMemoryHistory()
+
+	// HistoryLimit is how many messages each chat keeps
+	HistoryLimit = 500
+
+	// ReplayCount is how many recent messages a client is sent on joining
+	ReplayCount = 50
+
+	// MaxPageSize caps the messages returned by one history request
+	MaxPageSize = 100
+)
+
+// Latest is the seq to page back from to get a chat's newest messages
+const Latest = math.MaxUint64
+
+// MemoryHistory is a HistoryStore that lasts as long as the process
+type MemoryHistory struct {
+	mu   sync.RWMutex
+	logs map[string][]Entry
+}
+
+// NewMemoryHistory creates an empty in-memory history
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{logs: make(map[string][]Entry)}
+}
+
+func (s *MemoryHistory) Append(chatID string, entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log := append(s.logs[chatID], entry)
+	if over := len(log) - HistoryLimit; over > 0 {
+		log = append([]Entry(nil), log[over:]...)
+	}
+	s.logs[chatID] = log
+	return nil
+}
+
+func (s *MemoryHistory) Replace(chatID string, entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log := s.logs[chatID]
+	i := sort.Search(len(log), func(i int) bool { return log[i].Seq >= entry.Seq })
+	if i < len(log) && log[i].Seq == entry.Seq {
+		log[i] = entry
+	}
+	return nil
+}
+
+func (s *MemoryHistory) Before(chatID string, seq uint64, n int) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	log := s.logs[chatID]
+	end := len(log)
+	for end > 0 && log[end-1].Seq >= seq {
+		end--
+	}
+	start := max(end-n, 0)
+	return append([]Entry(nil), log[start:end]...), nil
+}
+
+func (s *MemoryHistory) Delete(chatID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.logs, chatID)
+	return nil
+}
+
+func (s *MemoryHistory) Close() error {
+	return nil
+}
+
+// historyPage answers a history request
+type historyPage struct {
+	Type     string            `json:"type"`
+	Messages []json.RawMessage `json:"messages"`
+	HasMore  bool              `json:"hasMore"`
+}
+
+// rawMessage embeds a logged message in a history page, quoting it if it
+// isn't JSON
+func rawMessage(data []byte) json.RawMessage {
+	if json.Valid(data) {
+		return data
+	}
+	quoted, _ := json.Marshal(string(data))
+	return quoted
+}
@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltHistory is a HistoryStore kept in a bbolt database file, with one
+// bucket per chat keyed by big-endian seq
+type BoltHistory struct {
+	db *bolt.DB
+}
+
+// OpenBoltHistory opens or creates a history file
+func OpenBoltHistory(path string) (*BoltHistory, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open chat history %s: %w", path, err)
+	}
+	return &BoltHistory{db: db}, nil
+}
+
+func (s *BoltHistory) Append(chatID string, entry Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(chatID))
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(seqKey(entry.Seq), entry.Data); err != nil {
+			return err
+		}
+
+		count := 0
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			count++
+		}
+		for key, _ := cursor.First(); key != nil && count > HistoryLimit; key, _ = cursor.First() {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			count--
+		}
+		return nil
+	})
+}
+
+func (s *BoltHistory) Replace(chatID string, entry Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(chatID))
+		if bucket == nil || bucket.Get(seqKey(entry.Seq)) == nil {
+			return nil
+		}
+		return bucket.Put(seqKey(entry.Seq), entry.Data)
+	})
+}
+
+func (s *BoltHistory) Before(chatID string, seq uint64, n int) ([]Entry, error) {
+	var entries []Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(chatID))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		key, data := cursor.Seek(seqKey(seq))
+		if key == nil {
+			key, data = cursor.Last()
+		} else {
+			key, data = cursor.Prev()
+		}
+		for ; key != nil && len(entries) < n; key, data = cursor.Prev() {
+			if binary.BigEndian.Uint64(key) >= seq {
+				continue
+			}
+			entries = append(entries, Entry{
+				Seq:  binary.BigEndian.Uint64(key),
+				Data: append([]byte(nil), data...),
+			})
+		}
+		return nil
+	})
+
+	// Collected newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+func (s *BoltHistory) Delete(chatID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(chatID)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *BoltHistory) Close() error {
+	return s.db.Close()
+}
+
+func seqKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryStores(t *testing.T) {
+	HistoryLimit = 5
+	defer func() { HistoryLimit = 500 }()
+
+	bolt, err := OpenBoltHistory(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+
+	for name, store := range map[string]HistoryStore{"memory": NewMemoryHistory(), "bolt": bolt} {
+		t.Run(name, func(t *testing.T) {
+			for seq := uint64(1); seq <= 8; seq++ {
+				if err := store.Append("room/a", Entry{Seq: seq, Data: []byte(fmt.Sprint(seq))}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store.Append("room/b", Entry{Seq: 1, Data: []byte("other")})
+
+			seqs := func(entries []Entry) string {
+				var s string
+				for _, entry := range entries {
+					s += string(entry.Data)
+				}
+				return s
+			}
+
+			entries, err := store.Before("room/a", Latest, 3)
+			if err != nil || seqs(entries) != "678" {
+				t.Errorf("latest 3 = %q, %v", seqs(entries), err)
+			}
+			entries, _ = store.Before("room/a", 6, 10)
+			if got := seqs(entries); got != "45" {
+				t.Errorf("before 6 = %q, want the 3 dropped by the limit missing", got)
+			}
+			entries, _ = store.Before("room/a", 4, 10)
+			if len(entries) != 0 {
+				t.Errorf("before 4 = %q", seqs(entries))
+			}
+
+			if err := store.Delete("room/a"); err != nil {
+				t.Fatal(err)
+			}
+			if entries, _ := store.Before("room/a", Latest, 10); len(entries) != 0 {
+				t.Errorf("log survived Delete: %q", seqs(entries))
+			}
+			if entries, _ := store.Before("room/b", Latest, 10); seqs(entries) != "other" {
+				t.Errorf("Delete touched another log: %q", seqs(entries))
+			}
+		})
+	}
+}
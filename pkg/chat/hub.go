@@ -1,59 +1,329 @@
 package chat
 
 import (
+	"context"
+	"encoding/json"
 	"log"
+	"slices"
+	"sync"
+
+	"videochat/pkg/signaling"
 )
 
 // Hub maintains the set of active clients and broadcasts messages
 type Hub struct {
 	Clients    map[*Client]bool
-	Broadcast  chan []byte
+	Broadcast  chan Message
 	Register   chan *Client
 	Unregister chan *Client
+
+	// Moderate, if set, screens each message and edit before it is
+	// broadcast; event is TypeMessage or TypeEdit. It returns the text to
+	// send or an error to reject the message with.
+	Moderate func(peerID, text string, private bool, event string) (string, *signaling.Error)
+
+	// Member, if set, reports whether a peer is in the room, so private
+	// messages can only be addressed to people who are
+	Member func(peerID string) bool
+
+	mu   sync.RWMutex  // Guards Clients for readers outside Run
+	done chan struct{} // Closed when Run returns
+
+	// Message log
+	id      string // Key of the log in History
+	seq     uint64 // Last logged message
+	replies chan reply
+	changes chan change
 }
 
-// NewHub creates a new chat hub
-func NewHub() *Hub {
-	return &Hub{
+// change is an edit, reaction or deletion of a logged message. Run applies
+// changes one at a time so two never race on the same message.
+type change struct {
+	id     string
+	event  string
+	apply  func(msg *Message) (notice interface{}, err *signaling.Error)
+	result chan *signaling.Error
+}
+
+// reply is a frame for one client only
+type reply struct {
+	client *Client
+	data   []byte
+}
+
+// NewHub creates a new chat hub logging to History under id
+func NewHub(id string) *Hub {
+	h := &Hub{
 		Clients:    make(map[*Client]bool),
-		Broadcast:  make(chan []byte),
+		Broadcast:  make(chan Message),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
+		done:       make(chan struct{}),
+		id:         id,
+		replies:    make(chan reply),
+		changes:    make(chan change),
+	}
+
+	// Carry on numbering from a log kept by an earlier process
+	if last, err := History.Before(id, Latest, 1); err != nil {
+		log.Printf("Error loading chat history %s: %v", id, err)
+	} else if len(last) > 0 {
+		h.seq = last[0].Seq
 	}
+	return h
 }
 
-// Run starts the hub and handles client registration/unregistration
-func (h *Hub) Run() {
+// Run starts the hub and handles client registration/unregistration until
+// ctx is cancelled, then disconnects every client
+func (h *Hub) Run(ctx context.Context) {
+	defer close(h.done)
+
 	for {
 		select {
 		case client := <-h.Register:
+			h.mu.Lock()
 			h.Clients[client] = true
-			log.Printf("Client registered. Total clients: %d", len(h.Clients))
+			h.mu.Unlock()
+			log.Printf("Client registered. Total clients: %d", h.GetClientCount())
+			h.replay(client)
 
 		case client := <-h.Unregister:
-			if _, ok := h.Clients[client]; ok {
+			h.mu.Lock()
+			_, ok := h.Clients[client]
+			if ok {
 				delete(h.Clients, client)
 				close(client.Send)
-				log.Printf("Client unregistered. Total clients: %d", len(h.Clients))
+			}
+			h.mu.Unlock()
+			if ok {
+				log.Printf("Client unregistered. Total clients: %d", h.GetClientCount())
 			}
 
-		case message := <-h.Broadcast:
-			// Broadcast message to all clients
-			for client := range h.Clients {
+		case r := <-h.replies:
+			// Clients that have left no longer own their Send channel
+			h.mu.RLock()
+			if h.Clients[r.client] {
 				select {
-				case client.Send <- message:
+				case r.client.Send <- r.data:
 				default:
-					// Client's send channel is full, remove it
-					close(client.Send)
-					delete(h.Clients, client)
-					log.Println("Client removed due to full send channel")
 				}
 			}
+			h.mu.RUnlock()
+
+		case msg := <-h.Broadcast:
+			h.deliver(h.record(msg), msg)
+
+		case ch := <-h.changes:
+			ch.result <- h.apply(ch)
+
+		case <-ctx.Done():
+			h.mu.Lock()
+			for client := range h.Clients {
+				close(client.Send)
+				delete(h.Clients, client)
+			}
+			h.mu.Unlock()
+			return
 		}
 	}
 }
 
+// deliver sends a frame to all clients, or one about a private message to
+// its sender and recipients
+func (h *Hub) deliver(data []byte, msg Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.Clients {
+		if !msg.visibleTo(client.PeerID) {
+			continue
+		}
+		select {
+		case client.Send <- data:
+		default:
+			// Client's send channel is full, remove it
+			close(client.Send)
+			delete(h.Clients, client)
+			log.Println("Client removed due to full send channel")
+		}
+	}
+}
+
+// Post logs and broadcasts a message authored by the server, such as a
+// file being shared. It returns false if the hub has stopped.
+func (h *Hub) Post(msg Message) bool {
+	select {
+	case h.Broadcast <- msg:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Delete removes a message for everyone. Its log entry is kept as a
+// tombstone so paging still lines up, and clients that could see it are
+// told to remove it. It returns false if the message isn't in the log.
+func (h *Hub) Delete(id string) bool {
+	err := h.change(id, TypeDeleted, func(msg *Message) (interface{}, *signaling.Error) {
+		msg.Text = ""
+		msg.Reactions = nil
+		msg.Deleted = true
+		return deletedFrame{Type: TypeDeleted, ID: msg.ID}, nil
+	})
+	return err == nil
+}
+
+// change has Run apply a change to a logged message. event names the frame
+// asking for it in errors.
+func (h *Hub) change(id, event string, apply func(msg *Message) (interface{}, *signaling.Error)) *signaling.Error {
+	ch := change{id: id, event: event, apply: apply, result: make(chan *signaling.Error, 1)}
+	select {
+	case h.changes <- ch:
+		return <-ch.result
+	case <-h.done:
+		return errHubStopped
+	}
+}
+
+// apply changes a logged message, saves it so clients joining later see
+// the change, and tells the clients that can see it
+func (h *Hub) apply(ch change) *signaling.Error {
+	msg, ok := h.find(ch.id)
+	if !ok {
+		return errNoMessage(ch.event)
+	}
+	notice, err := ch.apply(&msg)
+	if err != nil {
+		return err
+	}
+
+	data, _ := json.Marshal(msg)
+	if err := History.Replace(h.id, Entry{Seq: msg.Seq, Data: data}); err != nil {
+		log.Printf("Error saving chat message %s in %s: %v", msg.ID, h.id, err)
+	}
+	data, _ = json.Marshal(notice)
+	h.deliver(data, msg)
+	return nil
+}
+
+// find looks a message up in the log by ID
+func (h *Hub) find(id string) (Message, bool) {
+	before := uint64(Latest)
+	for {
+		entries, err := History.Before(h.id, before, MaxPageSize)
+		if err != nil {
+			log.Printf("Error loading chat history %s: %v", h.id, err)
+			return Message{}, false
+		}
+		for _, entry := range entries {
+			var msg Message
+			if json.Unmarshal(entry.Data, &msg) == nil && msg.ID == id && !msg.Deleted {
+				return msg, true
+			}
+		}
+		if len(entries) < MaxPageSize {
+			return Message{}, false
+		}
+		before = entries[0].Seq
+	}
+}
+
+// record numbers a message, adds it to the log and returns its encoding
+func (h *Hub) record(msg Message) []byte {
+	h.seq++
+	msg.Seq = h.seq
+	message, _ := json.Marshal(msg)
+	if err := History.Append(h.id, Entry{Seq: h.seq, Data: message}); err != nil {
+		log.Printf("Error logging chat message in %s: %v", h.id, err)
+	}
+	return message
+}
+
+// replay sends a newly registered client the last ReplayCount messages it
+// may see
+func (h *Hub) replay(client *Client) {
+	entries, _, err := h.visible(client.PeerID, Latest, ReplayCount)
+	if err != nil {
+		log.Printf("Error loading chat history %s: %v", h.id, err)
+		return
+	}
+	for _, entry := range entries {
+		select {
+		case client.Send <- entry.Data:
+		default:
+			return
+		}
+	}
+}
+
+// page returns up to limit messages older than before that a peer may see
+func (h *Hub) page(peerID string, before uint64, limit int) historyPage {
+	page := historyPage{Type: TypeHistory, Messages: []json.RawMessage{}}
+
+	entries, more, err := h.visible(peerID, before, limit)
+	if err != nil {
+		log.Printf("Error loading chat history %s: %v", h.id, err)
+		return page
+	}
+	page.HasMore = more
+	for _, entry := range entries {
+		page.Messages = append(page.Messages, rawMessage(entry.Data))
+	}
+	return page
+}
+
+// visible returns up to n logged messages older than before that a peer
+// may see, oldest first, and whether there are more
+func (h *Hub) visible(peerID string, before uint64, n int) ([]Entry, bool, error) {
+	var found []Entry // Newest first
+	for {
+		// One extra message tells whether there is more to page through
+		batch, err := History.Before(h.id, before, n+1)
+		if err != nil {
+			return nil, false, err
+		}
+		for i := len(batch) - 1; i >= 0; i-- {
+			if !canSee(batch[i].Data, peerID) {
+				continue
+			}
+			if len(found) == n {
+				slices.Reverse(found)
+				return found, true, nil
+			}
+			found = append(found, batch[i])
+		}
+		if len(batch) <= n {
+			slices.Reverse(found)
+			return found, false, nil
+		}
+		before = batch[0].Seq
+	}
+}
+
+// DeleteHistory drops the hub's message log
+func (h *Hub) DeleteHistory() {
+	if err := History.Delete(h.id); err != nil {
+		log.Printf("Error deleting chat history %s: %v", h.id, err)
+	}
+}
+
+// Join registers a client. It returns false if the hub has stopped.
+func (h *Hub) Join(client *Client) bool {
+	select {
+	case h.Register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Done is closed once the hub has stopped
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
 // GetClientCount returns the number of connected clients
 func (h *Hub) GetClientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	return len(h.Clients)
-}
\ No newline at end of file
+}
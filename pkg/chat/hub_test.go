@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"videochat/pkg/signaling"
+)
+
+func TestHubPrivateMessages(t *testing.T) {
+	saved := History
+	History = NewMemoryHistory()
+	defer func() { History = saved }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := NewHub("room/private")
+	go hub.Run(ctx)
+
+	clients := map[string]*Client{}
+	for _, peerID := range []string{"alice", "bob", "carol"} {
+		clients[peerID] = &Client{Hub: hub, Send: make(chan []byte, 16), PeerID: peerID}
+		if !hub.Join(clients[peerID]) {
+			t.Fatal("hub stopped")
+		}
+	}
+
+	hub.Broadcast <- Message{Type: TypeMessage, Sender: "alice", Text: "hello all"}
+	hub.Broadcast <- Message{Type: TypeMessage, Sender: "alice", Text: "psst", To: []string{"bob"}}
+
+	received := func(c *Client) (texts []string) {
+		for {
+			select {
+			case data := <-c.Send:
+				var msg Message
+				json.Unmarshal(data, &msg)
+				texts = append(texts, msg.Text)
+			case <-time.After(50 * time.Millisecond):
+				return texts
+			}
+		}
+	}
+	for peerID, want := range map[string]int{"alice": 2, "bob": 2, "carol": 1} {
+		if got := received(clients[peerID]); len(got) != want {
+			t.Errorf("%s received %q, want %d messages", peerID, got, want)
+		}
+	}
+
+	// Private messages only go to peers in the room
+	hub.Member = func(peerID string) bool { return clients[peerID] != nil }
+	if err := clients["alice"].handle(inbound{Type: TypeMessage, Text: "psst", To: []string{"bob", "mallory"}}); err == nil || err.Code != signaling.CodeNotFound {
+		t.Errorf("message to a peer not in the room: %v", err)
+	}
+
+	// History shows each peer only what it could see live
+	page := hub.page("carol", Latest, 10)
+	if len(page.Messages) != 1 || page.HasMore {
+		t.Errorf("carol's history = %s (more: %v)", page.Messages, page.HasMore)
+	}
+	page = hub.page("bob", Latest, 1)
+	if len(page.Messages) != 1 || !page.HasMore {
+		t.Errorf("bob's first page = %s (more: %v)", page.Messages, page.HasMore)
+	}
+
+	cancel()
+	<-hub.Done()
+	if _, open := <-clients["carol"].Send; open {
+		t.Error("client still connected after the hub stopped")
+	}
+	if hub.Join(&Client{Hub: hub, Send: make(chan []byte)}) {
+		t.Error("Join succeeded on a stopped hub")
+	}
+}
+
+func TestHubDelete(t *testing.T) {
+	saved := History
+	History = NewMemoryHistory()
+	defer func() { History = saved }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub("room/delete")
+	go hub.Run(ctx)
+
+	client := &Client{Hub: hub, Send: make(chan []byte, 16), PeerID: "alice"}
+	hub.Join(client)
+	hub.Broadcast <- Message{Type: TypeMessage, ID: "m1", Sender: "alice", Text: "oops"}
+	<-client.Send
+
+	if !hub.Delete("m1") {
+		t.Fatal("Delete did not find the message")
+	}
+	if got := string(<-client.Send); got != `{"type":"deleted","id":"m1"}` {
+		t.Errorf("notice = %s", got)
+	}
+
+	page := hub.page("alice", Latest, 10)
+	var msg Message
+	if len(page.Messages) != 1 || json.Unmarshal(page.Messages[0], &msg) != nil || !msg.Deleted || msg.Text != "" {
+		t.Errorf("history after Delete = %s", page.Messages)
+	}
+	if hub.Delete("m1") {
+		t.Error("deleted the same message twice")
+	}
+}
+
+func TestHubEditsAndReactions(t *testing.T) {
+	saved := History
+	History = NewMemoryHistory()
+	defer func() { History = saved }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub("room/changes")
+	var screenedPrivate bool
+	hub.Moderate = func(peerID, text string, private bool, event string) (string, *signaling.Error) {
+		screenedPrivate = private
+		return text, nil
+	}
+	go hub.Run(ctx)
+
+	alice := &Client{Hub: hub, Send: make(chan []byte, 16), PeerID: "alice"}
+	bob := &Client{Hub: hub, Send: make(chan []byte, 16), PeerID: "bob"}
+	hub.Join(alice)
+	hub.Join(bob)
+	hub.Broadcast <- Message{Type: TypeMessage, ID: "m1", Sender: "alice", Text: "helo"}
+	<-alice.Send
+	<-bob.Send
+
+	if err := bob.handle(inbound{Type: TypeEdit, ID: "m1", Text: "hijacked"}); err == nil || err.Code != signaling.CodeForbidden {
+		t.Errorf("bob edited alice's message: %v", err)
+	}
+	if err := alice.handle(inbound{Type: TypeEdit, ID: "m1", Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	var edited editedFrame
+	json.Unmarshal(<-bob.Send, &edited)
+	if edited.Type != TypeEdited || edited.Text != "hello" {
+		t.Errorf("edit notice = %+v", edited)
+	}
+	<-alice.Send
+
+	// Edits to private messages are screened as private
+	hub.Broadcast <- Message{Type: TypeMessage, ID: "m2", Sender: "alice", To: []string{"bob"}, Text: "psst"}
+	<-alice.Send
+	<-bob.Send
+	if err := alice.handle(inbound{Type: TypeEdit, ID: "m2", Text: "psst!"}); err != nil || !screenedPrivate {
+		t.Errorf("private edit screened as public: %v", err)
+	}
+	<-alice.Send
+	<-bob.Send
+
+	// Reacting twice takes the reaction back
+	for _, peer := range []*Client{bob, alice, bob} {
+		if err := peer.handle(inbound{Type: TypeReact, ID: "m1", Emoji: "👍"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bob.handle(inbound{Type: TypeReact, ID: "nope", Emoji: "👍"}); err == nil || err.Code != signaling.CodeNotFound {
+		t.Errorf("reaction to a missing message: %v", err)
+	}
+
+	// A client joining later sees the message as it is now
+	carol := &Client{Hub: hub, Send: make(chan []byte, 16), PeerID: "carol"}
+	hub.Join(carol)
+	var msg Message
+	json.Unmarshal(<-carol.Send, &msg)
+	if msg.Text != "hello" || msg.EditedAt == nil || !slices.Equal(msg.Reactions["👍"], []string{"alice"}) {
+		t.Errorf("replayed message = %+v", msg)
+	}
+}
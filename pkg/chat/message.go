@@ -0,0 +1,310 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"videochat/pkg/signaling"
+)
+
+// Frame types, sent by clients and by the server in the "type" field
+const (
+	TypeMessage    = "message"
+	TypeFileShared = "file-shared"
+	TypeHistory    = "history"
+	TypeError      = "error"
+
+	// Sent by clients to change a message
+	TypeEdit  = "edit"
+	TypeReact = "react"
+
+	// Sent by the server when a message changes
+	TypeEdited  = "edited"
+	TypeReacted = "reacted"
+	TypeDeleted = "deleted"
+)
+
+var (
+	// MaxTextLength caps a chat message, in characters
+	MaxTextLength = 2000
+
+	// MaxRecipients caps the peers a private message is addressed to
+	MaxRecipients = 50
+
+	// MaxReactions caps the different emoji on one message
+	MaxReactions = 20
+)
+
+// maxEmojiLength is long enough for any emoji sequence
+const maxEmojiLength = 32
+
+// Message is a chat message as the server broadcasts and logs it. Everything
+// but the text is filled in by the server.
+type Message struct {
+	Type       string    `json:"type"`
+	ID         string    `json:"id"`
+	Seq        uint64    `json:"seq"`
+	Sender     string    `json:"sender"`
+	SenderName string    `json:"senderName"`
+	Text       string    `json:"text"`
+	Timestamp  time.Time `json:"timestamp"`
+
+	// To lists the recipients of a private message. Only they and the
+	// sender receive it.
+	To []string `json:"to,omitempty"`
+
+	// File describes the file shared by a file-shared message
+	File *SharedFile `json:"file,omitempty"`
+
+	// ReplyTo is the ID of the message this one replies to, in its thread
+	ReplyTo string `json:"replyTo,omitempty"`
+
+	// EditedAt is when the sender last changed the text
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+
+	// Reactions lists who reacted with each emoji
+	Reactions map[string][]string `json:"reactions,omitempty"`
+
+	// Deleted marks a message removed by a moderator. Its text is gone.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// SharedFile is a file shared in a chat. Participants download it from the
+// room's files endpoint by ID.
+type SharedFile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// edit replaces the text of a message. Only its sender may edit it.
+func (m *Message) edit(peerID, text string) (interface{}, *signaling.Error) {
+	if m.Sender != peerID {
+		return nil, signaling.NewError(signaling.CodeForbidden, TypeEdit, "only the sender can edit a message")
+	}
+	if m.Type != TypeMessage {
+		return nil, signaling.NewError(signaling.CodeForbidden, TypeEdit, "only text messages can be edited")
+	}
+	now := time.Now().UTC()
+	m.Text = text
+	m.EditedAt = &now
+	return editedFrame{Type: TypeEdited, ID: m.ID, Text: text, EditedAt: now}, nil
+}
+
+// react adds a peer's reaction to a message, or takes it back if the peer
+// already reacted with that emoji
+func (m *Message) react(peerID, emoji string) (interface{}, *signaling.Error) {
+	peers := m.Reactions[emoji]
+	if i := slices.Index(peers, peerID); i >= 0 {
+		peers = slices.Delete(peers, i, i+1)
+		if len(peers) == 0 {
+			delete(m.Reactions, emoji)
+		} else {
+			m.Reactions[emoji] = peers
+		}
+		return reactedFrame{Type: TypeReacted, ID: m.ID, Emoji: emoji, PeerID: peerID}, nil
+	}
+
+	if _, exists := m.Reactions[emoji]; !exists && len(m.Reactions) >= MaxReactions {
+		return nil, signaling.NewError(signaling.CodeInvalidPayload, TypeReact,
+			fmt.Sprintf("a message can have at most %d different reactions", MaxReactions))
+	}
+	if m.Reactions == nil {
+		m.Reactions = make(map[string][]string)
+	}
+	m.Reactions[emoji] = append(peers, peerID)
+	return reactedFrame{Type: TypeReacted, ID: m.ID, Emoji: emoji, PeerID: peerID, Added: true}, nil
+}
+
+// errNoMessage rejects a frame referring to a message that doesn't exist or
+// that the sender can't see
+func errNoMessage(event string) *signaling.Error {
+	return signaling.NewError(signaling.CodeNotFound, event, "message not found")
+}
+
+// editedFrame tells clients a message's new text
+type editedFrame struct {
+	Type     string    `json:"type"`
+	ID       string    `json:"id"`
+	Text     string    `json:"text"`
+	EditedAt time.Time `json:"editedAt"`
+}
+
+// reactedFrame tells clients a reaction was added to or taken off a message
+type reactedFrame struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Emoji  string `json:"emoji"`
+	PeerID string `json:"peerId"`
+	Added  bool   `json:"added"`
+}
+
+// deletedFrame tells clients to remove a message
+type deletedFrame struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// Private reports whether the message is addressed to chosen peers
+func (m *Message) Private() bool {
+	return len(m.To) > 0
+}
+
+// visibleTo reports whether a peer may see the message
+func (m *Message) visibleTo(peerID string) bool {
+	if !m.Private() || m.Sender == peerID {
+		return true
+	}
+	for _, to := range m.To {
+		if to == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// canSee reports whether a peer may see a logged message. Messages logged
+// before envelopes existed are public.
+func canSee(data []byte, peerID string) bool {
+	var msg Message
+	if json.Unmarshal(data, &msg) != nil {
+		return true
+	}
+	return msg.visibleTo(peerID)
+}
+
+// inbound is a frame sent by a client. Frames without a type are messages,
+// which is what older clients send.
+type inbound struct {
+	Type string `json:"type"`
+
+	// Messages, to everyone or only the peers in To, optionally replying
+	// to another message
+	Text    string   `json:"text"`
+	To      []string `json:"to"`
+	ReplyTo string   `json:"replyTo"`
+
+	// Edits and reactions name the message they change
+	ID    string `json:"id"`
+	Emoji string `json:"emoji"`
+
+	// History requests
+	Before uint64 `json:"before"`
+	Limit  int    `json:"limit"`
+}
+
+// errorFrame reports a rejected frame to the client that sent it
+type errorFrame struct {
+	Type string `json:"type"`
+	*signaling.Error
+}
+
+// parseFrame decodes and validates a client frame. Message text comes back
+// sanitized.
+func parseFrame(raw []byte) (inbound, *signaling.Error) {
+	var frame inbound
+	if err := json.Unmarshal(raw, &frame); err != nil {
+		return frame, signaling.NewError(signaling.CodeMalformedMessage, "", "message is not a JSON object")
+	}
+
+	switch frame.Type {
+	case "", TypeMessage:
+		frame.Type = TypeMessage
+		text, err := CheckText(frame.Text, TypeMessage)
+		if err != nil {
+			return frame, err
+		}
+		frame.Text = text
+		addressed := len(frame.To) > 0
+		frame.To = recipients(frame.To)
+		if addressed && len(frame.To) == 0 {
+			return frame, signaling.NewError(signaling.CodeInvalidPayload, TypeMessage, "recipients must be peer IDs")
+		}
+		if len(frame.To) > MaxRecipients {
+			return frame, signaling.NewError(signaling.CodeInvalidPayload, TypeMessage,
+				fmt.Sprintf("a message can go to at most %d peers", MaxRecipients))
+		}
+
+	case TypeEdit:
+		if frame.ID == "" {
+			return frame, signaling.NewError(signaling.CodeInvalidPayload, TypeEdit, "id is required")
+		}
+		text, err := CheckText(frame.Text, TypeEdit)
+		if err != nil {
+			return frame, err
+		}
+		frame.Text = text
+
+	case TypeReact:
+		frame.Emoji = Sanitize(frame.Emoji)
+		if frame.ID == "" || frame.Emoji == "" {
+			return frame, signaling.NewError(signaling.CodeInvalidPayload, TypeReact, "id and emoji are required")
+		}
+		if len(frame.Emoji) > maxEmojiLength || strings.ContainsAny(frame.Emoji, " \n\t") {
+			return frame, signaling.NewError(signaling.CodeInvalidPayload, TypeReact, "emoji must be a single emoji")
+		}
+
+	case TypeHistory:
+		if frame.Before == 0 {
+			frame.Before = Latest
+		}
+		if frame.Limit <= 0 || frame.Limit > MaxPageSize {
+			frame.Limit = MaxPageSize
+		}
+
+	default:
+		return frame, signaling.NewError(signaling.CodeUnknownEvent, frame.Type, "unknown frame type")
+	}
+	return frame, nil
+}
+
+// CheckText sanitizes the text of a message and checks its length. event
+// names the frame or event being checked in errors.
+func CheckText(text, event string) (string, *signaling.Error) {
+	text = Sanitize(text)
+	if text == "" {
+		return "", signaling.NewError(signaling.CodeInvalidPayload, event, "text is required")
+	}
+	if utf8.RuneCountInString(text) > MaxTextLength {
+		return "", signaling.NewError(signaling.CodeMessageTooLarge, event,
+			fmt.Sprintf("text is over %d characters", MaxTextLength))
+	}
+	return text, nil
+}
+
+// recipients drops blank and repeated peer IDs
+func recipients(to []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(to))
+	for _, peerID := range to {
+		if peerID = strings.TrimSpace(peerID); peerID != "" && !seen[peerID] {
+			seen[peerID] = true
+			out = append(out, peerID)
+		}
+	}
+	return out
+}
+
+// Sanitize makes text safe to show: invalid UTF-8 is replaced, control
+// characters other than newlines and tabs and bidirectional overrides are
+// removed, and surrounding whitespace is trimmed. HTML is left to clients
+// to escape.
+func Sanitize(text string) string {
+	text = strings.ToValidUTF8(text, string(utf8.RuneError))
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsControl(r), unicode.Is(unicode.Bidi_Control, r):
+			return -1
+		}
+		return r
+	}, text)
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,36 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"videochat/pkg/signaling"
+)
+
+func TestParseFrame(t *testing.T) {
+	for _, tt := range []struct {
+		raw  string
+		code signaling.ErrorCode
+		text string
+	}{
+		{raw: `{"text":"  hi‮ there\u0007 "}`, text: "hi there"},
+		{raw: `{"type":"message","text":"a\nb","sender":"spoofed"}`, text: "a\nb"},
+		{raw: `not json`, code: signaling.CodeMalformedMessage},
+		{raw: `{"type":"message","text":" \u0000 "}`, code: signaling.CodeInvalidPayload},
+		{raw: `{"text":"` + strings.Repeat("é", MaxTextLength+1) + `"}`, code: signaling.CodeMessageTooLarge},
+		{raw: `{"type":"shout","text":"hi"}`, code: signaling.CodeUnknownEvent},
+	} {
+		frame, err := parseFrame([]byte(tt.raw))
+		switch {
+		case tt.code != "" && (err == nil || err.Code != tt.code):
+			t.Errorf("parseFrame(%.40s) = %v, want %s", tt.raw, err, tt.code)
+		case tt.code == "" && (err != nil || frame.Text != tt.text):
+			t.Errorf("parseFrame(%.40s) = %q, %v, want %q", tt.raw, frame.Text, err, tt.text)
+		}
+	}
+
+	frame, err := parseFrame([]byte(`{"type":"history","before":20,"limit":1000}`))
+	if err != nil || frame.Before != 20 || frame.Limit != MaxPageSize {
+		t.Errorf("history request = %+v, %v", frame, err)
+	}
+}
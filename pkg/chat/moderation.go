@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"videochat/pkg/signaling"
+)
+
+// Filter screens the text of chat messages, for example for banned words.
+// It returns the text to send, which may be masked, or an error to reject
+// the message with.
+type Filter interface {
+	Check(text string) (string, error)
+}
+
+// DefaultFilter is given to every new Moderator. Nil lets everything
+// through.
+var DefaultFilter Filter
+
+// ErrBannedWord is returned by a rejecting WordFilter
+var ErrBannedWord = errors.New("message contains a banned word")
+
+// WordFilter masks or rejects whole words from a list, ignoring case
+type WordFilter struct {
+	pattern *regexp.Regexp
+	reject  bool
+}
+
+// NewWordFilter creates a filter for the given words. Matches are replaced
+// with asterisks, or the message is rejected if reject is set.
+func NewWordFilter(words []string, reject bool) *WordFilter {
+	var quoted []string
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return &WordFilter{reject: reject}
+	}
+	return &WordFilter{
+		pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+		reject:  reject,
+	}
+}
+
+// Check implements Filter
+func (f *WordFilter) Check(text string) (string, error) {
+	if f.pattern == nil || !f.pattern.MatchString(text) {
+		return text, nil
+	}
+	if f.reject {
+		return "", ErrBannedWord
+	}
+	return f.pattern.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", len([]rune(word)))
+	}), nil
+}
+
+// Moderator holds a chat's moderation settings: who is muted, slow mode
+// and the word filter. The same Moderator screens every path a room's
+// messages arrive by.
+//
+// Mutes and slow mode apply to a sender key the caller chooses, such as a
+// user ID that outlives any one connection, and last as long as the
+// Moderator does.
+type Moderator struct {
+	Filter Filter
+
+	mu       sync.Mutex
+	muted    map[string]bool
+	slowMode time.Duration
+	lastSent map[string]time.Time
+}
+
+// NewModerator creates a moderator using DefaultFilter
+func NewModerator() *Moderator {
+	return &Moderator{
+		Filter:   DefaultFilter,
+		muted:    make(map[string]bool),
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// Mute stops a sender sending chat messages
+func (m *Moderator) Mute(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.muted[key] = true
+}
+
+// Unmute lets a muted sender chat again
+func (m *Moderator) Unmute(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.muted, key)
+}
+
+// IsMuted checks if a sender's chat is muted
+func (m *Moderator) IsMuted(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.muted[key]
+}
+
+// SetSlowMode limits each sender to one message per interval. Zero turns
+// slow mode off.
+func (m *Moderator) SetSlowMode(interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.slowMode = interval
+}
+
+// SlowMode returns the slow mode interval, or zero if it is off
+func (m *Moderator) SlowMode() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.slowMode
+}
+
+// Check screens a message from a sender sent at now, and returns the text
+// to send. Exempt senders, such as hosts, skip mutes and slow mode but not
+// the filter. event names the frame or event being checked in errors.
+// Edits (TypeEdit) are held to mutes and the filter but not slow mode, and
+// don't count towards it: fixing a typo isn't sending another message.
+func (m *Moderator) Check(key, text string, exempt bool, now time.Time, event string) (string, *signaling.Error) {
+	m.mu.Lock()
+	if !exempt {
+		if m.muted[key] {
+			m.mu.Unlock()
+			return "", signaling.NewError(signaling.CodeForbidden, event, "you have been muted in chat")
+		}
+		if wait := m.slowMode - now.Sub(m.lastSent[key]); m.slowMode > 0 && wait > 0 && event != TypeEdit {
+			m.mu.Unlock()
+			return "", signaling.NewError(signaling.CodeRateLimited, event,
+				fmt.Sprintf("slow mode is on; wait %d more seconds", int(wait.Seconds()+0.999)))
+		}
+	}
+	filter := m.Filter
+	m.mu.Unlock()
+
+	if filter != nil {
+		var err error
+		if text, err = filter.Check(text); err != nil {
+			return "", signaling.NewError(signaling.CodeForbidden, event, err.Error())
+		}
+	}
+
+	if event != TypeEdit {
+		m.mu.Lock()
+		m.lastSent[key] = now
+		m.mu.Unlock()
+	}
+	return text, nil
+}
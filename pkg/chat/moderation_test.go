@@ -0,0 +1,54 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"videochat/pkg/signaling"
+)
+
+func TestModerator(t *testing.T) {
+	m := NewModerator()
+	m.Filter = NewWordFilter([]string{"darn", "heck"}, false)
+	now := time.Now()
+
+	if text, err := m.Check("alice", "Darn it, what the heck", false, now, TypeMessage); err != nil || text != "**** it, what the ****" {
+		t.Errorf("masked = %q, %v", text, err)
+	}
+	if text, _ := m.Check("alice", "darning socks", false, now, TypeMessage); text != "darning socks" {
+		t.Errorf("partial word masked: %q", text)
+	}
+
+	m.SetSlowMode(10 * time.Second)
+	if _, err := m.Check("alice", "again", false, now.Add(5*time.Second), TypeMessage); err == nil || err.Code != signaling.CodeRateLimited {
+		t.Errorf("slow mode = %v", err)
+	}
+	if _, err := m.Check("host", "again", true, now.Add(5*time.Second), TypeMessage); err != nil {
+		t.Errorf("exempt peer held by slow mode: %v", err)
+	}
+	if _, err := m.Check("alice", "later", false, now.Add(10*time.Second), TypeMessage); err != nil {
+		t.Errorf("after the interval = %v", err)
+	}
+
+	// Edits aren't held by slow mode and don't restart it
+	if _, err := m.Check("alice", "later!", false, now.Add(11*time.Second), TypeEdit); err != nil {
+		t.Errorf("edit held by slow mode: %v", err)
+	}
+	if _, err := m.Check("alice", "next", false, now.Add(20*time.Second), TypeMessage); err != nil {
+		t.Errorf("edit restarted slow mode: %v", err)
+	}
+
+	m.Mute("bob")
+	if _, err := m.Check("bob", "hi", false, now, TypeMessage); err == nil || err.Code != signaling.CodeForbidden {
+		t.Errorf("muted = %v", err)
+	}
+	m.Unmute("bob")
+	if _, err := m.Check("bob", "hi", false, now, TypeMessage); err != nil {
+		t.Errorf("unmuted = %v", err)
+	}
+
+	m.Filter = NewWordFilter([]string{"darn"}, true)
+	if _, err := m.Check("host", "darn", true, now, TypeMessage); err == nil {
+		t.Error("rejecting filter let a banned word through")
+	}
+}
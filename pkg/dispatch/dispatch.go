@@ -0,0 +1,244 @@
+// Package dispatch routes signaling events received on a room websocket to
+// registered handlers. Each event is registered once with the permission it
+// requires, usually a capability of the sender's role, and every dispatch
+// runs through a shared middleware chain (authorization, rate limiting,
+// logging, metrics) before reaching it.
+//
+// Packages outside the server can add their own room events by registering
+// on Default before the server starts:
+//
+//	dispatch.Handle("poll-created", dispatch.ManageParticipants, func(ctx *dispatch.Context) error {
+//		...
+//	})
+package dispatch
+
+import (
+	"sync"
+
+	"videochat/pkg/signaling"
+	w "videochat/pkg/webrtc"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Permission is what a peer needs to send an event: a capability of its
+// role in the room, or being the host
+type Permission struct {
+	Capability w.Capability // Required capability; empty if none is
+	HostOnly   bool
+}
+
+var (
+	// Anyone may send the event
+	Anyone = Permission{}
+	// ManageParticipants requires the manage-participants capability,
+	// which hosts and co-hosts have unless the room changed it
+	ManageParticipants = Require(w.CapManageParticipants)
+	// HostOnly requires the sender to be the host
+	HostOnly = Permission{HostOnly: true}
+)
+
+// Require returns the permission of events that need a capability
+func Require(capability w.Capability) Permission {
+	return Permission{Capability: capability}
+}
+
+// String returns a readable permission name for logs and errors
+func (p Permission) String() string {
+	switch {
+	case p.HostOnly:
+		return "host"
+	case p.Capability != "":
+		return string(p.Capability)
+	default:
+		return "anyone"
+	}
+}
+
+// HandlerFunc handles a single event. Returning a *signaling.Error sends it
+// back to the sender as an error event.
+type HandlerFunc func(ctx *Context) error
+
+// Middleware wraps a handler with cross-cutting behaviour
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Route is a registered event handler and its requirements
+type Route struct {
+	Event      string
+	Permission Permission
+	Handler    HandlerFunc
+}
+
+// Registry maps event names to routes
+type Registry struct {
+	mu         sync.RWMutex
+	routes     map[string]*Route
+	relay      *Route
+	relayed    map[string]bool
+	middleware []Middleware
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		routes: make(map[string]*Route),
+	}
+}
+
+// Default is the registry used by the room websocket
+var Default = NewRegistry()
+
+// Handle registers a handler for an event. It panics if the event is
+// already registered, since two handlers for one event is always a bug.
+func (r *Registry) Handle(event string, perm Permission, h HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.routes[event]; exists {
+		panic("dispatch: duplicate handler for event " + event)
+	}
+	r.routes[event] = &Route{Event: event, Permission: perm, Handler: h}
+}
+
+// HandleRelay registers the handler for the given events when they are
+// addressed to another peer (carrying a targetPeerId). For those it takes
+// precedence over event routes; every other event goes to its own route,
+// target or not, so its permission always applies.
+func (r *Registry) HandleRelay(events []string, h HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.relay = &Route{Permission: Anyone, Handler: h}
+	r.relayed = make(map[string]bool, len(events))
+	for _, event := range events {
+		r.relayed[event] = true
+	}
+}
+
+// Use appends middleware to the chain. Middleware runs in the order added,
+// outermost first.
+func (r *Registry) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Route returns the route registered for an event
+func (r *Registry) Route(event string) (*Route, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	route, ok := r.routes[event]
+	return route, ok
+}
+
+// Dispatch runs the middleware chain and the matching handler for ctx
+func (r *Registry) Dispatch(ctx *Context) error {
+	r.mu.RLock()
+	route, ok := r.routes[ctx.Envelope.Event]
+	if r.relayed[ctx.Envelope.Event] && ctx.Envelope.Target() != "" {
+		route, ok = r.relay, true
+	}
+	middleware := r.middleware
+	r.mu.RUnlock()
+
+	if !ok {
+		return signaling.NewError(signaling.CodeUnknownEvent, ctx.Envelope.Event, "unknown event")
+	}
+	ctx.Route = route
+
+	h := route.Handler
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h(ctx)
+}
+
+// Handle registers a handler on the Default registry
+func Handle(event string, perm Permission, h HandlerFunc) {
+	Default.Handle(event, perm, h)
+}
+
+// Use adds middleware to the Default registry
+func Use(mw ...Middleware) {
+	Default.Use(mw...)
+}
+
+// Context carries one inbound event through the middleware chain
+type Context struct {
+	Room     *w.Room
+	RoomID   string
+	PeerID   string
+	Envelope *signaling.Envelope
+	Route    *Route
+}
+
+// Event returns the name of the event being handled
+func (c *Context) Event() string {
+	return c.Envelope.Event
+}
+
+// Username returns the sender's current display name
+func (c *Context) Username() string {
+	return c.Room.Peers.GetUsername(c.PeerID)
+}
+
+// PeerConnection returns the sender's server-side peer connection
+func (c *Context) PeerConnection() *webrtc.PeerConnection {
+	conn, ok := c.Room.Peers.Get(c.PeerID)
+	if !ok {
+		return nil
+	}
+	return conn.PeerConnection
+}
+
+// Bind decodes and validates the event payload into v
+func (c *Context) Bind(v interface{}) error {
+	return c.Envelope.Bind(v)
+}
+
+// TargetPeer decodes the peerId a host action is aimed at
+func (c *Context) TargetPeer() (string, error) {
+	var target signaling.PeerRef
+	if err := c.Bind(&target); err != nil {
+		return "", err
+	}
+	return target.PeerID, nil
+}
+
+// ManagedPeer decodes the peerId a moderation action is aimed at, such as
+// muting or removing someone. Nobody but the host may aim one at the host,
+// or at a co-host other than themselves.
+func (c *Context) ManagedPeer() (string, error) {
+	target, err := c.TargetPeer()
+	if err != nil {
+		return "", err
+	}
+	if target != c.PeerID && !c.Room.IsHost(c.PeerID) && (c.Room.IsHost(target) || c.Room.IsCoHost(target)) {
+		return "", signaling.NewError(signaling.CodeForbidden, c.Event(), "only the host can do that to the host or a co-host")
+	}
+	return target, nil
+}
+
+// Reply sends an event back to the sender
+func (c *Context) Reply(event string, data interface{}) {
+	c.Room.Peers.SendToPeer(signaling.New(event, data), c.PeerID)
+}
+
+// SendTo sends an event to a single peer
+func (c *Context) SendTo(peerID, event string, data interface{}) {
+	c.Room.Peers.SendToPeer(signaling.New(event, data), peerID)
+}
+
+// Broadcast sends an event to everyone in the room, including the sender
+func (c *Context) Broadcast(event string, data interface{}) {
+	c.Room.Peers.BroadcastMessage(signaling.New(event, data))
+}
+
+// BroadcastToOthers sends an event to everyone except the sender
+func (c *Context) BroadcastToOthers(event string, data interface{}) {
+	c.Room.Peers.BroadcastToOthers(signaling.New(event, data), c.PeerID)
+}
+
+// Forbidden builds the error returned when the sender lacks permission
+func (c *Context) Forbidden() error {
+	return signaling.NewError(signaling.CodeForbidden, c.Event(), "insufficient permissions")
+}
@@ -0,0 +1,159 @@
+package dispatch
+
+import (
+	"testing"
+
+	"videochat/pkg/signaling"
+	w "videochat/pkg/webrtc"
+)
+
+func newContext(t *testing.T, room *w.Room, peerID, raw string) *Context {
+	t.Helper()
+	env, err := signaling.Decode([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Context{Room: room, RoomID: "test", PeerID: peerID, Envelope: env}
+}
+
+func errorCode(err error) signaling.ErrorCode {
+	if err == nil {
+		return ""
+	}
+	return signaling.AsError(err).Code
+}
+
+func TestDispatchEnforcesPermissions(t *testing.T) {
+	room := w.CreateRoom("dispatch-permissions")
+	room.SetHost("host")
+	room.AddCoHost("cohost")
+	room.SetRole("viewer", w.RoleViewer)
+
+	r := NewRegistry()
+	r.Use(Authorize())
+	calls := 0
+	r.Handle("host-only", HostOnly, func(*Context) error { calls++; return nil })
+	r.Handle("staff", ManageParticipants, func(*Context) error { calls++; return nil })
+	r.Handle("draw", Require(w.CapAnnotate), func(*Context) error { calls++; return nil })
+	r.HandleRelay([]string{"offer"}, func(*Context) error { calls++; return nil })
+
+	tests := []struct {
+		peer, event, data string
+		want              signaling.ErrorCode
+	}{
+		{"host", "host-only", "", ""},
+		{"cohost", "host-only", "", signaling.CodeForbidden},
+		{"cohost", "staff", "", ""},
+		{"guest", "staff", "", signaling.CodeForbidden},
+		{"guest", "draw", "", ""},
+		{"viewer", "draw", "", signaling.CodeForbidden},
+		{"guest", "missing", "", signaling.CodeUnknownEvent},
+
+		// Addressing an event to one peer doesn't get around its permission
+		{"viewer", "draw", `{"targetPeerId":"host"}`, signaling.CodeForbidden},
+		{"viewer", "offer", `{"targetPeerId":"host"}`, ""},
+	}
+	for _, tt := range tests {
+		raw := `{"event":"` + tt.event + `"}`
+		if tt.data != "" {
+			raw = `{"event":"` + tt.event + `","data":` + tt.data + `}`
+		}
+		err := r.Dispatch(newContext(t, room, tt.peer, raw))
+		if got := errorCode(err); got != tt.want {
+			t.Errorf("%s sending %s: got %q, want %q", tt.peer, tt.event, got, tt.want)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("handlers ran %d times, want 4", calls)
+	}
+}
+
+func TestManagedPeerProtectsHostAndCoHosts(t *testing.T) {
+	room := w.CreateRoom("dispatch-managed")
+	room.SetHost("host")
+	room.AddCoHost("cohost")
+	room.AddCoHost("cohost2")
+
+	events := []string{"mute-participant", "remove-participant", "approve-screen-share", "deny-screen-share", "revoke-screen-share"}
+	r := NewRegistry()
+	r.Use(Authorize())
+	for _, event := range events {
+		r.Handle(event, ManageParticipants, func(ctx *Context) error {
+			_, err := ctx.ManagedPeer()
+			return err
+		})
+	}
+
+	tests := []struct {
+		peer, target string
+		want         signaling.ErrorCode
+	}{
+		{"cohost", "host", signaling.CodeForbidden},
+		{"cohost", "cohost2", signaling.CodeForbidden},
+		{"cohost", "guest", ""},
+		{"cohost", "cohost", ""},
+		{"host", "cohost", ""},
+		{"host", "guest", ""},
+	}
+	for _, event := range events {
+		for _, tt := range tests {
+			err := r.Dispatch(newContext(t, room, tt.peer, `{"event":"`+event+`","data":{"peerId":"`+tt.target+`"}}`))
+			if got := errorCode(err); got != tt.want {
+				t.Errorf("%s sending %s to %s: got %q, want %q", tt.peer, event, tt.target, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestDispatchMiddlewareOrderAndRelay(t *testing.T) {
+	room := w.CreateRoom("dispatch-order")
+
+	r := NewRegistry()
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx *Context) error {
+				order = append(order, name)
+				return next(ctx)
+			}
+		}
+	}
+	r.Use(trace("outer"), trace("inner"))
+	r.Handle("offer", Anyone, func(*Context) error { order = append(order, "offer"); return nil })
+	r.Handle("chat", Anyone, func(*Context) error { order = append(order, "chat"); return nil })
+	r.HandleRelay([]string{"offer"}, func(*Context) error { order = append(order, "relay"); return nil })
+
+	r.Dispatch(newContext(t, room, "a", `{"event":"offer","data":{"sdp":"x"}}`))
+	r.Dispatch(newContext(t, room, "a", `{"event":"offer","data":{"sdp":"x","targetPeerId":"b"}}`))
+	r.Dispatch(newContext(t, room, "a", `{"event":"chat","data":{"targetPeerId":"b"}}`))
+
+	want := []string{"outer", "inner", "offer", "outer", "inner", "relay", "outer", "inner", "chat"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	room := w.CreateRoom("dispatch-ratelimit")
+
+	r := NewRegistry()
+	r.Use(RateLimit(0.001, 3))
+	r.Handle("ping", Anyone, func(*Context) error { return nil })
+
+	for i := 0; i < 3; i++ {
+		if err := r.Dispatch(newContext(t, room, "a", `{"event":"ping"}`)); err != nil {
+			t.Fatalf("message %d rejected: %v", i, err)
+		}
+	}
+	if got := errorCode(r.Dispatch(newContext(t, room, "a", `{"event":"ping"}`))); got != signaling.CodeRateLimited {
+		t.Errorf("fourth message: got %q, want rate-limited", got)
+	}
+	if err := r.Dispatch(newContext(t, room, "b", `{"event":"ping"}`)); err != nil {
+		t.Errorf("other peer limited: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package dispatch
+
+import (
+	"sync"
+	"time"
+)
+
+// EventStats are the counters kept for a single event
+type EventStats struct {
+	Handled       uint64        `json:"handled"`
+	Failed        uint64        `json:"failed"`
+	TotalDuration time.Duration `json:"totalDurationNs"`
+}
+
+// Metrics counts dispatched events by name
+type Metrics struct {
+	mu     sync.Mutex
+	events map[string]*EventStats
+}
+
+// NewMetrics creates an empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		events: make(map[string]*EventStats),
+	}
+}
+
+// Middleware records the outcome and duration of every event
+func (m *Metrics) Middleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			start := time.Now()
+			err := next(ctx)
+			m.record(ctx.Event(), time.Since(start), err)
+			return err
+		}
+	}
+}
+
+func (m *Metrics) record(event string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.events[event]
+	if !ok {
+		stats = &EventStats{}
+		m.events[event] = stats
+	}
+	stats.Handled++
+	stats.TotalDuration += d
+	if err != nil {
+		stats.Failed++
+	}
+}
+
+// Snapshot returns a copy of the current counters
+func (m *Metrics) Snapshot() map[string]EventStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]EventStats, len(m.events))
+	for event, stats := range m.events {
+		snapshot[event] = *stats
+	}
+	return snapshot
+}
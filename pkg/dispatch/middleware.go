@@ -0,0 +1,98 @@
+package dispatch
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"videochat/pkg/signaling"
+)
+
+// Authorize rejects events whose route permission the sender does not hold
+func Authorize() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			perm := ctx.Route.Permission
+			if perm.HostOnly && !ctx.Room.IsHost(ctx.PeerID) {
+				return ctx.Forbidden()
+			}
+			if perm.Capability != "" && !ctx.Room.Can(ctx.PeerID, perm.Capability) {
+				return ctx.Forbidden()
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// Logger logs every failed event with its sender and handling time
+func Logger() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			start := time.Now()
+			err := next(ctx)
+			if err != nil {
+				log.Printf("Event %s from peer %s failed after %v: %v", ctx.Event(), ctx.PeerID, time.Since(start), err)
+			}
+			return err
+		}
+	}
+}
+
+// bucket is a token bucket for a single peer
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// RateLimit allows each peer a sustained rate of events per second with
+// the given burst. Events over the limit are rejected with a rate-limited
+// error instead of reaching the handler.
+func RateLimit(perSecond float64, burst int) Middleware {
+	var (
+		mu        sync.Mutex
+		buckets   = make(map[string]*bucket)
+		lastPrune = time.Now()
+	)
+
+	allow := func(key string, now time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Forget peers that have been quiet long enough to refill completely
+		if now.Sub(lastPrune) > time.Minute {
+			for k, b := range buckets {
+				if now.Sub(b.lastSeen) > time.Minute {
+					delete(buckets, k)
+				}
+			}
+			lastPrune = now
+		}
+
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{tokens: float64(burst), lastSeen: now}
+			buckets[key] = b
+		}
+
+		b.tokens += now.Sub(b.lastSeen).Seconds() * perSecond
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.lastSeen = now
+
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+		return true
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			if !allow(ctx.RoomID+"/"+ctx.PeerID, time.Now()) {
+				return signaling.NewError(signaling.CodeRateLimited, ctx.Event(), "too many messages, slow down")
+			}
+			return next(ctx)
+		}
+	}
+}
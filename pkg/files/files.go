@@ -0,0 +1,369 @@
+// Package files keeps the files participants share in a room's chat. Each
+// room's files live in their own directory under Dir, the content in a
+// file named by its ID and a <id>.json next to it describing it.
+package files
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Limits bound what can be shared in one room
+type Limits struct {
+	MaxFileSize  int64    // Largest single file, in bytes
+	MaxRoomSize  int64    // Total of all files kept for the room, in bytes
+	AllowedTypes []string // Media types that may be shared
+}
+
+var (
+	// Dir is the directory shared files are kept under
+	Dir = "shared-files"
+
+	// Retention is how long a file is kept after it is shared. Zero keeps
+	// files until their room is reaped or deleted; otherwise files expire
+	// on their own and outlive a reaped room until they do.
+	Retention time.Duration
+
+	// DefaultLimits are given to every new room
+	DefaultLimits = Limits{
+		MaxFileSize: 10 << 20,
+		MaxRoomSize: 100 << 20,
+		AllowedTypes: []string{
+			"image/jpeg", "image/png", "image/gif", "image/webp",
+			"application/pdf", "text/plain", "application/zip",
+			"application/msword",
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		},
+	}
+)
+
+var (
+	ErrTooLarge       = errors.New("file is too large")
+	ErrTypeNotAllowed = errors.New("file type is not allowed")
+	ErrRoomFull       = errors.New("room has no space left for files")
+	ErrNotFound       = errors.New("file not found")
+	ErrInvalidRoom    = errors.New("room ID is not a UUID")
+)
+
+// maxNameLength caps a file name, in characters
+const maxNameLength = 255
+
+// File describes a shared file
+type File struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	PeerID     string    `json:"peerId"`
+	Username   string    `json:"username,omitempty"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// Store holds the files shared in one room. The store of a room whose ID
+// isn't a UUID has no directory and refuses every file, so an ID from a
+// URL can never name a path outside Dir.
+type Store struct {
+	Limits Limits
+	dir    string
+}
+
+// mu serializes changes to the files on disk, so a room's usage can't be
+// overrun by uploads racing each other
+var mu sync.Mutex
+
+// NewStore returns the store of a room, with DefaultLimits
+func NewStore(roomID string) *Store {
+	if uuid.Validate(roomID) != nil {
+		return &Store{Limits: DefaultLimits}
+	}
+	return &Store{Limits: DefaultLimits, dir: filepath.Join(Dir, roomID)}
+}
+
+// Save stores a file shared by a peer. Its type is detected from the
+// content, falling back on the name's extension for content that isn't
+// recognized.
+func (s *Store) Save(name string, content io.Reader, peerID, username string) (*File, error) {
+	if s.dir == "" {
+		return nil, ErrInvalidRoom
+	}
+	name = cleanName(name)
+	reader := bufio.NewReaderSize(content, 512)
+	head, err := reader.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	fileType := detectType(name, head)
+	if !slices.Contains(s.Limits.AllowedTypes, fileType) {
+		return nil, ErrTypeNotAllowed
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	used, err := s.usage()
+	if err != nil {
+		return nil, err
+	}
+	if used >= s.Limits.MaxRoomSize {
+		return nil, ErrRoomFull
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+	file := &File{
+		ID:         uuid.New().String(),
+		Name:       name,
+		Type:       fileType,
+		PeerID:     peerID,
+		Username:   username,
+		UploadedAt: time.Now().UTC(),
+	}
+
+	out, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+	file.Size, err = io.Copy(out, io.LimitReader(reader, s.Limits.MaxFileSize+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.Size > s.Limits.MaxFileSize {
+		return nil, ErrTooLarge
+	}
+	if used+file.Size > s.Limits.MaxRoomSize {
+		return nil, ErrRoomFull
+	}
+
+	info, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.infoPath(file.ID), info, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(out.Name(), s.path(file.ID)); err != nil {
+		os.Remove(s.infoPath(file.ID))
+		return nil, err
+	}
+	return file, nil
+}
+
+// Open returns a shared file and the path of its content
+func (s *Store) Open(id string) (*File, string, error) {
+	if s.dir == "" || uuid.Validate(id) != nil {
+		return nil, "", ErrNotFound
+	}
+	file, err := s.info(id)
+	if err != nil {
+		return nil, "", err
+	}
+	return file, s.path(id), nil
+}
+
+// List returns the room's files, oldest first
+func (s *Store) List() ([]*File, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*File
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		file, err := s.info(id)
+		if err != nil {
+			log.Printf("Error reading shared file %s: %v", id, err)
+			continue
+		}
+		list = append(list, file)
+	}
+	slices.SortFunc(list, func(a, b *File) int { return a.UploadedAt.Compare(b.UploadedAt) })
+	return list, nil
+}
+
+// Expire deletes the files older than Retention as of now, and returns how
+// many it deleted
+func (s *Store) Expire(now time.Time) int {
+	if Retention <= 0 {
+		return 0
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	list, err := s.List()
+	if err != nil {
+		log.Printf("Error listing shared files in %s: %v", s.dir, err)
+		return 0
+	}
+	expired := 0
+	for _, file := range list {
+		if now.Sub(file.UploadedAt) >= Retention {
+			s.remove(file.ID)
+			expired++
+		}
+	}
+	if expired == len(list) && s.dir != "" {
+		os.Remove(s.dir)
+	}
+	return expired
+}
+
+// Release drops the files of a reaped room. Without a Retention every file
+// goes; otherwise only the expired ones do and the rest wait out their time.
+func (s *Store) Release(now time.Time) {
+	if Retention > 0 {
+		s.Expire(now)
+		return
+	}
+	s.RemoveAll()
+}
+
+// RemoveAll deletes every file of the room
+func (s *Store) RemoveAll() {
+	if s.dir == "" {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("Error deleting shared files in %s: %v", s.dir, err)
+	}
+}
+
+// StartExpiry periodically deletes files older than Retention across all
+// rooms, live or not, until ctx is cancelled
+func StartExpiry(ctx context.Context) {
+	if Retention <= 0 {
+		return
+	}
+	interval := min(max(Retention/4, time.Second), time.Minute)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				entries, err := os.ReadDir(Dir)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("Error listing shared files: %v", err)
+				}
+				for _, entry := range entries {
+					if entry.IsDir() && uuid.Validate(entry.Name()) == nil {
+						NewStore(entry.Name()).Expire(now)
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// usage totals the size of the room's files. Callers hold mu.
+func (s *Store) usage() (int64, error) {
+	list, err := s.List()
+	var total int64
+	for _, file := range list {
+		total += file.Size
+	}
+	return total, err
+}
+
+func (s *Store) info(id string) (*File, error) {
+	data, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// remove deletes one file. Callers hold mu.
+func (s *Store) remove(id string) {
+	for _, path := range []string{s.path(id), s.infoPath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error deleting shared file %s: %v", path, err)
+		}
+	}
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// detectType returns the media type of a file from its first bytes, or
+// from its name if the content isn't recognized
+func detectType(name string, head []byte) string {
+	fileType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if fileType == "application/octet-stream" {
+		if byName, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name))); err == nil {
+			fileType = byName
+		}
+	}
+	return fileType
+}
+
+// cleanName makes a file name safe to show and to offer as a download name
+func cleanName(name string) string {
+	name = strings.ToValidUTF8(filepath.Base(strings.ReplaceAll(name, "\\", "/")), "")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxNameLength {
+		// Keep the extension so the download still opens
+		ext := []rune(filepath.Ext(name))
+		if len(ext) > maxNameLength/2 {
+			ext = nil
+		}
+		name = string(runes[:maxNameLength-len(ext)]) + string(ext)
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	return name
+}
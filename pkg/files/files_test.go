@@ -0,0 +1,80 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestStoreLimitsAndRetention(t *testing.T) {
+	Dir = t.TempDir()
+	roomID := uuid.New().String()
+	store := NewStore(roomID)
+	store.Limits = Limits{MaxFileSize: 16, MaxRoomSize: 24, AllowedTypes: []string{"text/plain"}}
+
+	file, err := store.Save("../notes\x00.txt", strings.NewReader("hello, world"), "alice", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Name != "notes.txt" || file.Type != "text/plain" || file.Size != 12 {
+		t.Errorf("saved %+v", file)
+	}
+	got, path, err := store.Open(file.ID)
+	if err != nil || got.PeerID != "alice" {
+		t.Fatalf("Open = %+v, %v", got, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "hello, world" {
+		t.Errorf("content = %q", data)
+	}
+
+	if _, err := store.Save("big.txt", strings.NewReader(strings.Repeat("x", 17)), "alice", ""); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("oversized file: %v", err)
+	}
+	if _, err := store.Save("more.txt", strings.NewReader(strings.Repeat("x", 13)), "alice", ""); !errors.Is(err, ErrRoomFull) {
+		t.Errorf("file over the room's quota: %v", err)
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 8)...)
+	if _, err := store.Save("image.txt", bytes.NewReader(png), "alice", ""); !errors.Is(err, ErrTypeNotAllowed) {
+		t.Errorf("file of a type not allowed: %v", err)
+	}
+	if _, _, err := store.Open("../" + roomID + "/" + file.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open outside the room: %v", err)
+	}
+
+	// With a retention, a reaped room keeps files until they expire
+	Retention = time.Hour
+	defer func() { Retention = 0 }()
+	store.Release(file.UploadedAt.Add(time.Minute))
+	if _, _, err := store.Open(file.ID); err != nil {
+		t.Errorf("file deleted before it expired: %v", err)
+	}
+	store.Release(file.UploadedAt.Add(time.Hour))
+	if _, _, err := store.Open(file.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("file kept past its retention: %v", err)
+	}
+
+	Retention = 0
+	store.Save("notes.txt", strings.NewReader("again"), "alice", "")
+	store.Release(time.Now())
+	if list, _ := store.List(); len(list) != 0 {
+		t.Errorf("files left after the room was reaped: %d", len(list))
+	}
+
+	// Room IDs that aren't UUIDs can't reach outside Dir
+	os.WriteFile(Dir+"/keep", []byte("keep"), 0o644)
+	for _, roomID := range []string{"..", ".", "", "../x"} {
+		bad := NewStore(roomID)
+		if _, err := bad.Save("notes.txt", strings.NewReader("x"), "alice", ""); !errors.Is(err, ErrInvalidRoom) {
+			t.Errorf("saved in room %q: %v", roomID, err)
+		}
+		bad.Release(time.Now())
+	}
+	if _, err := os.Stat(Dir + "/keep"); err != nil {
+		t.Errorf("releasing an invalid room deleted files: %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+// Package hls packages the media forwarded in a stream as low-latency HLS
+// for viewers that can't use WebRTC. H264 video and Opus audio are muxed
+// into fMP4 (CMAF) segments that are split into partial segments, and an
+// LL-HLS media playlist with blocking reloads and preload hints describes
+// them.
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+var (
+	// Enabled turns HLS output on for streams
+	Enabled = true
+
+	// SegmentDuration is the target duration of a segment. Segments start
+	// on a keyframe, so they can run slightly longer.
+	SegmentDuration = 2 * time.Second
+
+	// PartDuration is the target duration of a partial segment
+	PartDuration = 500 * time.Millisecond
+
+	// Window is how many complete segments the playlist keeps
+	Window = 6
+)
+
+const (
+	// startDelay gives every track of a publisher time to arrive before
+	// the init segment fixes the track list
+	startDelay = 500 * time.Millisecond
+
+	// keyframeRetry throttles keyframe requests to the publisher
+	keyframeRetry = time.Second
+
+	// partSegments is how many of the newest complete segments still list
+	// their partial segments in the playlist
+	partSegments = 3
+)
+
+var (
+	// ErrNotFound is returned for a segment or part outside the window
+	ErrNotFound = errors.New("not found")
+
+	// ErrTooFarAhead is returned for a blocking request more than one
+	// segment beyond the one being written
+	ErrTooFarAhead = errors.New("requested segment is too far ahead")
+
+	// ErrUnsupportedCodec is returned for tracks that can't be packaged
+	ErrUnsupportedCodec = errors.New("codec can't be packaged as HLS")
+
+	// ErrTrackExists is returned for a second track of the same kind
+	ErrTrackExists = errors.New("muxer already has a track of this kind")
+
+	// ErrStarted is returned for tracks added after the init segment was
+	// written
+	ErrStarted = errors.New("muxer already started")
+)
+
+// Muxer packages one publisher's audio and video tracks
+type Muxer struct {
+	mu      sync.Mutex
+	created time.Time
+	video   *Track
+	audio   *Track
+
+	started   bool
+	startedAt time.Time
+	init      []byte
+	seq       uint32
+
+	segments       []*segment
+	current        *segment
+	targetDuration int
+	ended          bool
+
+	// changed is closed and replaced whenever a part is added or the
+	// stream ends, waking blocked requests
+	changed chan struct{}
+}
+
+type segment struct {
+	msn   uint64
+	parts []*part
+}
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+// NewMuxer creates a muxer. It starts writing segments once its tracks are
+// added and the first video keyframe arrives.
+func NewMuxer() *Muxer {
+	return &Muxer{
+		created:        time.Now(),
+		targetDuration: int(math.Ceil(SegmentDuration.Seconds())) + 1,
+		changed:        make(chan struct{}),
+	}
+}
+
+// Ended reports whether the muxer has written its last segment
+func (m *Muxer) Ended() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ended
+}
+
+// End finishes the current segment and closes the playlist
+func (m *Muxer) End() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.end()
+}
+
+func (m *Muxer) end() {
+	if m.ended {
+		return
+	}
+	if m.started {
+		for _, t := range []*Track{m.video, m.audio} {
+			if t != nil {
+				t.flushPending()
+			}
+		}
+		m.flushPart()
+		m.closeSegment()
+	}
+	m.ended = true
+	m.notify()
+	log.Println("HLS output ended")
+}
+
+// Started reports whether the init segment has been written. Tracks can
+// only be added before that.
+func (m *Muxer) Started() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.started
+}
+
+// start writes the init segment for the tracks added so far
+func (m *Muxer) start(now time.Time) error {
+	init := mp4.CreateEmptyInit()
+	var id uint32
+	if m.video != nil {
+		init.AddEmptyTrack(m.video.timescale, "video", "und")
+		id++
+		m.video.id = id
+		trak := init.Moov.Traks[id-1]
+		if err := trak.SetAVCDescriptor("avc3", [][]byte{m.video.sps}, [][]byte{m.video.pps}, true); err != nil {
+			return fmt.Errorf("invalid H264 parameter sets: %w", err)
+		}
+	}
+	if m.audio != nil {
+		init.AddEmptyTrack(m.audio.timescale, "audio", "und")
+		id++
+		m.audio.id = id
+		trak := init.Moov.Traks[id-1]
+		trak.Mdia.Minf.Stbl.Stsd.AddChild(mp4.CreateAudioSampleEntryBox("Opus", 2, 16, opusClockRate, &mp4.DopsBox{
+			OutputChannelCount: 2,
+			PreSkip:            opusPreSkip,
+			InputSampleRate:    opusClockRate,
+		}))
+	}
+
+	var buf bytes.Buffer
+	if err := init.Encode(&buf); err != nil {
+		return err
+	}
+
+	m.init = buf.Bytes()
+	m.started = true
+	m.startedAt = now
+	m.current = &segment{}
+	m.notify()
+	log.Printf("HLS output started with %d tracks", id)
+	return nil
+}
+
+// leader is the track whose samples decide where parts and segments are
+// cut: video when there is any, since segments must start on a keyframe
+func (m *Muxer) leader() *Track {
+	if m.video != nil {
+		return m.video
+	}
+	return m.audio
+}
+
+// push queues a sample whose duration is now known and cuts parts and
+// segments around it
+func (m *Muxer) push(t *Track, s mp4.FullSample) {
+	if t == m.leader() && t.queued > 0 && t.queued+uint64(s.Dur) > t.ticks(PartDuration) {
+		m.flushPart()
+	}
+	t.queue = append(t.queue, s)
+	t.queued += uint64(s.Dur)
+}
+
+// cutBefore ends the current segment before a sync sample of the leader
+// once the segment is long enough, and otherwise asks for a keyframe as
+// the segment nears its target duration
+func (m *Muxer) cutBefore(t *Track, sync bool) {
+	if t != m.leader() {
+		return
+	}
+	elapsed := m.current.duration() + t.duration(t.queued)
+	switch {
+	case sync && elapsed >= SegmentDuration:
+		m.flushPart()
+		m.closeSegment()
+	case !sync && elapsed >= SegmentDuration-PartDuration:
+		t.askKeyframe()
+	}
+}
+
+// flushPart writes every queued sample as a partial segment
+func (m *Muxer) flushPart() {
+	leader := m.leader()
+	if len(leader.queue) == 0 {
+		return
+	}
+
+	var tracks []*Track
+	var ids []uint32
+	for _, t := range []*Track{m.video, m.audio} {
+		if t != nil && len(t.queue) > 0 {
+			tracks = append(tracks, t)
+			ids = append(ids, t.id)
+		}
+	}
+
+	m.seq++
+	frag, err := mp4.CreateMultiTrackFragment(m.seq, ids)
+	if err != nil {
+		log.Printf("Error creating HLS fragment: %v", err)
+		return
+	}
+	for _, t := range tracks {
+		for _, s := range t.queue {
+			if err := frag.AddFullSampleToTrack(s, t.id); err != nil {
+				log.Printf("Error adding sample to HLS fragment: %v", err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := frag.Encode(&buf); err != nil {
+		log.Printf("Error encoding HLS fragment: %v", err)
+		return
+	}
+
+	m.current.parts = append(m.current.parts, &part{
+		data:        buf.Bytes(),
+		duration:    leader.duration(leader.queued),
+		independent: leader.queue[0].Flags == mp4.SyncSampleFlags,
+	})
+	for _, t := range tracks {
+		t.queue = nil
+		t.queued = 0
+	}
+	m.notify()
+}
+
+// closeSegment completes the current segment and slides the window
+func (m *Muxer) closeSegment() {
+	if len(m.current.parts) == 0 {
+		return
+	}
+	if d := m.current.duration(); d > time.Duration(m.targetDuration)*time.Second {
+		log.Printf("HLS segment %d is %.1fs, over the %ds target", m.current.msn, d.Seconds(), m.targetDuration)
+	}
+
+	m.segments = append(m.segments, m.current)
+	if len(m.segments) > Window {
+		m.segments = m.segments[len(m.segments)-Window:]
+	}
+	m.current = &segment{msn: m.current.msn + 1}
+	m.notify()
+}
+
+func (m *Muxer) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// await blocks until ready reports true, the muxer ends, or the request
+// times out. Callers hold mu; it is held again on return.
+func (m *Muxer) await(ready func() bool) bool {
+	timeout := time.NewTimer(3 * time.Duration(m.targetDuration) * time.Second)
+	defer timeout.Stop()
+
+	for !ready() {
+		if m.ended {
+			return false
+		}
+		changed := m.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+			m.mu.Lock()
+		case <-timeout.C:
+			m.mu.Lock()
+			return ready()
+		}
+	}
+	return true
+}
+
+// segment finds a complete segment in the window
+func (m *Muxer) segment(msn uint64) *segment {
+	for _, s := range m.segments {
+		if s.msn == msn {
+			return s
+		}
+	}
+	if m.current != nil && m.current.msn == msn {
+		return m.current
+	}
+	return nil
+}
+
+// Init returns the init segment, waiting for the muxer to start
+func (m *Muxer) Init() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.await(func() bool { return m.started }) {
+		return nil, ErrNotFound
+	}
+	return m.init, nil
+}
+
+// Segment returns a complete segment
+func (m *Muxer) Segment(msn uint64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.segment(msn)
+	if s == nil || s == m.current {
+		return nil, ErrNotFound
+	}
+	var buf bytes.Buffer
+	for _, p := range s.parts {
+		buf.Write(p.data)
+	}
+	return buf.Bytes(), nil
+}
+
+// Part returns a partial segment. A request for the part named by the
+// preload hint blocks until it is written.
+func (m *Muxer) Part(msn uint64, index int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.current != nil && msn == m.current.msn && index == len(m.current.parts) {
+		m.await(func() bool { return m.current.msn > msn || len(m.current.parts) > index })
+	}
+
+	s := m.segment(msn)
+	if s == nil || index < 0 || index >= len(s.parts) {
+		return nil, ErrNotFound
+	}
+	return s.parts[index].data, nil
+}
+
+// Playlist returns the media playlist. A negative msn returns it right
+// away once the muxer has started; otherwise it blocks until segment msn,
+// or part of it when part is not negative, is in the playlist.
+func (m *Muxer) Playlist(msn, part int64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if msn >= 0 && m.current != nil && uint64(msn) > m.current.msn+1 {
+		return nil, ErrTooFarAhead
+	}
+
+	ready := m.await(func() bool {
+		if !m.started {
+			return false
+		}
+		if msn < 0 || uint64(msn) < m.current.msn {
+			return true
+		}
+		return uint64(msn) == m.current.msn && part >= 0 && int(part) < len(m.current.parts)
+	})
+	if !m.started {
+		return nil, ErrNotFound
+	}
+	if !ready && !m.ended {
+		log.Printf("HLS blocking reload for %d.%d timed out", msn, part)
+	}
+	return m.playlist(), nil
+}
+
+func (m *Muxer) playlist() []byte {
+	var b strings.Builder
+	partTarget := PartDuration.Seconds()
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", m.targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+
+	first := m.current.msn
+	if len(m.segments) > 0 {
+		first = m.segments[0].msn
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	for i, s := range m.segments {
+		if i >= len(m.segments)-partSegments {
+			writeParts(&b, s)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.5f,\nsegment-%d.m4s\n", s.duration().Seconds(), s.msn)
+	}
+
+	if m.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+		return []byte(b.String())
+	}
+	writeParts(&b, m.current)
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-%d-%d.m4s\"\n", m.current.msn, len(m.current.parts))
+	return []byte(b.String())
+}
+
+func writeParts(b *strings.Builder, s *segment) {
+	for i, p := range s.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.5f,URI=\"part-%d-%d.m4s\"", p.duration.Seconds(), s.msn, i)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+func (s *segment) duration() time.Duration {
+	var d time.Duration
+	for _, p := range s.parts {
+		d += p.duration
+	}
+	return d
+}
@@ -0,0 +1,119 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestMuxerWritesPartsAndSegments(t *testing.T) {
+	SegmentDuration, PartDuration, Window = time.Second, 200*time.Millisecond, 2
+	defer func() { SegmentDuration, PartDuration, Window = 2*time.Second, 500*time.Millisecond, 6 }()
+
+	m := NewMuxer()
+	m.created = time.Now().Add(-startDelay)
+
+	video, err := m.AddTrack(webrtc.MimeTypeH264, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := m.AddTrack(webrtc.MimeTypeOpus, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddTrack("video/VP8", nil); err != ErrUnsupportedCodec {
+		t.Fatalf("AddTrack(VP8) = %v", err)
+	}
+
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	seq := uint16(0)
+	writeVideo := func(ts uint32, nalus ...[]byte) {
+		for i, nalu := range nalus {
+			seq++
+			if err := video.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{SequenceNumber: seq, Timestamp: ts, Marker: i == len(nalus)-1},
+				Payload: nalu,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 3s of 25fps video with a keyframe every second, and 20ms Opus frames
+	for frame := 0; frame < 75; frame++ {
+		ts := uint32(frame * 3600)
+		if frame%25 == 0 {
+			writeVideo(ts, sps, pps, []byte{0x65, 0x88, 0x84, 0x00})
+		} else {
+			writeVideo(ts, []byte{0x41, 0x9a, 0x02, 0x00})
+		}
+		for i := 0; i < 2; i++ {
+			if err := audio.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Timestamp: uint32((frame*2 + i) * 960)},
+				Payload: []byte{0xfc, 0xff, 0xfe},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	init, err := m.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := mp4.DecodeFile(bytes.NewReader(init))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(file.Init.Moov.Traks); n != 2 {
+		t.Fatalf("init segment has %d tracks", n)
+	}
+
+	data, err := m.Playlist(-1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := string(data)
+	for _, want := range []string{
+		"#EXT-X-PART-INF:PART-TARGET=0.200",
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		"#EXTINF:1.00000,\nsegment-1.m4s",
+		`#EXT-X-PART:DURATION=0.20000,URI="part-2-0.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part-2-4.m4s"`,
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist is missing %q:\n%s", want, playlist)
+		}
+	}
+
+	segment, err := m.Segment(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frag, err := mp4.DecodeFile(bytes.NewReader(segment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(frag.Segments[0].Fragments); n != 5 {
+		t.Errorf("segment 1 has %d fragments, want 5", n)
+	}
+	if _, err := m.Segment(2); err != ErrNotFound {
+		t.Errorf("Segment(2) = %v before it is complete", err)
+	}
+	if _, err := m.Playlist(5, -1); err != ErrTooFarAhead {
+		t.Errorf("Playlist(5) = %v", err)
+	}
+
+	video.Close()
+	data, _ = m.Playlist(-1, -1)
+	if !strings.HasSuffix(string(data), "#EXT-X-ENDLIST\n") {
+		t.Errorf("ended playlist:\n%s", data)
+	}
+}
@@ -0,0 +1,281 @@
+package hls
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	videoClockRate = 90000
+	opusClockRate  = 48000
+
+	// opusPreSkip is the encoder delay of libopus at 48kHz
+	opusPreSkip = 312
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+)
+
+// Track is one track of a muxer's output
+type Track struct {
+	m         *Muxer
+	id        uint32
+	video     bool
+	timescale uint32
+
+	requestKeyframe func()
+	lastRequest     time.Time
+
+	// H264 depacketization
+	h264    codecs.H264Packet
+	nalus   [][]byte
+	frameTS uint32
+	sps     []byte
+	pps     []byte
+
+	// Decode times are the unwrapped RTP timestamp plus the offset of the
+	// track's first sample from the start of the muxer
+	haveTS  bool
+	lastTS  uint32
+	extTS   int64
+	offset  uint64
+	lastDur uint32
+
+	// pending waits for the next sample to learn its duration; queue holds
+	// the samples of the next part
+	pending *mp4.FullSample
+	queue   []mp4.FullSample
+	queued  uint64
+
+	closed bool
+}
+
+// AddTrack adds a track in the given codec. A muxer takes one H264 and one
+// Opus track, and only until it starts. requestKeyframe asks the publisher
+// for a keyframe and may be nil.
+func (m *Muxer) AddTrack(mimeType string, requestKeyframe func()) (*Track, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := &Track{m: m, requestKeyframe: requestKeyframe}
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		if m.video != nil && !m.video.closed {
+			return nil, ErrTrackExists
+		}
+		t.video = true
+		t.timescale = videoClockRate
+		t.h264.IsAVC = true
+		t.lastDur = videoClockRate / 30
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		if m.audio != nil && !m.audio.closed {
+			return nil, ErrTrackExists
+		}
+		t.timescale = opusClockRate
+		t.lastDur = opusClockRate / 50
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+
+	if m.started || m.ended {
+		return nil, ErrStarted
+	}
+	if t.video {
+		m.video = t
+	} else {
+		m.audio = t
+	}
+	return t, nil
+}
+
+// WriteRTP adds a packet to the output. Video is held back until the
+// muxer starts on a keyframe.
+func (t *Track) WriteRTP(pkt *rtp.Packet) error {
+	m := t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.closed || m.ended || len(pkt.Payload) == 0 {
+		return nil
+	}
+
+	if !t.video {
+		data := make([]byte, len(pkt.Payload))
+		copy(data, pkt.Payload)
+		m.writeSample(t, pkt.Timestamp, data, true)
+		return nil
+	}
+
+	// A new timestamp with a frame still open means its last packet was lost
+	if len(t.nalus) > 0 && pkt.Timestamp != t.frameTS {
+		t.nalus = nil
+	}
+	t.frameTS = pkt.Timestamp
+
+	out, err := t.h264.Unmarshal(pkt.Payload)
+	if err != nil {
+		t.nalus = nil
+		return err
+	}
+	t.nalus = appendNALUs(t.nalus, out)
+	if !pkt.Marker {
+		return nil
+	}
+
+	data, keyframe := t.frame()
+	if len(data) == 0 {
+		return nil
+	}
+
+	if !m.started {
+		if !keyframe || t.sps == nil || time.Since(m.created) < startDelay {
+			t.askKeyframe()
+			return nil
+		}
+		if err := m.start(time.Now()); err != nil {
+			return err
+		}
+	}
+	m.writeSample(t, pkt.Timestamp, data, keyframe)
+	return nil
+}
+
+// Close removes the track from the output. The muxer ends once its
+// leading track or all of its tracks are closed.
+func (t *Track) Close() error {
+	m := t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if t == m.leader() || ((m.video == nil || m.video.closed) && (m.audio == nil || m.audio.closed)) {
+		m.end()
+	}
+	return nil
+}
+
+// writeSample completes the pending sample now that its duration is known
+// and holds the new one back in its place
+func (m *Muxer) writeSample(t *Track, ts uint32, data []byte, sync bool) {
+	if !m.started {
+		return
+	}
+
+	dts := t.decodeTime(ts)
+	if p := t.pending; p != nil {
+		if dts <= p.DecodeTime {
+			// Reordered or repeated; the sample before it was already sent
+			return
+		}
+		p.Dur = uint32(dts - p.DecodeTime)
+		t.lastDur = p.Dur
+		m.push(t, *p)
+	}
+	m.cutBefore(t, sync)
+
+	flags := mp4.NonSyncSampleFlags
+	if sync {
+		flags = mp4.SyncSampleFlags
+	}
+	t.pending = &mp4.FullSample{
+		Sample:     mp4.NewSample(flags, 0, uint32(len(data)), 0),
+		DecodeTime: dts,
+		Data:       data,
+	}
+}
+
+// flushPending queues the last sample, assuming it lasts as long as the
+// one before it
+func (t *Track) flushPending() {
+	if t.pending == nil {
+		return
+	}
+	t.pending.Dur = t.lastDur
+	t.m.push(t, *t.pending)
+	t.pending = nil
+}
+
+// frame turns the NALUs of a complete frame into a length-prefixed sample.
+// Parameter sets stay in band (the init segment uses avc3) so resolution
+// changes need no new init segment.
+func (t *Track) frame() (data []byte, keyframe bool) {
+	for _, nalu := range t.nalus {
+		switch nalu[0] & 0x1f {
+		case naluTypeAUD:
+			continue
+		case naluTypeSPS:
+			t.sps = nalu
+		case naluTypePPS:
+			t.pps = nalu
+		case naluTypeIDR:
+			keyframe = true
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	t.nalus = nil
+	return data, keyframe && t.pps != nil
+}
+
+// decodeTime converts an RTP timestamp to the track's decode time
+func (t *Track) decodeTime(ts uint32) uint64 {
+	if !t.haveTS {
+		// Tracks are aligned by when their first sample arrived
+		t.haveTS = true
+		t.lastTS = ts
+		if since := time.Since(t.m.startedAt); since > 0 {
+			t.offset = t.ticks(since)
+		}
+		return t.offset
+	}
+
+	t.extTS += int64(int32(ts - t.lastTS))
+	t.lastTS = ts
+	if t.extTS < 0 {
+		return t.offset
+	}
+	return t.offset + uint64(t.extTS)
+}
+
+// askKeyframe requests a keyframe from the publisher, at most once per
+// keyframeRetry
+func (t *Track) askKeyframe() {
+	if t.requestKeyframe == nil || time.Since(t.lastRequest) < keyframeRetry {
+		return
+	}
+	t.lastRequest = time.Now()
+	go t.requestKeyframe()
+}
+
+func (t *Track) ticks(d time.Duration) uint64 {
+	return uint64(d.Seconds() * float64(t.timescale))
+}
+
+func (t *Track) duration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / time.Duration(t.timescale)
+}
+
+// appendNALUs splits the length-prefixed output of the depacketizer
+func appendNALUs(nalus [][]byte, buf []byte) [][]byte {
+	for len(buf) >= 4 {
+		n := int(binary.BigEndian.Uint32(buf))
+		buf = buf[4:]
+		if n == 0 || n > len(buf) {
+			break
+		}
+		nalus = append(nalus, buf[:n])
+		buf = buf[n:]
+	}
+	return nalus
+}
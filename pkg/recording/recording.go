@@ -0,0 +1,216 @@
+// Package recording writes the media forwarded in a room to disk. Each
+// published track goes to its own file in the codec's natural container
+// (Opus to Ogg, VP8/VP9 to IVF, H264 to Annex-B) and a manifest.json next to
+// them describes who published what and when.
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+)
+
+// Dir is the directory new recordings are created under
+var Dir = "recordings"
+
+// ManifestFile is the name of the manifest written in each recording's directory
+const ManifestFile = "manifest.json"
+
+var errStopped = errors.New("recording already stopped")
+
+// Recording is one recording session of a room
+type Recording struct {
+	ID        string
+	RoomID    string
+	StartedAt time.Time
+
+	dir string
+
+	mu      sync.Mutex
+	tracks  []*Track
+	stopped bool
+}
+
+// TrackInfo describes a track when it is added to a recording
+type TrackInfo struct {
+	TrackID  string
+	PeerID   string
+	Username string
+	Kind     string
+	Source   string
+	MimeType string
+}
+
+// Track writes one published track to its file
+type Track struct {
+	info      TrackInfo
+	file      string
+	startedAt time.Time
+
+	mu      sync.Mutex
+	writer  mediaWriter
+	endedAt time.Time
+	packets int
+}
+
+// Manifest is written to manifest.json when a recording stops
+type Manifest struct {
+	ID        string          `json:"id"`
+	RoomID    string          `json:"roomId"`
+	StartedAt time.Time       `json:"startedAt"`
+	StoppedAt time.Time       `json:"stoppedAt"`
+	Duration  float64         `json:"durationSeconds"`
+	Tracks    []ManifestTrack `json:"tracks"`
+}
+
+// ManifestTrack is one recorded track. Offset is when the track started
+// relative to the start of the recording.
+type ManifestTrack struct {
+	File      string    `json:"file"`
+	TrackID   string    `json:"trackId"`
+	PeerID    string    `json:"peerId"`
+	Username  string    `json:"username,omitempty"`
+	Kind      string    `json:"kind"`
+	Source    string    `json:"source,omitempty"`
+	MimeType  string    `json:"mimeType"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Offset    float64   `json:"offsetSeconds"`
+	Packets   int       `json:"packets"`
+}
+
+// Start creates a new recording directory for a room
+func Start(roomID string) (*Recording, error) {
+	r := &Recording{
+		ID:        uuid.New().String(),
+		RoomID:    roomID,
+		StartedAt: time.Now(),
+	}
+	r.dir = filepath.Join(Dir, r.ID)
+
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create recording directory: %w", err)
+	}
+
+	log.Printf("Recording %s started for room %s in %s", r.ID, roomID, r.dir)
+	return r, nil
+}
+
+// AddTrack opens a file for a track. Tracks in a codec that can't be
+// written return an error and are left out of the recording.
+func (r *Recording) AddTrack(info TrackInfo) (*Track, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return nil, errStopped
+	}
+
+	ext, err := fileExtension(info.MimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	file := fmt.Sprintf("track-%d.%s", len(r.tracks)+1, ext)
+	writer, err := newMediaWriter(info.MimeType, filepath.Join(r.dir, file))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Track{
+		info:      info,
+		file:      file,
+		startedAt: time.Now(),
+		writer:    writer,
+	}
+	r.tracks = append(r.tracks, t)
+	return t, nil
+}
+
+// Stop closes every track file and writes the manifest
+func (r *Recording) Stop() (*Manifest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return nil, errStopped
+	}
+	r.stopped = true
+
+	manifest := &Manifest{
+		ID:        r.ID,
+		RoomID:    r.RoomID,
+		StartedAt: r.StartedAt,
+		StoppedAt: time.Now(),
+		Tracks:    make([]ManifestTrack, 0, len(r.tracks)),
+	}
+	manifest.Duration = manifest.StoppedAt.Sub(r.StartedAt).Seconds()
+
+	for _, t := range r.tracks {
+		if err := t.Close(); err != nil {
+			log.Printf("Error closing recording of track %s: %v", t.info.TrackID, err)
+		}
+
+		t.mu.Lock()
+		manifest.Tracks = append(manifest.Tracks, ManifestTrack{
+			File:      t.file,
+			TrackID:   t.info.TrackID,
+			PeerID:    t.info.PeerID,
+			Username:  t.info.Username,
+			Kind:      t.info.Kind,
+			Source:    t.info.Source,
+			MimeType:  t.info.MimeType,
+			StartedAt: t.startedAt,
+			EndedAt:   t.endedAt,
+			Offset:    t.startedAt.Sub(r.StartedAt).Seconds(),
+			Packets:   t.packets,
+		})
+		t.mu.Unlock()
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, ManifestFile), data, 0o644); err != nil {
+		return manifest, fmt.Errorf("write manifest: %w", err)
+	}
+
+	log.Printf("Recording %s stopped after %.1fs with %d tracks", r.ID, manifest.Duration, len(manifest.Tracks))
+	return manifest, nil
+}
+
+// WriteRTP appends a packet to the track's file. Packets after Close are
+// dropped.
+func (t *Track) WriteRTP(pkt *rtp.Packet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.writer == nil {
+		return nil
+	}
+	t.packets++
+	return t.writer.WriteRTP(pkt)
+}
+
+// Close ends the track's file. It is safe to call more than once.
+func (t *Track) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.writer == nil {
+		return nil
+	}
+	err := t.writer.Close()
+	t.writer = nil
+	t.endedAt = time.Now()
+	return err
+}
@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRecordingWritesTracksAndManifest(t *testing.T) {
+	Dir = t.TempDir()
+
+	rec, err := Start("room-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audio, err := rec.AddTrack(TrackInfo{TrackID: "mic", PeerID: "alice", Kind: "audio", MimeType: webrtc.MimeTypeOpus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := rec.AddTrack(TrackInfo{TrackID: "cam", PeerID: "alice", Kind: "video", MimeType: webrtc.MimeTypeVP9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.AddTrack(TrackInfo{TrackID: "x", MimeType: "video/unknown"}); err == nil {
+		t.Fatal("expected an error for an unsupported codec")
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := audio.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: []byte{0xfc, 0xff, 0xfe},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A single-packet VP9 keyframe: B and E set, P clear
+	if err := video.WriteRTP(&rtp.Packet{
+		Header:  rtp.Header{Marker: true, Timestamp: 3000},
+		Payload: []byte{0x0c, 0x82, 0x49, 0x83},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(Dir, rec.ID, ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.RoomID != "room-1" || len(manifest.Tracks) != 2 {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+	if manifest.Tracks[0].Packets != 10 || manifest.Tracks[0].File != "track-1.ogg" {
+		t.Errorf("audio track = %+v", manifest.Tracks[0])
+	}
+
+	ivf, err := os.ReadFile(filepath.Join(Dir, rec.ID, manifest.Tracks[1].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ivf[0:4]) != "DKIF" || string(ivf[8:12]) != "VP90" || ivf[24] != 1 {
+		t.Errorf("unexpected IVF header % x", ivf[:32])
+	}
+}
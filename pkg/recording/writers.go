@@ -0,0 +1,140 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// mediaWriter depacketizes RTP into a container file
+type mediaWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// fileExtension returns the file extension used for a codec
+func fileExtension(mimeType string) (string, error) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return "ogg", nil
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9):
+		return "ivf", nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return "h264", nil
+	default:
+		return "", fmt.Errorf("recording %s is not supported", mimeType)
+	}
+}
+
+func newMediaWriter(mimeType, path string) (mediaWriter, error) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return oggwriter.New(path, 48000, 2)
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return ivfwriter.New(path)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return newVP9Writer(path)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264writer.New(path)
+	default:
+		return nil, fmt.Errorf("recording %s is not supported", mimeType)
+	}
+}
+
+// vp9Writer writes VP9 frames to an IVF file. pion's ivfwriter only
+// handles VP8 and AV1.
+type vp9Writer struct {
+	file  *os.File
+	out   *bufio.Writer
+	frame []byte
+
+	seenKeyframe bool
+	firstTS      uint32
+	frames       uint32
+}
+
+func newVP9Writer(path string) (*vp9Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &vp9Writer{file: file, out: bufio.NewWriter(file)}
+
+	// IVF file header; the frame count is filled in on Close
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)      // version
+	binary.LittleEndian.PutUint16(header[6:], 32)     // header size
+	copy(header[8:], "VP90")                          // fourcc
+	binary.LittleEndian.PutUint16(header[12:], 640)   // width
+	binary.LittleEndian.PutUint16(header[14:], 480)   // height
+	binary.LittleEndian.PutUint32(header[16:], 90000) // timebase denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)     // timebase numerator
+	if _, err := w.out.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *vp9Writer) WriteRTP(pkt *rtp.Packet) error {
+	var vp9 codecs.VP9Packet
+	payload, err := vp9.Unmarshal(pkt.Payload)
+	if err != nil || len(payload) == 0 {
+		return err
+	}
+
+	// Start at a keyframe and only collect frames seen from their start
+	if !w.seenKeyframe {
+		if vp9.P || !vp9.B {
+			return nil
+		}
+		w.seenKeyframe = true
+		w.firstTS = pkt.Timestamp
+	}
+	if vp9.B {
+		w.frame = w.frame[:0]
+	}
+	w.frame = append(w.frame, payload...)
+
+	if !pkt.Marker {
+		return nil
+	}
+
+	frameHeader := make([]byte, 12)
+	binary.LittleEndian.PutUint32(frameHeader[0:], uint32(len(w.frame)))
+	binary.LittleEndian.PutUint64(frameHeader[4:], uint64(pkt.Timestamp-w.firstTS))
+	if _, err := w.out.Write(frameHeader); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(w.frame); err != nil {
+		return err
+	}
+	w.frame = w.frame[:0]
+	w.frames++
+	return nil
+}
+
+func (w *vp9Writer) Close() error {
+	if err := w.out.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frames)
+	if _, err := w.file.WriteAt(count, 24); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
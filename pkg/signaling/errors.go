@@ -0,0 +1,79 @@
+package signaling
+
+// ErrorCode identifies why the server rejected a client message
+type ErrorCode string
+
+const (
+	// CodeMalformedMessage means the frame was not a JSON envelope
+	CodeMalformedMessage ErrorCode = "malformed-message"
+
+	// CodeMalformedPayload means the data field did not match the event's payload type
+	CodeMalformedPayload ErrorCode = "malformed-payload"
+
+	// CodeInvalidPayload means the payload decoded but is missing required fields
+	CodeInvalidPayload ErrorCode = "invalid-payload"
+
+	// CodeMessageTooLarge means a chat message was over the length limit
+	CodeMessageTooLarge ErrorCode = "message-too-large"
+
+	// CodeNotFound means the event refers to something that doesn't exist
+	CodeNotFound ErrorCode = "not-found"
+
+	// CodeUnknownEvent means the server has no handler for the event
+	CodeUnknownEvent ErrorCode = "unknown-event"
+
+	// CodeUnsupportedVersion means the requested protocol version is too old
+	CodeUnsupportedVersion ErrorCode = "unsupported-version"
+
+	// CodeUnauthorized means the room only lets in people with a join token
+	CodeUnauthorized ErrorCode = "unauthorized"
+
+	// CodeForbidden means the sender lacks permission for the event
+	CodeForbidden ErrorCode = "forbidden"
+
+	// CodeNegotiationConflict means the client sent an offer while the
+	// server's own offer was outstanding. The client should roll back and
+	// answer the server's offer, then offer again.
+	CodeNegotiationConflict ErrorCode = "negotiation-conflict"
+
+	// CodeRateLimited means the sender is sending events too quickly
+	CodeRateLimited ErrorCode = "rate-limited"
+
+	// CodeInternal means the server failed while handling a valid message
+	CodeInternal ErrorCode = "internal-error"
+)
+
+// Error is the payload of the error event. It also implements error so
+// handlers can return it directly.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Event   string    `json:"event,omitempty"`
+	Message string    `json:"message"`
+}
+
+// NewError creates an error payload for the given event
+func NewError(code ErrorCode, event, message string) *Error {
+	return &Error{Code: code, Event: event, Message: message}
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Event != "" {
+		return string(e.Code) + " (" + e.Event + "): " + e.Message
+	}
+	return string(e.Code) + ": " + e.Message
+}
+
+// Frame wraps the error in an outgoing error event
+func (e *Error) Frame() Message {
+	return New(EventError, e)
+}
+
+// AsError converts any handler error into an error payload, treating
+// errors that are not already *Error as internal failures
+func AsError(err error) *Error {
+	if sigErr, ok := err.(*Error); ok {
+		return sigErr
+	}
+	return NewError(CodeInternal, "", err.Error())
+}
@@ -0,0 +1,154 @@
+package signaling
+
+// Events sent by clients to the server. Offer, answer and candidate are
+// also relayed back out to the target peer under the same name.
+const (
+	EventPing      = "ping"
+	EventJoin      = "join"
+	EventPasscode  = "passcode"
+	EventOffer     = "offer"
+	EventAnswer    = "answer"
+	EventCandidate = "candidate"
+
+	// Media subscriptions
+	EventSubscribe   = "subscribe"
+	EventUnsubscribe = "unsubscribe"
+	EventSelectLayer = "select-layer"
+
+	// Screen sharing
+	EventRequestScreenShare = "request-screen-share"
+	EventApproveScreenShare = "approve-screen-share"
+	EventDenyScreenShare    = "deny-screen-share"
+	EventRevokeScreenShare  = "revoke-screen-share"
+	EventScreenShareStarted = "screen-share-started"
+	EventScreenShareStopped = "screen-share-stopped"
+
+	// Co-host controls
+	EventAddCoHost    = "add-cohost"
+	EventRemoveCoHost = "remove-cohost"
+	EventTransferHost = "transfer-host"
+
+	// Roles
+	EventSetRole             = "set-role"
+	EventSetRoleCapabilities = "set-role-capabilities"
+
+	// Room security
+	EventLockRoom       = "lock-room"
+	EventUnlockRoom     = "unlock-room"
+	EventSetGuestPolicy = "set-guest-policy"
+	EventSetPasscode    = "set-passcode"
+
+	// Chat controls
+	EventDisableChat        = "disable-chat"
+	EventEnableChat         = "enable-chat"
+	EventDisablePrivateChat = "disable-private-chat"
+	EventEnablePrivateChat  = "enable-private-chat"
+
+	// Chat moderation
+	EventDeleteChatMessage = "delete-chat-message"
+	EventMuteChat          = "mute-chat"
+	EventUnmuteChat        = "unmute-chat"
+	EventSetSlowMode       = "set-slow-mode"
+
+	// Mute controls
+	EventMuteParticipant   = "mute-participant"
+	EventUnmuteParticipant = "unmute-participant"
+	EventMuteAll           = "mute-all"
+	EventUnmuteAll         = "unmute-all"
+
+	// Waiting room
+	EventAdmitParticipant = "admit-participant"
+	EventDenyParticipant  = "deny-participant"
+	EventGetWaitingRoom   = "get-waiting-room"
+	EventSetWaitingRoom   = "set-waiting-room"
+
+	// Recording
+	EventStartRecording = "start-recording"
+	EventStopRecording  = "stop-recording"
+
+	// Participants
+	EventRemoveParticipant = "remove-participant"
+
+	// Raised hands
+	EventRaiseHand     = "raise-hand"
+	EventLowerHand     = "lower-hand"
+	EventClearAllHands = "clear-all-hands"
+
+	// Engagement
+	EventReaction        = "reaction"
+	EventChatMessage     = "chat-message"
+	EventAnnotationDraw  = "annotation-draw"
+	EventAnnotationClear = "annotation-clear"
+)
+
+// Events sent by the server to clients
+const (
+	EventProtocol = "protocol"
+	EventError    = "error"
+
+	EventPeers      = "peers"
+	EventPeerJoined = "peer-joined"
+	EventPeerLeft   = "peer-left"
+
+	// SFU rooms announce which participant owns each forwarded track
+	EventTrackPublished   = "track-published"
+	EventTrackUnpublished = "track-unpublished"
+
+	// SFU rooms follow speakers from the audio levels publishers send
+	EventActiveSpeaker   = "active-speaker"
+	EventSpeakingChanged = "speaking-changed"
+
+	EventScreenShareRequest  = "screen-share-request"
+	EventScreenShareResponse = "screen-share-response"
+	EventScreenShareRevoked  = "screen-share-revoked"
+
+	EventCoHostPromoted = "cohost-promoted"
+	EventCoHostAdded    = "cohost-added"
+	EventCoHostDemoted  = "cohost-demoted"
+	EventCoHostRemoved  = "cohost-removed"
+	EventHostChanged    = "host-changed"
+
+	EventRoleChanged             = "role-changed"
+	EventRoleCapabilitiesChanged = "role-capabilities-changed"
+
+	EventRoomLocked         = "room-locked"
+	EventRoomUnlocked       = "room-unlocked"
+	EventGuestPolicyChanged = "guest-policy-changed"
+	EventPasscodeChanged    = "passcode-changed"
+
+	EventPasscodeRequired = "passcode-required"
+	EventPasscodeInvalid  = "passcode-invalid"
+
+	EventChatDisabled        = "chat-disabled"
+	EventChatEnabled         = "chat-enabled"
+	EventPrivateChatDisabled = "private-chat-disabled"
+	EventPrivateChatEnabled  = "private-chat-enabled"
+
+	EventChatMessageDeleted = "chat-message-deleted"
+	EventChatMuted          = "chat-muted"
+	EventChatUnmuted        = "chat-unmuted"
+	EventSlowModeChanged    = "slow-mode-changed"
+
+	EventMutedByHost   = "muted-by-host"
+	EventUnmutedByHost = "unmuted-by-host"
+	EventAllMuted      = "all-muted"
+	EventAllUnmuted    = "all-unmuted"
+
+	EventInWaitingRoom      = "in-waiting-room"
+	EventAdmittedToRoom     = "admitted-to-room"
+	EventEntryDenied        = "entry-denied"
+	EventWaitingRoomList    = "waiting-room-list"
+	EventWaitingRoomUpdated = "waiting-room-updated"
+	EventWaitingRoomChanged = "waiting-room-changed"
+
+	EventRecordingStarted = "recording-started"
+	EventRecordingStopped = "recording-stopped"
+
+	EventRemovedFromRoom = "removed-from-room"
+
+	EventAllHandsCleared = "all-hands-cleared"
+
+	EventViewerCount = "viewer_count"
+
+	EventRoomEnded = "room-ended"
+)
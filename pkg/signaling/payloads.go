@@ -0,0 +1,402 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ============= CLIENT -> SERVER =============
+
+// JoinRequest is sent once a client knows its display name
+type JoinRequest struct {
+	PeerID   string `json:"peerId,omitempty"` // client-side guess, ignored by the server
+	Username string `json:"username"`
+}
+
+// SessionDescription carries an SDP offer or answer. Clients set
+// TargetPeerID; the server replaces it with the sender's PeerID when relaying.
+type SessionDescription struct {
+	TargetPeerID string `json:"targetPeerId,omitempty"`
+	PeerID       string `json:"peerId,omitempty"`
+	Username     string `json:"username,omitempty"`
+	SDP          string `json:"sdp"`
+}
+
+// Validate implements Validator
+func (s *SessionDescription) Validate() error {
+	if s.SDP == "" {
+		return errors.New("sdp is required")
+	}
+	return nil
+}
+
+// ICECandidate carries a trickled ICE candidate
+type ICECandidate struct {
+	TargetPeerID string    `json:"targetPeerId,omitempty"`
+	PeerID       string    `json:"peerId,omitempty"`
+	Username     string    `json:"username,omitempty"`
+	Candidate    Candidate `json:"candidate"`
+}
+
+// Validate implements Validator
+func (c *ICECandidate) Validate() error {
+	if c.Candidate.Candidate == "" {
+		return errors.New("candidate is required")
+	}
+	return nil
+}
+
+// Candidate is an ICE candidate as produced by RTCIceCandidate.toJSON().
+// Older clients sent it JSON-encoded inside a string, which is still accepted.
+type Candidate webrtc.ICECandidateInit
+
+// UnmarshalJSON accepts both the object and the string-encoded form
+func (c *Candidate) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		b = []byte(s)
+	}
+	return json.Unmarshal(b, (*webrtc.ICECandidateInit)(c))
+}
+
+// Subscription selects which of a peer's tracks the sender receives.
+// Sources is any of "audio", "video" and "screen"; empty means all of them.
+// Leaving out PeerID applies the change to every peer in the room.
+type Subscription struct {
+	PeerID  string   `json:"peerId,omitempty"`
+	Sources []string `json:"sources,omitempty"`
+}
+
+// LayerSelection caps the simulcast layer the sender receives for a track.
+// An empty RID lets the server choose from the available bandwidth again.
+type LayerSelection struct {
+	TrackID string `json:"trackId"`
+	RID     string `json:"rid"`
+}
+
+// Validate implements Validator
+func (l *LayerSelection) Validate() error {
+	if l.TrackID == "" {
+		return errors.New("trackId is required")
+	}
+	return nil
+}
+
+// PeerRef identifies a single participant, either as the target of a host
+// action or as the subject of a notification
+type PeerRef struct {
+	PeerID string `json:"peerId"`
+}
+
+// Validate implements Validator
+func (p *PeerRef) Validate() error {
+	if p.PeerID == "" {
+		return errors.New("peerId is required")
+	}
+	return nil
+}
+
+// ScreenShareRequest asks the host for permission to share
+type ScreenShareRequest struct {
+	PeerName string `json:"peerName,omitempty"`
+}
+
+// Reaction is a floating emoji reaction
+type Reaction struct {
+	PeerID   string `json:"peerId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Emoji    string `json:"emoji"`
+}
+
+// Validate implements Validator
+func (r *Reaction) Validate() error {
+	if r.Emoji == "" {
+		return errors.New("emoji is required")
+	}
+	return nil
+}
+
+// ChatMessage is a chat line sent over the signaling websocket
+type ChatMessage struct {
+	ID        string          `json:"id,omitempty"`
+	PeerID    string          `json:"peerId,omitempty"`
+	Username  string          `json:"username,omitempty"`
+	Message   string          `json:"message"`
+	Timestamp json.RawMessage `json:"timestamp,omitempty"`
+	Type      string          `json:"type,omitempty"`
+
+	// TargetPeerID makes the message private to one peer
+	TargetPeerID string `json:"targetPeerId,omitempty"`
+}
+
+// Validate implements Validator
+func (m *ChatMessage) Validate() error {
+	if m.Message == "" {
+		return errors.New("message is required")
+	}
+	return nil
+}
+
+// ChatMessageRef identifies a chat message, as the target of a moderator
+// action or in the notice that follows it. PeerID is the moderator.
+type ChatMessageRef struct {
+	MessageID string `json:"messageId"`
+	PeerID    string `json:"peerId,omitempty"`
+}
+
+// Validate implements Validator
+func (m *ChatMessageRef) Validate() error {
+	if m.MessageID == "" {
+		return errors.New("messageId is required")
+	}
+	return nil
+}
+
+// MaxSlowMode is the longest slow mode interval a host can set
+const MaxSlowMode = 3600
+
+// SlowMode sets or announces the chat slow mode interval. Zero turns it off.
+type SlowMode struct {
+	Seconds int `json:"seconds"`
+}
+
+// Validate implements Validator
+func (s *SlowMode) Validate() error {
+	if s.Seconds < 0 || s.Seconds > MaxSlowMode {
+		return fmt.Errorf("seconds must be between 0 and %d", MaxSlowMode)
+	}
+	return nil
+}
+
+// GuestPolicy sets or announces what happens to people joining without a
+// join token: allow, waiting-room or reject
+type GuestPolicy struct {
+	Policy string `json:"policy"`
+}
+
+// Validate implements Validator
+func (g *GuestPolicy) Validate() error {
+	if g.Policy == "" {
+		return errors.New("policy is required")
+	}
+	return nil
+}
+
+// Passcode is entered by a joiner, or set by a host. An empty passcode set
+// by a host removes it.
+type Passcode struct {
+	Passcode string `json:"passcode"`
+}
+
+// PasscodeRequired asks a joiner for the room's passcode
+type PasscodeRequired struct {
+	AttemptsLeft int `json:"attemptsLeft"`
+}
+
+// PasscodeInvalid rejects a wrong passcode. Once no attempts are left the
+// client is locked out for RetryAfter seconds and disconnected.
+type PasscodeInvalid struct {
+	AttemptsLeft int    `json:"attemptsLeft"`
+	RetryAfter   int    `json:"retryAfter,omitempty"`
+	Message      string `json:"message"`
+}
+
+// PasscodeChanged tells the room whether joiners need a passcode
+type PasscodeChanged struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Point is a normalized position on the shared screen
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Annotation is a single stroke drawn over a shared screen
+type Annotation struct {
+	PeerID    string  `json:"peerId,omitempty"`
+	Type      string  `json:"type"`
+	Points    []Point `json:"points"`
+	Color     string  `json:"color,omitempty"`
+	Size      float64 `json:"size,omitempty"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+}
+
+// Validate implements Validator
+func (a *Annotation) Validate() error {
+	if a.Type == "" {
+		return errors.New("type is required")
+	}
+	return nil
+}
+
+// ============= SERVER -> CLIENT =============
+
+// Protocol confirms the version negotiated from the client's first message
+type Protocol struct {
+	Version    int `json:"version"`
+	MinVersion int `json:"minVersion"`
+	MaxVersion int `json:"maxVersion"`
+}
+
+// PeerInfo describes a participant in the room
+type PeerInfo struct {
+	PeerID   string `json:"peerId"`
+	Username string `json:"username"`
+}
+
+// TrackInfo ties a forwarded track to the participant that publishes it.
+// StreamID matches the MediaStream id subscribers see in ontrack.
+type TrackInfo struct {
+	PeerID   string `json:"peerId"`
+	TrackID  string `json:"trackId"`
+	StreamID string `json:"streamId"`
+	Kind     string `json:"kind"`
+	Source   string `json:"source"`
+}
+
+// Peers is sent to a new connection with the current room state. In SFU
+// rooms the client should wait for the server's offer instead of dialing
+// each peer, and Tracks lists what is already being published.
+type Peers struct {
+	Peers      []PeerInfo  `json:"peers"`
+	YourID     string      `json:"yourId"`
+	IsHost     bool        `json:"isHost"`
+	Role       string      `json:"role"`
+	HostID     string      `json:"hostId"`
+	RoomLocked bool        `json:"roomLocked"`
+	Mode       string      `json:"mode"`
+	Tracks     []TrackInfo `json:"tracks,omitempty"`
+
+	// Capabilities are what the joiner's role lets them do
+	Capabilities []string `json:"capabilities"`
+
+	// ActiveSpeaker is the current dominant speaker in SFU rooms
+	ActiveSpeaker string `json:"activeSpeaker,omitempty"`
+
+	// ChatToken identifies the joiner on the room's chat websocket
+	ChatToken string `json:"chatToken,omitempty"`
+}
+
+// SpeakingChanged is broadcast when a participant starts or stops speaking
+type SpeakingChanged struct {
+	PeerID   string `json:"peerId"`
+	Speaking bool   `json:"speaking"`
+}
+
+// Notice is a human-readable notification attached to state changes
+type Notice struct {
+	Message string `json:"message,omitempty"`
+}
+
+// ScreenShareRequested is forwarded to the host when a peer asks to share
+type ScreenShareRequested struct {
+	PeerID   string `json:"peerId"`
+	PeerName string `json:"peerName,omitempty"`
+}
+
+// ScreenShareResponse tells a peer whether it may share its screen
+type ScreenShareResponse struct {
+	Approved bool `json:"approved"`
+}
+
+// WaitingParticipant is a lobby entry as shown to hosts
+type WaitingParticipant struct {
+	PeerID   string    `json:"peerId"`
+	Name     string    `json:"name"`
+	JoinTime time.Time `json:"joinTime"`
+}
+
+// WaitingRoomList is the reply to get-waiting-room, and is sent to hosts
+// as waiting-room-updated whenever the waiting room changes
+type WaitingRoomList struct {
+	Participants []WaitingParticipant `json:"participants"`
+}
+
+// WaitingRoom turns the waiting room on or off, or announces that it was
+type WaitingRoom struct {
+	Enabled bool `json:"enabled"`
+}
+
+// DenyEntry turns someone away from the waiting room, optionally telling
+// them why
+type DenyEntry struct {
+	PeerID string `json:"peerId"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RecordingStopped reports which recording finished and how long it ran
+type RecordingStopped struct {
+	RecordingID string `json:"recordingId,omitempty"`
+	Duration    string `json:"duration"`
+}
+
+// HandRaised is broadcast when a participant raises their hand
+type HandRaised struct {
+	PeerID    string `json:"peerId"`
+	Username  string `json:"username"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// ViewerCount is pushed periodically on the viewer websockets. State is
+// set for streams: created, live or ended.
+type ViewerCount struct {
+	Count int    `json:"count"`
+	State string `json:"state,omitempty"`
+}
+
+// Reasons hosting changes hands
+const (
+	HostChangedTransferred = "transferred"
+	HostChangedLeft        = "left"
+	HostChangedReclaimed   = "reclaimed"
+	HostChangedJoined      = "joined"
+)
+
+// HostChanged tells the room who hosts it now. HostID is empty when the
+// host left and nobody took over.
+type HostChanged struct {
+	HostID         string `json:"hostId"`
+	PreviousHostID string `json:"previousHostId,omitempty"`
+	Reason         string `json:"reason"`
+}
+
+// RoleChange asks for a participant to be given another role
+type RoleChange struct {
+	PeerID string `json:"peerId"`
+	Role   string `json:"role"`
+}
+
+// RoleChanged tells the room a participant's role changed, and what they
+// can do now
+type RoleChanged struct {
+	PeerID       string   `json:"peerId"`
+	Role         string   `json:"role"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// RoleCapabilities sets, or tells the room, what a role can do
+type RoleCapabilities struct {
+	Role         string   `json:"role"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Reasons a room ends
+const (
+	RoomEndedIdle    = "idle"
+	RoomEndedDeleted = "deleted"
+)
+
+// RoomEnded is sent to everyone still connected when a room or stream is
+// closed
+type RoomEnded struct {
+	RoomID string `json:"roomId"`
+	Reason string `json:"reason"`
+}
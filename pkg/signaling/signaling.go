@@ -0,0 +1,121 @@
+// Package signaling defines the typed JSON protocol spoken over the room and
+// stream websockets. Every frame is an Envelope carrying an event name and an
+// event-specific payload; the payload types in this package are the contract
+// shared by the server, the browser frontends and any bots.
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ProtocolVersion is the newest protocol version spoken by this server
+	ProtocolVersion = 1
+
+	// MinProtocolVersion is the oldest protocol version still accepted
+	MinProtocolVersion = 1
+)
+
+// ErrUnsupportedVersion is returned when a client asks for a protocol
+// version this server cannot speak
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// Envelope is a single websocket frame as received from a client
+type Envelope struct {
+	Event   string          `json:"event"`
+	Version int             `json:"version,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Message is a single websocket frame as sent by the server
+type Message struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// Validator is implemented by payloads that check their own required fields
+type Validator interface {
+	Validate() error
+}
+
+// New builds an outgoing message. A nil payload is sent as an empty object
+// so clients can always index into data.
+func New(event string, data interface{}) Message {
+	if data == nil {
+		data = struct{}{}
+	}
+	return Message{Event: event, Data: data}
+}
+
+// Decode parses a raw frame into an envelope
+func Decode(raw []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, NewError(CodeMalformedMessage, "", "message is not valid JSON")
+	}
+	if env.Event == "" {
+		return nil, NewError(CodeMalformedMessage, "", "message has no event")
+	}
+	return &env, nil
+}
+
+// Bind decodes the envelope payload into v and validates it. The returned
+// error is always an *Error tagged with the envelope's event.
+func (e *Envelope) Bind(v interface{}) error {
+	if len(e.Data) > 0 && string(e.Data) != "null" {
+		if err := json.Unmarshal(e.Data, v); err != nil {
+			return NewError(CodeMalformedPayload, e.Event, fmt.Sprintf("invalid %s payload: %v", e.Event, err))
+		}
+	}
+
+	if val, ok := v.(Validator); ok {
+		if err := val.Validate(); err != nil {
+			return NewError(CodeInvalidPayload, e.Event, err.Error())
+		}
+	}
+	return nil
+}
+
+// Target returns the targetPeerId of a message addressed to a single peer,
+// or "" for messages meant for the server
+func (e *Envelope) Target() string {
+	var t struct {
+		TargetPeerID string `json:"targetPeerId"`
+	}
+	if len(e.Data) == 0 || json.Unmarshal(e.Data, &t) != nil {
+		return ""
+	}
+	return t.TargetPeerID
+}
+
+// Relay rewrites a directed message for delivery to its target: the
+// targetPeerId is dropped and peerId is set to the sender so it cannot be
+// spoofed. All other payload fields are passed through untouched.
+func (e *Envelope) Relay(from string) (Message, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(e.Data, &fields); err != nil {
+		return Message{}, NewError(CodeMalformedPayload, e.Event, "relayed payload must be an object")
+	}
+	delete(fields, "targetPeerId")
+	sender, _ := json.Marshal(from)
+	fields["peerId"] = sender
+	return New(e.Event, fields), nil
+}
+
+// Negotiate picks the protocol version to use for a client that asked for
+// requested. Clients that predate versioning send no version and get the
+// oldest supported one; clients newer than the server are downgraded.
+func Negotiate(requested int) (int, error) {
+	switch {
+	case requested == 0:
+		return MinProtocolVersion, nil
+	case requested < MinProtocolVersion:
+		return 0, ErrUnsupportedVersion
+	case requested > ProtocolVersion:
+		return ProtocolVersion, nil
+	default:
+		return requested, nil
+	}
+}
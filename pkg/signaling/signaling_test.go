@@ -0,0 +1,90 @@
+package signaling
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeRejectsMalformedFrames(t *testing.T) {
+	for _, raw := range []string{`not json`, `{"data":{}}`} {
+		_, err := Decode([]byte(raw))
+		sigErr, ok := err.(*Error)
+		if !ok || sigErr.Code != CodeMalformedMessage {
+			t.Errorf("Decode(%q) = %v, want %s", raw, err, CodeMalformedMessage)
+		}
+	}
+}
+
+func TestBindValidatesPayload(t *testing.T) {
+	env, err := Decode([]byte(`{"event":"mute-participant","data":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var target PeerRef
+	err = env.Bind(&target)
+	sigErr, ok := err.(*Error)
+	if !ok || sigErr.Code != CodeInvalidPayload || sigErr.Event != EventMuteParticipant {
+		t.Fatalf("Bind = %v, want invalid-payload for mute-participant", err)
+	}
+
+	env, _ = Decode([]byte(`{"event":"mute-participant","data":{"peerId":42}}`))
+	if err := env.Bind(&target); err.(*Error).Code != CodeMalformedPayload {
+		t.Fatalf("Bind = %v, want malformed-payload", err)
+	}
+}
+
+func TestCandidateAcceptsStringForm(t *testing.T) {
+	inner := `{"candidate":"candidate:1 1 udp 1 127.0.0.1 5000 typ host","sdpMid":"0"}`
+	quoted, _ := json.Marshal(inner)
+
+	for _, data := range []string{inner, string(quoted)} {
+		env, _ := Decode([]byte(`{"event":"candidate","data":{"candidate":` + data + `}}`))
+		var c ICECandidate
+		if err := env.Bind(&c); err != nil {
+			t.Fatalf("Bind(%s) = %v", data, err)
+		}
+		if c.Candidate.SDPMid == nil || *c.Candidate.SDPMid != "0" {
+			t.Errorf("Bind(%s) lost sdpMid", data)
+		}
+	}
+}
+
+func TestRelayStampsSender(t *testing.T) {
+	env, _ := Decode([]byte(`{"event":"kicked","data":{"targetPeerId":"b","peerId":"spoofed","reason":"bye"}}`))
+	if got := env.Target(); got != "b" {
+		t.Fatalf("Target = %q, want b", got)
+	}
+
+	msg, err := env.Relay("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(msg)
+	var decoded struct {
+		Data map[string]string `json:"data"`
+	}
+	json.Unmarshal(out, &decoded)
+	if decoded.Data["peerId"] != "a" || decoded.Data["reason"] != "bye" || decoded.Data["targetPeerId"] != "" {
+		t.Errorf("Relay produced %s", out)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		requested int
+		want      int
+		wantErr   bool
+	}{
+		{0, MinProtocolVersion, false},
+		{ProtocolVersion, ProtocolVersion, false},
+		{ProtocolVersion + 5, ProtocolVersion, false},
+		{-1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Negotiate(tt.requested)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Negotiate(%d) = %d, %v", tt.requested, got, err)
+		}
+	}
+}
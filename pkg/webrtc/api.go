@@ -0,0 +1,127 @@
+package webrtc
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// sdesRepairRTPStreamIDURI identifies the RTX stream of a simulcast layer
+const sdesRepairRTPStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+
+// Bandwidth estimator bounds for outgoing media, in bits per second
+const (
+	initialBitrate = 1_000_000
+	minBitrate     = 100_000
+	maxBitrate     = 10_000_000
+)
+
+var (
+	api     *webrtc.API
+	apiErr  error
+	apiOnce sync.Once
+
+	// newPeerLock serialises connection creation so each connection picks
+	// up the estimator created for it
+	newPeerLock sync.Mutex
+	estimators  = make(chan cc.BandwidthEstimator, 1)
+
+	// pendingEstimators holds estimators until AddPeerConnectionWithID
+	// attaches them to the connection's state
+	pendingEstimators sync.Map // *webrtc.PeerConnection -> cc.BandwidthEstimator
+)
+
+// NewPeerConnection creates a peer connection that can receive simulcast and
+// estimates the bandwidth towards the remote side
+func NewPeerConnection() (*webrtc.PeerConnection, error) {
+	apiOnce.Do(func() {
+		api, apiErr = newAPI()
+	})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	newPeerLock.Lock()
+	defer newPeerLock.Unlock()
+
+	pc, err := api.NewPeerConnection(RoomConfig)
+	if err != nil {
+		// Don't leave a failed connection's estimator for the next one
+		select {
+		case <-estimators:
+		default:
+		}
+		return nil, err
+	}
+	pendingEstimators.Store(pc, <-estimators)
+	return pc, nil
+}
+
+func newAPI() (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	// Simulcast layers are told apart by their RTP stream ID
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdesRepairRTPStreamIDURI} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	// Publishers report their microphone level for active speaker detection
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	// Send-side bandwidth estimation drives simulcast layer selection.
+	// Forwarded packets are never delayed, so the pacer is a no-op.
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrate),
+			gcc.SendSideBWEMinBitrate(minBitrate),
+			gcc.SendSideBWEMaxBitrate(maxBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		estimators <- estimator
+	})
+	i.Add(congestionController)
+
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
+
+// DiscardEstimator drops the bandwidth estimator created with pc when the
+// connection is given up on before it is added to a room. It does nothing
+// once the connection was added, so it can be deferred right after
+// NewPeerConnection.
+func DiscardEstimator(pc *webrtc.PeerConnection) {
+	pendingEstimators.Delete(pc)
+}
+
+// takeEstimator returns the bandwidth estimator created with pc, if any
+func takeEstimator(pc *webrtc.PeerConnection) cc.BandwidthEstimator {
+	estimator, ok := pendingEstimators.LoadAndDelete(pc)
+	if !ok {
+		return nil
+	}
+	return estimator.(cc.BandwidthEstimator)
+}
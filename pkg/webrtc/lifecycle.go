@@ -0,0 +1,218 @@
+package webrtc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"videochat/pkg/signaling"
+)
+
+var (
+	// RoomIdleTimeout is how long a room or stream may stay empty before
+	// it is closed and dropped from memory. Its stored record and chat
+	// history are kept for RecordRetention, so a visitor in that time
+	// brings it back. Zero disables reaping.
+	RoomIdleTimeout = 5 * time.Minute
+
+	// RecordRetention is how long a reaped room or stream is kept in the
+	// Store before it is deleted with its chat history, publish key and
+	// settings. Zero deletes it as soon as it is reaped.
+	RecordRetention = 7 * 24 * time.Hour
+)
+
+// Rooms and streams reaped since the process started
+var reapedRooms, reapedStreams atomic.Uint64
+
+// RoomStats counts the rooms and streams held in memory and those reaped
+// for being idle
+type RoomStats struct {
+	LiveRooms     int    `json:"liveRooms"`
+	LiveStreams   int    `json:"liveStreams"`
+	ReapedRooms   uint64 `json:"reapedRooms"`
+	ReapedStreams uint64 `json:"reapedStreams"`
+}
+
+// GetRoomStats returns the current room and stream counts
+func GetRoomStats() RoomStats {
+	return RoomStats{
+		LiveRooms:     GetRoomCount(),
+		LiveStreams:   GetStreamCount(),
+		ReapedRooms:   reapedRooms.Load(),
+		ReapedStreams: reapedStreams.Load(),
+	}
+}
+
+// StartRoomReaper periodically closes idle rooms and streams until ctx is
+// cancelled
+func StartRoomReaper(ctx context.Context) {
+	if RoomIdleTimeout <= 0 {
+		return
+	}
+	interval := min(max(RoomIdleTimeout/4, time.Second), 30*time.Second)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				ReapIdleRooms(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// ReapIdleRooms closes every room and stream that has been empty for
+// RoomIdleTimeout as of now, and returns how many it closed. A room's idle
+// time starts the first time it is seen empty. Rooms and streams reaped for
+// RecordRetention are deleted.
+func ReapIdleRooms(now time.Time) int {
+	reaped := reapIdle(Rooms, &RoomsLock, &reapedRooms, now) +
+		reapIdle(Streams, &StreamsLock, &reapedStreams, now)
+	expireRecords(KindRoom, func(uuid string) { deleteRoom(uuid, false) }, now)
+	expireRecords(KindStream, DeleteStream, now)
+	return reaped
+}
+
+func reapIdle(rooms map[string]*Room, lock *sync.RWMutex, reaped *atomic.Uint64, now time.Time) int {
+	// Idle rooms leave the registry before they close, so a new visitor
+	// gets a fresh room rather than one being torn down
+	lock.Lock()
+	var idle []*Room
+	for uuid, room := range rooms {
+		if room.idle(now) {
+			delete(rooms, uuid)
+			idle = append(idle, room)
+		}
+	}
+	lock.Unlock()
+
+	for _, room := range idle {
+		room.Close(signaling.RoomEndedIdle)
+		if room.Files != nil {
+			room.Files.Release(now)
+		}
+		room.retire(now)
+	}
+	reaped.Add(uint64(len(idle)))
+	return len(idle)
+}
+
+// retire marks the stored record of a reaped room with when it was reaped,
+// or deletes it straight away without a RecordRetention
+func (r *Room) retire(now time.Time) {
+	if RecordRetention <= 0 {
+		deleteStored(r.kind, r.ID)
+		return
+	}
+	r.PermLock.RLock()
+	record := r.record()
+	r.PermLock.RUnlock()
+	record.ReapedAt = now
+	if err := Store.Put(record); err != nil {
+		log.Printf("Error saving %s %s: %v", r.kind, r.ID, err)
+	}
+}
+
+// expireRecords deletes the rooms or streams of a kind that were reaped
+// RecordRetention ago or longer
+func expireRecords(kind RoomKind, remove func(uuid string), now time.Time) {
+	records, err := Store.List(kind)
+	if err != nil {
+		log.Printf("Error listing stored %ss: %v", kind, err)
+		return
+	}
+	for _, record := range records {
+		if !record.ReapedAt.IsZero() && now.Sub(record.ReapedAt) >= RecordRetention {
+			remove(record.ID)
+		}
+	}
+}
+
+// idle reports whether the room has been empty for RoomIdleTimeout.
+// Callers hold the registry lock.
+func (r *Room) idle(now time.Time) bool {
+	if !r.isEmpty() {
+		r.emptySince = time.Time{}
+		return false
+	}
+	if r.emptySince.IsZero() {
+		r.emptySince = now
+	}
+	return now.Sub(r.emptySince) >= RoomIdleTimeout
+}
+
+// isEmpty reports whether nobody is connected: no peers, chat clients,
+// viewer websockets, joiners entering the passcode or participants in the
+// waiting room
+func (r *Room) isEmpty() bool {
+	if r.Peers.GetConnectionCount() > 0 || r.Hub.GetClientCount() > 0 || r.viewers.Load() > 0 || r.joining.Load() > 0 {
+		return false
+	}
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return len(r.WaitingRoom) == 0
+}
+
+// Watch counts a viewer websocket as someone in the room until the
+// returned function is called
+func (r *Room) Watch() (release func()) {
+	r.viewers.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { r.viewers.Add(-1) })
+	}
+}
+
+// Joining counts a connection that hasn't joined yet, such as one entering
+// the room's passcode, as someone in the room until the returned function
+// is called
+func (r *Room) Joining() (release func()) {
+	r.joining.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { r.joining.Add(-1) })
+	}
+}
+
+// Close ends the room: connected peers are sent room-ended, recording
+// stops, and the chat hub, speaker detector and anything waiting on Done
+// shut down. Callers remove the room from the registry first.
+func (r *Room) Close(reason string) {
+	r.PermLock.Lock()
+	if r.endReason != "" {
+		r.PermLock.Unlock()
+		return
+	}
+	r.endReason = reason
+	r.PermLock.Unlock()
+
+	r.Peers.BroadcastMessage(signaling.New(signaling.EventRoomEnded, signaling.RoomEnded{
+		RoomID: r.ID,
+		Reason: reason,
+	}))
+	r.StopRecording()
+	if r.Peers.Speakers != nil {
+		r.Peers.Speakers.Stop()
+	}
+	r.cancel()
+	log.Printf("Closed %s %s (%s)", r.kind, r.ID, reason)
+}
+
+// Done is closed once the room has been closed
+func (r *Room) Done() <-chan struct{} {
+	return r.ctx.Done()
+}
+
+// EndReason says why a closed room ended
+func (r *Room) EndReason() string {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return r.endReason
+}
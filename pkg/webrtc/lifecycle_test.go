@@ -0,0 +1,139 @@
+package webrtc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"videochat/pkg/files"
+	"videochat/pkg/signaling"
+
+	"github.com/google/uuid"
+)
+
+func TestReapIdleRooms(t *testing.T) {
+	saved := Store
+	Store = NewMemoryStore()
+	defer func() { Store = saved }()
+
+	room := CreateRoom("reap-idle")
+	watched := CreateRoom("reap-watched")
+	release := watched.Watch()
+	before := GetRoomStats()
+
+	now := time.Now()
+	if n := ReapIdleRooms(now); n != 0 {
+		t.Fatalf("reaped %d rooms as soon as they were empty", n)
+	}
+	ReapIdleRooms(now.Add(RoomIdleTimeout))
+
+	select {
+	case <-room.Done():
+	default:
+		t.Fatal("idle room was not closed")
+	}
+	if reason := room.EndReason(); reason != signaling.RoomEndedIdle {
+		t.Errorf("EndReason = %q", reason)
+	}
+	if _, exists := Rooms["reap-idle"]; exists {
+		t.Error("idle room is still registered")
+	}
+	if stats := GetRoomStats(); stats.ReapedRooms != before.ReapedRooms+1 {
+		t.Errorf("ReapedRooms = %d, want %d", stats.ReapedRooms, before.ReapedRooms+1)
+	}
+
+	select {
+	case <-watched.Done():
+		t.Fatal("room with a viewer was closed")
+	default:
+	}
+
+	// The stored record brings the room back for the next visitor
+	restored, exists := GetRoom("reap-idle")
+	if !exists || restored == room {
+		t.Fatalf("GetRoom after reaping = %v, %v", restored, exists)
+	}
+	defer restored.Watch()()
+
+	release()
+	ReapIdleRooms(now.Add(2 * RoomIdleTimeout))
+	ReapIdleRooms(now.Add(3 * RoomIdleTimeout))
+	select {
+	case <-watched.Done():
+	default:
+		t.Fatal("room was not closed after its viewer left")
+	}
+
+	// Reaped rooms are kept for RecordRetention, then deleted
+	if record, _, _ := Store.Get(KindRoom, "reap-watched"); !record.ReapedAt.Equal(now.Add(3 * RoomIdleTimeout)) {
+		t.Errorf("reaped room's record ReapedAt = %v", record.ReapedAt)
+	}
+	ReapIdleRooms(now.Add(3*RoomIdleTimeout + RecordRetention))
+	if _, found, _ := Store.Get(KindRoom, "reap-watched"); found {
+		t.Error("record kept past RecordRetention")
+	}
+	if _, found, _ := Store.Get(KindRoom, "reap-idle"); !found {
+		t.Error("live room's record deleted")
+	}
+
+	DeleteRoom("reap-idle")
+	DeleteRoom("reap-watched")
+}
+
+func TestReaperWaitsForJoiners(t *testing.T) {
+	saved := Store
+	Store = NewMemoryStore()
+	defer func() { Store = saved }()
+
+	room := CreateRoom("reap-joining")
+	defer DeleteRoom("reap-joining")
+	release := room.Joining()
+
+	now := time.Now()
+	ReapIdleRooms(now)
+	ReapIdleRooms(now.Add(RoomIdleTimeout))
+	select {
+	case <-room.Done():
+		t.Fatal("room closed while someone was entering its passcode")
+	default:
+	}
+
+	release()
+	ReapIdleRooms(now.Add(2 * RoomIdleTimeout))
+	ReapIdleRooms(now.Add(3 * RoomIdleTimeout))
+	select {
+	case <-room.Done():
+	default:
+		t.Fatal("room was not closed after the joiner gave up")
+	}
+}
+
+func TestExpiredRecordsLeaveFilesToRetention(t *testing.T) {
+	saved, savedDir, savedRetention := Store, files.Dir, files.Retention
+	Store = NewMemoryStore()
+	files.Dir, files.Retention = t.TempDir(), 30*24*time.Hour
+	defer func() { Store, files.Dir, files.Retention = saved, savedDir, savedRetention }()
+
+	id := uuid.NewString()
+	room := CreateRoom(id)
+	if _, err := room.Files.Save("notes.txt", strings.NewReader("hello"), "alice", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	ReapIdleRooms(now)
+	ReapIdleRooms(now.Add(RoomIdleTimeout))
+	ReapIdleRooms(now.Add(RoomIdleTimeout + RecordRetention))
+	if _, found, _ := Store.Get(KindRoom, id); found {
+		t.Fatal("record kept past RecordRetention")
+	}
+	if shared, _ := files.NewStore(id).List(); len(shared) != 1 {
+		t.Errorf("%d shared files left before files.Retention, want 1", len(shared))
+	}
+
+	// Deleting the room outright takes its files too
+	DeleteRoom(id)
+	if shared, _ := files.NewStore(id).List(); len(shared) != 0 {
+		t.Errorf("%d shared files left after deleting the room", len(shared))
+	}
+}
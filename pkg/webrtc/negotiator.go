@@ -0,0 +1,319 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"videochat/pkg/signaling"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v3"
+)
+
+// audioBitrate is the bandwidth set aside for each forwarded audio track
+// before the rest is shared between video tracks
+const audioBitrate = 64_000
+
+// negotiator owns server-initiated renegotiation for one SFU connection.
+//
+// Sync requests are queued rather than acted on immediately: any number of
+// track changes that arrive while a sync is running, or while an offer is
+// waiting for its answer, collapse into a single follow-up sync. A sync only
+// sends an offer when the connection's sender set actually changed.
+//
+// The server is the impolite side of glare: a client offer that arrives
+// while a server offer is outstanding is rejected, and the client is
+// expected to roll back and answer the server's offer first.
+type negotiator struct {
+	peers  *Peers
+	peerID string
+	pc     *webrtc.PeerConnection
+	ws     *ThreadSafeWriter
+
+	// sendOnly makes new transceivers send-only, for viewers that must not
+	// publish
+	sendOnly bool
+
+	// opLock serialises every change to the connection's signaling state
+	opLock sync.Mutex
+
+	mu      sync.Mutex
+	pending bool // a sync has been requested
+	force   bool // the next sync must offer even if no sender changed
+	running bool // a goroutine is draining requests
+}
+
+func newNegotiator(peers *Peers, peerID string, pc *webrtc.PeerConnection, ws *ThreadSafeWriter, estimator cc.BandwidthEstimator) *negotiator {
+	n := &negotiator{
+		peers:  peers,
+		peerID: peerID,
+		pc:     pc,
+		ws:     ws,
+	}
+	if peers.SFU && estimator != nil {
+		go n.allocateBandwidth(estimator)
+	}
+	return n
+}
+
+// request queues a sync. force makes the sync send an offer even when the
+// sender set is unchanged, e.g. for a connection's first negotiation.
+func (n *negotiator) request(force bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.pending = true
+	n.force = n.force || force
+	if !n.running {
+		n.running = true
+		go n.run()
+	}
+}
+
+func (n *negotiator) run() {
+	for {
+		n.opLock.Lock()
+		n.mu.Lock()
+		if !n.pending ||
+			n.pc.ConnectionState() == webrtc.PeerConnectionStateClosed ||
+			n.pc.SignalingState() != webrtc.SignalingStateStable {
+			// Nothing queued, or an offer is waiting for its answer; the
+			// answer requests another sync
+			n.running = false
+			n.mu.Unlock()
+			n.opLock.Unlock()
+			return
+		}
+		force := n.force
+		n.pending, n.force = false, false
+		n.mu.Unlock()
+
+		err := n.sync(force)
+		n.opLock.Unlock()
+
+		if err != nil {
+			log.Printf("Renegotiation with peer %s failed: %v", n.peerID, err)
+		}
+	}
+}
+
+// sync brings the connection's senders in line with the tracks the peer
+// should receive and offers the result if anything changed
+func (n *negotiator) sync(force bool) error {
+	desired := n.peers.tracksFor(n.peerID)
+
+	// Connections signaled over HTTP have no channel for further offers, so
+	// the senders they were answered with are pointed at the tracks instead
+	if n.ws.Conn == nil {
+		return n.replaceTracks(desired)
+	}
+
+	changed := false
+
+	current := make(map[string]bool)
+	for _, sender := range n.pc.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+
+		// Stop sending tracks that no longer exist in TrackLocals
+		if _, ok := desired[track.ID()]; !ok {
+			if err := n.pc.RemoveTrack(sender); err != nil {
+				return fmt.Errorf("remove track %s: %w", track.ID(), err)
+			}
+			changed = true
+			continue
+		}
+		current[track.ID()] = true
+	}
+
+	for trackID, track := range desired {
+		if current[trackID] {
+			continue
+		}
+		sender, err := n.addSender(track)
+		if err != nil {
+			return fmt.Errorf("add track %s: %w", trackID, err)
+		}
+		go forwardRTCP(sender)
+		changed = true
+	}
+
+	if !changed && !force {
+		return nil
+	}
+
+	offer, err := n.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := n.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	return n.ws.WriteJSON(signaling.New(signaling.EventOffer, signaling.SessionDescription{
+		SDP: offer.SDP,
+	}))
+}
+
+// addSender starts sending a track on the connection
+func (n *negotiator) addSender(track *PublishedTrack) (*webrtc.RTPSender, error) {
+	if !n.sendOnly {
+		return n.pc.AddTrack(track)
+	}
+	transceiver, err := n.pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transceiver.Sender(), nil
+}
+
+// replaceTracks points each of the connection's senders at the desired
+// track of its kind, or at nothing when there is none. Senders whose track
+// is unchanged keep sending uninterrupted.
+func (n *negotiator) replaceTracks(desired map[string]*PublishedTrack) error {
+	replaced := false
+	for _, transceiver := range n.pc.GetTransceivers() {
+		sender := transceiver.Sender()
+		if sender == nil {
+			continue
+		}
+		track := pickTrack(desired, transceiver.Kind())
+		if current, _ := sender.Track().(*PublishedTrack); current == track {
+			continue
+		}
+
+		var local webrtc.TrackLocal
+		if track != nil {
+			local = track
+		}
+		if err := sender.ReplaceTrack(local); err != nil {
+			return fmt.Errorf("replace %s track: %w", transceiver.Kind(), err)
+		}
+		replaced = replaced || track != nil
+	}
+
+	// The new tracks can only be decoded from their next keyframe
+	if replaced {
+		n.peers.DispatchKeyFrame()
+	}
+	return nil
+}
+
+// pickTrack chooses the track of a kind a connection with a single sender
+// for it receives, preferring the camera over a screen share and breaking
+// ties by ID so the choice is stable
+func pickTrack(tracks map[string]*PublishedTrack, kind webrtc.RTPCodecType) *PublishedTrack {
+	var picked *PublishedTrack
+	for _, track := range tracks {
+		if track.Kind() != kind {
+			continue
+		}
+		switch {
+		case picked == nil,
+			picked.Source() == SourceScreen && track.Source() != SourceScreen,
+			(picked.Source() == SourceScreen) == (track.Source() == SourceScreen) && track.ID() < picked.ID():
+			picked = track
+		}
+	}
+	return picked
+}
+
+// acceptOffer applies a client-initiated offer and sends the answer. Any
+// track changes the client's offer had no room for follow in a server offer.
+func (n *negotiator) acceptOffer(sdp string) error {
+	n.opLock.Lock()
+	defer n.opLock.Unlock()
+
+	if n.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		return signaling.NewError(signaling.CodeNegotiationConflict, signaling.EventOffer,
+			"server offer outstanding; roll back and answer it first")
+	}
+
+	if err := n.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  sdp,
+	}); err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, signaling.EventOffer, err.Error())
+	}
+
+	answer, err := n.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := n.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	// Send while still holding opLock so the answer always precedes the
+	// next server offer
+	if err := n.ws.WriteJSON(signaling.New(signaling.EventAnswer, signaling.SessionDescription{
+		SDP: answer.SDP,
+	})); err != nil {
+		return err
+	}
+
+	n.request(false)
+	return nil
+}
+
+// acceptAnswer completes an outstanding server offer
+func (n *negotiator) acceptAnswer(sdp string) error {
+	n.opLock.Lock()
+	defer n.opLock.Unlock()
+
+	if err := n.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  sdp,
+	}); err != nil {
+		return signaling.NewError(signaling.CodeInvalidPayload, signaling.EventAnswer, err.Error())
+	}
+
+	// Changes queued while the offer was in flight go out now
+	n.request(false)
+	return nil
+}
+
+// allocateBandwidth periodically shares the estimated bandwidth towards the
+// peer between the tracks it receives, picking the simulcast layer of each
+// video track that fits its share
+func (n *negotiator) allocateBandwidth(estimator cc.BandwidthEstimator) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if n.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		var video []*webrtc.RTPSender
+		available := estimator.GetTargetBitrate()
+		for _, sender := range n.pc.GetSenders() {
+			track, ok := sender.Track().(*PublishedTrack)
+			if !ok {
+				continue
+			}
+			if track.Kind() == webrtc.RTPCodecTypeAudio {
+				available -= audioBitrate
+				continue
+			}
+			video = append(video, sender)
+		}
+		if len(video) == 0 {
+			continue
+		}
+
+		share := available / len(video)
+		if share < 1 {
+			share = 1
+		}
+		for _, sender := range video {
+			sender.Track().(*PublishedTrack).selectLayer(senderSSRC(sender), share)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestHTTPViewerTracksAreReplaced(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	p := &Peers{
+		TrackLocals: map[string]*PublishedTrack{},
+		PeerTracks:  map[string]map[string]*PublishedTrack{},
+	}
+	if err := p.AddSendTransceivers(pc); err != nil {
+		t.Fatal(err)
+	}
+	n := &negotiator{peers: p, peerID: "viewer", pc: pc, ws: &ThreadSafeWriter{}}
+
+	track := func(id, mime string, source TrackSource) *PublishedTrack {
+		return &PublishedTrack{id: id, source: source, codec: webrtc.RTPCodecCapability{MimeType: mime}}
+	}
+	sending := func() map[webrtc.RTPCodecType]string {
+		ids := make(map[webrtc.RTPCodecType]string)
+		for _, transceiver := range pc.GetTransceivers() {
+			if published, ok := transceiver.Sender().Track().(*PublishedTrack); ok {
+				ids[transceiver.Kind()] = published.ID()
+			}
+		}
+		return ids
+	}
+
+	// A viewer that joined before the publisher starts receiving once it
+	// publishes, and the camera wins over a screen share
+	p.PeerTracks["publisher"] = map[string]*PublishedTrack{
+		"mic":    track("mic", webrtc.MimeTypeOpus, SourceAudio),
+		"screen": track("screen", webrtc.MimeTypeVP8, SourceScreen),
+		"cam":    track("cam", webrtc.MimeTypeVP8, SourceVideo),
+	}
+	if err := n.sync(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := sending(); got[webrtc.RTPCodecTypeAudio] != "mic" || got[webrtc.RTPCodecTypeVideo] != "cam" {
+		t.Errorf("after publish: sending %v", got)
+	}
+
+	// Republished tracks replace the old ones
+	p.PeerTracks["publisher"] = map[string]*PublishedTrack{
+		"mic2": track("mic2", webrtc.MimeTypeOpus, SourceAudio),
+	}
+	if err := n.sync(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := sending(); len(got) != 1 || got[webrtc.RTPCodecTypeAudio] != "mic2" {
+		t.Errorf("after republish: sending %v", got)
+	}
+
+	delete(p.PeerTracks, "publisher")
+	if err := n.sync(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := sending(); len(got) != 0 {
+		t.Errorf("after the publisher left: sending %v", got)
+	}
+}
+
+func TestDiscardEstimator(t *testing.T) {
+	pc, err := NewPeerConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	DiscardEstimator(pc)
+	if _, ok := pendingEstimators.Load(pc); ok {
+		t.Error("estimator of an abandoned connection kept")
+	}
+}
@@ -0,0 +1,158 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ============= PASSCODES =============
+//
+// A host can protect a room with a passcode that joiners must enter before
+// they are let in. Only a bcrypt hash is kept. Clients that keep getting it
+// wrong are locked out for a while.
+//
+// Guests are told apart by address, so everyone behind one NAT or proxy
+// shares a count: one of them guessing locks the others out too. Running
+// behind a reverse proxy needs -trusted-proxies so the real client address
+// is used; people with join tokens are counted by user instead. Counts are
+// dropped once they no longer matter, so addresses that try once and go
+// away don't pile up.
+
+var (
+	// MaxPasscodeAttempts is how many wrong passcodes a client may enter
+	// before it is locked out
+	MaxPasscodeAttempts = 5
+
+	// PasscodeLockout is how long a client is locked out for
+	PasscodeLockout = 5 * time.Minute
+)
+
+// Passcode lengths, in characters. bcrypt reads at most 72 bytes.
+const (
+	MinPasscodeLength = 4
+	MaxPasscodeLength = 64
+)
+
+var errPasscodeLength = errors.New("passcode must be 4 to 64 characters")
+
+// passcodeAttempts counts one client's wrong passcodes
+type passcodeAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// expired reports whether the count no longer matters at now: its lockout
+// has run out or, short of one, PasscodeLockout has passed since the last
+// wrong passcode
+func (a *passcodeAttempts) expired(now time.Time) bool {
+	if !a.lockedUntil.IsZero() {
+		return !now.Before(a.lockedUntil)
+	}
+	return !now.Before(a.lastFailure.Add(PasscodeLockout))
+}
+
+// PasscodeResult is the outcome of trying a passcode
+type PasscodeResult struct {
+	OK           bool
+	AttemptsLeft int       // Wrong passcodes allowed before a lockout
+	LockedUntil  time.Time // Set while the client is locked out
+}
+
+// SetPasscode protects the room with a passcode. An empty passcode removes
+// it.
+func (r *Room) SetPasscode(passcode string) error {
+	var hash []byte
+	if passcode != "" {
+		if n := utf8.RuneCountInString(passcode); n < MinPasscodeLength || n > MaxPasscodeLength {
+			return errPasscodeLength
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(passcode), bcrypt.DefaultCost); err != nil {
+			return err
+		}
+	}
+
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.passcodeHash = hash
+	r.passcodeAttempts = make(map[string]*passcodeAttempts)
+	r.persist()
+	if hash == nil {
+		log.Printf("Passcode removed from room %s", r.ID)
+	} else {
+		log.Printf("Passcode set for room %s", r.ID)
+	}
+	return nil
+}
+
+// HasPasscode checks if joiners must enter a passcode
+func (r *Room) HasPasscode() bool {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return r.passcodeHash != nil
+}
+
+// PasscodeStatus returns how many wrong passcodes a client has left, or
+// until when it is locked out
+func (r *Room) PasscodeStatus(client string, now time.Time) PasscodeResult {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	attempts := r.passcodeAttempts[client]
+	switch {
+	case attempts == nil || attempts.expired(now):
+		return PasscodeResult{AttemptsLeft: MaxPasscodeAttempts}
+	case !attempts.lockedUntil.IsZero():
+		return PasscodeResult{LockedUntil: attempts.lockedUntil}
+	}
+	return PasscodeResult{AttemptsLeft: MaxPasscodeAttempts - attempts.failures}
+}
+
+// TryPasscode checks a passcode entered by a client, identified by its
+// user or address so reconnecting doesn't reset its count. After
+// MaxPasscodeAttempts wrong ones the client is locked out for
+// PasscodeLockout, during which every passcode is refused.
+func (r *Room) TryPasscode(client, passcode string, now time.Time) PasscodeResult {
+	if status := r.PasscodeStatus(client, now); !status.LockedUntil.IsZero() {
+		return status
+	}
+
+	r.PermLock.RLock()
+	hash := r.passcodeHash
+	r.PermLock.RUnlock()
+
+	// Comparing is slow on purpose, so it runs without the lock
+	ok := hash == nil || bcrypt.CompareHashAndPassword(hash, []byte(passcode)) == nil
+
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	if ok {
+		delete(r.passcodeAttempts, client)
+		return PasscodeResult{OK: true, AttemptsLeft: MaxPasscodeAttempts}
+	}
+
+	// Expired counts are dropped, this client's included, which starts its
+	// count again
+	for key, attempts := range r.passcodeAttempts {
+		if attempts.expired(now) {
+			delete(r.passcodeAttempts, key)
+		}
+	}
+	attempts := r.passcodeAttempts[client]
+	if attempts == nil {
+		attempts = &passcodeAttempts{}
+		r.passcodeAttempts[client] = attempts
+	}
+	attempts.failures++
+	attempts.lastFailure = now
+	if attempts.failures >= MaxPasscodeAttempts {
+		attempts.lockedUntil = now.Add(PasscodeLockout)
+		log.Printf("Client %s locked out of room %s after %d wrong passcodes", client, r.ID, attempts.failures)
+		return PasscodeResult{LockedUntil: attempts.lockedUntil}
+	}
+	return PasscodeResult{AttemptsLeft: MaxPasscodeAttempts - attempts.failures}
+}
@@ -0,0 +1,62 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPasscodeLockout(t *testing.T) {
+	saved := Store
+	Store = NewMemoryStore()
+	defer func() { Store = saved }()
+
+	room := CreateRoom("passcode-lockout")
+	defer DeleteRoom(room.ID)
+
+	if err := room.SetPasscode("abc"); err == nil {
+		t.Error("short passcode accepted")
+	}
+	if err := room.SetPasscode("open sesame"); err != nil {
+		t.Fatal(err)
+	}
+	if !room.HasPasscode() {
+		t.Fatal("passcode not set")
+	}
+
+	now := time.Now()
+	if result := room.TryPasscode("1.2.3.4", "open sesame", now); !result.OK {
+		t.Errorf("right passcode refused: %+v", result)
+	}
+	for i := 1; i < MaxPasscodeAttempts; i++ {
+		if result := room.TryPasscode("1.2.3.4", "wrong", now); result.OK || result.AttemptsLeft != MaxPasscodeAttempts-i {
+			t.Fatalf("wrong passcode %d = %+v", i, result)
+		}
+	}
+	if result := room.TryPasscode("1.2.3.4", "wrong", now); result.LockedUntil.IsZero() {
+		t.Fatalf("not locked out after %d wrong passcodes: %+v", MaxPasscodeAttempts, result)
+	}
+	if result := room.TryPasscode("1.2.3.4", "open sesame", now); result.OK {
+		t.Error("right passcode accepted during a lockout")
+	}
+	if result := room.TryPasscode("5.6.7.8", "open sesame", now); !result.OK {
+		t.Error("another client was locked out too")
+	}
+	if result := room.TryPasscode("1.2.3.4", "open sesame", now.Add(PasscodeLockout)); !result.OK {
+		t.Errorf("right passcode refused after the lockout: %+v", result)
+	}
+
+	// Counts that no longer matter are dropped rather than kept forever
+	room.TryPasscode("9.9.9.9", "wrong", now)
+	room.TryPasscode("1.2.3.4", "wrong", now)
+	room.TryPasscode("5.6.7.8", "wrong", now.Add(PasscodeLockout))
+	if status := room.PasscodeStatus("1.2.3.4", now.Add(PasscodeLockout)); status.AttemptsLeft != MaxPasscodeAttempts {
+		t.Errorf("old wrong passcode still counted: %+v", status)
+	}
+	if n := len(room.passcodeAttempts); n != 1 {
+		t.Errorf("%d passcode counts kept, want 1", n)
+	}
+
+	if err := room.SetPasscode(""); err != nil || room.HasPasscode() {
+		t.Errorf("passcode not removed: %v", err)
+	}
+}
@@ -1,20 +1,30 @@
 package webrtc
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"sync"
 
+	"videochat/pkg/hls"
+	"videochat/pkg/recording"
+
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
+var errPeerNotFound = errors.New("peer not found")
+
 // PeerConnectionState represents a WebRTC peer connection
 type PeerConnectionState struct {
 	PeerConnection *webrtc.PeerConnection
 	Websocket      *ThreadSafeWriter
 	PeerID         string
 	Username       string // Added to store peer username
+
+	negotiator *negotiator
 }
 
 // ThreadSafeWriter wraps websocket connection with mutex for thread safety
@@ -23,42 +33,85 @@ type ThreadSafeWriter struct {
 	sync.Mutex
 }
 
-// WriteJSON writes JSON to websocket in a thread-safe manner
+// WriteJSON writes JSON to websocket in a thread-safe manner. Connections
+// signaled over HTTP (WHIP/WHEP) have no websocket and drop the message.
 func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
 	t.Lock()
 	defer t.Unlock()
+	if t.Conn == nil {
+		return nil
+	}
 	return t.Conn.WriteJSON(v)
 }
 
+// Close closes the websocket, if there is one
+func (t *ThreadSafeWriter) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.Conn == nil {
+		return nil
+	}
+	return t.Conn.Close()
+}
+
 // Peers manages all peer connections in a room
 type Peers struct {
 	ListLock    sync.RWMutex
 	Connections []PeerConnectionState
-	TrackLocals map[string]*webrtc.TrackLocalStaticRTP
+	TrackLocals map[string]*PublishedTrack
 	// Track which tracks belong to which peer (peerID -> trackID -> track)
-	PeerTracks  map[string]map[string]*webrtc.TrackLocalStaticRTP
+	PeerTracks map[string]map[string]*PublishedTrack
+	// SFU is set when every connection exchanges media with the server, so
+	// the server owns the offer for each connection's sender set
+	SFU bool
+
+	// Speakers receives the audio levels of forwarded tracks, if set
+	Speakers *SpeakerDetector
+
+	// recorder receives every published track while the room is recorded
+	recorder *recording.Recording
+
+	// HLS packages the published tracks as LL-HLS for viewers without
+	// WebRTC. muxer is the output of the current publishing session.
+	HLS   bool
+	muxer *hls.Muxer
+
+	// subscriptions narrows what each connection receives (peerID -> set)
+	subscriptions map[string]*subscription
 }
 
-// AddTrack adds a new track to the peer connections
-func (p *Peers) AddTrack(t *webrtc.TrackRemote, peerID string) *webrtc.TrackLocalStaticRTP {
+// AddTrack registers a track received from a peer for forwarding. Each
+// simulcast layer of a track arrives separately; published is true only for
+// the first, when the track becomes available to subscribers.
+func (p *Peers) AddTrack(t *webrtc.TrackRemote, peerID string) (track *PublishedTrack, published bool) {
 	p.ListLock.Lock()
 	defer func() {
 		p.ListLock.Unlock()
-		p.SignalPeerConnections()
+		if published {
+			p.SignalPeerConnections()
+		}
 	}()
 
 	// Initialize peer tracks map if needed
 	if p.PeerTracks == nil {
-		p.PeerTracks = make(map[string]map[string]*webrtc.TrackLocalStaticRTP)
+		p.PeerTracks = make(map[string]map[string]*PublishedTrack)
 	}
 	if p.PeerTracks[peerID] == nil {
-		p.PeerTracks[peerID] = make(map[string]*webrtc.TrackLocalStaticRTP)
+		p.PeerTracks[peerID] = make(map[string]*PublishedTrack)
 	}
 
-	// Check if this peer already has a track of the same kind
-	var oldTrack *webrtc.TrackLocalStaticRTP
+	// Another simulcast layer of a track we already forward
+	if existing, ok := p.PeerTracks[peerID][t.ID()]; ok {
+		existing.addLayer(t)
+		log.Printf("Added layer %q to track %s for peer %s", t.RID(), t.ID(), peerID)
+		return existing, false
+	}
+
+	// Check if this peer is republishing a track of the same kind in the
+	// same stream. A new stream (e.g. a screen share) is added alongside.
+	var oldTrack *PublishedTrack
 	for trackID, track := range p.PeerTracks[peerID] {
-		if track.Kind() == t.Kind() {
+		if track.Kind() == t.Kind() && track.StreamID() == t.StreamID() {
 			oldTrack = track
 			delete(p.TrackLocals, trackID)
 			delete(p.PeerTracks[peerID], trackID)
@@ -68,18 +121,28 @@ func (p *Peers) AddTrack(t *webrtc.TrackRemote, peerID string) *webrtc.TrackLoca
 	}
 
 	// Create a new track
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(
-		t.Codec().RTPCodecCapability,
-		t.ID(),
-		t.StreamID(),
-	)
-	if err != nil {
-		log.Println("Error creating track:", err)
-		return nil
+	var publisher *webrtc.PeerConnection
+	for _, conn := range p.Connections {
+		if conn.PeerID == peerID {
+			publisher = conn.PeerConnection
+			break
+		}
 	}
+	track = newPublishedTrack(t, peerID, publisher, classifySource(t, p.PeerTracks[peerID]))
+	track.addLayer(t)
 
-	p.TrackLocals[t.ID()] = trackLocal
-	p.PeerTracks[peerID][t.ID()] = trackLocal
+	p.TrackLocals[t.ID()] = track
+	p.PeerTracks[peerID][t.ID()] = track
+
+	if p.recorder != nil {
+		p.recordTrack(track)
+	}
+	if p.HLS {
+		if oldTrack != nil {
+			oldTrack.stopPackaging()
+		}
+		p.packageTrack(track)
+	}
 
 	// If we had an old track, we need to replace it in all peer connections
 	if oldTrack != nil {
@@ -90,7 +153,7 @@ func (p *Peers) AddTrack(t *webrtc.TrackRemote, peerID string) *webrtc.TrackLoca
 				senders := p.Connections[i].PeerConnection.GetSenders()
 				for _, sender := range senders {
 					if sender.Track() == oldTrack {
-						if replaceErr := sender.ReplaceTrack(trackLocal); replaceErr != nil {
+						if replaceErr := sender.ReplaceTrack(track); replaceErr != nil {
 							log.Printf("Error replacing track for peer %s: %v", p.Connections[i].PeerID, replaceErr)
 						} else {
 							log.Printf("Replaced track for peer %s", p.Connections[i].PeerID)
@@ -100,106 +163,373 @@ func (p *Peers) AddTrack(t *webrtc.TrackRemote, peerID string) *webrtc.TrackLoca
 				}
 			}
 		}
-	} else {
-		// Add this track to all existing peer connections that are connected
-		for i := range p.Connections {
-			// Only add track to connected peer connections
-			if p.Connections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected {
-				if rtpSender, addTrackErr := p.Connections[i].PeerConnection.AddTrack(trackLocal); addTrackErr != nil {
-					log.Printf("Error adding track to peer %s: %v", p.Connections[i].PeerID, addTrackErr)
-				} else {
-					log.Printf("Added track %s to connected peer %s", trackLocal.ID(), p.Connections[i].PeerID)
-					// Read RTCP packets to keep connection alive
-					go func(sender *webrtc.RTPSender, peerID string) {
-						rtcpBuf := make([]byte, 1500)
-						for {
-							if _, _, rtcpErr := sender.Read(rtcpBuf); rtcpErr != nil {
-								return
-							}
-						}
-					}(rtpSender, p.Connections[i].PeerID)
-				}
-			} else {
-				log.Printf("Skipping track addition to peer %s (not connected, state: %s)", p.Connections[i].PeerID, p.Connections[i].PeerConnection.ConnectionState())
-			}
-		}
 	}
 
-	return trackLocal
+	// Connections that don't send this track yet pick it up on the next
+	// renegotiation
+	return track, true
 }
 
-// RemoveTrack removes a track from peer connections
-func (p *Peers) RemoveTrack(t *webrtc.TrackLocalStaticRTP) {
+// SourceOf tells what a track a peer is about to publish carries, as
+// AddTrack will classify it
+func (p *Peers) SourceOf(t *webrtc.TrackRemote, peerID string) TrackSource {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+	if existing, ok := p.PeerTracks[peerID][t.ID()]; ok {
+		return existing.Source()
+	}
+	return classifySource(t, p.PeerTracks[peerID])
+}
+
+// classifySource tells camera video from a screen share. Browsers put the
+// microphone and camera in one stream, so video in a stream other than the
+// one the peer already publishes is a screen share.
+func classifySource(t *webrtc.TrackRemote, existing map[string]*PublishedTrack) TrackSource {
+	if t.Kind() == webrtc.RTPCodecTypeAudio {
+		return SourceAudio
+	}
+	for _, track := range existing {
+		if track.StreamID() != t.StreamID() && track.Source() != SourceScreen {
+			return SourceScreen
+		}
+	}
+	return SourceVideo
+}
+
+// RemoveTrack drops one layer of a track when the publisher stops sending
+// it. unpublished is true once the last layer is gone and the track has
+// been withdrawn from subscribers.
+func (p *Peers) RemoveTrack(t *PublishedTrack, rid string) (unpublished bool) {
+	if t.removeLayer(rid) > 0 {
+		return false
+	}
+	t.stopRecording()
+	t.stopPackaging()
+
 	p.ListLock.Lock()
 	defer func() {
 		p.ListLock.Unlock()
 		p.SignalPeerConnections()
 	}()
 
-	delete(p.TrackLocals, t.ID())
+	if p.TrackLocals[t.ID()] == t {
+		delete(p.TrackLocals, t.ID())
+	}
+	for _, tracks := range p.PeerTracks {
+		if tracks[t.ID()] == t {
+			delete(tracks, t.ID())
+		}
+	}
+	return true
 }
 
-// SignalPeerConnections triggers renegotiation for all peer connections
-func (p *Peers) SignalPeerConnections() {
+// StartRecording sends every published track, and any published later, to
+// a recording
+func (p *Peers) StartRecording(rec *recording.Recording) {
 	p.ListLock.Lock()
-	defer func() {
-		p.ListLock.Unlock()
-		p.DispatchKeyFrame()
-	}()
+	defer p.ListLock.Unlock()
 
-	// Trigger renegotiation for each peer
-	for syncAttempt := 0; ; syncAttempt++ {
-		if syncAttempt == 25 {
-			// Give up after 25 attempts
-			return
+	p.recorder = rec
+	for _, tracks := range p.PeerTracks {
+		for _, track := range tracks {
+			p.recordTrack(track)
 		}
+	}
+}
+
+// StopRecording stops sending tracks to the current recording
+func (p *Peers) StopRecording() {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	p.recorder = nil
+	for _, tracks := range p.PeerTracks {
+		for _, track := range tracks {
+			track.stopRecording()
+		}
+	}
+}
 
-		if !p.dispatchKeyFrameFunc() {
+// recordTrack adds a track to the current recording. Callers hold ListLock.
+func (p *Peers) recordTrack(track *PublishedTrack) {
+	username := ""
+	for _, conn := range p.Connections {
+		if conn.PeerID == track.PublisherID() {
+			username = conn.Username
 			break
 		}
 	}
+
+	rec, err := p.recorder.AddTrack(recording.TrackInfo{
+		TrackID:  track.ID(),
+		PeerID:   track.PublisherID(),
+		Username: username,
+		Kind:     track.Kind().String(),
+		Source:   string(track.Source()),
+		MimeType: track.Codec().MimeType,
+	})
+	if err != nil {
+		log.Printf("Not recording track %s: %v", track.ID(), err)
+		return
+	}
+	track.startRecording(rec)
 }
 
-// DispatchKeyFrame sends keyframe request to all peers
-func (p *Peers) DispatchKeyFrame() {
-	p.ListLock.Lock()
-	defer p.ListLock.Unlock()
+// HLSMuxer returns the stream's HLS output, or nil before anything was
+// published
+func (p *Peers) HLSMuxer() *hls.Muxer {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+	return p.muxer
+}
 
-	p.dispatchKeyFrameFunc()
+// packageTrack adds a track to the HLS output. Once the output has started
+// its track list is fixed, so a track arriving later (e.g. audio published
+// after the camera) starts a new output with every published track.
+// Callers hold ListLock.
+func (p *Peers) packageTrack(track *PublishedTrack) {
+	if p.muxer != nil && !p.muxer.Ended() {
+		err := track.startPackaging(p.muxer)
+		if err == nil {
+			log.Printf("Packaging track %s as HLS", track.ID())
+			return
+		}
+		if !errors.Is(err, hls.ErrStarted) {
+			log.Printf("Not packaging track %s as HLS: %v", track.ID(), err)
+			return
+		}
+		p.muxer.End()
+	}
+
+	// Cameras go first so a screen share only takes the video slot alone
+	var tracks []*PublishedTrack
+	for _, published := range p.PeerTracks {
+		for _, t := range published {
+			tracks = append(tracks, t)
+		}
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].Source() != SourceScreen && tracks[j].Source() == SourceScreen
+	})
+
+	p.muxer = hls.NewMuxer()
+	for _, t := range tracks {
+		t.stopPackaging()
+		if err := t.startPackaging(p.muxer); err != nil {
+			log.Printf("Not packaging track %s as HLS: %v", t.ID(), err)
+			continue
+		}
+		log.Printf("Packaging track %s as HLS", t.ID())
+	}
 }
 
-func (p *Peers) dispatchKeyFrameFunc() bool {
-	var activeSenders []*webrtc.RTPSender
+// Forward copies RTP from one layer of a publisher's track to the
+// subscribers of that layer. It blocks until the remote track ends.
+func (p *Peers) Forward(remote *webrtc.TrackRemote, track *PublishedTrack) {
+	rid := remote.RID()
+	for {
+		pkt, _, readErr := remote.ReadRTP()
+		if readErr != nil {
+			return
+		}
 
-	for i := range p.Connections {
-		if p.Connections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
-			p.Connections = append(p.Connections[:i], p.Connections[i+1:]...)
+		if p.Speakers != nil {
+			if level, ok := track.audioLevel(pkt); ok {
+				p.Speakers.Observe(track.PublisherID(), level)
+			}
+		}
+
+		// A failed write only affects the subscriber it was meant for
+		_ = track.writeRTP(rid, pkt)
+	}
+}
+
+// SelectLayer caps the simulcast layer a peer receives for a track. An
+// empty rid hands the choice back to bandwidth estimation.
+func (p *Peers) SelectLayer(peerID, trackID, rid string) error {
+	conn, ok := p.Get(peerID)
+	if !ok {
+		return errPeerNotFound
+	}
+
+	for _, sender := range conn.PeerConnection.GetSenders() {
+		track, ok := sender.Track().(*PublishedTrack)
+		if !ok || track.ID() != trackID {
+			continue
+		}
+		return track.setMaxLayer(senderSSRC(sender), rid)
+	}
+	return errUnknownLayer
+}
+
+// SignalPeerConnections prunes closed connections and, in SFU rooms, queues
+// a renegotiation for every connection. Each connection's negotiator only
+// offers if its sender set actually changed.
+func (p *Peers) SignalPeerConnections() {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	live := p.Connections[:0]
+	for _, conn := range p.Connections {
+		if conn.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
 			log.Println("Removed closed peer connection")
-			return true
+			continue
 		}
+		live = append(live, conn)
+	}
+	p.Connections = live
+
+	if !p.SFU {
+		return
+	}
+	for _, conn := range p.Connections {
+		conn.negotiator.request(false)
+	}
+}
 
-		// Collect all senders
-		for _, sender := range p.Connections[i].PeerConnection.GetSenders() {
-			if sender.Track() != nil {
-				activeSenders = append(activeSenders, sender)
+// Renegotiate sends a peer a fresh offer even if its senders are unchanged.
+// SFU rooms use it to open the first negotiation with a new connection.
+func (p *Peers) Renegotiate(peerID string) {
+	if conn, ok := p.Get(peerID); ok {
+		conn.negotiator.request(true)
+	}
+}
+
+// AcceptOffer applies an offer a peer sent to the server and replies with
+// the answer
+func (p *Peers) AcceptOffer(peerID, sdp string) error {
+	conn, ok := p.Get(peerID)
+	if !ok {
+		return errPeerNotFound
+	}
+	return conn.negotiator.acceptOffer(sdp)
+}
+
+// AcceptAnswer applies a peer's answer to the server's last offer
+func (p *Peers) AcceptAnswer(peerID, sdp string) error {
+	conn, ok := p.Get(peerID)
+	if !ok {
+		return errPeerNotFound
+	}
+	if err := conn.negotiator.acceptAnswer(sdp); err != nil {
+		return err
+	}
+
+	// Senders added by this negotiation need a keyframe to start decoding
+	p.DispatchKeyFrame()
+	return nil
+}
+
+// tracksFor returns the tracks a peer should receive: the tracks of other
+// peers it is subscribed to
+func (p *Peers) tracksFor(peerID string) map[string]*PublishedTrack {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	sub := p.subscriptions[peerID]
+	tracks := make(map[string]*PublishedTrack, len(p.TrackLocals))
+	for publisherID, published := range p.PeerTracks {
+		if publisherID == peerID {
+			continue
+		}
+		for trackID, track := range published {
+			if sub.includes(publisherID, track.Source()) {
+				tracks[trackID] = track
 			}
 		}
 	}
+	return tracks
+}
 
-	// Send PLI (Picture Loss Indication) to request keyframe
+// AddSendTransceivers gives a connection that isn't in the room yet one
+// send-only audio and one send-only video transceiver. HTTP-signaled
+// viewers can't be renegotiated, so these are the only senders they get;
+// once the connection is added, its negotiator points them at the published
+// tracks and swaps them as tracks come and go.
+func (p *Peers) AddSendTransceivers(pc *webrtc.PeerConnection) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		transceiver, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			return fmt.Errorf("add %s transceiver: %w", kind, err)
+		}
+		go forwardRTCP(transceiver.Sender())
+	}
+	return nil
+}
+
+// DispatchKeyFrame asks every publisher for a keyframe
+func (p *Peers) DispatchKeyFrame() {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	p.dispatchKeyFrameFunc()
+}
+
+func (p *Peers) dispatchKeyFrameFunc() {
+	// Send PLI (Picture Loss Indication) for every track we receive
 	for i := range p.Connections {
-		for _, sender := range p.Connections[i].PeerConnection.GetSenders() {
-			if sender.Track() != nil {
-				_ = p.Connections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
-					&rtcp.PictureLossIndication{
-						MediaSSRC: 0, // Request keyframe for all streams
-					},
-				})
+		pc := p.Connections[i].PeerConnection
+		for _, receiver := range pc.GetReceivers() {
+			if receiver.Track() == nil {
+				continue
 			}
+
+			_ = pc.WriteRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{
+					MediaSSRC: uint32(receiver.Track().SSRC()),
+				},
+			})
 		}
 	}
+}
 
-	return false
+// forwardRTCP reads RTCP from a subscriber's sender until it closes,
+// passing keyframe requests on to the publisher of the layer the subscriber
+// receives. Interceptors such as NACK only run while packets are being read.
+// The track is looked up for every packet, as HTTP-signaled viewers have
+// theirs replaced.
+func forwardRTCP(sender *webrtc.RTPSender) {
+	ssrc := senderSSRC(sender)
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		track, ok := sender.Track().(*PublishedTrack)
+		if !ok {
+			continue
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				track.requestKeyframe(track.currentLayer(ssrc))
+			}
+		}
+	}
+}
+
+// senderSSRC returns the SSRC a sender writes with
+func senderSSRC(sender *webrtc.RTPSender) webrtc.SSRC {
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		return encodings[0].SSRC
+	}
+	return 0
+}
+
+// Get returns the connection state for a peer
+func (p *Peers) Get(peerID string) (PeerConnectionState, bool) {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	for _, conn := range p.Connections {
+		if conn.PeerID == peerID {
+			return conn, true
+		}
+	}
+	return PeerConnectionState{}, false
 }
 
 // AddPeerConnection adds a new peer connection to the room
@@ -207,21 +537,75 @@ func (p *Peers) AddPeerConnection(peerConnection *webrtc.PeerConnection, ws *web
 	p.AddPeerConnectionWithID(peerConnection, ws, "", "Guest")
 }
 
-// AddPeerConnectionWithID adds a new peer connection with a specific ID
+// AddPeerConnectionWithID adds a new peer connection with a specific ID. ws
+// is nil for connections signaled over HTTP, which are never renegotiated.
 func (p *Peers) AddPeerConnectionWithID(peerConnection *webrtc.PeerConnection, ws *websocket.Conn, peerID string, username string) {
+	p.addPeerConnection(peerConnection, ws, peerID, username, false)
+}
+
+// AddViewerConnection adds a connection that only receives. The server's
+// transceivers for it are send-only, so the viewer can't publish on them.
+func (p *Peers) AddViewerConnection(peerConnection *webrtc.PeerConnection, ws *websocket.Conn, peerID string, username string) {
+	p.addPeerConnection(peerConnection, ws, peerID, username, true)
+}
+
+func (p *Peers) addPeerConnection(peerConnection *webrtc.PeerConnection, ws *websocket.Conn, peerID string, username string, viewer bool) {
 	p.ListLock.Lock()
 	defer p.ListLock.Unlock()
 
+	writer := &ThreadSafeWriter{Conn: ws}
+	negotiator := newNegotiator(p, peerID, peerConnection, writer, takeEstimator(peerConnection))
+	negotiator.sendOnly = viewer
 	p.Connections = append(p.Connections, PeerConnectionState{
 		PeerConnection: peerConnection,
-		Websocket: &ThreadSafeWriter{
-			Conn: ws,
-		},
-		PeerID:   peerID,
-		Username: username,
+		Websocket:      writer,
+		PeerID:         peerID,
+		Username:       username,
+		negotiator:     negotiator,
 	})
 }
 
+// SetUsername updates the display name of a peer
+func (p *Peers) SetUsername(peerID, username string) bool {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	for i := range p.Connections {
+		if p.Connections[i].PeerID == peerID {
+			p.Connections[i].Username = username
+			return true
+		}
+	}
+	return false
+}
+
+// GetUsername returns the display name of a peer
+func (p *Peers) GetUsername(peerID string) string {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	for _, conn := range p.Connections {
+		if conn.PeerID == peerID {
+			return conn.Username
+		}
+	}
+	return ""
+}
+
+// PeerIDs lists the peers in the room, longest present first
+func (p *Peers) PeerIDs() []string {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	peerIDs := make([]string, 0, len(p.Connections))
+	for _, conn := range p.Connections {
+		if conn.PeerID != "" {
+			peerIDs = append(peerIDs, conn.PeerID)
+		}
+	}
+	return peerIDs
+}
+
 // RemovePeerConnection removes a peer connection from the room
 func (p *Peers) RemovePeerConnection(peerConnection *webrtc.PeerConnection) {
 	p.ListLock.Lock()
@@ -230,6 +614,7 @@ func (p *Peers) RemovePeerConnection(peerConnection *webrtc.PeerConnection) {
 	for i, conn := range p.Connections {
 		if conn.PeerConnection == peerConnection {
 			p.Connections = append(p.Connections[:i], p.Connections[i+1:]...)
+			delete(p.subscriptions, conn.PeerID)
 			log.Println("Removed peer connection")
 			return
 		}
@@ -278,12 +663,6 @@ func (p *Peers) SendToPeer(message interface{}, peerID string) {
 	log.Printf("Peer %s not found", peerID)
 }
 
-// WebSocketMessage represents messages exchanged via WebSocket
-type WebSocketMessage struct {
-	Event string                    `json:"event"`
-	Data  map[string]interface{}    `json:"data"`
-}
-
 // GetConnectionCount returns the number of active connections
 func (p *Peers) GetConnectionCount() int {
 	p.ListLock.RLock()
@@ -295,7 +674,7 @@ func (p *Peers) GetConnectionCount() int {
 func (p *Peers) BroadcastToAll(message map[string]interface{}) {
 	p.ListLock.RLock()
 	defer p.ListLock.RUnlock()
-	
+
 	for _, conn := range p.Connections {
 		if err := conn.Websocket.WriteJSON(message); err != nil {
 			log.Println("Error broadcasting to peer:", err)
@@ -307,7 +686,7 @@ func (p *Peers) BroadcastToAll(message map[string]interface{}) {
 func (p *Peers) RemovePeer(peerID string) {
 	p.ListLock.Lock()
 	defer p.ListLock.Unlock()
-	
+
 	for i, conn := range p.Connections {
 		if conn.PeerID == peerID {
 			// Close the peer connection
@@ -320,8 +699,9 @@ func (p *Peers) RemovePeer(peerID string) {
 			}
 			// Remove from list
 			p.Connections = append(p.Connections[:i], p.Connections[i+1:]...)
+			delete(p.subscriptions, peerID)
 			log.Printf("Removed peer: %s", peerID)
 			return
 		}
 	}
-}
\ No newline at end of file
+}
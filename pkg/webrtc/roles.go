@@ -0,0 +1,186 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// ============= ROLES =============
+//
+// Every participant has a named role, and what they may do in a room comes
+// from the capabilities that role has there. The host and co-host roles
+// follow HostPeerID and CoHosts; everyone else is a presenter, attendee or
+// viewer. Each room can change what the roles other than host can do.
+
+// Role is a participant's part in a room
+type Role string
+
+const (
+	RoleHost      Role = "host"
+	RoleCoHost    Role = "co-host"
+	RolePresenter Role = "presenter"
+	RoleAttendee  Role = "attendee"
+	RoleViewer    Role = "viewer"
+)
+
+// Roles lists every role, most capable first
+var Roles = []Role{RoleHost, RoleCoHost, RolePresenter, RoleAttendee, RoleViewer}
+
+// ParseRole validates a role from configuration or an event
+func ParseRole(s string) (Role, error) {
+	if role := Role(s); slices.Contains(Roles, role) {
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q", s)
+}
+
+// Capability is something a role lets a participant do
+type Capability string
+
+const (
+	CapPublishAudio       Capability = "publish-audio"
+	CapPublishVideo       Capability = "publish-video"
+	CapShareScreen        Capability = "share-screen"
+	CapChat               Capability = "chat"
+	CapAnnotate           Capability = "annotate"
+	CapManageParticipants Capability = "manage-participants"
+)
+
+// Capabilities lists every capability
+var Capabilities = []Capability{
+	CapPublishAudio, CapPublishVideo, CapShareScreen, CapChat, CapAnnotate, CapManageParticipants,
+}
+
+// ParseCapability validates a capability from configuration or an event
+func ParseCapability(s string) (Capability, error) {
+	if capability := Capability(s); slices.Contains(Capabilities, capability) {
+		return capability, nil
+	}
+	return "", fmt.Errorf("unknown capability %q", s)
+}
+
+var (
+	// DefaultRoleCapabilities is what each role can do in rooms that
+	// haven't changed it. The host can always do everything.
+	DefaultRoleCapabilities = map[Role][]Capability{
+		RoleHost:      Capabilities,
+		RoleCoHost:    Capabilities,
+		RolePresenter: {CapPublishAudio, CapPublishVideo, CapShareScreen, CapChat, CapAnnotate},
+		RoleAttendee:  {CapPublishAudio, CapPublishVideo, CapChat, CapAnnotate},
+		RoleViewer:    {CapChat},
+	}
+
+	// DefaultRole is the role of participants who join without one
+	DefaultRole = RoleAttendee
+)
+
+// ErrHostRole is returned for role changes that would make or unmake the
+// host, which only happens by handing hosting over
+var ErrHostRole = errors.New("the host role can only be handed over with transfer-host")
+
+// Role returns a peer's role in the room
+func (r *Room) Role(peerID string) Role {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return r.role(peerID)
+}
+
+// role returns a peer's role. Callers hold PermLock.
+func (r *Room) role(peerID string) Role {
+	switch {
+	case peerID != "" && r.HostPeerID == peerID:
+		return RoleHost
+	case r.CoHosts[peerID]:
+		return RoleCoHost
+	}
+	if role, ok := r.roles[peerID]; ok {
+		return role
+	}
+	return DefaultRole
+}
+
+// SetRole gives a peer a role other than host. Making them a co-host or
+// taking it away works like AddCoHost and RemoveCoHost.
+func (r *Room) SetRole(peerID string, role Role) error {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+
+	if role == RoleHost || r.HostPeerID == peerID {
+		return ErrHostRole
+	}
+	if role == RoleCoHost {
+		r.CoHosts[peerID] = true
+		delete(r.roles, peerID)
+	} else {
+		delete(r.CoHosts, peerID)
+		r.roles[peerID] = role
+	}
+	r.persist()
+	log.Printf("Peer %s is now %s in room %s", peerID, role, r.ID)
+	return nil
+}
+
+// ForgetRole drops the role of a peer that left, along with co-host and
+// screen sharing grants made to its peer ID
+func (r *Room) ForgetRole(peerID string) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	delete(r.roles, peerID)
+	delete(r.CoHosts, peerID)
+	delete(r.ScreenSharePerms, peerID)
+}
+
+// RoleCapabilities returns what a role can do in the room
+func (r *Room) RoleCapabilities(role Role) []Capability {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return slices.Clone(r.capabilities(role))
+}
+
+// capabilities returns what a role can do. Callers hold PermLock.
+func (r *Room) capabilities(role Role) []Capability {
+	if role == RoleHost {
+		return Capabilities
+	}
+	if capabilities, ok := r.roleCapabilities[role]; ok {
+		return capabilities
+	}
+	return DefaultRoleCapabilities[role]
+}
+
+// SetRoleCapabilities changes what a role can do in the room. The host's
+// capabilities can't be changed, so a room always has someone able to
+// manage it.
+func (r *Room) SetRoleCapabilities(role Role, capabilities []Capability) error {
+	if role == RoleHost {
+		return ErrHostRole
+	}
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.roleCapabilities[role] = slices.Compact(slices.Sorted(slices.Values(capabilities)))
+	r.persist()
+	log.Printf("Role %s in room %s can now: %v", role, r.ID, capabilities)
+	return nil
+}
+
+// Can checks if a peer's role has a capability
+func (r *Room) Can(peerID string, capability Capability) bool {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return slices.Contains(r.capabilities(r.role(peerID)), capability)
+}
+
+// CanPublish checks if a peer may publish a track of the given source.
+// Screen shares are also allowed for peers the host approved.
+func (r *Room) CanPublish(peerID string, source TrackSource) bool {
+	switch source {
+	case SourceAudio:
+		return r.Can(peerID, CapPublishAudio)
+	case SourceVideo:
+		return r.Can(peerID, CapPublishVideo)
+	default:
+		return r.CanShareScreen(peerID)
+	}
+}
@@ -0,0 +1,75 @@
+package webrtc
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	saved := Store
+	Store = NewMemoryStore()
+	defer func() { Store = saved }()
+
+	room := CreateRoom("roles")
+	defer DeleteRoom(room.ID)
+	room.SetHost("host")
+	room.AddCoHost("cohost")
+
+	for peerID, want := range map[string]Role{"host": RoleHost, "cohost": RoleCoHost, "someone": DefaultRole} {
+		if role := room.Role(peerID); role != want {
+			t.Errorf("role of %s = %s, want %s", peerID, role, want)
+		}
+	}
+	if !room.Can("cohost", CapManageParticipants) || room.Can("someone", CapManageParticipants) {
+		t.Error("only the co-host should manage participants")
+	}
+
+	// Roles other than host can be given and taken away
+	if err := room.SetRole("host", RoleViewer); !errors.Is(err, ErrHostRole) {
+		t.Errorf("changing the host's role: %v", err)
+	}
+	if err := room.SetRole("someone", RoleHost); !errors.Is(err, ErrHostRole) {
+		t.Errorf("making someone host: %v", err)
+	}
+	if err := room.SetRole("cohost", RoleViewer); err != nil || room.IsCoHost("cohost") {
+		t.Errorf("co-host not demoted: %v", err)
+	}
+	if room.CanPublish("cohost", SourceAudio) || !room.Can("cohost", CapChat) {
+		t.Error("viewer capabilities not applied")
+	}
+	room.SetRole("presenter", RolePresenter)
+	if !room.CanPublish("presenter", SourceScreen) || room.CanPublish("someone", SourceScreen) {
+		t.Error("only presenters should share without asking")
+	}
+	room.GrantScreenShare("someone")
+	if !room.CanShareScreen("someone") {
+		t.Error("approved screen share not allowed")
+	}
+
+	// Grants go with the peer when it leaves
+	room.AddCoHost("leaving")
+	room.GrantScreenShare("leaving")
+	room.ForgetRole("leaving")
+	if room.IsCoHost("leaving") || room.CanShareScreen("leaving") {
+		t.Error("grants kept after the peer left")
+	}
+
+	// Each room can change what roles other than host can do
+	if err := room.SetRoleCapabilities(RoleHost, nil); !errors.Is(err, ErrHostRole) {
+		t.Errorf("changing the host's capabilities: %v", err)
+	}
+	if err := room.SetRoleCapabilities(RoleViewer, []Capability{CapAnnotate, CapChat, CapAnnotate}); err != nil {
+		t.Fatal(err)
+	}
+	if caps := room.RoleCapabilities(RoleViewer); !slices.Equal(caps, []Capability{CapAnnotate, CapChat}) {
+		t.Errorf("viewer capabilities = %v", caps)
+	}
+	if !slices.Equal(DefaultRoleCapabilities[RoleViewer], []Capability{CapChat}) {
+		t.Error("room override changed the defaults")
+	}
+
+	if record, ok, _ := Store.Get(KindRoom, room.ID); !ok || !slices.Equal(record.RoleCapabilities[RoleViewer], []Capability{CapAnnotate, CapChat}) {
+		t.Errorf("stored viewer capabilities = %v", record.RoleCapabilities)
+	}
+}
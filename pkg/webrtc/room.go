@@ -1,39 +1,86 @@
 package webrtc
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+	"videochat/pkg/auth"
 	"videochat/pkg/chat"
+	"videochat/pkg/files"
+	"videochat/pkg/hls"
+	"videochat/pkg/recording"
+	"videochat/pkg/signaling"
 
+	"github.com/google/uuid"
 	"github.com/pion/webrtc/v3"
 )
 
 // Room represents a video conference room with comprehensive host controls
 type Room struct {
+	ID               string
 	Peers            *Peers
 	Hub              *chat.Hub
+	Mode             RoomMode          // Media topology chosen at creation
 	
 	// Host & Admin Controls
-	HostPeerID       string            // First person to join is the host
+	HostPeerID       string            // Empty while the room has no host
 	CoHosts          map[string]bool   // Co-hosts who can manage meeting
+	formerHost       *formerHost       // Host who left and may reclaim hosting
+	roles            map[string]Role   // Peer ID -> role, for presenters, attendees and viewers
+	roleCapabilities map[Role][]Capability // What roles can do, where the room differs from the defaults
 	
 	// Permissions & Security
-	ScreenSharePerms map[string]bool   // Permissions for screen sharing
+	ScreenSharePerms map[string]bool   // Screen sharing approved by the host
 	IsLocked         bool              // Room locked - no new participants
+	GuestPolicy      GuestPolicy       // What happens to joiners without a join token
+	passcodeHash     []byte            // bcrypt hash; nil when the room has no passcode
+	passcodeAttempts map[string]*passcodeAttempts // Client user or address -> wrong passcodes
+	identities       map[string]auth.Identity // Peer ID -> verified join token identity
 	IsChatDisabled   bool              // Chat disabled by host
+	IsPrivateChatDisabled bool         // Private messages disabled by host
 	MutedParticipants map[string]bool  // Participants muted by host
 	
 	// Waiting Room
+	WaitingRoomEnabled bool            // Everyone but hosts waits to be admitted
 	WaitingRoom      map[string]*WaitingParticipant // Participants waiting to join
 	
 	// Recording
 	IsRecording      bool              // Recording status
 	RecordingStartTime time.Time       // When recording started
+	recorder         *recording.Recording
 	
 	// Reactions & Engagement
 	RaisedHands      map[string]time.Time // Participants with raised hands
 	
+	// Chat
+	chatTokens       map[string]string // Chat websocket token -> peer ID
+	Moderation       *chat.Moderator   // Chat mutes, slow mode and filter
+	sentChat         map[string][]string // Chat-message event ID -> who received it; nil for everyone
+	sentChatOrder    []string          // sentChat IDs, oldest first
+	Files            *files.Store      // Files shared in chat; nil for streams
+	
+	// Persistence
+	kind             RoomKind          // Room or stream, for the store
+	createdAt        time.Time
+	
+	// Live streams
+	publishKeyHash   string            // SHA-256 of the publisher's key
+	streamState      StreamState
+	publisherID      string            // Connection currently publishing
+	
+	// Lifecycle
+	ctx              context.Context   // Cancelled when the room is closed
+	cancel           context.CancelFunc
+	emptySince       time.Time         // Guarded by the registry lock
+	viewers          atomic.Int32      // Open viewer websockets
+	joining          atomic.Int32      // Connections still entering the passcode
+	endReason        string            // Set once by Close
+	
 	PermLock         sync.RWMutex      // Lock for permissions and settings
 }
 
@@ -43,8 +90,95 @@ type WaitingParticipant struct {
 	Name        string
 	JoinTime    time.Time
 	Conn        interface{} // WebSocket connection
+	
+	decision    chan bool   // Receives true on admission, false on denial
+	reason      string      // Why they were turned away
+	expiry      *time.Timer // Turns them away after WaitingRoomTimeout
+}
+
+// Decision delivers whether the participant was admitted (true) or denied
+// (false)
+func (p *WaitingParticipant) Decision() <-chan bool {
+	return p.decision
+}
+
+// Reason tells a denied participant why. It is set once Decision has
+// delivered false.
+func (p *WaitingParticipant) Reason() string {
+	return p.reason
 }
 
+// RoomMode selects how media flows between participants
+type RoomMode string
+
+const (
+	// RoomModeMesh connects every browser to every other browser; the
+	// server only relays signaling
+	RoomModeMesh RoomMode = "mesh"
+
+	// RoomModeSFU has every participant negotiate a single connection with
+	// the server, which forwards each published track to all subscribers
+	RoomModeSFU RoomMode = "sfu"
+)
+
+// ParseRoomMode validates a room mode from configuration or a query string
+func ParseRoomMode(s string) (RoomMode, error) {
+	switch mode := RoomMode(s); mode {
+	case RoomModeMesh, RoomModeSFU:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown room mode %q (want %q or %q)", s, RoomModeMesh, RoomModeSFU)
+	}
+}
+
+// GuestPolicy decides what happens to someone joining a room without a
+// join token
+type GuestPolicy string
+
+const (
+	// GuestsAllowed lets them in as ordinary participants
+	GuestsAllowed GuestPolicy = "allow"
+
+	// GuestsWait parks them in the waiting room until a host admits them
+	GuestsWait GuestPolicy = "waiting-room"
+
+	// GuestsRejected turns them away
+	GuestsRejected GuestPolicy = "reject"
+)
+
+// ParseGuestPolicy validates a guest policy from configuration, a query
+// string or an event
+func ParseGuestPolicy(s string) (GuestPolicy, error) {
+	switch policy := GuestPolicy(s); policy {
+	case GuestsAllowed, GuestsWait, GuestsRejected:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown guest policy %q (want %q, %q or %q)", s, GuestsAllowed, GuestsWait, GuestsRejected)
+	}
+}
+
+// RoomOptions are the settings fixed when a room is created
+type RoomOptions struct {
+	Mode        RoomMode
+	GuestPolicy GuestPolicy // Hosts can change it later
+	WaitingRoom bool        // Enable the waiting room even if it is off by default
+}
+
+var (
+	// DefaultRoomMode is used for rooms created without explicit options
+	DefaultRoomMode = RoomModeMesh
+
+	// DefaultGuestPolicy is used for rooms created without one
+	DefaultGuestPolicy = GuestsAllowed
+
+	// DefaultWaitingRoom enables the waiting room of every new room
+	DefaultWaitingRoom = false
+
+	// WaitingRoomTimeout is how long someone may wait to be admitted
+	// before they are turned away. Zero lets them wait as long as they like.
+	WaitingRoomTimeout = 10 * time.Minute
+)
+
 var (
 	// Rooms stores all active video conference rooms
 	Rooms     = make(map[string]*Room)
@@ -73,6 +207,21 @@ var RoomConfig = webrtc.Configuration{
 
 // CreateRoom creates or gets an existing room
 func CreateRoom(uuid string) *Room {
+	return CreateRoomWithOptions(uuid, RoomOptions{Mode: DefaultRoomMode})
+}
+
+// CreateRoomWithOptions creates a room with the given options, or returns
+// the existing room unchanged if one is already registered under uuid.
+// Rooms saved in the Store by an earlier process are restored with their
+// original settings.
+func CreateRoomWithOptions(uuid string, opts RoomOptions) *Room {
+	if opts.Mode == "" {
+		opts.Mode = DefaultRoomMode
+	}
+	if opts.GuestPolicy == "" {
+		opts.GuestPolicy = DefaultGuestPolicy
+	}
+
 	RoomsLock.Lock()
 	defer RoomsLock.Unlock()
 
@@ -80,91 +229,271 @@ func CreateRoom(uuid string) *Room {
 		return room
 	}
 
-	// Create new room
-	hub := chat.NewHub()
-	go hub.Run()
+	if room := restoreRoom(uuid); room != nil {
+		return room
+	}
+
+	room := newRoom(uuid, opts.Mode)
+	room.GuestPolicy = opts.GuestPolicy
+	room.WaitingRoomEnabled = opts.WaitingRoom || DefaultWaitingRoom
+	room.persist()
+	Rooms[uuid] = room
+	log.Printf("Room created: %s (%s)", uuid, opts.Mode)
+
+	return room
+}
+
+// newRoom builds a room without registering it
+func newRoom(uuid string, mode RoomMode) *Room {
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := chat.NewHub(string(KindRoom) + "/" + uuid)
 
 	room := &Room{
+		ID: uuid,
 		Peers: &Peers{
-			TrackLocals: make(map[string]*webrtc.TrackLocalStaticRTP),
+			TrackLocals: make(map[string]*PublishedTrack),
 			Connections: []PeerConnectionState{},
-			PeerTracks:  make(map[string]map[string]*webrtc.TrackLocalStaticRTP),
+			PeerTracks:  make(map[string]map[string]*PublishedTrack),
+			SFU:         mode == RoomModeSFU,
 		},
 		Hub:               hub,
+		Mode:              mode,
 		HostPeerID:        "",                      // Will be set when first person joins
 		CoHosts:           make(map[string]bool),
+		roles:             make(map[string]Role),
+		roleCapabilities:  make(map[Role][]Capability),
 		ScreenSharePerms:  make(map[string]bool),   // Track who can share screen
 		MutedParticipants: make(map[string]bool),
+		GuestPolicy:       DefaultGuestPolicy,
+		passcodeAttempts:  make(map[string]*passcodeAttempts),
+		identities:        make(map[string]auth.Identity),
 		WaitingRoom:       make(map[string]*WaitingParticipant),
 		RaisedHands:       make(map[string]time.Time), // Track raised hands with timestamps
+		chatTokens:        make(map[string]string),
+		Moderation:        chat.NewModerator(),
+		Files:             files.NewStore(uuid),
 		IsLocked:          false,
 		IsChatDisabled:    false,
 		IsRecording:       false,
+		kind:              KindRoom,
+		createdAt:         time.Now(),
+		ctx:               ctx,
+		cancel:            cancel,
 	}
 
-	Rooms[uuid] = room
-	log.Printf("Room created: %s", uuid)
+	hub.Moderate = room.moderateHubChat
+	hub.Member = room.isPeer
+	go hub.Run(ctx)
+
+	// Only SFU rooms receive the audio needed to detect speakers
+	if room.Mode == RoomModeSFU {
+		room.Peers.Speakers = NewSpeakerDetector(
+			func(peerID string) {
+				room.Peers.BroadcastMessage(signaling.New(signaling.EventActiveSpeaker, signaling.PeerRef{PeerID: peerID}))
+			},
+			func(peerID string, speaking bool) {
+				room.Peers.BroadcastMessage(signaling.New(signaling.EventSpeakingChanged, signaling.SpeakingChanged{
+					PeerID:   peerID,
+					Speaking: speaking,
+				}))
+			},
+		)
+		go room.Peers.Speakers.Run()
+	}
+
+	return room
+}
 
+// restoreRoom brings back a room saved by an earlier process. Callers hold
+// RoomsLock.
+func restoreRoom(uuid string) *Room {
+	record, found, err := Store.Get(KindRoom, uuid)
+	if err != nil {
+		log.Printf("Error loading room %s: %v", uuid, err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+
+	room := newRoom(uuid, record.Mode)
+	room.restore(record)
+	room.persist() // Live again, so no longer due to expire
+	Rooms[uuid] = room
+	log.Printf("Room restored: %s (%s)", uuid, room.Mode)
 	return room
 }
 
 // GetRoom retrieves a room by UUID
 func GetRoom(uuid string) (*Room, bool) {
 	RoomsLock.RLock()
-	defer RoomsLock.RUnlock()
-
 	room, exists := Rooms[uuid]
-	return room, exists
+	RoomsLock.RUnlock()
+	if exists {
+		return room, true
+	}
+
+	RoomsLock.Lock()
+	defer RoomsLock.Unlock()
+	if room, exists := Rooms[uuid]; exists {
+		return room, true
+	}
+	room = restoreRoom(uuid)
+	return room, room != nil
 }
 
-// DeleteRoom removes a room when empty
+// DeleteRoom removes a room, its shared files and its stored record when
+// nobody is connected
 func DeleteRoom(uuid string) {
+	deleteRoom(uuid, true)
+}
+
+// deleteRoom removes a room and its stored record, and its shared files if
+// removeFiles is set. Rooms that were reaped keep their files, which
+// expire after files.Retention on their own.
+func deleteRoom(uuid string, removeFiles bool) {
 	RoomsLock.Lock()
 	defer RoomsLock.Unlock()
 
 	if room, exists := Rooms[uuid]; exists {
-		if room.Peers.GetConnectionCount() == 0 {
-			delete(Rooms, uuid)
-			log.Printf("Room deleted: %s", uuid)
+		if room.Peers.GetConnectionCount() > 0 {
+			return
 		}
+		delete(Rooms, uuid)
+		room.Close(signaling.RoomEndedDeleted)
 	}
+	if removeFiles {
+		files.NewStore(uuid).RemoveAll()
+	}
+	deleteStored(KindRoom, uuid)
+	log.Printf("Room deleted: %s", uuid)
 }
 
-// CreateStream creates or gets an existing stream
-func CreateStream(uuid string) *Room {
+// deleteStored drops the stored record and chat history of a room or
+// stream
+func deleteStored(kind RoomKind, uuid string) {
+	if err := chat.History.Delete(string(kind) + "/" + uuid); err != nil {
+		log.Printf("Error deleting chat history of %s %s: %v", kind, uuid, err)
+	}
+	if err := Store.Delete(kind, uuid); err != nil {
+		log.Printf("Error deleting stored %s %s: %v", kind, uuid, err)
+	}
+}
+
+// CreateStream registers a new stream and returns the key its publisher
+// must present. The key is not available again.
+func CreateStream(uuid string) (*Room, string, error) {
+	key, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
 	StreamsLock.Lock()
 	defer StreamsLock.Unlock()
 
-	if stream, exists := Streams[uuid]; exists {
-		return stream
+	if _, exists := Streams[uuid]; exists {
+		return nil, "", ErrStreamExists
 	}
+	if _, found, _ := Store.Get(KindStream, uuid); found {
+		return nil, "", ErrStreamExists
+	}
+
+	stream := newStream(uuid)
+	stream.publishKeyHash = hashPublishKey(key)
+	stream.streamState = StreamCreated
+	stream.persist()
 
-	// Create new stream
-	hub := chat.NewHub()
-	go hub.Run()
+	Streams[uuid] = stream
+	log.Printf("Stream created: %s", uuid)
+
+	return stream, key, nil
+}
+
+// newStream builds a stream without registering it
+func newStream(uuid string) *Room {
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := chat.NewHub(string(KindStream) + "/" + uuid)
 
 	stream := &Room{
+		ID: uuid,
 		Peers: &Peers{
-			TrackLocals: make(map[string]*webrtc.TrackLocalStaticRTP),
+			TrackLocals: make(map[string]*PublishedTrack),
 			Connections: []PeerConnectionState{},
-			PeerTracks:  make(map[string]map[string]*webrtc.TrackLocalStaticRTP),
+			PeerTracks:  make(map[string]map[string]*PublishedTrack),
+			SFU:         true,
+			HLS:         hls.Enabled,
 		},
-		Hub: hub,
+		Hub:              hub,
+		Mode:             RoomModeSFU,
+		CoHosts:          make(map[string]bool),
+		roles:            make(map[string]Role),
+		roleCapabilities: make(map[Role][]Capability),
+		ScreenSharePerms: make(map[string]bool),
+		chatTokens:       make(map[string]string),
+		Moderation:       chat.NewModerator(),
+		kind:             KindStream,
+		createdAt:        time.Now(),
+		ctx:              ctx,
+		cancel:           cancel,
 	}
-
-	Streams[uuid] = stream
-	log.Printf("Stream created: %s", uuid)
+	hub.Moderate = stream.moderateHubChat
+	hub.Member = stream.isPeer
+	go hub.Run(ctx)
 
 	return stream
 }
 
-// GetStream retrieves a stream by UUID
+// GetStream retrieves a stream by UUID. Streams saved by an earlier process
+// are restored; one that was live has lost its publisher and is ended.
 func GetStream(uuid string) (*Room, bool) {
 	StreamsLock.RLock()
-	defer StreamsLock.RUnlock()
-
 	stream, exists := Streams[uuid]
-	return stream, exists
+	StreamsLock.RUnlock()
+	if exists {
+		return stream, true
+	}
+
+	StreamsLock.Lock()
+	defer StreamsLock.Unlock()
+	if stream, exists := Streams[uuid]; exists {
+		return stream, true
+	}
+
+	record, found, err := Store.Get(KindStream, uuid)
+	if err != nil {
+		log.Printf("Error loading stream %s: %v", uuid, err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+
+	stream = newStream(uuid)
+	stream.restore(record)
+	if stream.streamState == StreamLive {
+		stream.streamState = StreamEnded
+	}
+	stream.persist() // Live again, so no longer due to expire
+	Streams[uuid] = stream
+	log.Printf("Stream restored: %s", uuid)
+	return stream, true
+}
+
+// DeleteStream removes a stream and its stored record when nobody is
+// connected
+func DeleteStream(uuid string) {
+	StreamsLock.Lock()
+	defer StreamsLock.Unlock()
+
+	if stream, exists := Streams[uuid]; exists {
+		if stream.Peers.GetConnectionCount() > 0 {
+			return
+		}
+		delete(Streams, uuid)
+		stream.Close(signaling.RoomEndedDeleted)
+	}
+	deleteStored(KindStream, uuid)
+	log.Printf("Stream deleted: %s", uuid)
 }
 
 // StartKeyFrameDispatcher starts periodic keyframe requests for smooth video
@@ -207,16 +536,20 @@ func GetStreamCount() int {
 	return len(Streams)
 }
 
-// SetHost sets the host/admin of the room (first person to join)
-func (r *Room) SetHost(peerID string) {
+// SetHost makes a peer the host of the room if it has none yet, and
+// reports whether it did. Peers become host by joining with a host join
+// token or, when join tokens are disabled, by joining a room that has
+// none; after that hosting is handed on (see HostLeft).
+func (r *Room) SetHost(peerID string) bool {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
 	
 	if r.HostPeerID == "" {
 		r.HostPeerID = peerID
-		r.ScreenSharePerms[peerID] = true // Host can always share screen
 		log.Printf("Host set to peer: %s", peerID)
+		return true
 	}
+	return false
 }
 
 // IsHost checks if a peer is the host
@@ -246,11 +579,12 @@ func (r *Room) RevokeScreenShare(peerID string) {
 	}
 }
 
-// CanShareScreen checks if a peer has screen sharing permission
+// CanShareScreen checks if a peer's role can share its screen or the host
+// approved it
 func (r *Room) CanShareScreen(peerID string) bool {
 	r.PermLock.RLock()
 	defer r.PermLock.RUnlock()
-	return r.ScreenSharePerms[peerID]
+	return r.ScreenSharePerms[peerID] || slices.Contains(r.capabilities(r.role(peerID)), CapShareScreen)
 }
 
 // GetHostPeerID returns the current host's peer ID
@@ -267,7 +601,7 @@ func (r *Room) AddCoHost(peerID string) {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
 	r.CoHosts[peerID] = true
-	r.ScreenSharePerms[peerID] = true // Co-hosts can share screen
+	delete(r.roles, peerID)
 	log.Printf("Co-host added: %s", peerID)
 }
 
@@ -286,13 +620,6 @@ func (r *Room) IsCoHost(peerID string) bool {
 	return r.CoHosts[peerID]
 }
 
-// IsHostOrCoHost checks if a peer has admin privileges
-func (r *Room) IsHostOrCoHost(peerID string) bool {
-	r.PermLock.RLock()
-	defer r.PermLock.RUnlock()
-	return r.HostPeerID == peerID || r.CoHosts[peerID]
-}
-
 // ============= ROOM SECURITY =============
 
 // LockRoom prevents new participants from joining
@@ -300,6 +627,7 @@ func (r *Room) LockRoom() {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
 	r.IsLocked = true
+	r.persist()
 	log.Println("Room locked")
 }
 
@@ -308,6 +636,7 @@ func (r *Room) UnlockRoom() {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
 	r.IsLocked = false
+	r.persist()
 	log.Println("Room unlocked")
 }
 
@@ -318,6 +647,45 @@ func (r *Room) IsRoomLocked() bool {
 	return r.IsLocked
 }
 
+// SetGuestPolicy changes what happens to joiners without a join token
+func (r *Room) SetGuestPolicy(policy GuestPolicy) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.GuestPolicy = policy
+	r.persist()
+	log.Printf("Guest policy set to %s", policy)
+}
+
+// GetGuestPolicy returns what happens to joiners without a join token
+func (r *Room) GetGuestPolicy() GuestPolicy {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return r.GuestPolicy
+}
+
+// SetIdentity records the verified join token identity of a peer
+func (r *Room) SetIdentity(peerID string, identity auth.Identity) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.identities[peerID] = identity
+}
+
+// Identity returns the verified identity of a peer, or false if it joined
+// without a join token
+func (r *Room) Identity(peerID string) (auth.Identity, bool) {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	identity, ok := r.identities[peerID]
+	return identity, ok
+}
+
+// ForgetIdentity drops the identity of a peer that left
+func (r *Room) ForgetIdentity(peerID string) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	delete(r.identities, peerID)
+}
+
 // ============= CHAT CONTROLS =============
 
 // DisableChat disables chat for all participants
@@ -325,6 +693,7 @@ func (r *Room) DisableChat() {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
 	r.IsChatDisabled = true
+	r.persist()
 	log.Println("Chat disabled")
 }
 
@@ -333,6 +702,7 @@ func (r *Room) EnableChat() {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
 	r.IsChatDisabled = false
+	r.persist()
 	log.Println("Chat enabled")
 }
 
@@ -343,6 +713,201 @@ func (r *Room) IsChatEnabled() bool {
 	return !r.IsChatDisabled
 }
 
+// DisablePrivateChat stops participants messaging each other privately
+func (r *Room) DisablePrivateChat() {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.IsPrivateChatDisabled = true
+	r.persist()
+	log.Println("Private chat disabled")
+}
+
+// EnablePrivateChat allows private messages again
+func (r *Room) EnablePrivateChat() {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.IsPrivateChatDisabled = false
+	r.persist()
+	log.Println("Private chat enabled")
+}
+
+// IsPrivateChatEnabled checks if private messages are allowed
+func (r *Room) IsPrivateChatEnabled() bool {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return !r.IsChatDisabled && !r.IsPrivateChatDisabled
+}
+
+// ModerateChat screens a chat message from either chat path: the room
+// websocket's chat-message event or the chat websocket. It returns the text
+// to send, which the filter may have masked. Those who can manage
+// participants are exempt from chat mutes and slow mode, which follow a
+// peer's user across reconnects when it joined with a token.
+func (r *Room) ModerateChat(peerID, text string, private bool, event string) (string, *signaling.Error) {
+	if !r.Can(peerID, CapChat) {
+		return "", signaling.NewError(signaling.CodeForbidden, event, "your role can't chat")
+	}
+	if !r.IsChatEnabled() {
+		return "", signaling.NewError(signaling.CodeForbidden, event, "chat is disabled")
+	}
+	if private && !r.IsPrivateChatEnabled() {
+		return "", signaling.NewError(signaling.CodeForbidden, event, "private chat is disabled")
+	}
+	return r.Moderation.Check(r.chatKey(peerID), text, r.Can(peerID, CapManageParticipants), time.Now(), event)
+}
+
+// chatKey is who chat mutes and slow mode apply to for a peer: its user
+// when it joined with a token, so leaving and rejoining doesn't lift them,
+// or else the peer itself
+func (r *Room) chatKey(peerID string) string {
+	if identity, ok := r.Identity(peerID); ok && identity.UserID != "" {
+		return "user:" + identity.UserID
+	}
+	return "peer:" + peerID
+}
+
+// NoteChatMessage remembers a message sent as a chat-message event rather
+// than over the chat websocket, and who received it: everyone, or the
+// sender and recipient of a private message. The last chat.HistoryLimit
+// are kept so moderators can delete them.
+func (r *Room) NoteChatMessage(id, senderID, targetID string) {
+	var audience []string
+	if targetID != "" {
+		audience = []string{senderID, targetID}
+	}
+
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	if r.sentChat == nil {
+		r.sentChat = make(map[string][]string)
+	}
+	r.sentChat[id] = audience
+	r.sentChatOrder = append(r.sentChatOrder, id)
+	if over := len(r.sentChatOrder) - chat.HistoryLimit; over > 0 {
+		for _, old := range r.sentChatOrder[:over] {
+			delete(r.sentChat, old)
+		}
+		r.sentChatOrder = r.sentChatOrder[over:]
+	}
+}
+
+// TakeChatMessage forgets a message noted by NoteChatMessage and returns
+// who received it, nil meaning everyone. It returns false if the message
+// isn't known.
+func (r *Room) TakeChatMessage(id string) ([]string, bool) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	audience, ok := r.sentChat[id]
+	delete(r.sentChat, id)
+	return audience, ok
+}
+
+// isPeer checks if a peer is connected to the room
+func (r *Room) isPeer(peerID string) bool {
+	_, ok := r.Peers.Get(peerID)
+	return ok
+}
+
+func (r *Room) moderateHubChat(peerID, text string, private bool, event string) (string, *signaling.Error) {
+	return r.ModerateChat(peerID, text, private, event)
+}
+
+// MuteChat stops a participant sending chat messages
+func (r *Room) MuteChat(peerID string) {
+	r.Moderation.Mute(r.chatKey(peerID))
+	log.Printf("Chat muted for peer: %s", peerID)
+}
+
+// UnmuteChat lets a participant chat again
+func (r *Room) UnmuteChat(peerID string) {
+	r.Moderation.Unmute(r.chatKey(peerID))
+	log.Printf("Chat unmuted for peer: %s", peerID)
+}
+
+// SetSlowMode limits participants to one chat message per interval; zero
+// turns slow mode off
+func (r *Room) SetSlowMode(interval time.Duration) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.Moderation.SetSlowMode(interval)
+	r.persist()
+	log.Printf("Chat slow mode set to %s", interval)
+}
+
+// IssueChatToken returns a token that identifies a peer on the chat
+// websocket, so chat messages carry who really sent them
+func (r *Room) IssueChatToken(peerID string) string {
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Error issuing chat token for peer %s: %v", peerID, err)
+		return ""
+	}
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	r.chatTokens[token] = peerID
+	return token
+}
+
+// RevokeChatTokens invalidates the chat tokens of a peer that left
+func (r *Room) RevokeChatTokens(peerID string) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+	for token, owner := range r.chatTokens {
+		if owner == peerID {
+			delete(r.chatTokens, token)
+		}
+	}
+}
+
+// ChatIdentity returns the peer a chat token was issued to
+func (r *Room) ChatIdentity(token string) (string, bool) {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	peerID, ok := r.chatTokens[token]
+	return peerID, ok
+}
+
+// ============= FILE SHARING =============
+
+// ShareFile stores a file uploaded by a participant and posts a
+// file-shared message to the room's chat. Uploads are moderated like chat
+// messages, by their name.
+func (r *Room) ShareFile(peerID, name string, content io.Reader) (*files.File, error) {
+	if r.Files == nil {
+		return nil, signaling.NewError(signaling.CodeForbidden, chat.TypeFileShared, "files can't be shared here")
+	}
+	name, modErr := r.ModerateChat(peerID, name, false, chat.TypeFileShared)
+	if modErr != nil {
+		return nil, modErr
+	}
+
+	username := r.Peers.GetUsername(peerID)
+	file, err := r.Files.Save(name, content, peerID, username)
+	if err != nil {
+		return nil, err
+	}
+
+	posted := r.Hub.Post(chat.Message{
+		Type:       chat.TypeFileShared,
+		ID:         uuid.New().String(),
+		Sender:     peerID,
+		SenderName: username,
+		Text:       file.Name,
+		Timestamp:  file.UploadedAt,
+		File: &chat.SharedFile{
+			ID:   file.ID,
+			Name: file.Name,
+			Type: file.Type,
+			Size: file.Size,
+		},
+	})
+	if !posted {
+		return nil, signaling.NewError(signaling.CodeForbidden, chat.TypeFileShared, "the room has ended")
+	}
+	log.Printf("Peer %s shared file %s (%d bytes)", peerID, file.ID, file.Size)
+	return file, nil
+}
+
 // ============= MUTE CONTROLS =============
 
 // MuteParticipant mutes a specific participant
@@ -368,15 +933,14 @@ func (r *Room) IsParticipantMuted(peerID string) bool {
 	return r.MutedParticipants[peerID]
 }
 
-// MuteAll mutes all participants except host and co-hosts
+// MuteAll mutes all participants except those who manage the room
 func (r *Room) MuteAll() {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
 	
 	r.Peers.ListLock.RLock()
 	for _, conn := range r.Peers.Connections {
-		// Don't mute host or co-hosts
-		if conn.PeerID != r.HostPeerID && !r.CoHosts[conn.PeerID] {
+		if !slices.Contains(r.capabilities(r.role(conn.PeerID)), CapManageParticipants) {
 			r.MutedParticipants[conn.PeerID] = true
 		}
 	}
@@ -393,43 +957,108 @@ func (r *Room) UnmuteAll() {
 }
 
 // ============= WAITING ROOM =============
-
-// AddToWaitingRoom adds a participant to the waiting room
-func (r *Room) AddToWaitingRoom(peerID, name string, conn interface{}) {
+//
+// Joiners who must be admitted are parked here with their websocket open
+// but no peer connection. Those who can manage participants are sent the
+// list every time it changes, and entries that wait longer than
+// WaitingRoomTimeout are turned away.
+
+// SetWaitingRoom turns the waiting room on or off. Turning it off doesn't
+// let in those already waiting; hosts still admit or deny them.
+func (r *Room) SetWaitingRoom(enabled bool) {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
-	
-	r.WaitingRoom[peerID] = &WaitingParticipant{
+	r.WaitingRoomEnabled = enabled
+	r.persist()
+	log.Printf("Waiting room of room %s enabled: %v", r.ID, enabled)
+}
+
+// IsWaitingRoomEnabled checks if joiners wait to be admitted
+func (r *Room) IsWaitingRoomEnabled() bool {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return r.WaitingRoomEnabled
+}
+
+// AddToWaitingRoom adds a participant to the waiting room. The returned
+// entry's Decision tells its connection whether it was let in.
+func (r *Room) AddToWaitingRoom(peerID, name string, conn interface{}) *WaitingParticipant {
+	r.PermLock.Lock()
+	participant := &WaitingParticipant{
 		PeerID:   peerID,
 		Name:     name,
 		JoinTime: time.Now(),
 		Conn:     conn,
+		decision: make(chan bool, 1),
 	}
+	if WaitingRoomTimeout > 0 {
+		participant.expiry = time.AfterFunc(WaitingRoomTimeout, func() {
+			r.RemoveFromWaitingRoom(peerID, "You waited too long to be admitted")
+		})
+	}
+	r.WaitingRoom[peerID] = participant
+	r.PermLock.Unlock()
+
 	log.Printf("Added to waiting room: %s (%s)", name, peerID)
+	r.notifyWaitingRoom()
+	return participant
+}
+
+// SetWaitingName updates the name a waiting participant is shown under
+func (r *Room) SetWaitingName(peerID, name string) {
+	r.PermLock.Lock()
+	participant := r.WaitingRoom[peerID]
+	if participant != nil {
+		participant.Name = name
+	}
+	r.PermLock.Unlock()
+
+	if participant != nil {
+		r.notifyWaitingRoom()
+	}
 }
 
 // AdmitFromWaitingRoom admits a participant from waiting room
 func (r *Room) AdmitFromWaitingRoom(peerID string) *WaitingParticipant {
 	r.PermLock.Lock()
-	defer r.PermLock.Unlock()
-	
 	participant := r.WaitingRoom[peerID]
 	if participant != nil {
 		delete(r.WaitingRoom, peerID)
+		participant.stopExpiry()
+		participant.decision <- true
+	}
+	r.PermLock.Unlock()
+
+	if participant != nil {
 		log.Printf("Admitted from waiting room: %s", peerID)
+		r.notifyWaitingRoom()
 	}
 	return participant
 }
 
-// RemoveFromWaitingRoom removes a participant from waiting room (deny entry)
-func (r *Room) RemoveFromWaitingRoom(peerID string) {
+// RemoveFromWaitingRoom turns a participant away from the waiting room,
+// telling them why, and reports whether they were waiting
+func (r *Room) RemoveFromWaitingRoom(peerID, reason string) bool {
 	r.PermLock.Lock()
-	defer r.PermLock.Unlock()
-	delete(r.WaitingRoom, peerID)
-	log.Printf("Removed from waiting room: %s", peerID)
+	participant := r.WaitingRoom[peerID]
+	if participant != nil {
+		delete(r.WaitingRoom, peerID)
+		participant.stopExpiry()
+		participant.reason = reason
+		participant.decision <- false
+	}
+	r.PermLock.Unlock()
+
+	if participant == nil {
+		return false
+	}
+	log.Printf("Removed from waiting room: %s (%s)", peerID, reason)
+	r.notifyWaitingRoom()
+	return true
 }
 
-// GetWaitingParticipants returns all participants in waiting room
+// GetWaitingParticipants returns all participants in waiting room, longest
+// waiting first
 func (r *Room) GetWaitingParticipants() []*WaitingParticipant {
 	r.PermLock.RLock()
 	defer r.PermLock.RUnlock()
@@ -438,35 +1067,86 @@ func (r *Room) GetWaitingParticipants() []*WaitingParticipant {
 	for _, p := range r.WaitingRoom {
 		participants = append(participants, p)
 	}
+	slices.SortFunc(participants, func(a, b *WaitingParticipant) int { return a.JoinTime.Compare(b.JoinTime) })
 	return participants
 }
 
+// WaitingRoomList describes the waiting room as hosts are shown it
+func (r *Room) WaitingRoomList() signaling.WaitingRoomList {
+	waiting := r.GetWaitingParticipants()
+	list := signaling.WaitingRoomList{Participants: make([]signaling.WaitingParticipant, 0, len(waiting))}
+	r.PermLock.RLock()
+	for _, p := range waiting {
+		list.Participants = append(list.Participants, signaling.WaitingParticipant{
+			PeerID:   p.PeerID,
+			Name:     p.Name,
+			JoinTime: p.JoinTime,
+		})
+	}
+	r.PermLock.RUnlock()
+	return list
+}
+
+// notifyWaitingRoom sends the waiting room to everyone in the room who can
+// manage participants
+func (r *Room) notifyWaitingRoom() {
+	frame := signaling.New(signaling.EventWaitingRoomUpdated, r.WaitingRoomList())
+	for _, peerID := range r.Peers.PeerIDs() {
+		if r.Can(peerID, CapManageParticipants) {
+			r.Peers.SendToPeer(frame, peerID)
+		}
+	}
+}
+
+// stopExpiry cancels the participant's timeout. Callers hold PermLock.
+func (p *WaitingParticipant) stopExpiry() {
+	if p.expiry != nil {
+		p.expiry.Stop()
+	}
+}
+
 // ============= RECORDING =============
 
-// StartRecording starts recording the session
-func (r *Room) StartRecording() {
+// StartRecording starts writing every published track to disk
+func (r *Room) StartRecording() error {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
-	
-	if !r.IsRecording {
-		r.IsRecording = true
-		r.RecordingStartTime = time.Now()
-		log.Println("Recording started")
+
+	if r.IsRecording {
+		return nil
+	}
+
+	rec, err := recording.Start(r.ID)
+	if err != nil {
+		return err
 	}
+	r.recorder = rec
+	r.IsRecording = true
+	r.RecordingStartTime = rec.StartedAt
+	r.Peers.StartRecording(rec)
+	return nil
 }
 
-// StopRecording stops recording the session
-func (r *Room) StopRecording() time.Duration {
+// StopRecording finishes the recording and writes its manifest. It returns
+// the recording ID and how long it ran.
+func (r *Room) StopRecording() (string, time.Duration) {
 	r.PermLock.Lock()
 	defer r.PermLock.Unlock()
-	
-	var duration time.Duration
-	if r.IsRecording {
-		duration = time.Since(r.RecordingStartTime)
-		r.IsRecording = false
-		log.Printf("Recording stopped. Duration: %v", duration)
+
+	if !r.IsRecording {
+		return "", 0
+	}
+
+	r.Peers.StopRecording()
+	rec := r.recorder
+	r.recorder = nil
+	r.IsRecording = false
+
+	duration := time.Since(r.RecordingStartTime)
+	if _, err := rec.Stop(); err != nil {
+		log.Printf("Error finishing recording %s: %v", rec.ID, err)
 	}
-	return duration
+	return rec.ID, duration
 }
 
 // IsRecordingActive checks if recording is active
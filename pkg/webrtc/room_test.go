@@ -0,0 +1,99 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"videochat/pkg/auth"
+)
+
+func TestWaitingRoom(t *testing.T) {
+	saved, savedTimeout := Store, WaitingRoomTimeout
+	Store = NewMemoryStore()
+	defer func() { Store, WaitingRoomTimeout = saved, savedTimeout }()
+
+	room := CreateRoomWithOptions("waiting-room", RoomOptions{WaitingRoom: true})
+	defer DeleteRoom(room.ID)
+	if !room.IsWaitingRoomEnabled() {
+		t.Fatal("waiting room not enabled by the room options")
+	}
+
+	WaitingRoomTimeout = time.Minute
+	alice := room.AddToWaitingRoom("alice", "Alice", nil)
+	bob := room.AddToWaitingRoom("bob", "Bob", nil)
+	if list := room.WaitingRoomList(); len(list.Participants) != 2 || list.Participants[0].PeerID != "alice" {
+		t.Fatalf("waiting room = %+v", list)
+	}
+
+	if room.AdmitFromWaitingRoom("alice") == nil || !<-alice.Decision() {
+		t.Error("alice was not admitted")
+	}
+	if !room.RemoveFromWaitingRoom("bob", "Not today") || <-bob.Decision() || bob.Reason() != "Not today" {
+		t.Errorf("bob was not denied: %q", bob.Reason())
+	}
+	if room.RemoveFromWaitingRoom("bob", "again") {
+		t.Error("bob denied twice")
+	}
+
+	WaitingRoomTimeout = 10 * time.Millisecond
+	carol := room.AddToWaitingRoom("carol", "Carol", nil)
+	select {
+	case admitted := <-carol.Decision():
+		if admitted || carol.Reason() == "" {
+			t.Errorf("expired entry = %v, %q", admitted, carol.Reason())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting room entry did not expire")
+	}
+	if list := room.WaitingRoomList(); len(list.Participants) != 0 {
+		t.Errorf("waiting room after expiry = %+v", list)
+	}
+}
+
+func TestChatMuteFollowsUser(t *testing.T) {
+	saved := Store
+	Store = NewMemoryStore()
+	defer func() { Store = saved }()
+
+	room := CreateRoom("chat-mute")
+	defer DeleteRoom(room.ID)
+	room.SetIdentity("alice-1", auth.Identity{UserID: "u-alice"})
+	room.MuteChat("alice-1")
+	room.MuteChat("guest-1")
+
+	// Rejoining as a new peer doesn't lift a mute on a token user
+	room.ForgetIdentity("alice-1")
+	room.SetIdentity("alice-2", auth.Identity{UserID: "u-alice"})
+	if _, err := room.ModerateChat("alice-2", "hi", false, "chat-message"); err == nil {
+		t.Error("muted user chatted after rejoining")
+	}
+	if _, err := room.ModerateChat("guest-2", "hi", false, "chat-message"); err != nil {
+		t.Errorf("unrelated guest muted: %v", err)
+	}
+
+	room.UnmuteChat("alice-2")
+	if _, err := room.ModerateChat("alice-2", "hi", false, "chat-message"); err != nil {
+		t.Errorf("unmuted user can't chat: %v", err)
+	}
+}
+
+func TestNoteChatMessage(t *testing.T) {
+	saved := Store
+	Store = NewMemoryStore()
+	defer func() { Store = saved }()
+
+	room := CreateRoom("chat-notes")
+	defer DeleteRoom(room.ID)
+	room.NoteChatMessage("public", "alice", "")
+	room.NoteChatMessage("private", "alice", "bob")
+
+	if audience, ok := room.TakeChatMessage("public"); !ok || audience != nil {
+		t.Errorf("public message audience = %v, %v", audience, ok)
+	}
+	if audience, ok := room.TakeChatMessage("private"); !ok || len(audience) != 2 || audience[0] != "alice" || audience[1] != "bob" {
+		t.Errorf("private message audience = %v, %v", audience, ok)
+	}
+	if _, ok := room.TakeChatMessage("private"); ok {
+		t.Error("message deleted twice")
+	}
+}
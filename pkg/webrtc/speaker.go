@@ -0,0 +1,163 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+)
+
+// Audio levels follow RFC 6464: 0 is the loudest (0 dBov) and 127 silence.
+// Speaking thresholds have some hysteresis so a peer doesn't flicker
+// between speaking and silent at the boundary.
+const (
+	speakingOnLevel  = 50 // louder than -50 dBov starts speaking
+	speakingOffLevel = 60 // quieter than -60 dBov stops speaking
+
+	// levelSmoothing is the weight of each new packet in the running level
+	levelSmoothing = 0.1
+
+	// speakerInterval is how often the dominant speaker is re-evaluated
+	speakerInterval = 200 * time.Millisecond
+
+	// speakerHold is how long a new dominant speaker must wait before
+	// taking over from one who is still speaking
+	speakerHold = time.Second
+
+	// speakerTimeout is how long without audio before a peer is silent
+	speakerTimeout = time.Second
+)
+
+// SpeakerDetector follows the audio levels publishers report in their RTP
+// headers and works out who is speaking and who the dominant speaker is
+type SpeakerDetector struct {
+	mu       sync.Mutex
+	levels   map[string]*speakerLevel
+	active   string
+	switched time.Time
+
+	onActive   func(peerID string)
+	onSpeaking func(peerID string, speaking bool)
+
+	done chan struct{}
+	once sync.Once
+}
+
+// speakerLevel is the smoothed loudness of one peer, where 0 is silence and
+// 127 is the loudest
+type speakerLevel struct {
+	loudness float64
+	speaking bool
+	lastSeen time.Time
+}
+
+// NewSpeakerDetector creates a detector. onActive is called when the
+// dominant speaker changes and onSpeaking when a peer starts or stops
+// speaking; both run on the detector's goroutine.
+func NewSpeakerDetector(onActive func(peerID string), onSpeaking func(peerID string, speaking bool)) *SpeakerDetector {
+	return &SpeakerDetector{
+		levels:     make(map[string]*speakerLevel),
+		onActive:   onActive,
+		onSpeaking: onSpeaking,
+		done:       make(chan struct{}),
+	}
+}
+
+// Observe records the audio level of one packet from a peer
+func (d *SpeakerDetector) Observe(peerID string, level uint8) {
+	loudness := float64(127 - min(level, 127))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	l, ok := d.levels[peerID]
+	if !ok {
+		l = &speakerLevel{}
+		d.levels[peerID] = l
+	}
+	l.loudness += levelSmoothing * (loudness - l.loudness)
+	l.lastSeen = time.Now()
+}
+
+// Run evaluates speakers until Stop is called
+func (d *SpeakerDetector) Run() {
+	ticker := time.NewTicker(speakerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.evaluate()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Stop ends Run
+func (d *SpeakerDetector) Stop() {
+	d.once.Do(func() { close(d.done) })
+}
+
+// ActiveSpeaker returns the current dominant speaker, if any
+func (d *SpeakerDetector) ActiveSpeaker() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+type speakingChange struct {
+	peerID   string
+	speaking bool
+}
+
+func (d *SpeakerDetector) evaluate() {
+	now := time.Now()
+	var changes []speakingChange
+
+	d.mu.Lock()
+	loudest, loudestLevel := "", 0.0
+	for peerID, l := range d.levels {
+		if now.Sub(l.lastSeen) > speakerTimeout {
+			// The track ended or the peer stopped sending audio
+			l.loudness = 0
+		}
+
+		switch {
+		case !l.speaking && l.loudness >= 127-speakingOnLevel:
+			l.speaking = true
+			changes = append(changes, speakingChange{peerID, true})
+		case l.speaking && l.loudness <= 127-speakingOffLevel:
+			l.speaking = false
+			changes = append(changes, speakingChange{peerID, false})
+		}
+
+		if l.speaking && l.loudness > loudestLevel {
+			loudest, loudestLevel = peerID, l.loudness
+		}
+
+		if !l.speaking && now.Sub(l.lastSeen) > 10*speakerTimeout {
+			delete(d.levels, peerID)
+		}
+	}
+
+	// The dominant speaker only changes when someone else is louder and the
+	// current one has held the floor long enough, or has gone quiet
+	changed := false
+	current, stillSpeaking := d.levels[d.active]
+	if loudest != "" && loudest != d.active &&
+		(!stillSpeaking || !current.speaking || now.Sub(d.switched) >= speakerHold) {
+		d.active = loudest
+		d.switched = now
+		changed = true
+	}
+	active := d.active
+	d.mu.Unlock()
+
+	for _, c := range changes {
+		if d.onSpeaking != nil {
+			d.onSpeaking(c.peerID, c.speaking)
+		}
+	}
+	if changed && d.onActive != nil {
+		d.onActive(active)
+	}
+}
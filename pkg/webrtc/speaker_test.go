@@ -0,0 +1,46 @@
+package webrtc
+
+import "testing"
+
+func TestSpeakerDetectorPicksLoudestSpeaker(t *testing.T) {
+	var active []string
+	speaking := map[string]bool{}
+	d := NewSpeakerDetector(
+		func(peerID string) { active = append(active, peerID) },
+		func(peerID string, s bool) { speaking[peerID] = s },
+	)
+
+	talk := func(peerID string, level uint8, packets int) {
+		for i := 0; i < packets; i++ {
+			d.Observe(peerID, level)
+		}
+	}
+
+	talk("alice", 30, 100)
+	talk("bob", 127, 100)
+	d.evaluate()
+
+	if !speaking["alice"] || speaking["bob"] {
+		t.Fatalf("speaking = %v, want only alice", speaking)
+	}
+	if len(active) != 1 || active[0] != "alice" {
+		t.Fatalf("active speakers = %v, want [alice]", active)
+	}
+
+	// Bob is louder, but alice still holds the floor
+	talk("bob", 10, 100)
+	d.evaluate()
+	if d.ActiveSpeaker() != "alice" {
+		t.Fatalf("active speaker switched to %q within the hold time", d.ActiveSpeaker())
+	}
+
+	// Once alice goes quiet bob takes over immediately
+	talk("alice", 127, 100)
+	d.evaluate()
+	if !speaking["bob"] || speaking["alice"] {
+		t.Fatalf("speaking = %v, want only bob", speaking)
+	}
+	if d.ActiveSpeaker() != "bob" {
+		t.Fatalf("active speaker = %q, want bob", d.ActiveSpeaker())
+	}
+}
@@ -0,0 +1,166 @@
+package webrtc
+
+import (
+	"log"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RoomKind tells rooms and streams apart in a RoomStore
+type RoomKind string
+
+const (
+	KindRoom   RoomKind = "room"
+	KindStream RoomKind = "stream"
+)
+
+// RoomRecord is the part of a room or stream that outlives the process:
+// its metadata and host settings. Connections, tracks and chat are not
+// persisted, and neither is recording, which can't resume after a restart.
+// Nor is anything granted to a participant, such as co-host or screen
+// sharing: peer IDs are new on every connection, so those grants would
+// point at nobody once the peer is gone.
+type RoomRecord struct {
+	ID        string    `json:"id"`
+	Kind      RoomKind  `json:"kind"`
+	Mode      RoomMode  `json:"mode"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	IsLocked              bool          `json:"isLocked,omitempty"`
+	GuestPolicy           GuestPolicy   `json:"guestPolicy,omitempty"`
+	PasscodeHash          []byte        `json:"passcodeHash,omitempty"`
+	WaitingRoom           bool          `json:"waitingRoom,omitempty"`
+	IsChatDisabled        bool          `json:"isChatDisabled,omitempty"`
+	IsPrivateChatDisabled bool          `json:"isPrivateChatDisabled,omitempty"`
+	ChatSlowMode          time.Duration `json:"chatSlowMode,omitempty"`
+
+	RoleCapabilities map[Role][]Capability `json:"roleCapabilities,omitempty"`
+
+	// ReapedAt is when the room was last closed for being idle; zero while
+	// it is live. Records reaped for RecordRetention are deleted.
+	ReapedAt time.Time `json:"reapedAt,omitempty"`
+
+	// Streams only
+	PublishKeyHash string      `json:"publishKeyHash,omitempty"`
+	StreamState    StreamState `json:"streamState,omitempty"`
+}
+
+// RoomStore persists room and stream records. CreateRoom, GetRoom,
+// DeleteRoom and their stream equivalents keep it up to date.
+type RoomStore interface {
+	// Get returns a record, or false if there is none
+	Get(kind RoomKind, id string) (RoomRecord, bool, error)
+
+	// Put creates or replaces a record
+	Put(record RoomRecord) error
+
+	// Delete removes a record. Deleting a missing record is not an error.
+	Delete(kind RoomKind, id string) error
+
+	// List returns every record of a kind
+	List(kind RoomKind) ([]RoomRecord, error)
+
+	Close() error
+}
+
+// Store holds the records of every room and stream. It defaults to memory;
+// set it to a persistent store before serving to keep rooms across restarts.
+var Store RoomStore = NewMemoryStore()
+
+// MemoryStore is a RoomStore that lasts as long as the process
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[RoomKind]map[string]RoomRecord
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[RoomKind]map[string]RoomRecord)}
+}
+
+func (s *MemoryStore) Get(kind RoomKind, id string) (RoomRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[kind][id]
+	return record, ok, nil
+}
+
+func (s *MemoryStore) Put(record RoomRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[record.Kind] == nil {
+		s.records[record.Kind] = make(map[string]RoomRecord)
+	}
+	s.records[record.Kind][record.ID] = record
+	return nil
+}
+
+func (s *MemoryStore) Delete(kind RoomKind, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records[kind], id)
+	return nil
+}
+
+func (s *MemoryStore) List(kind RoomKind) ([]RoomRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]RoomRecord, 0, len(s.records[kind]))
+	for _, record := range s.records[kind] {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// record snapshots the persisted part of a room. Callers hold PermLock.
+func (r *Room) record() RoomRecord {
+	return RoomRecord{
+		ID:                    r.ID,
+		Kind:                  r.kind,
+		Mode:                  r.Mode,
+		CreatedAt:             r.createdAt,
+		IsLocked:              r.IsLocked,
+		GuestPolicy:           r.GuestPolicy,
+		PasscodeHash:          r.passcodeHash,
+		WaitingRoom:           r.WaitingRoomEnabled,
+		IsChatDisabled:        r.IsChatDisabled,
+		IsPrivateChatDisabled: r.IsPrivateChatDisabled,
+		ChatSlowMode:          r.Moderation.SlowMode(),
+		RoleCapabilities:      maps.Clone(r.roleCapabilities),
+		PublishKeyHash:        r.publishKeyHash,
+		StreamState:           r.streamState,
+	}
+}
+
+// persist writes the room's record to the store. Callers hold PermLock.
+func (r *Room) persist() {
+	if err := Store.Put(r.record()); err != nil {
+		log.Printf("Error saving %s %s: %v", r.kind, r.ID, err)
+	}
+}
+
+// restore applies a stored record to a freshly created room
+func (r *Room) restore(record RoomRecord) {
+	r.createdAt = record.CreatedAt
+	r.IsLocked = record.IsLocked
+	if record.GuestPolicy != "" {
+		r.GuestPolicy = record.GuestPolicy
+	}
+	r.passcodeHash = record.PasscodeHash
+	r.WaitingRoomEnabled = record.WaitingRoom
+	r.IsChatDisabled = record.IsChatDisabled
+	r.IsPrivateChatDisabled = record.IsPrivateChatDisabled
+	r.Moderation.SetSlowMode(record.ChatSlowMode)
+	for role, capabilities := range record.RoleCapabilities {
+		r.roleCapabilities[role] = capabilities
+	}
+	r.publishKeyHash = record.PublishKeyHash
+	r.streamState = record.StreamState
+}
@@ -0,0 +1,86 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a RoomStore kept in a bbolt database file, with one bucket
+// per kind holding JSON records keyed by ID
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates a store file
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open room store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, kind := range []RoomKind{KindRoom, KindStream} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(kind)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initialize room store %s: %w", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(kind RoomKind, id string) (RoomRecord, bool, error) {
+	var record RoomRecord
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(kind)).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &record)
+	})
+	return record, found, err
+}
+
+func (s *BoltStore) Put(record RoomRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(record.Kind)).Put([]byte(record.ID), data)
+	})
+}
+
+func (s *BoltStore) Delete(kind RoomKind, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(kind)).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) List(kind RoomKind) ([]RoomRecord, error) {
+	var records []RoomRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(kind)).ForEach(func(_, data []byte) error {
+			var record RoomRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,139 @@
+package webrtc
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoresRoundTrip(t *testing.T) {
+	bolt, err := OpenBoltStore(filepath.Join(t.TempDir(), "rooms.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+
+	for name, store := range map[string]RoomStore{"memory": NewMemoryStore(), "bolt": bolt} {
+		t.Run(name, func(t *testing.T) {
+			record := RoomRecord{ID: "r1", Kind: KindRoom, Mode: RoomModeSFU, IsLocked: true, GuestPolicy: GuestsWait}
+			if err := store.Put(record); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Put(RoomRecord{ID: "s1", Kind: KindStream, StreamState: StreamCreated}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, found, err := store.Get(KindRoom, "r1")
+			if err != nil || !found {
+				t.Fatalf("Get = %v, %v", found, err)
+			}
+			if got.Mode != RoomModeSFU || !got.IsLocked || got.GuestPolicy != GuestsWait {
+				t.Errorf("Get = %+v", got)
+			}
+			if _, found, _ := store.Get(KindStream, "r1"); found {
+				t.Error("room record found as a stream")
+			}
+
+			rooms, err := store.List(KindRoom)
+			if err != nil || len(rooms) != 1 {
+				t.Fatalf("List = %v, %v", rooms, err)
+			}
+
+			if err := store.Delete(KindRoom, "r1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, found, _ := store.Get(KindRoom, "r1"); found {
+				t.Error("record survived Delete")
+			}
+		})
+	}
+}
+
+func TestRoomsRestoreFromStore(t *testing.T) {
+	saved := Store
+	Store = NewMemoryStore()
+	defer func() { Store = saved }()
+
+	room := CreateRoomWithOptions("store-restore", RoomOptions{Mode: RoomModeSFU, GuestPolicy: GuestsWait, WaitingRoom: true})
+	room.LockRoom()
+	room.AddCoHost("alice")
+
+	_, key, err := CreateStream("store-restore-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := GetStream("store-restore-stream")
+	if err := stream.AuthorizePublisher("pub", key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a restart by dropping the live rooms
+	RoomsLock.Lock()
+	delete(Rooms, "store-restore")
+	RoomsLock.Unlock()
+	StreamsLock.Lock()
+	delete(Streams, "store-restore-stream")
+	StreamsLock.Unlock()
+
+	restored, ok := GetRoom("store-restore")
+	if !ok {
+		t.Fatal("room was not restored")
+	}
+	if restored == room || restored.Mode != RoomModeSFU || !restored.IsRoomLocked() {
+		t.Errorf("restored room = mode %s, locked %v", restored.Mode, restored.IsRoomLocked())
+	}
+	if restored.IsCoHost("alice") {
+		t.Error("co-host of a peer ID from before the restart restored")
+	}
+	if policy := restored.GetGuestPolicy(); policy != GuestsWait {
+		t.Errorf("restored guest policy = %s", policy)
+	}
+	if !restored.IsWaitingRoomEnabled() {
+		t.Error("waiting room not restored")
+	}
+
+	restoredStream, ok := GetStream("store-restore-stream")
+	if !ok {
+		t.Fatal("stream was not restored")
+	}
+	if restoredStream.StreamState() != StreamEnded {
+		t.Errorf("restored stream state = %s", restoredStream.StreamState())
+	}
+	if err := restoredStream.AuthorizePublisher("pub2", key); err != nil {
+		t.Errorf("publish key lost on restore: %v", err)
+	}
+}
+
+// countingStore counts the records written to a store
+type countingStore struct {
+	RoomStore
+	puts int
+}
+
+func (s *countingStore) Put(record RoomRecord) error {
+	s.puts++
+	return s.RoomStore.Put(record)
+}
+
+func TestPeerGrantsAreNotStored(t *testing.T) {
+	saved := Store
+	store := &countingStore{RoomStore: NewMemoryStore()}
+	Store = store
+	defer func() { Store = saved }()
+
+	room := CreateRoom("store-grants")
+	defer DeleteRoom(room.ID)
+	before, _, _ := Store.Get(KindRoom, room.ID)
+	puts := store.puts
+
+	room.AddCoHost("alice")
+	room.RemoveCoHost("alice")
+	room.GrantScreenShare("bob")
+	room.RevokeScreenShare("bob")
+	if store.puts != puts {
+		t.Errorf("%d writes for peer grants, want none", store.puts-puts)
+	}
+	if after, _, _ := Store.Get(KindRoom, room.ID); !reflect.DeepEqual(after, before) {
+		t.Errorf("stored record changed: %+v", after)
+	}
+}
@@ -1,7 +1,117 @@
 package webrtc
 
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+)
+
 // Stream is an alias for Room as they share the same structure
 // Streams are used for one-to-many broadcasting (like live streaming)
 // while Rooms are used for many-to-many conferencing
 type Stream = Room
 
+// StreamState is where a stream is in its lifecycle
+type StreamState string
+
+const (
+	// StreamCreated is a registered stream nobody has published to yet
+	StreamCreated StreamState = "created"
+
+	// StreamLive has a publisher connected
+	StreamLive StreamState = "live"
+
+	// StreamEnded has lost its publisher. The publisher may go live again
+	// with the same key.
+	StreamEnded StreamState = "ended"
+)
+
+// StreamRole is what a stream connection may do
+type StreamRole string
+
+const (
+	// StreamPublisher presented the publish key and may send tracks
+	StreamPublisher StreamRole = "publisher"
+
+	// StreamViewer only receives the published tracks
+	StreamViewer StreamRole = "viewer"
+)
+
+var (
+	// ErrStreamExists is returned when registering a stream ID twice
+	ErrStreamExists = errors.New("stream already exists")
+
+	// ErrInvalidPublishKey is returned for a missing or wrong publish key
+	ErrInvalidPublishKey = errors.New("invalid publish key")
+
+	// ErrStreamBusy is returned when another connection is publishing
+	ErrStreamBusy = errors.New("stream already has a publisher")
+)
+
+// randomToken generates a random key or token
+func randomToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashPublishKey is how publish keys are kept, so a leaked store doesn't
+// leak the keys
+func hashPublishKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthorizePublisher makes a connection the stream's publisher if it
+// presents the publish key and nobody else is publishing
+func (r *Room) AuthorizePublisher(peerID, key string) error {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+
+	if r.publishKeyHash == "" || subtle.ConstantTimeCompare([]byte(hashPublishKey(key)), []byte(r.publishKeyHash)) != 1 {
+		return ErrInvalidPublishKey
+	}
+	if r.publisherID != "" && r.publisherID != peerID {
+		return ErrStreamBusy
+	}
+
+	r.publisherID = peerID
+	r.streamState = StreamLive
+	r.persist()
+	log.Printf("Stream %s is live, published by %s", r.ID, peerID)
+	return nil
+}
+
+// ReleasePublisher ends the stream when its publisher disconnects
+func (r *Room) ReleasePublisher(peerID string) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+
+	if r.publisherID != peerID {
+		return
+	}
+	r.publisherID = ""
+	r.streamState = StreamEnded
+	r.persist()
+	log.Printf("Stream %s ended", r.ID)
+}
+
+// IsPublisher checks if a connection is the stream's publisher
+func (r *Room) IsPublisher(peerID string) bool {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return peerID != "" && r.publisherID == peerID
+}
+
+// StreamState returns where the stream is in its lifecycle
+func (r *Room) StreamState() StreamState {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return r.streamState
+}
@@ -0,0 +1,46 @@
+package webrtc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStreamPublisherLifecycle(t *testing.T) {
+	stream, key, err := CreateStream("stream-lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateStream("stream-lifecycle"); !errors.Is(err, ErrStreamExists) {
+		t.Fatalf("second CreateStream = %v", err)
+	}
+	if stream.StreamState() != StreamCreated {
+		t.Fatalf("state = %s", stream.StreamState())
+	}
+
+	if err := stream.AuthorizePublisher("a", "wrong"); !errors.Is(err, ErrInvalidPublishKey) {
+		t.Fatalf("wrong key = %v", err)
+	}
+	if err := stream.AuthorizePublisher("a", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.AuthorizePublisher("b", key); !errors.Is(err, ErrStreamBusy) {
+		t.Fatalf("second publisher = %v", err)
+	}
+	if !stream.IsPublisher("a") || stream.StreamState() != StreamLive {
+		t.Fatalf("publisher a not live: state %s", stream.StreamState())
+	}
+
+	stream.ReleasePublisher("b")
+	if stream.StreamState() != StreamLive {
+		t.Fatal("a viewer leaving ended the stream")
+	}
+	stream.ReleasePublisher("a")
+	if stream.StreamState() != StreamEnded || stream.IsPublisher("a") {
+		t.Fatalf("state after publisher left = %s", stream.StreamState())
+	}
+
+	// The publisher can go live again with the same key
+	if err := stream.AuthorizePublisher("b", key); err != nil {
+		t.Fatal(err)
+	}
+}
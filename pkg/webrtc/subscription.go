@@ -0,0 +1,117 @@
+package webrtc
+
+import "fmt"
+
+// TrackSource says what a published track carries
+type TrackSource string
+
+const (
+	SourceAudio  TrackSource = "audio"
+	SourceVideo  TrackSource = "video"
+	SourceScreen TrackSource = "screen"
+)
+
+// AllSources lists every track source
+var AllSources = []TrackSource{SourceAudio, SourceVideo, SourceScreen}
+
+// ParseTrackSource validates a source name received from a client
+func ParseTrackSource(s string) (TrackSource, error) {
+	switch source := TrackSource(s); source {
+	case SourceAudio, SourceVideo, SourceScreen:
+		return source, nil
+	default:
+		return "", fmt.Errorf("unknown track source %q (want audio, video or screen)", s)
+	}
+}
+
+// subscription is the set of tracks one connection asked to receive. A
+// connection receives everything until it first narrows its subscription.
+type subscription struct {
+	manual bool
+	wants  map[string]map[TrackSource]bool // publisher peer ID -> sources
+}
+
+func (s *subscription) includes(publisherID string, source TrackSource) bool {
+	if s == nil || !s.manual {
+		return true
+	}
+	return s.wants[publisherID][source]
+}
+
+// Subscribe adds a publisher's sources to what a peer receives. With no
+// publisher the peer goes back to receiving every track in the room.
+func (p *Peers) Subscribe(peerID, publisherID string, sources []TrackSource) {
+	p.updateSubscription(peerID, func(s *subscription) {
+		if publisherID == "" {
+			s.manual = false
+			s.wants = nil
+			return
+		}
+		if !s.manual {
+			// Already receiving everything
+			return
+		}
+		if s.wants[publisherID] == nil {
+			s.wants[publisherID] = make(map[TrackSource]bool)
+		}
+		for _, source := range sources {
+			s.wants[publisherID][source] = true
+		}
+	})
+}
+
+// Unsubscribe stops a peer receiving some of a publisher's sources. With no
+// publisher the peer stops receiving anything until it subscribes again.
+func (p *Peers) Unsubscribe(peerID, publisherID string, sources []TrackSource) {
+	p.updateSubscription(peerID, func(s *subscription) {
+		if !s.manual {
+			// Narrow "everything" down to what is published right now
+			s.manual = true
+			s.wants = make(map[string]map[TrackSource]bool)
+			for publisher, tracks := range p.PeerTracks {
+				for _, track := range tracks {
+					if s.wants[publisher] == nil {
+						s.wants[publisher] = make(map[TrackSource]bool)
+					}
+					s.wants[publisher][track.Source()] = true
+				}
+			}
+		}
+
+		if publisherID == "" {
+			s.wants = make(map[string]map[TrackSource]bool)
+			return
+		}
+		for _, source := range sources {
+			delete(s.wants[publisherID], source)
+		}
+	})
+}
+
+// updateSubscription applies a change to a peer's subscription and queues a
+// renegotiation so its senders follow
+func (p *Peers) updateSubscription(peerID string, update func(s *subscription)) {
+	p.ListLock.Lock()
+	if p.subscriptions == nil {
+		p.subscriptions = make(map[string]*subscription)
+	}
+	s := p.subscriptions[peerID]
+	if s == nil {
+		s = &subscription{}
+		p.subscriptions[peerID] = s
+	}
+	update(s)
+
+	var n *negotiator
+	for _, conn := range p.Connections {
+		if conn.PeerID == peerID {
+			n = conn.negotiator
+			break
+		}
+	}
+	p.ListLock.Unlock()
+
+	if n != nil && p.SFU {
+		n.request(false)
+	}
+}
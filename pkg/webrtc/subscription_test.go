@@ -0,0 +1,55 @@
+package webrtc
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestSubscriptionsFilterForwardedTracks(t *testing.T) {
+	track := func(id string, source TrackSource) *PublishedTrack {
+		return &PublishedTrack{id: id, source: source}
+	}
+	p := &Peers{
+		TrackLocals: map[string]*PublishedTrack{},
+		PeerTracks: map[string]map[string]*PublishedTrack{
+			"alice": {"a-mic": track("a-mic", SourceAudio), "a-cam": track("a-cam", SourceVideo)},
+			"bob":   {"b-mic": track("b-mic", SourceAudio), "b-screen": track("b-screen", SourceScreen)},
+			"carol": {"c-cam": track("c-cam", SourceVideo)},
+		},
+	}
+
+	received := func() []string {
+		var ids []string
+		for id := range p.tracksFor("carol") {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	expect := func(step string, want ...string) {
+		t.Helper()
+		got := received()
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %v, want %v", step, got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("%s: got %v, want %v", step, got, want)
+			}
+		}
+	}
+
+	expect("default", "a-cam", "a-mic", "b-mic", "b-screen")
+
+	p.Unsubscribe("carol", "bob", []TrackSource{SourceScreen})
+	expect("unsubscribe screen", "a-cam", "a-mic", "b-mic")
+
+	p.Unsubscribe("carol", "", nil)
+	expect("unsubscribe all")
+
+	p.Subscribe("carol", "alice", []TrackSource{SourceVideo})
+	expect("subscribe video", "a-cam")
+
+	p.Subscribe("carol", "", nil)
+	expect("subscribe all", "a-cam", "a-mic", "b-mic", "b-screen")
+}
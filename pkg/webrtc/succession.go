@@ -0,0 +1,180 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ============= HOST SUCCESSION =============
+//
+// When the host leaves, hosting passes to whoever has been in the room the
+// longest, co-hosts first. A host who joined with a join token can take the
+// role back by rejoining within HostReclaimGrace.
+
+// HostSuccession decides who takes over when the host leaves
+type HostSuccession string
+
+const (
+	// SuccessionAnyone hands hosting to the longest-present co-host, or
+	// the longest-present participant if there are no co-hosts
+	SuccessionAnyone HostSuccession = "anyone"
+
+	// SuccessionCoHosts only hands hosting to co-hosts
+	SuccessionCoHosts HostSuccession = "co-hosts"
+
+	// SuccessionNone leaves the room without a host until a new one joins
+	SuccessionNone HostSuccession = "none"
+)
+
+// ParseHostSuccession validates a succession policy from configuration
+func ParseHostSuccession(s string) (HostSuccession, error) {
+	switch succession := HostSuccession(s); succession {
+	case SuccessionAnyone, SuccessionCoHosts, SuccessionNone:
+		return succession, nil
+	default:
+		return "", fmt.Errorf("unknown host succession %q (want %q, %q or %q)", s, SuccessionAnyone, SuccessionCoHosts, SuccessionNone)
+	}
+}
+
+var (
+	// Succession is who takes over rooms whose host leaves
+	Succession = SuccessionAnyone
+
+	// HostReclaimGrace is how long a host who left can rejoin and take
+	// hosting back. Zero disables reclaiming.
+	HostReclaimGrace = 2 * time.Minute
+)
+
+var (
+	ErrNotHost     = errors.New("only the host can hand hosting over")
+	ErrNotInRoom   = errors.New("participant is not in the room")
+	ErrAlreadyHost = errors.New("participant is already the host")
+)
+
+// formerHost remembers a host who left, so they can reclaim hosting
+type formerHost struct {
+	userID string
+	until  time.Time
+
+	// What the host in the meantime goes back to when hosting is reclaimed
+	successor       string
+	successorCoHost bool
+}
+
+// HostLeft hands hosting on when the host leaves, after their connection
+// has been removed from Peers. It returns the new host, empty if nobody
+// took over, and whether the leaving peer was the host at all.
+func (r *Room) HostLeft(peerID string, now time.Time) (string, bool) {
+	present := r.Peers.PeerIDs()
+
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+
+	if r.HostPeerID != peerID || peerID == "" {
+		return "", false
+	}
+
+	// Keep the first host's claim if the room has been handed on since;
+	// otherwise remember this one if a join token says who they are
+	if r.formerHost == nil || !now.Before(r.formerHost.until) {
+		r.formerHost = nil
+		if id, ok := r.identities[peerID]; ok && HostReclaimGrace > 0 {
+			r.formerHost = &formerHost{userID: id.UserID, until: now.Add(HostReclaimGrace)}
+		}
+	}
+
+	successor := r.successor(present, peerID)
+	r.HostPeerID = successor
+	if successor != "" {
+		if r.formerHost != nil {
+			r.formerHost.successor = successor
+			r.formerHost.successorCoHost = r.CoHosts[successor]
+		}
+		delete(r.CoHosts, successor)
+	}
+	r.persist()
+	log.Printf("Host %s left room %s; new host: %q", peerID, r.ID, successor)
+	return successor, true
+}
+
+// successor picks the next host among the peers present, listed longest
+// present first. Callers hold PermLock.
+func (r *Room) successor(present []string, leaving string) string {
+	if Succession == SuccessionNone {
+		return ""
+	}
+	for _, peerID := range present {
+		if peerID != leaving && r.CoHosts[peerID] {
+			return peerID
+		}
+	}
+	if Succession == SuccessionCoHosts {
+		return ""
+	}
+	for _, peerID := range present {
+		if peerID != leaving {
+			return peerID
+		}
+	}
+	return ""
+}
+
+// CanReclaimHost checks if a user is a host who left recently enough to
+// take hosting back
+func (r *Room) CanReclaimHost(userID string, now time.Time) bool {
+	r.PermLock.RLock()
+	defer r.PermLock.RUnlock()
+	return r.formerHost != nil && userID != "" && r.formerHost.userID == userID && now.Before(r.formerHost.until)
+}
+
+// ReclaimHost gives hosting back to a former host rejoining as peerID
+// within the grace window. Whoever hosted in the meantime goes back to
+// being a co-host or participant, as they were. It returns the peer that
+// lost hosting, if any, and whether peerID reclaimed it.
+func (r *Room) ReclaimHost(peerID, userID string, now time.Time) (string, bool) {
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+
+	former := r.formerHost
+	if former == nil || userID == "" || former.userID != userID || !now.Before(former.until) {
+		return "", false
+	}
+	r.formerHost = nil
+
+	previous := r.HostPeerID
+	if previous != "" && previous == former.successor && former.successorCoHost {
+		r.CoHosts[previous] = true
+	}
+	r.HostPeerID = peerID
+	delete(r.CoHosts, peerID)
+	r.persist()
+	log.Printf("Host reclaimed room %s as peer %s", r.ID, peerID)
+	return previous, true
+}
+
+// TransferHost hands hosting from the host to another peer in the room.
+// The old host stays on as a participant and gives up any claim to reclaim
+// hosting.
+func (r *Room) TransferHost(from, to string) error {
+	if _, ok := r.Peers.Get(to); !ok {
+		return ErrNotInRoom
+	}
+
+	r.PermLock.Lock()
+	defer r.PermLock.Unlock()
+
+	switch {
+	case r.HostPeerID != from:
+		return ErrNotHost
+	case to == from:
+		return ErrAlreadyHost
+	}
+	r.HostPeerID = to
+	delete(r.CoHosts, to)
+	r.formerHost = nil
+	r.persist()
+	log.Printf("Host of room %s handed from %s to %s", r.ID, from, to)
+	return nil
+}
@@ -0,0 +1,68 @@
+package webrtc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"videochat/pkg/auth"
+)
+
+func TestHostSuccession(t *testing.T) {
+	saved, savedSuccession := Store, Succession
+	Store = NewMemoryStore()
+	defer func() { Store, Succession = saved, savedSuccession }()
+
+	room := CreateRoom("host-succession")
+	defer DeleteRoom(room.ID)
+	for _, peerID := range []string{"alice", "bob", "carol"} {
+		room.Peers.AddPeerConnectionWithID(nil, nil, peerID, peerID)
+	}
+	room.SetHost("host")
+	room.SetIdentity("host", auth.Identity{UserID: "u-host", Role: auth.RoleHost})
+	room.AddCoHost("carol")
+
+	// The longest-present co-host takes over, ahead of other participants
+	now := time.Now()
+	if next, wasHost := room.HostLeft("bob", now); wasHost || next != "" {
+		t.Errorf("non-host leaving = %q, %v", next, wasHost)
+	}
+	if next, wasHost := room.HostLeft("host", now); !wasHost || next != "carol" || room.IsCoHost("carol") {
+		t.Fatalf("host leaving = %q, %v", next, wasHost)
+	}
+
+	// Then the longest-present participant, unless only co-hosts may host
+	Succession = SuccessionCoHosts
+	if next, _ := room.HostLeft("carol", now); next != "" || room.GetHostPeerID() != "" {
+		t.Errorf("co-hosts only succession = %q", next)
+	}
+	room.SetHost("carol")
+	Succession = SuccessionAnyone
+	if next, _ := room.HostLeft("carol", now); next != "alice" {
+		t.Errorf("succession without co-hosts = %q", next)
+	}
+
+	// The first host can still come back and take over
+	if room.CanReclaimHost("u-other", now) || !room.CanReclaimHost("u-host", now) {
+		t.Error("wrong user allowed to reclaim hosting")
+	}
+	if previous, ok := room.ReclaimHost("host-again", "u-host", now.Add(HostReclaimGrace)); ok {
+		t.Errorf("hosting reclaimed after the grace window from %q", previous)
+	}
+	if previous, ok := room.ReclaimHost("host-again", "u-host", now.Add(time.Second)); !ok || previous != "alice" || !room.IsHost("host-again") {
+		t.Fatalf("reclaim = %q, %v", previous, ok)
+	}
+	if room.IsCoHost("alice") {
+		t.Error("participant who hosted meanwhile kept co-host rights")
+	}
+
+	if err := room.TransferHost("host-again", "nobody"); !errors.Is(err, ErrNotInRoom) {
+		t.Errorf("transfer to a missing peer: %v", err)
+	}
+	if err := room.TransferHost("alice", "bob"); !errors.Is(err, ErrNotHost) {
+		t.Errorf("transfer by a non-host: %v", err)
+	}
+	if err := room.TransferHost("host-again", "bob"); err != nil || !room.IsHost("bob") {
+		t.Errorf("transfer = %v", err)
+	}
+}
@@ -0,0 +1,743 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"videochat/pkg/hls"
+	"videochat/pkg/recording"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var errUnknownLayer = errors.New("unknown simulcast layer")
+
+// PublishedTrack is a publisher's track as forwarded to subscribers. A
+// simulcast publisher sends several encodings (layers) of the same track,
+// told apart by RID; each subscriber is forwarded exactly one of them and
+// sees a single continuous stream across layer switches.
+//
+// PublishedTrack implements webrtc.TrackLocal, so it can be added to
+// subscriber connections like any other local track.
+type PublishedTrack struct {
+	id       string
+	streamID string
+	codec    webrtc.RTPCodecCapability
+	source   TrackSource
+
+	// publisher is used to ask for keyframes on a layer
+	publisherID string
+	publisher   *webrtc.PeerConnection
+
+	// audioLevelExt is the negotiated ID of the RFC 6464 audio level header
+	// extension, or 0 if the publisher doesn't send it
+	audioLevelExt uint8
+
+	mu     sync.RWMutex
+	layers map[string]*layer
+	downs  map[string]*downTrack // binding ID -> subscriber
+
+	// recorder receives the packets of one layer while the room is recorded
+	recorder    *recording.Track
+	recordedRID string
+
+	// packager receives the packets of one layer for a stream's HLS output
+	packager    *hls.Track
+	packagedRID string
+}
+
+// layer is one simulcast encoding received from the publisher
+type layer struct {
+	rid  string
+	ssrc webrtc.SSRC
+
+	// quality is the layer's place among the publisher's encodings, lowest
+	// first, for ranking layers before their bitrate is measured
+	quality int
+
+	// bitrate is the measured rate in bits per second over the last window
+	bitrate     int
+	windowBytes int
+	windowStart time.Time
+}
+
+// downTrack is the forwarding state for one subscriber
+type downTrack struct {
+	id          string
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+
+	current string // layer being forwarded
+	target  string // layer to switch to at the next keyframe
+	max     string // highest layer the subscriber asked for, "" for any
+
+	// Sequence numbers and timestamps are rewritten so a layer switch
+	// looks like one stream to the subscriber
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+}
+
+// newPublishedTrack creates the forwarded form of a publisher's remote track
+func newPublishedTrack(remote *webrtc.TrackRemote, publisherID string, publisher *webrtc.PeerConnection, source TrackSource) *PublishedTrack {
+	return &PublishedTrack{
+		publisherID:   publisherID,
+		id:            remote.ID(),
+		streamID:      remote.StreamID(),
+		codec:         remote.Codec().RTPCodecCapability,
+		source:        source,
+		publisher:     publisher,
+		audioLevelExt: audioLevelExtension(remote, publisher),
+		layers:        make(map[string]*layer),
+		downs:         make(map[string]*downTrack),
+	}
+}
+
+// audioLevelExtension finds the audio level extension ID negotiated for the
+// receiver of a remote track
+func audioLevelExtension(remote *webrtc.TrackRemote, publisher *webrtc.PeerConnection) uint8 {
+	if publisher == nil || remote.Kind() != webrtc.RTPCodecTypeAudio {
+		return 0
+	}
+	for _, receiver := range publisher.GetReceivers() {
+		if receiver.Track() != remote {
+			continue
+		}
+		for _, ext := range receiver.GetParameters().HeaderExtensions {
+			if ext.URI == sdp.AudioLevelURI {
+				return uint8(ext.ID)
+			}
+		}
+	}
+	return 0
+}
+
+// audioLevel reads the level a publisher reported in a packet
+func (t *PublishedTrack) audioLevel(pkt *rtp.Packet) (uint8, bool) {
+	if t.audioLevelExt == 0 {
+		return 0, false
+	}
+	payload := pkt.GetExtension(t.audioLevelExt)
+	if payload == nil {
+		return 0, false
+	}
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	return ext.Level, true
+}
+
+// ID implements webrtc.TrackLocal
+func (t *PublishedTrack) ID() string { return t.id }
+
+// StreamID implements webrtc.TrackLocal
+func (t *PublishedTrack) StreamID() string { return t.streamID }
+
+// RID implements webrtc.TrackLocal. Subscribers always receive a single
+// encoding, so the forwarded track has no RID of its own.
+func (t *PublishedTrack) RID() string { return "" }
+
+// Kind implements webrtc.TrackLocal
+func (t *PublishedTrack) Kind() webrtc.RTPCodecType {
+	switch {
+	case strings.HasPrefix(t.codec.MimeType, "audio/"):
+		return webrtc.RTPCodecTypeAudio
+	case strings.HasPrefix(t.codec.MimeType, "video/"):
+		return webrtc.RTPCodecTypeVideo
+	default:
+		return webrtc.RTPCodecType(0)
+	}
+}
+
+// PublisherID returns the peer that publishes the track
+func (t *PublishedTrack) PublisherID() string {
+	return t.publisherID
+}
+
+// Source says whether the track is a microphone, camera or screen share
+func (t *PublishedTrack) Source() TrackSource {
+	return t.source
+}
+
+// Codec returns the codec the publisher sends
+func (t *PublishedTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+// Layers returns the RIDs currently received, best quality first. A track
+// without simulcast has a single layer with an empty RID.
+func (t *PublishedTrack) Layers() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.rankedLayers()
+}
+
+// Bind implements webrtc.TrackLocal
+func (t *PublishedTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(t.codec, ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	down := &downTrack{
+		id:          ctx.ID(),
+		ssrc:        ctx.SSRC(),
+		payloadType: codec.PayloadType,
+		writeStream: ctx.WriteStream(),
+	}
+
+	// New subscribers start on the lowest layer and are moved up once their
+	// bandwidth is known
+	if ranked := t.rankedLayers(); len(ranked) > 0 {
+		down.target = ranked[len(ranked)-1]
+		down.current = down.target
+	}
+	t.downs[ctx.ID()] = down
+
+	return codec, nil
+}
+
+// Unbind implements webrtc.TrackLocal
+func (t *PublishedTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.downs[ctx.ID()]; !ok {
+		return webrtc.ErrUnbindFailed
+	}
+	delete(t.downs, ctx.ID())
+	return nil
+}
+
+// addLayer registers an encoding received from the publisher
+func (t *PublishedTrack) addLayer(remote *webrtc.TrackRemote) {
+	quality := simulcastQuality(remote, t.publisher)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.layers[remote.RID()] = &layer{
+		rid:         remote.RID(),
+		ssrc:        remote.SSRC(),
+		quality:     quality,
+		windowStart: time.Now(),
+	}
+
+	for _, down := range t.downs {
+		if down.target == "" {
+			down.target = remote.RID()
+		}
+	}
+}
+
+// removeLayer forgets an encoding and reports how many remain
+func (t *PublishedTrack) removeLayer(rid string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.layers, rid)
+
+	// Subscribers on the removed layer fall back to the best one left
+	ranked := t.rankedLayers()
+	for _, down := range t.downs {
+		if down.target == rid || down.current == rid {
+			down.target = ""
+			if len(ranked) > 0 {
+				down.target = ranked[0]
+			}
+		}
+	}
+	if len(ranked) > 0 && len(t.downs) > 0 {
+		go t.requestKeyframe(ranked[0])
+	}
+
+	return len(t.layers)
+}
+
+// rankedLayers orders layers by measured bitrate, highest first, falling
+// back to the publisher's order of encodings for layers not yet measured.
+// Callers hold t.mu.
+func (t *PublishedTrack) rankedLayers() []string {
+	ranked := make([]*layer, 0, len(t.layers))
+	for _, l := range t.layers {
+		ranked = append(ranked, l)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].bitrate != ranked[j].bitrate {
+			return ranked[i].bitrate > ranked[j].bitrate
+		}
+		if ranked[i].quality != ranked[j].quality {
+			return ranked[i].quality > ranked[j].quality
+		}
+		return ranked[i].rid < ranked[j].rid
+	})
+
+	rids := make([]string, len(ranked))
+	for i, l := range ranked {
+		rids[i] = l.rid
+	}
+	return rids
+}
+
+// simulcastQuality finds where a layer stands among the encodings of its
+// media section in the publisher's offer, lowest quality first. Encodings
+// are ranked by the size given in their a=rid restrictions when every one
+// has one, and otherwise by their a=simulcast order: publishers list them
+// from the lowest resolution up, as browsers and SFUs conventionally do.
+func simulcastQuality(remote *webrtc.TrackRemote, publisher *webrtc.PeerConnection) int {
+	if publisher == nil || remote.RID() == "" || publisher.RemoteDescription() == nil {
+		return 0
+	}
+	mid := ""
+	for _, transceiver := range publisher.GetTransceivers() {
+		if receiver := transceiver.Receiver(); receiver != nil && slices.Contains(receiver.Tracks(), remote) {
+			mid = transceiver.Mid()
+			break
+		}
+	}
+	parsed, err := publisher.RemoteDescription().Unmarshal()
+	if err != nil {
+		return 0
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if value, _ := media.Attribute("mid"); mid != "" && value != mid {
+			continue
+		}
+		rids, sizes := simulcastEncodings(media)
+		if !slices.Contains(rids, remote.RID()) {
+			continue
+		}
+		if len(sizes) == len(rids) {
+			sort.SliceStable(rids, func(i, j int) bool { return sizes[rids[i]] < sizes[rids[j]] })
+		}
+		return slices.Index(rids, remote.RID())
+	}
+	return 0
+}
+
+// simulcastEncodings lists the RIDs a media section is sent with, in the
+// order of its a=simulcast line, or of its a=rid lines without one, and
+// the pixel count of those whose a=rid line restricts their size
+func simulcastEncodings(media *sdp.MediaDescription) (rids []string, sizes map[string]int) {
+	sizes = make(map[string]int)
+	var declared []string
+	for _, attr := range media.Attributes {
+		if attr.Key != "rid" {
+			continue
+		}
+		fields := strings.Fields(attr.Value)
+		if len(fields) < 2 || fields[1] != "send" {
+			continue
+		}
+		declared = append(declared, fields[0])
+		if len(fields) < 3 {
+			continue
+		}
+		var width, height int
+		for _, param := range strings.Split(fields[2], ";") {
+			key, value, _ := strings.Cut(param, "=")
+			switch key {
+			case "max-width":
+				width, _ = strconv.Atoi(value)
+			case "max-height":
+				height, _ = strconv.Atoi(value)
+			}
+		}
+		if width > 0 && height > 0 {
+			sizes[fields[0]] = width * height
+		}
+	}
+
+	value, ok := media.Attribute("simulcast")
+	if !ok {
+		return declared, sizes
+	}
+	fields := strings.Fields(value)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] != "send" {
+			continue
+		}
+		for _, stream := range strings.Split(fields[i+1], ";") {
+			// The first of any alternatives, whether or not it is paused
+			first, _, _ := strings.Cut(stream, ",")
+			rids = append(rids, strings.TrimPrefix(first, "~"))
+		}
+	}
+	return rids, sizes
+}
+
+// writeRTP forwards a packet received on one layer to every subscriber
+// currently on, or switching to, that layer, and to the recording and HLS
+// output of that layer. Those write to disk, so they happen after the lock
+// is released and a slow disk can't hold up layer changes or new
+// subscribers.
+func (t *PublishedTrack) writeRTP(rid string, pkt *rtp.Packet) error {
+	t.mu.Lock()
+
+	if l, ok := t.layers[rid]; ok {
+		l.windowBytes += len(pkt.Payload)
+		if elapsed := time.Since(l.windowStart); elapsed >= time.Second {
+			l.bitrate = int(float64(l.windowBytes*8) / elapsed.Seconds())
+			l.windowBytes = 0
+			l.windowStart = time.Now()
+		}
+	}
+
+	var recorder *recording.Track
+	if rid == t.recordedRID {
+		recorder = t.recorder
+	}
+	var packager *hls.Track
+	if rid == t.packagedRID {
+		packager = t.packager
+	}
+
+	var keyframe, checked bool
+	var writeErr error
+	for _, down := range t.downs {
+		if down.target != down.current && down.target == rid {
+			if !checked {
+				keyframe = isKeyframe(t.codec.MimeType, pkt.Payload)
+				checked = true
+			}
+			if keyframe {
+				down.switchLayer(rid, pkt, t.codec.ClockRate)
+			}
+		}
+		if down.current != rid {
+			continue
+		}
+		if err := down.write(pkt); err != nil {
+			writeErr = err
+		}
+	}
+	t.mu.Unlock()
+
+	// Both ignore packets once closed, so a stop that happened since is safe
+	if recorder != nil {
+		if err := recorder.WriteRTP(pkt); err != nil {
+			log.Printf("Error recording track %s: %v", t.id, err)
+		}
+	}
+	if packager != nil {
+		if err := packager.WriteRTP(pkt); err != nil {
+			log.Printf("Error packaging track %s as HLS: %v", t.id, err)
+		}
+	}
+	return writeErr
+}
+
+// startRecording sends the best layer of the track to a recording
+func (t *PublishedTrack) startRecording(rec *recording.Track) {
+	t.mu.Lock()
+	ranked := t.rankedLayers()
+	if len(ranked) == 0 {
+		t.mu.Unlock()
+		rec.Close()
+		return
+	}
+	t.recorder = rec
+	t.recordedRID = ranked[0]
+	t.mu.Unlock()
+
+	// Video files must start with a keyframe
+	if t.Kind() == webrtc.RTPCodecTypeVideo {
+		t.requestKeyframe(ranked[0])
+	}
+}
+
+// stopRecording closes the track's recording, if any
+func (t *PublishedTrack) stopRecording() {
+	t.mu.Lock()
+	rec := t.recorder
+	t.recorder = nil
+	t.mu.Unlock()
+
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Printf("Error closing recording of track %s: %v", t.id, err)
+		}
+	}
+}
+
+// startPackaging sends the best layer of the track to an HLS muxer
+func (t *PublishedTrack) startPackaging(m *hls.Muxer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ranked := t.rankedLayers()
+	if len(ranked) == 0 {
+		return errUnknownLayer
+	}
+	rid := ranked[0]
+	packager, err := m.AddTrack(t.codec.MimeType, func() { t.requestKeyframe(rid) })
+	if err != nil {
+		return err
+	}
+	t.packager = packager
+	t.packagedRID = rid
+	return nil
+}
+
+// stopPackaging removes the track from its HLS muxer, if any
+func (t *PublishedTrack) stopPackaging() {
+	t.mu.Lock()
+	packager := t.packager
+	t.packager = nil
+	t.mu.Unlock()
+
+	if packager != nil {
+		packager.Close()
+	}
+}
+
+// switchLayer moves a subscriber onto a new layer. The offsets are chosen so
+// the first packet of the new layer directly follows the last one sent.
+func (d *downTrack) switchLayer(rid string, pkt *rtp.Packet, clockRate uint32) {
+	d.current = rid
+	if !d.started {
+		return
+	}
+
+	elapsed := uint32(time.Since(d.lastWrite).Seconds() * float64(clockRate))
+	if elapsed == 0 {
+		elapsed = 1
+	}
+	d.seqOffset = pkt.SequenceNumber - d.lastSeq - 1
+	d.tsOffset = pkt.Timestamp - d.lastTS - elapsed
+}
+
+func (d *downTrack) write(pkt *rtp.Packet) error {
+	header := pkt.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	header.SequenceNumber = pkt.SequenceNumber - d.seqOffset
+	header.Timestamp = pkt.Timestamp - d.tsOffset
+
+	// Extension IDs were negotiated with the publisher, not this subscriber
+	header.Extension = false
+	header.Extensions = nil
+
+	d.started = true
+	d.lastSeq = header.SequenceNumber
+	d.lastTS = header.Timestamp
+	d.lastWrite = time.Now()
+
+	_, err := d.writeStream.WriteRTP(&header, pkt.Payload)
+	return err
+}
+
+// selectLayer sets the layer a subscriber should receive given its share
+// of the available bandwidth. bitrate <= 0 means no estimate is available.
+func (t *PublishedTrack) selectLayer(ssrc webrtc.SSRC, bitrate int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	down := t.downBySSRC(ssrc)
+	if down == nil {
+		return
+	}
+
+	ranked := t.rankedLayers()
+	if len(ranked) < 2 {
+		return
+	}
+
+	// Skip layers above the subscriber's requested maximum
+	start := 0
+	if down.max != "" {
+		for i, rid := range ranked {
+			if rid == down.max {
+				start = i
+				break
+			}
+		}
+	}
+
+	target := ranked[len(ranked)-1]
+	for _, rid := range ranked[start:] {
+		if bitrate <= 0 || t.layers[rid].bitrate <= bitrate {
+			target = rid
+			break
+		}
+	}
+
+	if target != down.target {
+		down.target = target
+		if target != down.current {
+			go t.requestKeyframe(target)
+		}
+	}
+}
+
+// setMaxLayer caps the layer a subscriber receives. An empty rid removes
+// the cap.
+func (t *PublishedTrack) setMaxLayer(ssrc webrtc.SSRC, rid string) error {
+	t.mu.Lock()
+	down := t.downBySSRC(ssrc)
+	if down == nil {
+		t.mu.Unlock()
+		return errUnknownLayer
+	}
+	if _, ok := t.layers[rid]; rid != "" && !ok {
+		t.mu.Unlock()
+		return errUnknownLayer
+	}
+	down.max = rid
+	if rid != "" {
+		down.target = rid
+	}
+	t.mu.Unlock()
+
+	if rid != "" {
+		t.requestKeyframe(rid)
+	}
+	return nil
+}
+
+// downBySSRC finds a subscriber by the SSRC of its sender. Callers hold t.mu.
+func (t *PublishedTrack) downBySSRC(ssrc webrtc.SSRC) *downTrack {
+	for _, down := range t.downs {
+		if down.ssrc == ssrc {
+			return down
+		}
+	}
+	return nil
+}
+
+// currentLayer returns the layer a subscriber is receiving
+func (t *PublishedTrack) currentLayer(ssrc webrtc.SSRC) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if down := t.downBySSRC(ssrc); down != nil {
+		return down.current
+	}
+	return ""
+}
+
+// requestKeyframe asks the publisher for a keyframe on one layer
+func (t *PublishedTrack) requestKeyframe(rid string) {
+	t.mu.RLock()
+	l, ok := t.layers[rid]
+	t.mu.RUnlock()
+	if !ok || t.publisher == nil {
+		return
+	}
+
+	_ = t.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(l.ssrc)},
+	})
+}
+
+// matchCodec finds the negotiated codec for a subscriber, preferring an
+// exact fmtp match
+func matchCodec(want webrtc.RTPCodecCapability, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	var fallback *webrtc.RTPCodecParameters
+	for i := range negotiated {
+		c := negotiated[i]
+		if !strings.EqualFold(c.MimeType, want.MimeType) {
+			continue
+		}
+		if c.SDPFmtpLine == want.SDPFmtpLine {
+			return c, true
+		}
+		if fallback == nil {
+			fallback = &negotiated[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// isKeyframe reports whether an RTP payload starts a keyframe. Codecs it
+// can't inspect are treated as always switchable.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		frame, err := vp8.Unmarshal(payload)
+		if err != nil || len(frame) == 0 {
+			return false
+		}
+		// Start of partition 0 with the P bit clear
+		return vp8.S == 1 && vp8.PID == 0 && frame[0]&0x01 == 0
+
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var vp9 codecs.VP9Packet
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return !vp9.P && vp9.B
+
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+
+	default:
+		return true
+	}
+}
+
+// isH264Keyframe looks for an SPS or IDR slice in single NAL, STAP-A and
+// FU-A payloads
+func isH264Keyframe(payload []byte) bool {
+	const (
+		naluIDR   = 5
+		naluSPS   = 7
+		naluSTAPA = 24
+		naluFUA   = 28
+	)
+
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalu := payload[0] & 0x1F; nalu {
+	case naluIDR, naluSPS:
+		return true
+
+	case naluSTAPA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if i >= len(payload) {
+				break
+			}
+			if t := payload[i] & 0x1F; t == naluIDR || t == naluSPS {
+				return true
+			}
+			i += size
+		}
+
+	case naluFUA:
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		t := payload[1] & 0x1F
+		return start && (t == naluIDR || t == naluSPS)
+	}
+
+	return false
+}
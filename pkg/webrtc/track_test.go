@@ -0,0 +1,166 @@
+package webrtc
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+type recordingWriter struct {
+	headers []rtp.Header
+}
+
+func (r *recordingWriter) WriteRTP(header *rtp.Header, _ []byte) (int, error) {
+	r.headers = append(r.headers, *header)
+	return 0, nil
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+// vp8Frame builds a VP8 payload; keyframes have the P bit clear
+func vp8Frame(keyframe bool) []byte {
+	header := byte(0x01)
+	if keyframe {
+		header = 0x00
+	}
+	return []byte{0x10, header, 0x00, 0x00}
+}
+
+func TestLayerSwitchRewritesSequenceAndTimestamp(t *testing.T) {
+	track := &PublishedTrack{
+		codec:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		layers: map[string]*layer{"q": {rid: "q"}, "f": {rid: "f"}},
+		downs:  make(map[string]*downTrack),
+	}
+	w := &recordingWriter{}
+	down := &downTrack{ssrc: 1234, payloadType: 96, writeStream: w, current: "q", target: "q"}
+	track.downs["sub"] = down
+
+	send := func(rid string, seq uint16, ts uint32, keyframe bool) {
+		_ = track.writeRTP(rid, &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: seq, Timestamp: ts, SSRC: 1},
+			Payload: vp8Frame(keyframe),
+		})
+	}
+
+	send("q", 100, 9000, true)
+	send("f", 5000, 70000, false) // not subscribed yet
+	send("q", 101, 12000, false)
+
+	down.target = "f"
+	send("f", 5001, 73000, false) // waits for a keyframe
+	send("q", 102, 15000, false)
+	time.Sleep(10 * time.Millisecond)
+	send("f", 5002, 76000, true)
+	send("q", 103, 18000, false) // old layer is dropped
+	send("f", 5003, 79000, false)
+
+	if len(w.headers) != 5 {
+		t.Fatalf("forwarded %d packets, want 5", len(w.headers))
+	}
+	for i, h := range w.headers {
+		if h.SSRC != 1234 || h.PayloadType != 96 {
+			t.Errorf("packet %d: ssrc %d pt %d", i, h.SSRC, h.PayloadType)
+		}
+		if want := uint16(100 + i); h.SequenceNumber != want {
+			t.Errorf("packet %d: seq %d, want %d", i, h.SequenceNumber, want)
+		}
+		if i > 0 && h.Timestamp <= w.headers[i-1].Timestamp {
+			t.Errorf("packet %d: timestamp %d did not advance", i, h.Timestamp)
+		}
+	}
+	if got := w.headers[4].Timestamp - w.headers[3].Timestamp; got != 3000 {
+		t.Errorf("timestamp delta after switch = %d, want 3000", got)
+	}
+}
+
+func TestSelectLayerHonoursBitrateAndCap(t *testing.T) {
+	track := &PublishedTrack{
+		codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		layers: map[string]*layer{
+			"q": {rid: "q", bitrate: 150_000},
+			"h": {rid: "h", bitrate: 500_000},
+			"f": {rid: "f", bitrate: 1_500_000},
+		},
+		downs: map[string]*downTrack{"sub": {ssrc: 1, current: "q", target: "q"}},
+	}
+	down := track.downs["sub"]
+
+	for _, tc := range []struct {
+		max     string
+		bitrate int
+		want    string
+	}{
+		{"", 2_000_000, "f"},
+		{"", 800_000, "h"},
+		{"", 50_000, "q"},
+		{"h", 2_000_000, "h"},
+	} {
+		down.max = tc.max
+		track.selectLayer(1, tc.bitrate)
+		if down.target != tc.want {
+			t.Errorf("max %q at %d bps: target %q, want %q", tc.max, tc.bitrate, down.target, tc.want)
+		}
+	}
+}
+
+func TestIsH264Keyframe(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"idr", []byte{0x65}, true},
+		{"non-idr", []byte{0x41}, false},
+		{"stap-a with sps", []byte{0x78, 0x00, 0x02, 0x67, 0x42}, true},
+		{"fu-a idr start", []byte{0x7c, 0x85}, true},
+		{"fu-a idr middle", []byte{0x7c, 0x05}, false},
+	} {
+		if got := isH264Keyframe(tc.payload); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUnmeasuredLayersRankedByEncodingOrder(t *testing.T) {
+	var media sdp.MediaDescription
+	for _, attr := range []string{
+		"rid:high send",
+		"rid:low send",
+		"rid:mid send",
+		"simulcast:send low;mid;~high",
+	} {
+		key, value, _ := strings.Cut(attr, ":")
+		media.Attributes = append(media.Attributes, sdp.NewAttribute(key, value))
+	}
+	if rids, _ := simulcastEncodings(&media); !slices.Equal(rids, []string{"low", "mid", "high"}) {
+		t.Errorf("simulcast order = %v", rids)
+	}
+
+	media.Attributes = []sdp.Attribute{
+		sdp.NewAttribute("rid", "0 send max-width=1280;max-height=720"),
+		sdp.NewAttribute("rid", "1 send max-width=320;max-height=180"),
+	}
+	if rids, sizes := simulcastEncodings(&media); !slices.Equal(rids, []string{"0", "1"}) || sizes["1"] >= sizes["0"] {
+		t.Errorf("rid order = %v, sizes %v", rids, sizes)
+	}
+
+	// Before any bitrate is measured, the publisher's order decides
+	track := &PublishedTrack{
+		codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		layers: map[string]*layer{
+			"low":  {rid: "low", quality: 0},
+			"mid":  {rid: "mid", quality: 1},
+			"high": {rid: "high", quality: 2},
+		},
+		downs: make(map[string]*downTrack),
+	}
+	if ranked := track.rankedLayers(); !slices.Equal(ranked, []string{"high", "mid", "low"}) {
+		t.Errorf("ranked = %v", ranked)
+	}
+}